@@ -8,14 +8,108 @@ import (
 
 // Config represents the SIP server configuration
 type Config struct {
-	Server ServerConfig `json:"server"`
+	Server    ServerConfig      `json:"server"`
+	Peers     []PeerConfig      `json:"peers,omitempty"`
+	Messages  *MessagesConfig   `json:"messages,omitempty"`
+	DialPlan  []RuleConfig      `json:"dial_plan,omitempty"`
+	Trunks    []TrunkConfig     `json:"trunks,omitempty"`
+	Numbering []NumberingConfig `json:"numbering,omitempty"`
+	ENUM      *ENUMConfig       `json:"enum,omitempty"`
+	Groups    []GroupConfig     `json:"groups,omitempty"`
 }
 
 // ServerConfig holds server-specific settings
 type ServerConfig struct {
-	Port     string `json:"port"`
-	LogLevel string `json:"log_level"`
-	BindAddr string `json:"bind_addr"`
+	Port           string   `json:"port"`
+	LogLevel       string   `json:"log_level"`
+	BindAddr       string   `json:"bind_addr"`
+	AdvertisedAddr string   `json:"advertised_addr,omitempty"`
+	Domains        []string `json:"domains,omitempty"`
+	DNSServer      string   `json:"dns_server,omitempty"`
+	AdminAddr      string   `json:"admin_addr,omitempty"`
+	UnsolicitedMWI bool     `json:"unsolicited_mwi,omitempty"`
+	SessionExpires int      `json:"session_expires,omitempty"` // session timer interval in seconds
+	MinSE          int      `json:"min_se,omitempty"`          // smallest accepted session interval in seconds
+	RecordRoute    bool     `json:"record_route,omitempty"`    // keep the server on the route of dialogs
+	Mode           string   `json:"mode,omitempty"`            // "proxy" (default), "stateless", "b2bua" or "redirect"
+	FeaturesFile   string   `json:"features_file,omitempty"`   // JSON file keeping the call features of users
+}
+
+// PeerConfig describes a remote SIP element monitored with OPTIONS pings
+type PeerConfig struct {
+	Name     string `json:"name"`
+	URI      string `json:"uri"`
+	Interval int    `json:"interval"` // seconds between pings
+}
+
+// MessagesConfig enables store-and-forward of instant messages for offline users
+type MessagesConfig struct {
+	StoreDir string `json:"store_dir"`
+	Quota    int    `json:"quota"` // maximum stored messages per user, 0 for no limit
+	TTL      int    `json:"ttl"`   // seconds a stored message is kept, 7 days when 0
+}
+
+// RuleConfig is a dial plan rule: conditions on requests and what to do with
+// the matching ones
+type RuleConfig struct {
+	Name          string            `json:"name,omitempty"`
+	Methods       []string          `json:"methods,omitempty"`
+	User          string            `json:"user,omitempty"`    // regular expression on the Request-URI user
+	Prefix        string            `json:"prefix,omitempty"`  // prefix of the Request-URI user
+	From          string            `json:"from,omitempty"`    // regular expression on the From URI
+	Headers       map[string]string `json:"headers,omitempty"` // header name -> regular expression
+	Sources       []string          `json:"sources,omitempty"` // source IPs or CIDR networks
+	Time          string            `json:"time,omitempty"`    // time of day such as "08:00-18:00"
+	Days          []string          `json:"days,omitempty"`    // weekdays such as "mon"
+	Rewrite       string            `json:"rewrite,omitempty"` // new Request-URI
+	AddHeaders    map[string]string `json:"add_headers,omitempty"`
+	RemoveHeaders []string          `json:"remove_headers,omitempty"`
+	Action        string            `json:"action,omitempty"` // forward, trunk, redirect, reject or continue
+	Target        string            `json:"target,omitempty"` // URI, or trunk name for trunk
+	Code          int               `json:"code,omitempty"`   // response code of reject
+	Reason        string            `json:"reason,omitempty"`
+}
+
+// TrunkConfig describes a SIP trunk of a provider
+type TrunkConfig struct {
+	Name      string `json:"name"`
+	Domain    string `json:"domain"`
+	Proxy     string `json:"proxy,omitempty"`     // provider's outbound proxy URI, located from the domain when empty
+	Registrar string `json:"registrar,omitempty"` // registrar URI of providers that require REGISTER
+	Username  string `json:"username,omitempty"`
+	Password  string `json:"password,omitempty"`
+	Expires   int    `json:"expires,omitempty"` // seconds of registration asked for
+}
+
+// NumberingConfig describes how the users of a domain dial telephone numbers
+type NumberingConfig struct {
+	Domain              string `json:"domain,omitempty"` // empty for every local domain without a plan of its own
+	CountryCode         string `json:"country_code"`
+	AreaCode            string `json:"area_code,omitempty"`
+	NationalPrefix      string `json:"national_prefix,omitempty"`      // "0" by default
+	InternationalPrefix string `json:"international_prefix,omitempty"` // "00" by default
+	LocalLength         int    `json:"local_length,omitempty"`         // digits of local numbers dialed without area code
+}
+
+// ENUMConfig enables ENUM lookups of E.164 numbers
+type ENUMConfig struct {
+	Suffix    string `json:"suffix,omitempty"`     // "e164.arpa" by default
+	DNSServer string `json:"dns_server,omitempty"` // host:port, the server's DNS server by default
+}
+
+// GroupConfig describes an AOR ringing a set of members, such as a support line
+type GroupConfig struct {
+	AOR      string              `json:"aor"`
+	Strategy string              `json:"strategy,omitempty"` // ring-all (default), linear, round-robin or least-recent
+	Members  []GroupMemberConfig `json:"members"`
+	Timeout  int                 `json:"timeout,omitempty"`  // seconds each member rings, 20 by default
+	Overflow string              `json:"overflow,omitempty"` // URI calls go to when no member answers
+}
+
+// GroupMemberConfig is a member of a group
+type GroupMemberConfig struct {
+	URI     string `json:"uri"`
+	Timeout int    `json:"timeout,omitempty"` // seconds the member rings, the group's timeout by default
 }
 
 // DefaultConfig returns the default configuration
@@ -127,3 +127,30 @@ func TestLoadNonExistentConfig(t *testing.T) {
 		t.Errorf("Expected default port %s, got %s", defaultCfg.Server.Port, cfg.Server.Port)
 	}
 }
+
+func TestLoadPeers(t *testing.T) {
+	testDir := filepath.Join("testdata")
+	if err := os.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("Failed to create test directory: %v", err)
+	}
+
+	tempFile := filepath.Join(testDir, "test_config_peers.json")
+	defer os.Remove(tempFile)
+
+	data := `{"server":{"port":"5060"},"peers":[{"name":"carrier","uri":"sip:carrier.example.com","interval":15}]}`
+	if err := os.WriteFile(tempFile, []byte(data), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	cfg, err := LoadConfig(tempFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if len(cfg.Peers) != 1 {
+		t.Fatalf("Expected 1 peer, got %d", len(cfg.Peers))
+	}
+	if cfg.Peers[0].Name != "carrier" || cfg.Peers[0].URI != "sip:carrier.example.com" || cfg.Peers[0].Interval != 15 {
+		t.Errorf("Wrong peer: %+v", cfg.Peers[0])
+	}
+}
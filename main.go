@@ -3,10 +3,15 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/user/go-sip/config"
 	"github.com/user/go-sip/sip"
@@ -18,6 +23,8 @@ func main() {
 	generateConfig := flag.Bool("generate-config", false, "Generate default config file and exit")
 	overridePort := flag.String("port", "", "Override port setting from config file")
 	overrideBindAddr := flag.String("bind", "", "Override bind address setting from config file")
+	checkPlan := flag.Bool("check-dialplan", false, "Validate the dial plan, show how the URIs or numbers given as arguments are routed and exit")
+	checkSource := flag.String("source", "", "Source IP address of the requests checked with -check-dialplan")
 	flag.Parse()
 
 	// Generate default configuration file option
@@ -47,9 +54,91 @@ func main() {
 		cfg.Server.BindAddr = *overrideBindAddr
 	}
 
+	if *checkPlan {
+		os.Exit(checkDialPlan(os.Stdout, cfg, flag.Args(), *checkSource))
+	}
+	plan, err := validateDialPlan(cfg)
+	if err != nil {
+		log.Fatalf("Dial plan error: %v", err)
+	}
+
 	// Create SIP server
 	server := sip.NewServer(cfg.Server.Port)
 	server.SetBindAddr(cfg.Server.BindAddr)
+	if cfg.Server.AdvertisedAddr != "" {
+		server.SetAdvertisedAddr(cfg.Server.AdvertisedAddr)
+	}
+	server.SetDomains(cfg.Server.Domains)
+	if cfg.Server.DNSServer != "" {
+		server.SetResolver(sip.NewResolver(sip.NewDNSClient(cfg.Server.DNSServer)))
+	}
+
+	server.SetUnsolicitedMWI(cfg.Server.UnsolicitedMWI)
+	server.SetSessionTimer(cfg.Server.SessionExpires, cfg.Server.MinSE)
+	server.SetRecordRoute(cfg.Server.RecordRoute)
+	setNumberingPlans(server, cfg)
+	if cfg.ENUM != nil {
+		dnsServer := cfg.ENUM.DNSServer
+		if dnsServer == "" {
+			dnsServer = cfg.Server.DNSServer
+		}
+		if dnsServer == "" {
+			dnsServer = sip.SystemDNSServer()
+		}
+		server.SetENUM(sip.NewENUM(sip.NewDNSClient(dnsServer), cfg.ENUM.Suffix))
+	}
+	if len(cfg.DialPlan) > 0 {
+		server.SetDialPlan(plan)
+	}
+	for _, trunk := range cfg.Trunks {
+		server.AddTrunk(sip.Trunk{
+			Name:      trunk.Name,
+			Domain:    trunk.Domain,
+			Proxy:     trunk.Proxy,
+			Registrar: trunk.Registrar,
+			Username:  trunk.Username,
+			Password:  trunk.Password,
+			Expires:   time.Duration(trunk.Expires) * time.Second,
+		})
+	}
+
+	switch cfg.Server.Mode {
+	case "", "proxy":
+	case "stateless":
+		server.SetStateless(true)
+	case "b2bua":
+		server.SetB2BUA(sip.Bridge{})
+	case "redirect":
+		server.SetRedirect(true)
+	default:
+		log.Fatalf("Unknown server mode: %s", cfg.Server.Mode)
+	}
+
+	for _, peer := range cfg.Peers {
+		server.AddPeer(sip.Peer{
+			Name:     peer.Name,
+			URI:      peer.URI,
+			Interval: time.Duration(peer.Interval) * time.Second,
+		})
+	}
+
+	if cfg.Messages != nil {
+		store, err := sip.NewMessageStore(cfg.Messages.StoreDir, cfg.Messages.Quota, time.Duration(cfg.Messages.TTL)*time.Second)
+		if err != nil {
+			log.Fatalf("Message store error: %v", err)
+		}
+		server.SetMessageStore(store)
+	}
+	if cfg.Server.FeaturesFile != "" {
+		if err := server.SetFeaturesFile(cfg.Server.FeaturesFile); err != nil {
+			log.Fatalf("Call features error: %v", err)
+		}
+	}
+	for _, group := range cfg.Groups {
+		if err := server.AddGroup(huntGroup(group)); err != nil {
+			log.Fatalf("Group error: %v", err)
+		}
+	}
 
 	// Setup signal handling
 	sigChan := make(chan os.Signal, 1)
@@ -62,6 +151,14 @@ func main() {
 		}
 	}()
 
+	if cfg.Server.AdminAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(cfg.Server.AdminAddr, server.AdminHandler()); err != nil {
+				log.Fatalf("Admin API error: %v", err)
+			}
+		}()
+	}
+
 	fmt.Printf("SIP server started on %s:%s\n", cfg.Server.BindAddr, cfg.Server.Port)
 	fmt.Println("Press Ctrl+C to exit...")
 
@@ -69,3 +166,159 @@ func main() {
 	<-sigChan
 	fmt.Println("\nShutting down server...")
 }
+
+// dialPlanRules converts the dial plan of the configuration
+func dialPlanRules(cfg *config.Config) []sip.Rule {
+	var rules []sip.Rule
+	for _, rule := range cfg.DialPlan {
+		rules = append(rules, sip.Rule{
+			Name:          rule.Name,
+			Methods:       rule.Methods,
+			User:          rule.User,
+			Prefix:        rule.Prefix,
+			From:          rule.From,
+			Headers:       rule.Headers,
+			Sources:       rule.Sources,
+			Time:          rule.Time,
+			Days:          rule.Days,
+			Rewrite:       rule.Rewrite,
+			AddHeaders:    rule.AddHeaders,
+			RemoveHeaders: rule.RemoveHeaders,
+			Action:        rule.Action,
+			Target:        rule.Target,
+			Code:          rule.Code,
+			Reason:        rule.Reason,
+		})
+	}
+	return rules
+}
+
+// numberingPlan converts a numbering plan of the configuration
+func numberingPlan(numbering config.NumberingConfig) sip.NumberingPlan {
+	return sip.NumberingPlan{
+		CountryCode:         numbering.CountryCode,
+		AreaCode:            numbering.AreaCode,
+		NationalPrefix:      numbering.NationalPrefix,
+		InternationalPrefix: numbering.InternationalPrefix,
+		LocalLength:         numbering.LocalLength,
+	}
+}
+
+// huntGroup converts a group of the configuration
+func huntGroup(group config.GroupConfig) sip.Group {
+	members := make([]sip.GroupMember, 0, len(group.Members))
+	for _, member := range group.Members {
+		members = append(members, sip.GroupMember{
+			URI:     member.URI,
+			Timeout: time.Duration(member.Timeout) * time.Second,
+		})
+	}
+	return sip.Group{
+		AOR:      group.AOR,
+		Strategy: group.Strategy,
+		Members:  members,
+		Timeout:  time.Duration(group.Timeout) * time.Second,
+		Overflow: group.Overflow,
+	}
+}
+
+// setNumberingPlans gives the server the numbering plans of the configuration
+func setNumberingPlans(server *sip.Server, cfg *config.Config) {
+	for _, numbering := range cfg.Numbering {
+		server.SetNumberingPlan(numbering.Domain, numberingPlan(numbering))
+	}
+}
+
+// validateDialPlan compiles the dial plan of the configuration and checks
+// that the trunks its rules route to exist
+func validateDialPlan(cfg *config.Config) (*sip.DialPlan, error) {
+	plan, err := sip.NewDialPlan(dialPlanRules(cfg))
+	if err != nil {
+		return nil, err
+	}
+	trunks := make(map[string]bool)
+	for _, trunk := range cfg.Trunks {
+		trunks[trunk.Name] = true
+	}
+	for i, rule := range cfg.DialPlan {
+		if rule.Action != "trunk" {
+			continue
+		}
+		for _, name := range strings.Split(rule.Target, ",") {
+			if name = strings.TrimSpace(name); !trunks[name] {
+				return nil, fmt.Errorf("rule %d uses unknown trunk %s", i+1, name)
+			}
+		}
+	}
+	return plan, nil
+}
+
+// checkDialPlan validates the dial plan of the configuration and prints how
+// an INVITE from source to each of the given URIs or numbers would be routed
+// now. Without a source, rules limited to sources never match. It returns
+// the exit status.
+func checkDialPlan(w io.Writer, cfg *config.Config, targets []string, source string) int {
+	plan, err := validateDialPlan(cfg)
+	if err != nil {
+		fmt.Fprintf(w, "dial plan error: %v\n", err)
+		return 1
+	}
+	var from net.Addr
+	if source != "" {
+		ip := net.ParseIP(source)
+		if ip == nil {
+			fmt.Fprintf(w, "invalid source address %s\n", source)
+			return 1
+		}
+		from = &net.UDPAddr{IP: ip, Port: 5060}
+	}
+	fmt.Fprintf(w, "dial plan OK: %d rules\n", len(cfg.DialPlan))
+	if from == nil {
+		for i, rule := range cfg.DialPlan {
+			if len(rule.Sources) > 0 {
+				fmt.Fprintf(w, "rule %d (%s) is source-dependent and only matches with -source\n", i+1, rule.Name)
+			}
+		}
+	}
+
+	// Numbers are normalized by the same lookup as at runtime
+	server := sip.NewServer(cfg.Server.Port)
+	server.SetDomains(cfg.Server.Domains)
+	setNumberingPlans(server, cfg)
+
+	domain := "localhost"
+	if len(cfg.Server.Domains) > 0 {
+		domain = cfg.Server.Domains[0]
+	}
+	for _, target := range targets {
+		uri := target
+		if !strings.HasPrefix(uri, "sip:") && !strings.HasPrefix(uri, "sips:") {
+			uri = "sip:" + target + "@" + domain
+		}
+		// Rules see dialed numbers normalized to E.164
+		if u, err := sip.ParseURI(uri); err == nil {
+			if numbering, ok := server.NumberingPlanFor(u.Host); ok {
+				if number, ok := numbering.Normalize(u.User); ok {
+					u.User = number
+					uri = u.String()
+				}
+			}
+		}
+		invite := sip.NewMessage()
+		invite.StartLine = "INVITE " + uri + " SIP/2.0"
+		invite.Headers["From"] = "<sip:check@" + domain + ">;tag=check"
+		invite.Headers["To"] = "<" + uri + ">"
+
+		decision := plan.Evaluate(invite, from, time.Now())
+		if decision.Rule == "" {
+			fmt.Fprintf(w, "%s: no rule, routed as %s\n", target, decision.Request.RequestURI())
+			continue
+		}
+		fmt.Fprintf(w, "%s: rule %q, %s %s", target, decision.Rule, decision.Action, decision.Target)
+		if decision.Action == "reject" {
+			fmt.Fprintf(w, "%d %s", decision.Code, decision.Reason)
+		}
+		fmt.Fprintf(w, " (Request-URI %s)\n", decision.Request.RequestURI())
+	}
+	return 0
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/user/go-sip/config"
 )
 
 // TestMainCompilation は、mainパッケージがコンパイルできることを確認するだけのテスト
@@ -137,3 +141,78 @@ func TestGenerateConfigFlag(t *testing.T) {
 	// ここで実際に設定ファイルを生成する代わりに値だけを確認する
 	t.Logf("Would generate config file at: %s", *configPath)
 }
+
+// TestCheckDialPlan は-check-dialplanでダイヤルプランの検証と経路表示ができることをテストする
+func TestCheckDialPlan(t *testing.T) {
+	cfg := &config.Config{
+		DialPlan: []config.RuleConfig{
+			{Name: "international", User: "^00(\\d+)$", Rewrite: "sip:+$1@example.com", Action: "trunk", Target: "carrier"},
+			{Name: "blocked", Prefix: "0900", Action: "reject", Code: 603, Reason: "Decline"},
+		},
+		Trunks: []config.TrunkConfig{{Name: "carrier", Domain: "carrier.example"}},
+	}
+	cfg.Server.Domains = []string{"example.com"}
+
+	var out bytes.Buffer
+	if code := checkDialPlan(&out, cfg, []string{"0049301234", "sip:bob@example.com"}, ""); code != 0 {
+		t.Fatalf("Expected exit status 0, got %d: %s", code, out.String())
+	}
+	for _, want := range []string{
+		"dial plan OK: 2 rules",
+		`0049301234: rule "international", trunk carrier (Request-URI sip:+49301234@example.com)`,
+		"sip:bob@example.com: no rule, routed as sip:bob@example.com",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Output misses %q:\n%s", want, out.String())
+		}
+	}
+
+	// 番号計画があればルールはE.164に正規化された番号を見る
+	cfg.DialPlan[0].User = "^\\+(\\d+)$"
+	cfg.Numbering = []config.NumberingConfig{{CountryCode: "49"}}
+	out.Reset()
+	checkDialPlan(&out, cfg, []string{"0301234"}, "")
+	if want := `0301234: rule "international", trunk carrier (Request-URI sip:+49301234@example.com)`; !strings.Contains(out.String(), want) {
+		t.Errorf("Output misses %q:\n%s", want, out.String())
+	}
+
+	// 実行時と同じく、ドメインなしの番号計画は他のドメインには適用されない
+	out.Reset()
+	checkDialPlan(&out, cfg, []string{"sip:0301234@other.example"}, "")
+	if want := "sip:0301234@other.example: no rule, routed as sip:0301234@other.example"; !strings.Contains(out.String(), want) {
+		t.Errorf("Output misses %q:\n%s", want, out.String())
+	}
+
+	// 送信元を条件とするルールは-sourceを指定したときだけ評価される
+	cfg.DialPlan = append([]config.RuleConfig{{Name: "office", Sources: []string{"192.0.2.0/24"}, Action: "reject", Code: 403, Reason: "Forbidden"}}, cfg.DialPlan...)
+	out.Reset()
+	checkDialPlan(&out, cfg, []string{"0301234"}, "")
+	if want := "rule 1 (office) is source-dependent"; !strings.Contains(out.String(), want) {
+		t.Errorf("Output misses %q:\n%s", want, out.String())
+	}
+	if want := `0301234: rule "international"`; !strings.Contains(out.String(), want) {
+		t.Errorf("Output misses %q:\n%s", want, out.String())
+	}
+	out.Reset()
+	checkDialPlan(&out, cfg, []string{"0301234"}, "192.0.2.7")
+	if want := `0301234: rule "office", reject 403 Forbidden`; !strings.Contains(out.String(), want) {
+		t.Errorf("Output misses %q:\n%s", want, out.String())
+	}
+	out.Reset()
+	if code := checkDialPlan(&out, cfg, nil, "not-an-address"); code != 1 {
+		t.Errorf("Invalid source accepted: %s", out.String())
+	}
+	cfg.DialPlan = cfg.DialPlan[1:]
+
+	// 存在しないトランクや不正なルールはエラーになる
+	cfg.Trunks = nil
+	out.Reset()
+	if code := checkDialPlan(&out, cfg, nil, ""); code != 1 || !strings.Contains(out.String(), "unknown trunk carrier") {
+		t.Errorf("Unknown trunk not reported: %d %s", code, out.String())
+	}
+	cfg.DialPlan[0].User = "("
+	out.Reset()
+	if code := checkDialPlan(&out, cfg, nil, ""); code != 1 || !strings.Contains(out.String(), "rule international") {
+		t.Errorf("Invalid rule not reported: %d %s", code, out.String())
+	}
+}
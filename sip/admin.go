@@ -0,0 +1,97 @@
+package sip
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// mailboxStatus is the JSON representation of a user's voicemail counts
+type mailboxStatus struct {
+	AOR string `json:"aor"`
+	mailbox
+}
+
+// featuresStatus is the JSON representation of a user's call features
+type featuresStatus struct {
+	AOR string `json:"aor"`
+	CallFeatures
+}
+
+// AdminHandler returns the HTTP handler of the administration API
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mwi", s.handleAdminMWI)
+	mux.HandleFunc("/features", s.handleAdminFeatures)
+	return mux
+}
+
+// handleAdminMWI reads (GET /mwi?aor=...) and sets (PUT or POST with a JSON
+// body) the message-waiting counts of a user
+func (s *Server) handleAdminMWI(w http.ResponseWriter, r *http.Request) {
+	var status mailboxStatus
+
+	switch r.Method {
+	case http.MethodGet:
+		status.AOR = r.URL.Query().Get("aor")
+	case http.MethodPut, http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if status.New < 0 || status.Old < 0 {
+			http.Error(w, "message counts must not be negative", http.StatusBadRequest)
+			return
+		}
+		if status.AOR != "" {
+			s.SetMessageWaiting(status.AOR, status.New, status.Old)
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if status.AOR == "" {
+		http.Error(w, "aor is required", http.StatusBadRequest)
+		return
+	}
+
+	status.New, status.Old = s.MessageWaiting(status.AOR)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleAdminFeatures reads (GET /features?aor=...) and sets (PUT or POST
+// with a JSON body) the call features of a user
+func (s *Server) handleAdminFeatures(w http.ResponseWriter, r *http.Request) {
+	var status featuresStatus
+
+	switch r.Method {
+	case http.MethodGet:
+		status.AOR = r.URL.Query().Get("aor")
+	case http.MethodPut, http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if status.AOR != "" {
+			if err := s.SetCallFeatures(status.AOR, status.CallFeatures); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if status.AOR == "" {
+		http.Error(w, "aor is required", http.StatusBadRequest)
+		return
+	}
+
+	status.CallFeatures = s.CallFeatures(status.AOR)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,90 @@
+package sip
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminMWI(t *testing.T) {
+	server := setupTestServer(t)
+	admin := httptest.NewServer(server.AdminHandler())
+	defer admin.Close()
+
+	resp, err := http.Post(admin.URL+"/mwi", "application/json", strings.NewReader(`{"aor":"sip:bob@example.com","new":3,"old":1}`))
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	if n, o := server.MessageWaiting("sip:bob@example.com"); n != 3 || o != 1 {
+		t.Errorf("MessageWaiting = %d/%d, want 3/1", n, o)
+	}
+
+	resp, err = http.Get(admin.URL + "/mwi?aor=sip:bob@example.com")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var status mailboxStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	if status.AOR != "sip:bob@example.com" || status.New != 3 || status.Old != 1 {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+
+	resp, err = http.Post(admin.URL+"/mwi", "application/json", strings.NewReader(`{"aor":"sip:bob@example.com","new":-1}`))
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for negative counts, got %d", resp.StatusCode)
+	}
+}
+
+func TestAdminFeatures(t *testing.T) {
+	server := setupTestServer(t)
+	admin := httptest.NewServer(server.AdminHandler())
+	defer admin.Close()
+
+	body := `{"aor":"sip:bob@example.com","forward_no_answer":"sip:voicemail@example.com","ring_timeout":15,"follow_me":["sip:bob-mobile@example.com"]}`
+	resp, err := http.Post(admin.URL+"/features", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	if f := server.CallFeatures("sip:bob@example.com"); f.ForwardNoAnswer != "sip:voicemail@example.com" || f.RingTimeout != 15 || len(f.FollowMe) != 1 {
+		t.Errorf("Unexpected features: %+v", f)
+	}
+
+	resp, err = http.Get(admin.URL + "/features?aor=sip:bob@example.com")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var status featuresStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	if status.AOR != "sip:bob@example.com" || status.FollowMe[0] != "sip:bob-mobile@example.com" {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+
+	resp, err = http.Post(admin.URL+"/features", "application/json", strings.NewReader(`{"aor":"sip:bob@example.com","dnd":true,"dnd_code":603}`))
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid DND code, got %d", resp.StatusCode)
+	}
+}
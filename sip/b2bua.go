@@ -0,0 +1,644 @@
+package sip
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// CallHandler is a back-to-back user agent application. HandleCall is
+// called for every new incoming call, on the goroutine handling its INVITE,
+// and decides how the call proceeds: answer it, reject it or dial an
+// outbound leg to bridge it to.
+type CallHandler interface {
+	HandleCall(call *Call)
+}
+
+// CallHandlerFunc adapts a function to the CallHandler interface
+type CallHandlerFunc func(call *Call)
+
+// HandleCall implements CallHandler
+func (f CallHandlerFunc) HandleCall(call *Call) {
+	f(call)
+}
+
+// Interceptor sees every message a call sends on one of its legs on behalf
+// of the other leg, including the INVITE of the outbound leg, and may modify
+// it. Returning false drops the message: a request is refused with 403
+// Forbidden and a provisional response is not relayed. Final responses are
+// always sent.
+type Interceptor func(leg *Leg, msg *Message) bool
+
+// Call is a call handled by the server as a B2BUA: the inbound leg from the
+// caller and, once dialed, the independent outbound leg toward the callee
+type Call struct {
+	ID        string   // Call-ID of the inbound leg
+	Invite    *Message // INVITE that created the call
+	Inbound   *Leg
+	Outbound  *Leg // nil until Dial
+	server    *Server
+	intercept Interceptor
+}
+
+// Leg is one side of a B2BUA call, a dialog in which the server is a user
+// agent. The Dialog of the outbound leg is set once it is answered.
+type Leg struct {
+	Dialog *Dialog
+	call   *Call
+	invite *Message // INVITE that created the leg
+	addr   net.Addr // where the leg's peer is reached
+}
+
+// Call returns the call the leg belongs to
+func (l *Leg) Call() *Call {
+	return l.call
+}
+
+// other returns the leg at the other side of the call
+func (l *Leg) other() *Leg {
+	if l == l.call.Inbound {
+		return l.call.Outbound
+	}
+	return l.call.Inbound
+}
+
+// errCallCancelled is returned when the caller cancelled the call before
+// it could be answered
+var errCallCancelled = errors.New("call cancelled")
+
+// SetB2BUA makes the server act as a back-to-back user agent: every INVITE
+// outside a dialog is handed to handler instead of being proxied. Pass nil
+// to return to proxy mode.
+func (s *Server) SetB2BUA(handler CallHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.b2bua = handler
+}
+
+// newCall creates the call of an incoming INVITE with its inbound leg
+func (s *Server) newCall(addr net.Addr, invite *Message) *Call {
+	c := &Call{
+		ID:     invite.Headers["Call-ID"],
+		Invite: invite,
+		server: s,
+	}
+	c.Inbound = &Leg{
+		Dialog: newUASDialog(addr, invite, newTag()),
+		call:   c,
+		invite: invite,
+		addr:   addr,
+	}
+	return c
+}
+
+// SetInterceptor installs the function that sees and may modify the
+// messages of the call. Set it before dialing the outbound leg.
+func (c *Call) SetInterceptor(intercept Interceptor) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	c.intercept = intercept
+}
+
+// intercepted passes a message the call is about to send on a leg to the
+// interceptor and reports whether it may be sent
+func (c *Call) intercepted(leg *Leg, msg *Message) bool {
+	c.server.mu.Lock()
+	intercept := c.intercept
+	c.server.mu.Unlock()
+	return intercept == nil || intercept(leg, msg)
+}
+
+// respond sends the final response to the INVITE of the call unless one
+// was sent already
+func (c *Call) respond(resp *Message) bool {
+	if !c.server.finalizeInvite(c.Invite) {
+		return false
+	}
+	c.server.sendResponse(c.Inbound.addr, resp)
+	return true
+}
+
+// Reject ends a call that has not been answered with a failure response
+func (c *Call) Reject(code int, reason string) {
+	c.server.setCallState(c.Invite, "")
+	c.respond(NewResponse(strconv.Itoa(code), reason, c.Invite))
+}
+
+// Ring sends 180 Ringing on the inbound leg. A caller supporting 100rel
+// gets it reliably and must answer it with PRACK (RFC 3262); without one
+// the call is rejected with 504 and Ring fails. Ring also fails once the
+// call is cancelled while the 180 waits for its PRACK.
+func (c *Call) Ring() error {
+	s := c.server
+	resp := NewResponse("180", "Ringing", c.Invite)
+	resp.Headers["To"] = c.Invite.Headers["To"] + ";tag=" + c.Inbound.Dialog.LocalTag
+	s.setCallState(c.Invite, "ringing")
+
+	if !wantsReliable(c.Invite) {
+		s.sendResponse(c.Inbound.addr, resp)
+		return nil
+	}
+	if err := s.sendReliable(c.Inbound.addr, resp); err != nil {
+		if err == errNotAcknowledged {
+			c.Reject(504, "Server Time-out")
+		}
+		return err
+	}
+	return nil
+}
+
+// Answer answers the inbound leg with 200 OK, the server itself being the
+// callee, and makes the call a session of the server. The answer to the
+// caller's offer must have been set on the inbound dialog before.
+func (c *Call) Answer() error {
+	s := c.server
+	// A CANCEL may have terminated the call while it was ringing
+	if !s.finalizeInvite(c.Invite) {
+		s.setCallState(c.Invite, "")
+		return errCallCancelled
+	}
+
+	d := c.Inbound.Dialog
+	okResp := NewResponse("200", "OK", c.Invite)
+	okResp.Headers["To"] = c.Invite.Headers["To"] + ";tag=" + d.LocalTag
+	okResp.Headers["Contact"] = s.contactHeader()
+	if d.LocalSDP != "" {
+		setSDPBody(okResp, d.LocalSDP)
+	}
+	s.addRecvInfo(c.Invite, okResp)
+	interval, refresher := s.negotiateSessionTimer(c.Invite, okResp)
+	s.sendResponse(c.Inbound.addr, okResp)
+
+	s.mu.Lock()
+	s.sessions[c.ID] = d
+	s.mu.Unlock()
+	s.startSessionTimer(&sessionTimer{
+		callID:    c.ID,
+		interval:  interval,
+		refresher: refresher,
+		legs:      []*Dialog{d},
+	})
+	s.setCallState(okResp, "connected")
+	log.Printf("call established: %s", c.ID)
+	return nil
+}
+
+// endToEndHeader reports whether a header is passed from one leg of a
+// call to the other. Headers describing the hop, the dialog or the
+// transaction belong to each leg and are never copied.
+func endToEndHeader(name string) bool {
+	switch strings.ToLower(name) {
+	case "via", "from", "to", "call-id", "cseq", "contact", "route", "record-route",
+		"max-forwards", "content-length", "rseq", "rack", "replaces",
+		"authorization", "proxy-authorization", "server", "user-agent", "date":
+		return false
+	}
+	return true
+}
+
+// copyEndToEnd copies the end-to-end headers and the body of a message
+// received on one leg into a message sent on the other
+func copyEndToEnd(dst, src *Message) {
+	for name, value := range src.Headers {
+		if endToEndHeader(name) {
+			dst.Headers[name] = value
+		}
+	}
+	dst.Body = src.Body
+	dst.Headers["Content-Length"] = strconv.Itoa(len(src.Body))
+}
+
+// withoutOptionTag removes an option tag from a Supported or Require value
+func withoutOptionTag(value, tag string) string {
+	var tags []string
+	for _, option := range strings.Split(value, ",") {
+		if option = strings.TrimSpace(option); option != "" && !strings.EqualFold(option, tag) {
+			tags = append(tags, option)
+		}
+	}
+	return strings.Join(tags, ", ")
+}
+
+// Dial places the outbound leg of the call to target, an address of
+// record or a SIP URI of another domain, with a new Call-ID, tags and Via,
+// and bridges it to the inbound leg. Responses are relayed to the caller as
+// they arrive; Dial itself returns once the INVITE is sent.
+func (c *Call) Dial(target string) error {
+	s := c.server
+	if reject := s.checkForwarding(c.Invite); reject != nil {
+		return forwardingError(reject)
+	}
+	requestURI, addr, err := s.locate(target)
+	if err != nil {
+		return err
+	}
+
+	invite := s.newRequest("INVITE", requestURI, withoutTag(c.Invite.Headers["From"]), withoutTag(c.Invite.Headers["To"]))
+	copyEndToEnd(invite, c.Invite)
+	invite.Headers["Contact"] = s.contactHeader()
+	decrementMaxForwards(invite, c.Invite)
+	// Reliable provisional responses are acknowledged hop by hop, and the
+	// server does not send PRACKs for the outbound leg
+	for _, header := range []string{"Supported", "Require"} {
+		if value, ok := invite.Headers[header]; ok {
+			if value = withoutOptionTag(value, "100rel"); value != "" {
+				invite.Headers[header] = value
+			} else {
+				delete(invite.Headers, header)
+			}
+		}
+	}
+
+	leg := &Leg{call: c, invite: invite, addr: addr}
+	s.mu.Lock()
+	c.Outbound = leg
+	s.mu.Unlock()
+	if !c.intercepted(leg, invite) {
+		s.mu.Lock()
+		c.Outbound = nil
+		s.mu.Unlock()
+		return errors.New("outbound INVITE refused by the application")
+	}
+
+	s.mu.Lock()
+	s.bridgedCalls[c.ID] = c
+	s.mu.Unlock()
+
+	log.Printf("call %s bridged to %s as %s", c.ID, requestURI, invite.Headers["Call-ID"])
+	s.setCallState(c.Invite, "trying")
+	err = s.sendRequest(addr, invite, func(resp *Message) {
+		c.outboundResponse(leg, resp)
+	})
+	if err != nil {
+		c.forget()
+		s.setCallState(c.Invite, "")
+	}
+	return err
+}
+
+// relayedResponse builds the response to the caller's INVITE that relays a
+// response of the outbound leg
+func (c *Call) relayedResponse(resp *Message) *Message {
+	relay := NewResponse(strconv.Itoa(resp.StatusCode()), resp.Reason(), c.Invite)
+	copyEndToEnd(relay, resp)
+	if resp.StatusCode() < 300 {
+		relay.Headers["To"] = c.Invite.Headers["To"] + ";tag=" + c.Inbound.Dialog.LocalTag
+		relay.Headers["Contact"] = c.server.contactHeader()
+	}
+	return relay
+}
+
+// outboundResponse relays a response to the INVITE of the outbound leg to the caller
+func (c *Call) outboundResponse(leg *Leg, resp *Message) {
+	s := c.server
+	if resp == nil {
+		c.forget()
+		c.Reject(408, "Request Timeout")
+		return
+	}
+
+	code := resp.StatusCode()
+	switch {
+	case code == 100:
+	case code < 200:
+		relay := c.relayedResponse(resp)
+		if c.intercepted(c.Inbound, relay) {
+			s.setCallState(c.Invite, "ringing")
+			s.sendResponse(c.Inbound.addr, relay)
+		}
+	case code < 300:
+		c.bridge(leg, resp)
+	default:
+		c.forget()
+		relay := c.relayedResponse(resp)
+		c.intercepted(c.Inbound, relay)
+		s.setCallState(c.Invite, "")
+		c.respond(relay)
+	}
+}
+
+// bridge completes the call once the outbound leg is answered
+func (c *Call) bridge(leg *Leg, resp *Message) {
+	s := c.server
+	s.ackSuccess(leg.addr, leg.invite, resp)
+
+	s.mu.Lock()
+	if leg.Dialog != nil {
+		// Only the first 2xx of a forked INVITE is bridged
+		s.mu.Unlock()
+		if d := newUACDialog(leg.addr, leg.invite, resp); d.RemoteTag != leg.Dialog.RemoteTag {
+			s.sendBye(d)
+		}
+		return
+	}
+	leg.Dialog = newUACDialog(leg.addr, leg.invite, resp)
+	leg.Dialog.LocalSDP = sdpBody(leg.invite)
+	leg.Dialog.RemoteSDP = sdpBody(resp)
+	s.mu.Unlock()
+
+	relay := c.relayedResponse(resp)
+	c.intercepted(c.Inbound, relay)
+	if !s.finalizeInvite(c.Invite) {
+		// The caller cancelled while the callee answered
+		c.forget()
+		s.sendBye(leg.Dialog)
+		return
+	}
+
+	s.mu.Lock()
+	c.Inbound.Dialog.RemoteSDP = sdpBody(c.Invite)
+	c.Inbound.Dialog.LocalSDP = sdpBody(relay)
+	s.bridgedCalls[leg.Dialog.CallID] = c
+	s.mu.Unlock()
+
+	s.sendResponse(c.Inbound.addr, relay)
+	s.setCallState(relay, "connected")
+	log.Printf("call established: %s", c.ID)
+
+	// The parties refresh the session through the server, which only
+	// watches for the refreshes
+	if interval, _, ok := parseSessionExpires(resp); ok {
+		s.startSessionTimer(&sessionTimer{
+			callID:   c.ID,
+			interval: interval,
+			observed: true,
+			call:     c,
+			legs:     []*Dialog{c.Inbound.Dialog, leg.Dialog},
+		})
+	}
+}
+
+// forget removes the call from the calls bridged by the server
+func (c *Call) forget() {
+	s := c.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.bridgedCalls, c.ID)
+	if c.Outbound != nil && c.Outbound.Dialog != nil {
+		delete(s.bridgedCalls, c.Outbound.Dialog.CallID)
+	}
+}
+
+// Hangup ends a bridged call by sending BYE on both legs
+func (c *Call) Hangup() {
+	c.end(nil)
+}
+
+// end tears down a bridged call, sending BYE on every established leg
+// except the one that hung up. A call not answered yet is terminated with
+// 487, and its outbound INVITE is cancelled.
+func (c *Call) end(hungUp *Leg) {
+	s := c.server
+	s.mu.Lock()
+	var ringing *Leg
+	if c.Outbound != nil && c.Outbound.Dialog == nil {
+		ringing = c.Outbound
+	}
+	s.mu.Unlock()
+	c.forget()
+	s.stopSessionTimer(c.ID)
+
+	c.respond(NewResponse("487", "Request Terminated", c.Invite))
+	if ringing != nil {
+		s.cancelRequest(ringing.invite, ringing.addr)
+	}
+
+	for _, leg := range []*Leg{c.Inbound, c.Outbound} {
+		if leg == nil || leg == hungUp || leg.Dialog == nil {
+			continue
+		}
+		s.sendBye(leg.Dialog)
+	}
+	s.setCallState(c.Invite, "")
+	log.Printf("call terminated: %s", c.ID)
+}
+
+// sendBye sends a BYE within a dialog and returns it
+func (s *Server) sendBye(d *Dialog) *Message {
+	bye := s.newDialogRequest(d, "BYE")
+	if err := s.sendRequest(d.target, bye, nil); err != nil {
+		log.Printf("BYE sending error: %v", err)
+	}
+	return bye
+}
+
+// bridgedLeg returns the established leg of a bridged call a request
+// within a dialog belongs to
+func (s *Server) bridgedLeg(msg *Message) *Leg {
+	toTag, inDialog := headerParam(msg.Headers["To"], "tag")
+	if !inDialog {
+		return nil
+	}
+	callID := msg.Headers["Call-ID"]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.bridgedCalls[callID]
+	if !ok {
+		return nil
+	}
+	for _, leg := range []*Leg{c.Inbound, c.Outbound} {
+		if leg != nil && leg.Dialog != nil && leg.Dialog.CallID == callID && leg.Dialog.LocalTag == toTag {
+			return leg
+		}
+	}
+	return nil
+}
+
+// bridgeRequest passes a request received within one leg of a bridged call
+// on to the other leg and relays the responses back. It returns false if
+// the request does not belong to a bridged call.
+func (s *Server) bridgeRequest(addr net.Addr, msg *Message) bool {
+	method := msg.Method()
+	if method == "CANCEL" {
+		return false
+	}
+	leg := s.bridgedLeg(msg)
+	if leg == nil {
+		return false
+	}
+	c := leg.call
+
+	switch method {
+	case "ACK":
+		// 2xx responses are acknowledged on each leg separately
+		return true
+	case "BYE":
+		s.sendResponse(addr, NewResponse("200", "OK", msg))
+		c.end(leg)
+		return true
+	case "INVITE":
+		s.startInviteTransaction(addr, msg)
+	}
+
+	other := leg.other()
+	s.mu.Lock()
+	early := other == nil || other.Dialog == nil
+	s.mu.Unlock()
+	if early {
+		// Reliable provisional responses are acknowledged hop by hop
+		if method == "PRACK" {
+			return false
+		}
+		// Nothing can be passed on before the callee answers
+		resp := NewResponse("500", "Server Internal Error", msg)
+		resp.Headers["Retry-After"] = strconv.Itoa(rand.Intn(11))
+		s.respondBridged(addr, msg, resp)
+		return true
+	}
+	req := s.newDialogRequest(other.Dialog, method)
+	copyEndToEnd(req, msg)
+	if !c.intercepted(other, req) {
+		s.respondBridged(addr, msg, NewResponse("403", "Forbidden", msg))
+		return true
+	}
+
+	err := s.sendRequest(other.Dialog.target, req, func(resp *Message) {
+		s.bridgeResponse(addr, msg, other, req, resp)
+	})
+	if err != nil {
+		log.Printf("%s bridging error: %v", method, err)
+		s.respondBridged(addr, msg, NewResponse("503", "Service Unavailable", msg))
+	}
+	return true
+}
+
+// bridgeResponse relays the response to a request bridged onto a leg back
+// to the leg the request came from
+func (s *Server) bridgeResponse(addr net.Addr, msg *Message, leg *Leg, req, resp *Message) {
+	c := leg.call
+	if resp == nil {
+		s.respondBridged(addr, msg, NewResponse("408", "Request Timeout", msg))
+		return
+	}
+	code := resp.StatusCode()
+	if code == 100 {
+		return
+	}
+
+	relay := NewResponse(strconv.Itoa(code), resp.Reason(), msg)
+	copyEndToEnd(relay, resp)
+	if code < 300 {
+		relay.Headers["Contact"] = s.contactHeader()
+	}
+	if !c.intercepted(leg.other(), relay) && code < 200 {
+		return
+	}
+	if code < 200 {
+		s.sendResponse(addr, relay)
+		return
+	}
+
+	if code < 300 {
+		if req.Method() == "INVITE" {
+			s.ackSuccess(leg.Dialog.target, req, resp)
+		}
+		// Offer/answer exchanges are followed on both legs
+		if offer, answer := sdpBody(req), sdpBody(resp); offer != "" && answer != "" {
+			s.mu.Lock()
+			leg.Dialog.LocalSDP, leg.Dialog.RemoteSDP = offer, answer
+			from := leg.other().Dialog
+			from.RemoteSDP, from.LocalSDP = offer, answer
+			s.mu.Unlock()
+		}
+		if method := req.Method(); method == "INVITE" || method == "UPDATE" {
+			s.sessionRefreshed(c.ID, resp, false)
+		}
+	}
+	s.respondBridged(addr, msg, relay)
+}
+
+// respondBridged sends the final response to a bridged request
+func (s *Server) respondBridged(addr net.Addr, msg, resp *Message) {
+	if msg.Method() == "INVITE" && !s.finalizeInvite(msg) {
+		return
+	}
+	s.sendResponse(addr, resp)
+}
+
+// cancelCall cancels the outbound leg of a call whose caller cancelled it
+func (s *Server) cancelCall(invite *Message) {
+	s.mu.Lock()
+	c, ok := s.bridgedCalls[invite.Headers["Call-ID"]]
+	var leg *Leg
+	if ok && c.Invite == invite && c.Outbound != nil && c.Outbound.Dialog == nil {
+		leg = c.Outbound
+	}
+	s.mu.Unlock()
+
+	if leg != nil {
+		c.forget()
+		s.cancelRequest(leg.invite, leg.addr)
+	}
+}
+
+// AutoAnswer is the B2BUA application that answers every call itself
+// after ringing, accepting the caller's offer with the server's offer
+// handler. A call replacing another one (RFC 3891) is answered without
+// ringing and the replaced call is hung up. It is what the server does with
+// calls to local users it cannot proxy.
+type AutoAnswer struct{}
+
+// HandleCall implements CallHandler
+func (AutoAnswer) HandleCall(call *Call) {
+	s := call.server
+
+	// A call replacing another one is answered without ringing (RFC 3891)
+	replaced, failure := s.replacedSession(call.Invite)
+	if failure != nil {
+		call.respond(failure)
+		return
+	}
+
+	// An offer the server cannot answer is refused before ringing
+	if offer := sdpBody(call.Invite); offer != "" {
+		if _, err := s.answerOffer(call.Inbound.Dialog, offer); err != nil {
+			log.Printf("offer of %s rejected: %v", call.ID, err)
+			call.Reject(488, "Not Acceptable Here")
+			return
+		}
+	}
+
+	if replaced == nil {
+		if err := call.Ring(); err != nil {
+			return
+		}
+	}
+	if err := call.Answer(); err != nil {
+		return
+	}
+
+	if replaced != nil {
+		log.Printf("call %s replaces %s", call.ID, replaced.CallID)
+		s.endSession(replaced)
+	}
+}
+
+// Bridge is the B2BUA application that places every call to the target
+// of its Request-URI, a registered user or another domain, hiding each
+// side's topology from the other
+type Bridge struct{}
+
+// HandleCall implements CallHandler
+func (Bridge) HandleCall(call *Call) {
+	if err := call.Dial(call.Invite.RequestURI()); err != nil {
+		log.Printf("cannot bridge %s: %v", call.ID, err)
+		switch {
+		case errors.Is(err, errTooManyHops):
+			call.Reject(483, "Too Many Hops")
+		case errors.Is(err, errLoopDetected):
+			call.Reject(482, "Loop Detected")
+		case errors.Is(err, errInvalidMaxForwards):
+			call.Reject(400, "Invalid Max-Forwards")
+		case errors.Is(err, errNotRegistered):
+			call.Reject(404, "Not Found")
+		case errors.Is(err, errUnresolvable):
+			call.Reject(503, "Service Unavailable")
+		default:
+			call.Reject(500, "Server Internal Error")
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package sip
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var (
+	b2buaAliceAddr = &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	b2buaCarolAddr = &net.UDPAddr{IP: net.ParseIP("127.0.0.4"), Port: 5064}
+)
+
+// dialedTestCall registers carol, sends a call from alice to carol to a
+// B2BUA server and returns alice's INVITE and the INVITE of the outbound leg
+func dialedTestCall(t *testing.T, server *Server, callID string) (*Message, *Message) {
+	t.Helper()
+	register := newOutboundRegister("<sip:carol@127.0.0.4:5064>")
+	register.Headers["From"] = "<sip:carol@example.com>;tag=777"
+	server.handleRegister(b2buaCarolAddr, register)
+
+	invite := newTestInvite("sip:carol@example.com", callID)
+	invite.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bK" + callID
+	invite.Headers["Supported"] = "100rel, timer"
+	setSDPBody(invite, testOffer("sendrecv"))
+	server.handleMessage(b2buaAliceAddr, []byte(invite.String()))
+
+	invites := sentRequests(t, server.conn.(*MockConn), "INVITE")
+	if len(invites) != 1 {
+		t.Fatalf("Expected an outbound INVITE, got %d", len(invites))
+	}
+	return invite, invites[0]
+}
+
+// answerTestLeg answers the outbound leg as carol and returns alice's 200 OK
+func answerTestLeg(t *testing.T, server *Server, outbound *Message) *Message {
+	t.Helper()
+	ok := NewResponse("200", "OK", outbound)
+	ok.Headers["To"] += ";tag=carol1"
+	ok.Headers["Contact"] = "<sip:carol@127.0.0.4:5064>"
+	setSDPBody(ok, testOffer("sendrecv"))
+	server.handleMessage(b2buaCarolAddr, []byte(ok.String()))
+	return lastSent(t, server.conn.(*MockConn))
+}
+
+func TestB2BUABridge(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetB2BUA(Bridge{})
+	mockConn := server.conn.(*MockConn)
+
+	invite, outbound := dialedTestCall(t, server, "b2bua-call")
+
+	// The outbound leg is independent of the inbound one
+	if outbound.Headers["Call-ID"] == "b2bua-call" || strings.Contains(outbound.Headers["From"], "tag=123") {
+		t.Errorf("Outbound leg reuses the caller's identifiers: %s", outbound.String())
+	}
+	if len(splitHeaderValues(outbound.Headers["Via"])) != 1 || outbound.Headers["Contact"] != server.contactHeader() {
+		t.Errorf("Outbound leg reveals the caller: %s", outbound.String())
+	}
+	if outbound.Body != invite.Body || outbound.Headers["Supported"] != "timer" {
+		t.Errorf("Wrong outbound body or Supported: %s", outbound.String())
+	}
+
+	ringing := NewResponse("180", "Ringing", outbound)
+	ringing.Headers["To"] += ";tag=carol1"
+	server.handleMessage(b2buaCarolAddr, []byte(ringing.String()))
+	relayed := lastSent(t, mockConn)
+	if relayed.StatusCode() != 180 || relayed.Headers["Call-ID"] != "b2bua-call" || strings.Contains(relayed.Headers["To"], "carol1") {
+		t.Fatalf("Wrong relayed 180: %s", relayed.String())
+	}
+
+	ok := answerTestLeg(t, server, outbound)
+	if ok.StatusCode() != 200 || ok.Headers["Call-ID"] != "b2bua-call" || ok.Headers["Contact"] != server.contactHeader() {
+		t.Fatalf("Wrong relayed 200: %s", ok.String())
+	}
+	if ok.Body != testOffer("sendrecv") {
+		t.Errorf("Answer not relayed: %q", ok.Body)
+	}
+	if acks := sentRequests(t, mockConn, "ACK"); len(acks) != 1 || acks[0].Headers["Call-ID"] != outbound.Headers["Call-ID"] {
+		t.Errorf("Outbound 200 not acknowledged: %v", acks)
+	}
+
+	// A re-INVITE from alice is bridged onto carol's leg
+	reinvite := newTestReinvite(ok, "2", "z9hG4bKb2buare1", testOffer("sendonly"))
+	server.handleMessage(b2buaAliceAddr, []byte(reinvite.String()))
+	invites := sentRequests(t, mockConn, "INVITE")
+	bridged := invites[len(invites)-1]
+	if bridged.Headers["Call-ID"] != outbound.Headers["Call-ID"] || !strings.Contains(bridged.Headers["To"], "tag=carol1") {
+		t.Fatalf("re-INVITE not bridged: %s", bridged.String())
+	}
+	if bridged.Body != testOffer("sendonly") || bridged.RequestURI() != "sip:carol@127.0.0.4:5064" {
+		t.Errorf("Wrong bridged re-INVITE: %s", bridged.String())
+	}
+	answered := NewResponse("200", "OK", bridged)
+	setSDPBody(answered, testOffer("recvonly"))
+	server.handleMessage(b2buaCarolAddr, []byte(answered.String()))
+	resp := lastSent(t, mockConn)
+	if resp.StatusCode() != 200 || resp.Headers["CSeq"] != "2 INVITE" || resp.Body != testOffer("recvonly") {
+		t.Fatalf("re-INVITE answer not relayed: %s", resp.String())
+	}
+
+	// Carol hangs up; alice gets a BYE within her own dialog
+	bye := NewMessage()
+	bye.StartLine = "BYE sip:127.0.0.1:5060 SIP/2.0"
+	bye.Headers["Via"] = "SIP/2.0/UDP 127.0.0.4:5064;branch=z9hG4bKb2buabye"
+	bye.Headers["From"] = answered.Headers["To"]
+	bye.Headers["To"] = outbound.Headers["From"]
+	bye.Headers["Call-ID"] = outbound.Headers["Call-ID"]
+	bye.Headers["CSeq"] = "1 BYE"
+	server.handleMessage(b2buaCarolAddr, []byte(bye.String()))
+
+	byes := sentRequests(t, mockConn, "BYE")
+	if len(byes) != 1 || byes[0].Headers["Call-ID"] != "b2bua-call" || byes[0].Headers["To"] != invite.Headers["From"] {
+		t.Fatalf("BYE not bridged to alice: %v", byes)
+	}
+	server.mu.Lock()
+	remaining := len(server.bridgedCalls)
+	server.mu.Unlock()
+	if remaining != 0 {
+		t.Errorf("%d bridged calls left after BYE", remaining)
+	}
+}
+
+func TestB2BUACancel(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetB2BUA(Bridge{})
+	mockConn := server.conn.(*MockConn)
+
+	invite, outbound := dialedTestCall(t, server, "b2bua-cancel")
+	server.handleMessage(b2buaAliceAddr, []byte(newTestCancel(invite).String()))
+
+	if code := lastSent(t, mockConn).StatusCode(); code == 487 {
+		// The 487 comes before the CANCEL of the outbound leg
+		t.Fatal("Outbound leg not cancelled")
+	}
+	cancels := sentRequests(t, mockConn, "CANCEL")
+	if len(cancels) != 1 || cancels[0].Headers["Via"] != outbound.Headers["Via"] {
+		t.Fatalf("Expected a CANCEL of the outbound INVITE, got %v", cancels)
+	}
+	var terminated bool
+	for _, msg := range sentMessages(t, mockConn) {
+		terminated = terminated || (msg.StatusCode() == 487 && msg.Headers["Call-ID"] == "b2bua-cancel")
+	}
+	if !terminated {
+		t.Error("Caller did not get 487")
+	}
+
+	// The 487 of the outbound leg is acknowledged but not relayed again
+	server.handleMessage(b2buaCarolAddr, []byte(NewResponse("487", "Request Terminated", outbound).String()))
+	if acks := sentRequests(t, mockConn, "ACK"); len(acks) != 1 {
+		t.Errorf("Expected the 487 to be acknowledged, got %d ACKs", len(acks))
+	}
+	if msg := lastSent(t, mockConn); msg.StatusCode() == 487 {
+		t.Error("Second final response relayed to the caller")
+	}
+}
+
+// earlyTestRequest builds a request of alice within the early dialog of a
+// bridged call that is ringing
+func earlyTestRequest(invite, ringing *Message, method, cseq string) *Message {
+	msg := NewMessage()
+	msg.StartLine = method + " sip:127.0.0.1:5060 SIP/2.0"
+	msg.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKearly" + cseq
+	msg.Headers["From"] = invite.Headers["From"]
+	msg.Headers["To"] = ringing.Headers["To"]
+	msg.Headers["Call-ID"] = invite.Headers["Call-ID"]
+	msg.Headers["CSeq"] = cseq + " " + method
+	msg.Headers["Content-Length"] = "0"
+	return msg
+}
+
+func TestB2BUAEarlyDialog(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetB2BUA(Bridge{})
+	mockConn := server.conn.(*MockConn)
+
+	invite, outbound := dialedTestCall(t, server, "b2bua-early")
+	ringing := NewResponse("180", "Ringing", outbound)
+	ringing.Headers["To"] += ";tag=carol1"
+	server.handleMessage(b2buaCarolAddr, []byte(ringing.String()))
+	relayed := lastSent(t, mockConn)
+	if relayed.StatusCode() != 180 {
+		t.Fatalf("Expected 180 relayed to the caller, got %s", relayed.StartLine)
+	}
+
+	// Requests of the early dialog are answered by the server
+	for i, method := range []string{"UPDATE", "INFO"} {
+		server.handleMessage(b2buaAliceAddr, []byte(earlyTestRequest(invite, relayed, method, strconv.Itoa(i+2)).String()))
+		if resp := lastSent(t, mockConn); resp.StatusCode() != 500 || resp.Headers["Retry-After"] == "" {
+			t.Errorf("Expected 500 with Retry-After to an early %s, got %s", method, resp.StartLine)
+		}
+	}
+	if sent := len(requestsTo(t, mockConn, b2buaCarolAddr)); sent != 1 {
+		t.Errorf("Early requests passed on to the callee: %d requests", sent)
+	}
+
+	// A BYE of the early dialog cancels the outbound INVITE
+	server.handleMessage(b2buaAliceAddr, []byte(earlyTestRequest(invite, relayed, "BYE", "4").String()))
+	cancels := sentRequests(t, mockConn, "CANCEL")
+	if len(cancels) != 1 || cancels[0].Headers["Via"] != outbound.Headers["Via"] {
+		t.Fatalf("Expected a CANCEL of the outbound INVITE, got %v", cancels)
+	}
+	var byeOK, terminated bool
+	for _, msg := range sentTo(t, mockConn, b2buaAliceAddr) {
+		byeOK = byeOK || (msg.StatusCode() == 200 && msg.Headers["CSeq"] == "4 BYE")
+		terminated = terminated || (msg.StatusCode() == 487 && msg.Headers["CSeq"] == invite.Headers["CSeq"])
+	}
+	if !byeOK || !terminated {
+		t.Errorf("Expected 200 to the BYE and 487 to the INVITE: %v %v", byeOK, terminated)
+	}
+}
+
+func TestB2BUAFailure(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetB2BUA(Bridge{})
+	mockConn := server.conn.(*MockConn)
+
+	_, outbound := dialedTestCall(t, server, "b2bua-busy")
+	busy := NewResponse("486", "Busy Here", outbound)
+	busy.Headers["To"] += ";tag=carol1"
+	server.handleMessage(b2buaCarolAddr, []byte(busy.String()))
+
+	resp := lastSent(t, mockConn)
+	if resp.StatusCode() != 486 || resp.Headers["Call-ID"] != "b2bua-busy" || resp.Reason() != "Busy Here" {
+		t.Fatalf("Failure not relayed: %s", resp.String())
+	}
+
+	// Unknown targets are rejected by the bridge application
+	invite := newTestInvite("sip:nobody@example.com", "b2bua-unknown")
+	server.handleMessage(b2buaAliceAddr, []byte(invite.String()))
+	if code := lastSent(t, mockConn).StatusCode(); code != 404 {
+		t.Errorf("Expected 404, got %d", code)
+	}
+
+	// Domains that cannot be resolved make the service unavailable
+	server.SetDomains([]string{"example.com"})
+	server.SetResolver(newStubResolver(t, nil))
+	invite = newTestInvite("sip:dave@remote.com", "b2bua-unresolvable")
+	invite.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKunresolvable"
+	server.handleMessage(b2buaAliceAddr, []byte(invite.String()))
+	if code := lastSent(t, mockConn).StatusCode(); code != 503 {
+		t.Errorf("Expected 503, got %d", code)
+	}
+}
+
+func TestB2BUAInterceptor(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+
+	server.SetB2BUA(CallHandlerFunc(func(call *Call) {
+		call.SetInterceptor(func(leg *Leg, msg *Message) bool {
+			if leg == call.Outbound {
+				msg.Headers["X-Screened"] = "yes"
+			}
+			return msg.Method() != "INFO"
+		})
+		if err := call.Dial("sip:carol@example.com"); err != nil {
+			call.Reject(480, "Temporarily Unavailable")
+		}
+	}))
+
+	_, outbound := dialedTestCall(t, server, "b2bua-intercept")
+	if outbound.Headers["X-Screened"] != "yes" {
+		t.Errorf("Outbound INVITE not modified: %s", outbound.String())
+	}
+	ok := answerTestLeg(t, server, outbound)
+
+	info := newTestInfo(ok, "2", "", "application/dtmf", "5")
+	server.handleMessage(b2buaAliceAddr, []byte(info.String()))
+	if code := lastSent(t, mockConn).StatusCode(); code != 403 {
+		t.Errorf("Expected 403 for an intercepted INFO, got %d", code)
+	}
+	if infos := sentRequests(t, mockConn, "INFO"); len(infos) != 0 {
+		t.Errorf("Intercepted INFO was bridged: %v", infos)
+	}
+}
+
+func TestAutoAnswerApplication(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetB2BUA(AutoAnswer{})
+
+	invite := newTestInvite("sip:carol@example.net", "auto-answer")
+	server.handleInvite(b2buaAliceAddr, invite)
+
+	// Even calls to other domains are answered by the server itself
+	resp := lastSent(t, server.conn.(*MockConn))
+	if resp.StatusCode() != 200 || server.lookupSession("auto-answer") == nil {
+		t.Fatalf("Call not answered: %s", resp.String())
+	}
+}
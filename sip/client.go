@@ -0,0 +1,139 @@
+package sip
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// responseHandler receives the responses to a request the server sent as a
+// client. It is called with nil when the request times out.
+type responseHandler func(resp *Message)
+
+// clientTransaction is a request originated by the server itself
+type clientTransaction struct {
+	branch     string
+	request    *Message
+	target     net.Addr
+	onResponse responseHandler
+	timer      *time.Timer
+}
+
+// newRequest builds a request originated by the server. from and to are
+// name-addr header values; a From tag, Call-ID and CSeq are generated.
+func (s *Server) newRequest(method, requestURI, from, to string) *Message {
+	req := NewMessage()
+	req.StartLine = fmt.Sprintf("%s %s SIP/2.0", method, requestURI)
+	req.Headers["From"] = from + ";tag=" + newTag()
+	req.Headers["To"] = to
+	req.Headers["Call-ID"] = randomToken(12) + "@" + s.viaSentBy()
+	req.Headers["CSeq"] = "1 " + method
+	req.Headers["Max-Forwards"] = "70"
+	req.Headers["User-Agent"] = "Go-SIP-Server"
+	req.Headers["Content-Length"] = "0"
+	return req
+}
+
+// sendRequest sends a request as a client with the server's Via on top and
+// passes every response to onResponse. onResponse may be nil.
+func (s *Server) sendRequest(target net.Addr, req *Message, onResponse responseHandler) error {
+	branch := newBranch()
+	via := fmt.Sprintf("SIP/2.0/%s %s;branch=%s", viaTransport(target), s.viaSentBy(), branch)
+	if target.Network() == "tls" {
+		via += ";alias"
+	}
+	req.Headers["Via"] = via
+
+	// ACK has no response, so no transaction is kept for it
+	if req.Method() == "ACK" {
+		return s.send(target, req)
+	}
+
+	txn := &clientTransaction{
+		branch:     branch,
+		request:    req,
+		target:     target,
+		onResponse: onResponse,
+	}
+	s.mu.Lock()
+	s.requests[branch] = txn
+	txn.timer = time.AfterFunc(s.transactionTimeout, func() {
+		s.requestTimedOut(branch)
+	})
+	s.mu.Unlock()
+
+	if err := s.send(target, req); err != nil {
+		s.mu.Lock()
+		delete(s.requests, branch)
+		txn.timer.Stop()
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// requestTimedOut reports a timeout to the sender of a request
+func (s *Server) requestTimedOut(branch string) {
+	s.mu.Lock()
+	txn, ok := s.requests[branch]
+	delete(s.requests, branch)
+	s.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	log.Printf("%s to %s timed out", txn.request.Method(), txn.target.String())
+	if txn.onResponse != nil {
+		txn.onResponse(nil)
+	}
+}
+
+// handleClientResponse passes a response to the request the server sent.
+// It returns false if the response does not belong to such a request.
+func (s *Server) handleClientResponse(msg *Message) bool {
+	branch, _ := headerParam(topHeaderValue(msg.Headers["Via"]), "branch")
+	code := msg.StatusCode()
+
+	s.mu.Lock()
+	txn, ok := s.requests[branch]
+	if ok && code >= 200 {
+		delete(s.requests, branch)
+	}
+	// A final response, or any response to an INVITE, stops the timeout
+	if ok && (code >= 200 || strings.HasSuffix(msg.Headers["CSeq"], "INVITE")) {
+		txn.timer.Stop()
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	if code >= 300 && txn.request.Method() == "INVITE" {
+		s.ackFailure(txn.request, msg, txn.target)
+	}
+	if txn.onResponse != nil {
+		txn.onResponse(msg)
+	}
+	return true
+}
+
+// ackFailure acknowledges a non-2xx final response to an INVITE the server
+// sent; the ACK reuses the branch of the INVITE (RFC 3261 17.1.1.3)
+func (s *Server) ackFailure(invite, resp *Message, target net.Addr) {
+	ack := NewMessage()
+	ack.StartLine = fmt.Sprintf("ACK %s SIP/2.0", invite.RequestURI())
+	ack.Headers["Via"] = topHeaderValue(invite.Headers["Via"])
+	ack.Headers["From"] = invite.Headers["From"]
+	ack.Headers["To"] = resp.Headers["To"]
+	ack.Headers["Call-ID"] = invite.Headers["Call-ID"]
+	ack.Headers["CSeq"] = strings.Replace(invite.Headers["CSeq"], "INVITE", "ACK", 1)
+	ack.Headers["Max-Forwards"] = "70"
+	ack.Headers["Content-Length"] = "0"
+
+	if err := s.send(target, ack); err != nil {
+		log.Printf("ACK sending error: %v", err)
+	}
+}
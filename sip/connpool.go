@@ -0,0 +1,282 @@
+package sip
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultIdleTimeout closes outbound connections nobody used for this long
+	defaultIdleTimeout = 5 * time.Minute
+	// defaultMaxConnsPerPeer limits the connections kept open to one peer
+	defaultMaxConnsPerPeer = 4
+	// defaultMaxDialFailures is the number of consecutive failures that mark a peer down
+	defaultMaxDialFailures = 3
+	// defaultPeerRetryAfter is how long a peer stays down before it is dialed again
+	defaultPeerRetryAfter = 30 * time.Second
+)
+
+// tlsAddr is the address of a TLS peer together with the server name
+// used for SNI and certificate verification
+type tlsAddr struct {
+	*net.TCPAddr
+	ServerName string
+}
+
+// Network returns the SIP transport name of the address
+func (a *tlsAddr) Network() string {
+	return "tls"
+}
+
+// connKey identifies outbound connections to a peer (RFC 5923)
+type connKey struct {
+	transport string
+	addr      string
+	sni       string
+}
+
+// poolKey returns the pool key of a stream address
+func poolKey(addr net.Addr) connKey {
+	key := connKey{transport: addr.Network(), addr: addr.String()}
+	if t, ok := addr.(*tlsAddr); ok {
+		key.sni = t.ServerName
+	}
+	return key
+}
+
+// pooledConn is a connection kept open by the pool
+type pooledConn struct {
+	conn     net.Conn
+	lastUsed time.Time
+}
+
+// peerHealth tracks connection failures to a peer
+type peerHealth struct {
+	failures  int
+	downUntil time.Time
+}
+
+// ConnPool keeps persistent outbound TCP and TLS connections so that
+// requests and responses to the same peer reuse a single connection
+type ConnPool struct {
+	mu          sync.Mutex
+	conns       map[connKey][]*pooledConn
+	dialing     map[connKey]int
+	health      map[connKey]*peerHealth
+	tlsConfig   *tls.Config
+	dialTimeout time.Duration
+
+	IdleTimeout time.Duration
+	MaxPerPeer  int
+	MaxFailures int
+	RetryAfter  time.Duration
+}
+
+// NewConnPool creates an empty connection pool
+func NewConnPool() *ConnPool {
+	return &ConnPool{
+		conns:       make(map[connKey][]*pooledConn),
+		dialing:     make(map[connKey]int),
+		health:      make(map[connKey]*peerHealth),
+		tlsConfig:   &tls.Config{},
+		dialTimeout: 5 * time.Second,
+		IdleTimeout: defaultIdleTimeout,
+		MaxPerPeer:  defaultMaxConnsPerPeer,
+		MaxFailures: defaultMaxDialFailures,
+		RetryAfter:  defaultPeerRetryAfter,
+	}
+}
+
+// SetTLSConfig sets the TLS configuration used for outbound TLS connections
+func (p *ConnPool) SetTLSConfig(config *tls.Config) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tlsConfig = config
+}
+
+// Get returns a connection to addr, dialing a new one when none is open.
+// The second result reports whether the connection was newly dialed.
+func (p *ConnPool) Get(addr net.Addr) (net.Conn, bool, error) {
+	key := poolKey(addr)
+
+	p.mu.Lock()
+	if conns := p.conns[key]; len(conns) > 0 {
+		pc := conns[0]
+		for _, c := range conns[1:] {
+			if c.lastUsed.After(pc.lastUsed) {
+				pc = c
+			}
+		}
+		pc.lastUsed = time.Now()
+		p.mu.Unlock()
+		return pc.conn, false, nil
+	}
+
+	if h := p.health[key]; h != nil && time.Now().Before(h.downUntil) {
+		p.mu.Unlock()
+		return nil, false, fmt.Errorf("peer %s/%s is down", key.transport, key.addr)
+	}
+	if len(p.conns[key])+p.dialing[key] >= p.MaxPerPeer {
+		p.mu.Unlock()
+		return nil, false, fmt.Errorf("connection limit reached for %s/%s", key.transport, key.addr)
+	}
+	p.dialing[key]++
+	tlsConfig := p.tlsConfig
+	p.mu.Unlock()
+
+	conn, err := p.dial(key, tlsConfig)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing[key]--
+	if p.dialing[key] == 0 {
+		delete(p.dialing, key)
+	}
+
+	if err != nil {
+		p.recordFailure(key)
+		return nil, false, err
+	}
+
+	delete(p.health, key)
+	p.conns[key] = append(p.conns[key], &pooledConn{conn: conn, lastUsed: time.Now()})
+	return conn, true, nil
+}
+
+// dial opens a connection for the key
+func (p *ConnPool) dial(key connKey, tlsConfig *tls.Config) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.dialTimeout)
+	defer cancel()
+
+	switch key.transport {
+	case "tcp":
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", key.addr)
+	case "tls":
+		config := tlsConfig.Clone()
+		config.ServerName = key.sni
+		dialer := tls.Dialer{Config: config}
+		return dialer.DialContext(ctx, "tcp", key.addr)
+	default:
+		return nil, fmt.Errorf("unsupported stream transport: %s", key.transport)
+	}
+}
+
+// recordFailure counts a failure to reach a peer. The caller must hold p.mu.
+func (p *ConnPool) recordFailure(key connKey) {
+	h := p.health[key]
+	if h == nil {
+		h = &peerHealth{}
+		p.health[key] = h
+	}
+	h.failures++
+	if h.failures >= p.MaxFailures {
+		h.downUntil = time.Now().Add(p.RetryAfter)
+		log.Printf("peer %s/%s marked down after %d failures", key.transport, key.addr, h.failures)
+	}
+}
+
+// Lookup returns an open connection to addr without dialing
+func (p *ConnPool) Lookup(addr net.Addr) net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if conns := p.conns[poolKey(addr)]; len(conns) > 0 {
+		return conns[0].conn
+	}
+	return nil
+}
+
+// Alias makes an existing connection available for requests to addr, as
+// requested by the alias Via parameter (RFC 5923)
+func (p *ConnPool) Alias(addr net.Addr, conn net.Conn) {
+	key := poolKey(addr)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, pc := range p.conns[key] {
+		if pc.conn == conn {
+			return
+		}
+	}
+	if len(p.conns[key]) >= p.MaxPerPeer {
+		return
+	}
+	p.conns[key] = append(p.conns[key], &pooledConn{conn: conn, lastUsed: time.Now()})
+}
+
+// Touch records activity on a connection
+func (p *ConnPool) Touch(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, conns := range p.conns {
+		for _, pc := range conns {
+			if pc.conn == conn {
+				pc.lastUsed = time.Now()
+			}
+		}
+	}
+}
+
+// Fail drops a connection that failed and counts the failure against its peer
+func (p *ConnPool) Fail(addr net.Addr, conn net.Conn) {
+	p.Remove(conn)
+	conn.Close()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.recordFailure(poolKey(addr))
+}
+
+// Remove forgets a connection, e.g. after it was closed
+func (p *ConnPool) Remove(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, conns := range p.conns {
+		kept := conns[:0]
+		for _, pc := range conns {
+			if pc.conn != conn {
+				kept = append(kept, pc)
+			}
+		}
+		if len(kept) == 0 {
+			delete(p.conns, key)
+		} else {
+			p.conns[key] = kept
+		}
+	}
+}
+
+// CloseIdle closes connections that have not been used within the idle timeout
+func (p *ConnPool) CloseIdle(now time.Time) {
+	p.mu.Lock()
+	var idle []net.Conn
+	for key, conns := range p.conns {
+		kept := conns[:0]
+		for _, pc := range conns {
+			if now.Sub(pc.lastUsed) > p.IdleTimeout {
+				idle = append(idle, pc.conn)
+				continue
+			}
+			kept = append(kept, pc)
+		}
+		if len(kept) == 0 {
+			delete(p.conns, key)
+		} else {
+			p.conns[key] = kept
+		}
+	}
+	p.mu.Unlock()
+
+	for _, conn := range idle {
+		conn.Close()
+	}
+}
@@ -0,0 +1,228 @@
+package sip
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// acceptCounter accepts connections on a loopback listener and counts them
+type acceptCounter struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	conns    []net.Conn
+}
+
+func newAcceptCounter(t *testing.T) *acceptCounter {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	a := &acceptCounter{listener: listener}
+	t.Cleanup(func() {
+		listener.Close()
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		for _, conn := range a.conns {
+			conn.Close()
+		}
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			a.mutex.Lock()
+			a.conns = append(a.conns, conn)
+			a.mutex.Unlock()
+		}
+	}()
+	return a
+}
+
+func (a *acceptCounter) count() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return len(a.conns)
+}
+
+func (a *acceptCounter) conn(i int) net.Conn {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.conns[i]
+}
+
+func TestConnPoolReuse(t *testing.T) {
+	peer := newAcceptCounter(t)
+	pool := NewConnPool()
+	addr := peer.listener.Addr().(*net.TCPAddr)
+
+	first, dialed, err := pool.Get(addr)
+	if err != nil || !dialed {
+		t.Fatalf("Expected a new connection, got dialed=%v err=%v", dialed, err)
+	}
+	second, dialed, err := pool.Get(addr)
+	if err != nil || dialed {
+		t.Fatalf("Expected a pooled connection, got dialed=%v err=%v", dialed, err)
+	}
+	if first != second {
+		t.Error("Pool returned a different connection for the same peer")
+	}
+
+	waitFor(t, "connection accepted", func() bool { return peer.count() == 1 })
+	time.Sleep(50 * time.Millisecond)
+	if peer.count() != 1 {
+		t.Errorf("Expected 1 connection to the peer, got %d", peer.count())
+	}
+
+	// Different SNI names get different connections
+	tlsKey := poolKey(&tlsAddr{TCPAddr: addr, ServerName: "a.example.com"})
+	if tlsKey == poolKey(&tlsAddr{TCPAddr: addr, ServerName: "b.example.com"}) || tlsKey == poolKey(addr) {
+		t.Error("Pool keys should include transport and SNI")
+	}
+}
+
+func TestConnPoolIdleTimeout(t *testing.T) {
+	peer := newAcceptCounter(t)
+	pool := NewConnPool()
+	addr := peer.listener.Addr()
+
+	conn, _, err := pool.Get(addr)
+	if err != nil {
+		t.Fatalf("Failed to get connection: %v", err)
+	}
+
+	pool.CloseIdle(time.Now())
+	if pool.Lookup(addr) == nil {
+		t.Fatal("Recently used connection was closed")
+	}
+
+	pool.CloseIdle(time.Now().Add(pool.IdleTimeout + time.Second))
+	if pool.Lookup(addr) != nil {
+		t.Error("Idle connection still pooled")
+	}
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Error("Idle connection was not closed")
+	}
+}
+
+func TestConnPoolHealth(t *testing.T) {
+	// Find a port nobody listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := listener.Addr()
+	listener.Close()
+
+	pool := NewConnPool()
+	for i := 0; i < pool.MaxFailures; i++ {
+		if _, _, err := pool.Get(addr); err == nil {
+			t.Fatal("Expected dial error")
+		}
+	}
+
+	// Once marked down the peer is not dialed again
+	_, _, err = pool.Get(addr)
+	if err == nil || !strings.Contains(err.Error(), "is down") {
+		t.Errorf("Expected peer down error, got %v", err)
+	}
+}
+
+func TestConnPoolLimit(t *testing.T) {
+	pool := NewConnPool()
+	pool.MaxPerPeer = 1
+	addr := &tlsAddr{TCPAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5061}, ServerName: "peer.example.com"}
+
+	first, _ := net.Pipe()
+	second, _ := net.Pipe()
+	pool.Alias(addr, first)
+	pool.Alias(addr, second)
+
+	if pool.Lookup(addr) != first {
+		t.Error("First connection should be pooled")
+	}
+	pool.Remove(first)
+	if pool.Lookup(addr) != nil {
+		t.Error("Connection beyond the per-peer limit was pooled")
+	}
+}
+
+func TestApplyAlias(t *testing.T) {
+	server := setupTestServer(t)
+	source := &tlsAddr{TCPAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}, ServerName: "peer.example.com"}
+	conn, _ := net.Pipe()
+	server.pool.Alias(source, conn)
+
+	msg := newTestInvite("sip:bob@example.com", "alias-call-1")
+	msg.Headers["Via"] = "SIP/2.0/TLS peer.example.com:5061;branch=z9hG4bKalias;alias"
+	server.applyAlias(source, msg)
+
+	alias := &tlsAddr{TCPAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5061}, ServerName: "peer.example.com"}
+	if server.pool.Lookup(alias) != conn {
+		t.Error("Connection not aliased to the Via sent-by")
+	}
+
+	// Plain TCP connections are never aliased
+	tcpSource := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 40000}
+	tcpConn, _ := net.Pipe()
+	server.pool.Alias(tcpSource, tcpConn)
+	msg.Headers["Via"] = "SIP/2.0/TCP 192.0.2.2:5060;branch=z9hG4bKalias2;alias"
+	server.applyAlias(tcpSource, msg)
+	if server.pool.Lookup(&net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 5060}) != nil {
+		t.Error("TCP connection aliased")
+	}
+}
+
+func TestForwardReusesConnection(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	peer := newAcceptCounter(t)
+	target := peer.listener.Addr()
+	callerAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	for _, callID := range []string{"reuse-call-1", "reuse-call-2"} {
+		if err := server.forwardRequest(callerAddr, newTestInvite("sip:bob@example.com", callID), "sip:bob@peer.example.com", target); err != nil {
+			t.Fatalf("Failed to forward INVITE: %v", err)
+		}
+	}
+
+	waitFor(t, "connection accepted", func() bool { return peer.count() == 1 })
+	conn := peer.conn(0)
+	reader := bufio.NewReader(conn)
+	var invites []*Message
+	for i := 0; i < 2; i++ {
+		invites = append(invites, readTestMessage(t, conn, reader))
+	}
+	if peer.count() != 1 {
+		t.Errorf("Expected both INVITEs on one connection, got %d connections", peer.count())
+	}
+	if !strings.HasPrefix(invites[0].Headers["Via"], "SIP/2.0/TCP ") {
+		t.Errorf("Wrong Via transport: %s", invites[0].Headers["Via"])
+	}
+
+	// The response comes back over the pooled connection and is relayed
+	if _, err := conn.Write([]byte(NewResponse("486", "Busy Here", invites[1]).String())); err != nil {
+		t.Fatalf("Failed to send response: %v", err)
+	}
+	waitFor(t, "486 relayed to the caller", func() bool {
+		for _, packet := range mockConn.GetSentPackets() {
+			if strings.HasPrefix(string(packet.Data), "SIP/2.0 486") && strings.Contains(string(packet.Data), "reuse-call-2") {
+				return true
+			}
+		}
+		return false
+	})
+
+	// The hop-by-hop ACK reuses the same connection
+	ack := readTestMessage(t, conn, reader)
+	if ack.Method() != "ACK" {
+		t.Errorf("Expected ACK, got %s", ack.StartLine)
+	}
+}
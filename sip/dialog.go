@@ -0,0 +1,174 @@
+package sip
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Dialog is a dialog in which the server is one of the user agents, such as
+// a call it answered itself or placed on behalf of a REFER (RFC 3261 12)
+type Dialog struct {
+	CallID       string
+	LocalTag     string
+	RemoteTag    string
+	LocalURI     string // From or To value of the server's side, without tag
+	RemoteURI    string // From or To value of the peer, without tag
+	RemoteTarget string // peer's Contact, the Request-URI of requests in the dialog
+	LocalSDP     string // session description the server last agreed to
+	RemoteSDP    string // session description the peer last agreed to
+	target       net.Addr
+	localSeq     int      // CSeq of the last request the server sent
+	owner        bool     // the server created the dialog and its Call-ID
+	allowUpdate  bool     // the peer accepts UPDATE requests
+	recvInfo     []string // info packages the peer accepts (RFC 6086)
+	routeSet     []string // Route of requests within the dialog
+
+	// Offer/answer state (RFC 3264), guarded by the server's mutex
+	sdpID          int64 // o= session ID of the server's session description
+	sdpVersion     int   // o= version of the server's session description
+	mediaPort      int   // port of the server's first media stream
+	inviteSent     bool  // a re-INVITE from the server has not completed
+	inviteReceived bool  // a re-INVITE from the peer has not completed
+	offerSent      bool  // an offer from the server waits for its answer
+	// ackPending is the 2xx carrying an offer of the server, retransmitted
+	// until the ACK with the answer arrives
+	ackPending *Message
+}
+
+// ID returns the dialog ID of the dialog
+func (d *Dialog) ID() string {
+	return dialogID(d.CallID, d.LocalTag, d.RemoteTag)
+}
+
+// newUASDialog creates the dialog of an INVITE the server answers
+func newUASDialog(addr net.Addr, invite *Message, localTag string) *Dialog {
+	remoteTag, _ := headerParam(invite.Headers["From"], "tag")
+	d := &Dialog{
+		CallID:      invite.Headers["Call-ID"],
+		LocalTag:    localTag,
+		RemoteTag:   remoteTag,
+		LocalURI:    withoutTag(invite.Headers["To"]),
+		RemoteURI:   withoutTag(invite.Headers["From"]),
+		target:      addr,
+		allowUpdate: hasOptionTag(invite.Headers["Allow"], "UPDATE"),
+		recvInfo:    parseRecvInfo(invite.Headers["Recv-Info"]),
+		routeSet:    splitHeaderValues(invite.Headers["Record-Route"]),
+	}
+	if contact := topHeaderValue(invite.Headers["Contact"]); contact != "" {
+		d.RemoteTarget = contactURI(contact)
+	} else {
+		d.RemoteTarget = extractSIPURI(invite.Headers["From"])
+	}
+	return d
+}
+
+// newUACDialog creates the dialog of an INVITE the server sent once it is answered
+func newUACDialog(target net.Addr, invite, resp *Message) *Dialog {
+	localTag, _ := headerParam(invite.Headers["From"], "tag")
+	remoteTag, _ := headerParam(resp.Headers["To"], "tag")
+	d := &Dialog{
+		CallID:      invite.Headers["Call-ID"],
+		LocalTag:    localTag,
+		RemoteTag:   remoteTag,
+		LocalURI:    withoutTag(invite.Headers["From"]),
+		RemoteURI:   withoutTag(resp.Headers["To"]),
+		target:      target,
+		localSeq:    cseqNumber(invite),
+		owner:       true,
+		allowUpdate: hasOptionTag(resp.Headers["Allow"], "UPDATE"),
+		recvInfo:    parseRecvInfo(resp.Headers["Recv-Info"]),
+	}
+	// The UAC uses the Record-Route of the response in reverse (RFC 3261 12.1.2)
+	routes := splitHeaderValues(resp.Headers["Record-Route"])
+	for i := len(routes) - 1; i >= 0; i-- {
+		d.routeSet = append(d.routeSet, routes[i])
+	}
+	if contact := topHeaderValue(resp.Headers["Contact"]); contact != "" {
+		d.RemoteTarget = contactURI(contact)
+	} else {
+		d.RemoteTarget = invite.RequestURI()
+	}
+	return d
+}
+
+// withoutTag removes the tag parameter from a From or To header value
+func withoutTag(value string) string {
+	for _, param := range strings.Split(value, ";") {
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(param)), "tag=") {
+			value = strings.Replace(value, ";"+param, "", 1)
+		}
+	}
+	return value
+}
+
+// cseqNumber returns the sequence number of a message's CSeq header
+func cseqNumber(msg *Message) int {
+	fields := strings.Fields(msg.Headers["CSeq"])
+	if len(fields) == 0 {
+		return 0
+	}
+	n, _ := strconv.Atoi(fields[0])
+	return n
+}
+
+// contactHeader returns the Contact the server puts in requests and
+// responses so that requests within dialogs reach it
+func (s *Server) contactHeader() string {
+	return "<sip:" + s.viaSentBy() + ">"
+}
+
+// lookupSession returns the dialog of a call the server is a party of
+func (s *Server) lookupSession(callID string) *Dialog {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[callID]
+}
+
+// newDialogRequest builds a request within a dialog
+func (s *Server) newDialogRequest(d *Dialog, method string) *Message {
+	s.mu.Lock()
+	d.localSeq++
+	cseq := d.localSeq
+	s.mu.Unlock()
+
+	req := NewMessage()
+	req.StartLine = fmt.Sprintf("%s %s SIP/2.0", method, d.RemoteTarget)
+	req.Headers["From"] = d.LocalURI + ";tag=" + d.LocalTag
+	req.Headers["To"] = d.RemoteURI + ";tag=" + d.RemoteTag
+	req.Headers["Call-ID"] = d.CallID
+	req.Headers["CSeq"] = fmt.Sprintf("%d %s", cseq, method)
+	req.Headers["Max-Forwards"] = "70"
+	if len(d.routeSet) > 0 {
+		req.Headers["Route"] = strings.Join(d.routeSet, ", ")
+	}
+	req.Headers["Contact"] = s.contactHeader()
+	req.Headers["User-Agent"] = "Go-SIP-Server"
+	req.Headers["Content-Length"] = "0"
+	return req
+}
+
+// endSession hangs up a call the server is a party of
+func (s *Server) endSession(d *Dialog) {
+	s.mu.Lock()
+	delete(s.sessions, d.CallID)
+	s.mu.Unlock()
+	s.stopSessionTimer(d.CallID)
+
+	bye := s.sendBye(d)
+	s.setCallState(bye, "")
+	log.Printf("call terminated: %s", d.CallID)
+}
+
+// dialogSession returns the call the server is a party of that a request
+// within a dialog belongs to
+func (s *Server) dialogSession(msg *Message) *Dialog {
+	toTag, _ := headerParam(msg.Headers["To"], "tag")
+	d := s.lookupSession(msg.Headers["Call-ID"])
+	if d == nil || d.LocalTag != toTag {
+		return nil
+	}
+	return d
+}
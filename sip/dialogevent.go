@@ -0,0 +1,137 @@
+package sip
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// dialogInfoContentType is the body type of dialog event NOTIFYs (RFC 4235)
+const dialogInfoContentType = "application/dialog-info+xml"
+
+// dialogStates maps call states to the dialog states of RFC 4235
+var dialogStates = map[string]string{
+	"trying":    "trying",
+	"ringing":   "early",
+	"connected": "confirmed",
+	"":          "terminated",
+}
+
+// callDialog is a call as reported by the dialog event package
+type callDialog struct {
+	callID    string
+	caller    string // AOR of the caller
+	callee    string // AOR of the called user
+	callerTag string
+	calleeTag string
+	state     string // RFC 4235 dialog state
+}
+
+// dialogPackage is the dialog event package used for busy lamp fields. It
+// reports the calls of an extension as they progress.
+type dialogPackage struct {
+	server *Server
+	mu     sync.Mutex
+	calls  map[string]*callDialog // Call-ID -> call
+}
+
+// newDialogPackage creates the dialog event package of a server
+func newDialogPackage(server *Server) *dialogPackage {
+	return &dialogPackage{
+		server: server,
+		calls:  make(map[string]*callDialog),
+	}
+}
+
+// Name implements EventPackage
+func (d *dialogPackage) Name() string {
+	return "dialog"
+}
+
+// ContentType implements EventPackage
+func (d *dialogPackage) ContentType() string {
+	return dialogInfoContentType
+}
+
+// callStateChanged records a call state change and notifies the watchers of
+// both parties. Ended calls are reported as terminated once, then forgotten.
+func (d *dialogPackage) callStateChanged(msg *Message, state string) {
+	callID := msg.Headers["Call-ID"]
+
+	d.mu.Lock()
+	call, ok := d.calls[callID]
+	if !ok {
+		call = &callDialog{
+			callID: callID,
+			caller: extractSIPURI(msg.Headers["From"]),
+			callee: extractSIPURI(msg.Headers["To"]),
+		}
+		d.calls[callID] = call
+	}
+	// Requests within the call may flow in either direction; only the INVITE
+	// and its responses tell which tag belongs to whom
+	if strings.HasSuffix(msg.Headers["CSeq"], "INVITE") {
+		if tag, ok := headerParam(msg.Headers["From"], "tag"); ok {
+			call.callerTag = tag
+		}
+		if tag, ok := headerParam(msg.Headers["To"], "tag"); ok {
+			call.calleeTag = tag
+		}
+	}
+	call.state = dialogStates[state]
+	caller, callee := call.caller, call.callee
+	d.mu.Unlock()
+
+	d.server.NotifySubscribers(d.Name(), caller)
+	if callee != caller {
+		d.server.NotifySubscribers(d.Name(), callee)
+	}
+
+	if state == "" {
+		d.mu.Lock()
+		delete(d.calls, callID)
+		d.mu.Unlock()
+	}
+}
+
+// State implements EventPackage. It lists the calls of the watched extension
+// as a full dialog-info document.
+func (d *dialogPackage) State(sub *Subscription) string {
+	d.mu.Lock()
+	callIDs := make([]string, 0, len(d.calls))
+	for callID := range d.calls {
+		callIDs = append(callIDs, callID)
+	}
+	sort.Strings(callIDs)
+
+	var dialogs []string
+	for _, callID := range callIDs {
+		call := d.calls[callID]
+		var direction, localTag, remoteTag, remote string
+		switch sub.Resource {
+		case call.caller:
+			direction, localTag, remoteTag, remote = "initiator", call.callerTag, call.calleeTag, call.callee
+		case call.callee:
+			direction, localTag, remoteTag, remote = "recipient", call.calleeTag, call.callerTag, call.caller
+		default:
+			continue
+		}
+
+		attrs := fmt.Sprintf(` id="%s" call-id="%s"`, xmlEscape(callID), xmlEscape(callID))
+		if localTag != "" {
+			attrs += fmt.Sprintf(` local-tag="%s"`, xmlEscape(localTag))
+		}
+		if remoteTag != "" {
+			attrs += fmt.Sprintf(` remote-tag="%s"`, xmlEscape(remoteTag))
+		}
+		dialogs = append(dialogs, fmt.Sprintf("  <dialog%s direction=\"%s\">\n    <state>%s</state>\n    <remote><identity>%s</identity></remote>\n  </dialog>\n",
+			attrs, direction, call.state, xmlEscape(remote)))
+	}
+	d.mu.Unlock()
+
+	return "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n" +
+		fmt.Sprintf("<dialog-info xmlns=\"urn:ietf:params:xml:ns:dialog-info\" version=\"%d\" state=\"full\" entity=\"%s\">\n", sub.Notified, xmlEscape(sub.Resource)) +
+		strings.Join(dialogs, "") +
+		"</dialog-info>\n"
+}
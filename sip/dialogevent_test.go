@@ -0,0 +1,65 @@
+package sip
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDialogEventsFollowCall(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	watcherAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.3"), Port: 5063}
+	aliceAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	// A watcher subscribes to bob's dialogs
+	server.handleSubscribe(watcherAddr, newTestSubscribe("dialog", "600"))
+	notify := lastSent(t, mockConn)
+	if notify.Headers["Content-Type"] != "application/dialog-info+xml" || strings.Contains(notify.Body, "<dialog ") {
+		t.Fatalf("Expected an empty dialog-info document, got %s", notify.String())
+	}
+	if !strings.Contains(notify.Body, `version="0"`) {
+		t.Errorf("First document should have version 0: %s", notify.Body)
+	}
+
+	before := len(sentMessages(t, mockConn))
+	server.handleInvite(aliceAddr, newTestInvite("sip:bob@example.com", "blf-call-1"))
+
+	var states []string
+	for _, msg := range sentMessages(t, mockConn)[before:] {
+		if msg.Method() != "NOTIFY" {
+			continue
+		}
+		if !strings.Contains(msg.Body, `direction="recipient"`) || !strings.Contains(msg.Body, "<identity>sip:alice@example.com</identity>") {
+			t.Errorf("Unexpected dialog: %s", msg.Body)
+		}
+		start := strings.Index(msg.Body, "<state>") + len("<state>")
+		end := strings.Index(msg.Body, "</state>")
+		states = append(states, msg.Body[start:end])
+	}
+	if strings.Join(states, ",") != "early,confirmed" {
+		t.Errorf("Expected early then confirmed, got %v", states)
+	}
+
+	bye := newTestInvite("sip:bob@example.com", "blf-call-1")
+	bye.StartLine = "BYE sip:bob@example.com SIP/2.0"
+	bye.Headers["CSeq"] = "2 BYE"
+	server.handleBye(aliceAddr, bye)
+
+	msgs := sentMessages(t, mockConn)
+	var last *Message
+	for _, msg := range msgs {
+		if msg.Method() == "NOTIFY" {
+			last = msg
+		}
+	}
+	if !strings.Contains(last.Body, "<state>terminated</state>") {
+		t.Errorf("Expected a terminated dialog after BYE, got %s", last.Body)
+	}
+
+	// The ended call is no longer reported
+	server.NotifySubscribers("dialog", "sip:bob@example.com")
+	if body := lastSent(t, mockConn).Body; strings.Contains(body, "<dialog ") {
+		t.Errorf("Ended call still reported: %s", body)
+	}
+}
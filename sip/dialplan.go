@@ -0,0 +1,386 @@
+package sip
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rule is a dial plan rule. A request matches when it meets every condition
+// that is set; the rule then rewrites the request and applies its action.
+type Rule struct {
+	Name    string
+	Methods []string          // request methods, any when empty
+	User    string            // regular expression on the Request-URI user
+	Prefix  string            // prefix of the Request-URI user
+	From    string            // regular expression on the From URI
+	Headers map[string]string // header name -> regular expression on its value
+	Sources []string          // source IP addresses or CIDR networks
+	Time    string            // time of day such as "08:00-18:00"
+	Days    []string          // weekdays such as "mon", any when empty
+
+	Rewrite       string            // new Request-URI; $1... refer to the user match
+	AddHeaders    map[string]string // headers set on the request
+	RemoveHeaders []string          // headers removed from the request
+	Action        string            // "forward", "trunk", "redirect", "reject" or "continue" (default)
+	Target        string            // URI to forward or redirect to, or comma-separated trunk names; $1... as in Rewrite
+	Code          int               // response code of "reject", 403 by default
+	Reason        string            // reason phrase of "reject"
+}
+
+// Decision is the outcome of a dial plan for a request
+type Decision struct {
+	Rule    string   // name of the rule that decided, empty when none did
+	Action  string   // action of the rule, "continue" when none decided
+	Target  string   // expanded target of the action
+	Code    int      // response code of a rejection
+	Reason  string   // reason phrase of a rejection
+	Request *Message // the request with the rewrites of all matching rules
+}
+
+// dialPlanActions are the valid rule actions
+var dialPlanActions = map[string]bool{
+	"forward": true, "trunk": true, "redirect": true, "reject": true, "continue": true,
+}
+
+// weekdays maps the day names of rules to weekdays
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// compiledRule is a rule with its patterns parsed
+type compiledRule struct {
+	Rule
+	user     *regexp.Regexp
+	from     *regexp.Regexp
+	headers  map[string]*regexp.Regexp
+	sources  []*net.IPNet
+	start    int // minutes after midnight, -1 when any time matches
+	end      int
+	weekdays map[time.Weekday]bool
+}
+
+// DialPlan routes requests by ordered rules
+type DialPlan struct {
+	rules []*compiledRule
+}
+
+// NewDialPlan validates and compiles dial plan rules
+func NewDialPlan(rules []Rule) (*DialPlan, error) {
+	plan := &DialPlan{}
+	for i, rule := range rules {
+		compiled, err := compileRule(rule)
+		if err != nil {
+			name := rule.Name
+			if name == "" {
+				name = "#" + strconv.Itoa(i+1)
+			}
+			return nil, fmt.Errorf("rule %s: %v", name, err)
+		}
+		plan.rules = append(plan.rules, compiled)
+	}
+	return plan, nil
+}
+
+// compileRule parses the patterns of a rule and checks its action
+func compileRule(rule Rule) (*compiledRule, error) {
+	c := &compiledRule{Rule: rule, start: -1, headers: make(map[string]*regexp.Regexp)}
+	if c.Action == "" {
+		c.Action = "continue"
+	}
+	if !dialPlanActions[c.Action] {
+		return nil, fmt.Errorf("unknown action %q", c.Action)
+	}
+	switch c.Action {
+	case "forward", "redirect", "trunk":
+		if c.Target == "" {
+			return nil, fmt.Errorf("action %s needs a target", c.Action)
+		}
+	case "reject":
+		if c.Code == 0 {
+			c.Code = 403
+		}
+		if c.Code < 400 || c.Code > 699 {
+			return nil, fmt.Errorf("invalid reject code %d", c.Code)
+		}
+		if c.Reason == "" {
+			c.Reason = "Rejected"
+		}
+	}
+
+	// The user pattern always captures: without one, $1 is the user after the prefix
+	pattern := "^" + regexp.QuoteMeta(rule.Prefix) + "(.*)$"
+	if rule.User != "" {
+		pattern = rule.User
+	}
+	var err error
+	if c.user, err = regexp.Compile(pattern); err != nil {
+		return nil, fmt.Errorf("invalid user pattern: %v", err)
+	}
+	if rule.From != "" {
+		if c.from, err = regexp.Compile(rule.From); err != nil {
+			return nil, fmt.Errorf("invalid from pattern: %v", err)
+		}
+	}
+	for name, value := range rule.Headers {
+		if c.headers[name], err = regexp.Compile(value); err != nil {
+			return nil, fmt.Errorf("invalid pattern of header %s: %v", name, err)
+		}
+	}
+
+	for _, source := range rule.Sources {
+		if !strings.Contains(source, "/") {
+			if ip := net.ParseIP(source); ip != nil && ip.To4() != nil {
+				source += "/32"
+			} else {
+				source += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source %q", source)
+		}
+		c.sources = append(c.sources, network)
+	}
+
+	if rule.Time != "" {
+		from, to, ok := strings.Cut(rule.Time, "-")
+		start, err1 := parseTimeOfDay(from)
+		end, err2 := parseTimeOfDay(to)
+		if !ok || err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid time %q", rule.Time)
+		}
+		c.start, c.end = start, end
+	}
+	if len(rule.Days) > 0 {
+		c.weekdays = make(map[time.Weekday]bool)
+		for _, day := range rule.Days {
+			weekday, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return nil, fmt.Errorf("invalid day %q", day)
+			}
+			c.weekdays[weekday] = true
+		}
+	}
+	return c, nil
+}
+
+// parseTimeOfDay parses "hh:mm" into minutes after midnight
+func parseTimeOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// matches reports whether a request meets the conditions of the rule and
+// returns the submatches of its user pattern
+func (c *compiledRule) matches(msg *Message, source net.Addr, now time.Time) ([]int, bool) {
+	if len(c.Methods) > 0 && !containsFold(c.Methods, msg.Method()) {
+		return nil, false
+	}
+	user := ""
+	if uri, err := ParseURI(msg.RequestURI()); err == nil {
+		user = uri.User
+	}
+	if !strings.HasPrefix(user, c.Prefix) {
+		return nil, false
+	}
+	match := c.user.FindStringSubmatchIndex(user)
+	if match == nil {
+		return nil, false
+	}
+	if c.from != nil && !c.from.MatchString(extractSIPURI(msg.Headers["From"])) {
+		return nil, false
+	}
+	for name, pattern := range c.headers {
+		if !pattern.MatchString(msg.Headers[name]) {
+			return nil, false
+		}
+	}
+
+	if len(c.sources) > 0 {
+		ip := addrIP(source)
+		found := false
+		for _, network := range c.sources {
+			found = found || (ip != nil && network.Contains(ip))
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	if c.weekdays != nil && !c.weekdays[now.Weekday()] {
+		return nil, false
+	}
+	if c.start >= 0 {
+		minute := now.Hour()*60 + now.Minute()
+		inside := minute >= c.start && minute < c.end
+		if c.end <= c.start {
+			// The range wraps around midnight
+			inside = minute >= c.start || minute < c.end
+		}
+		if !inside {
+			return nil, false
+		}
+	}
+	return match, true
+}
+
+// expand fills the user submatches into a rewrite or target template
+func (c *compiledRule) expand(template string, msg *Message, match []int) string {
+	user := ""
+	if uri, err := ParseURI(msg.RequestURI()); err == nil {
+		user = uri.User
+	}
+	return string(c.user.ExpandString(nil, template, user, match))
+}
+
+// Evaluate runs a request through the dial plan. Matching rules rewrite a
+// copy of the request in order until one with an action other than
+// "continue" decides what happens to it.
+func (p *DialPlan) Evaluate(msg *Message, source net.Addr, now time.Time) *Decision {
+	req := msg.Clone()
+	for _, rule := range p.rules {
+		match, ok := rule.matches(req, source, now)
+		if !ok {
+			continue
+		}
+
+		target := rule.expand(rule.Target, req, match)
+		if rule.Rewrite != "" {
+			req.StartLine = fmt.Sprintf("%s %s SIP/2.0", req.Method(), rule.expand(rule.Rewrite, req, match))
+		}
+		for _, name := range rule.RemoveHeaders {
+			delete(req.Headers, name)
+		}
+		for name, value := range rule.AddHeaders {
+			req.Headers[name] = value
+		}
+		if rule.Action == "continue" {
+			continue
+		}
+		return &Decision{
+			Rule:    rule.Name,
+			Action:  rule.Action,
+			Target:  target,
+			Code:    rule.Code,
+			Reason:  rule.Reason,
+			Request: req,
+		}
+	}
+	return &Decision{Action: "continue", Request: req}
+}
+
+// containsFold reports whether list contains value, ignoring case
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns the IP address of a network address
+func addrIP(addr net.Addr) net.IP {
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// SetDialPlan sets the dial plan applied to requests outside of dialogs
+func (s *Server) SetDialPlan(plan *DialPlan) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dialPlan = plan
+}
+
+// applyDialPlan runs a request outside of a dialog through the dial plan
+// and carries out its decision. It returns the request to process further,
+// possibly rewritten, or nil when the dial plan handled it.
+func (s *Server) applyDialPlan(addr net.Addr, msg *Message) *Message {
+	s.mu.Lock()
+	plan := s.dialPlan
+	s.mu.Unlock()
+	if plan == nil {
+		return msg
+	}
+	switch msg.Method() {
+	case "REGISTER", "ACK", "CANCEL":
+		return msg
+	}
+	if _, inDialog := headerParam(msg.Headers["To"], "tag"); inDialog {
+		return msg
+	}
+
+	decision := plan.Evaluate(msg, addr, time.Now())
+	req := decision.Request
+	if decision.Action == "continue" {
+		return req
+	}
+	log.Printf("dial plan rule %s: %s %s -> %s %s", decision.Rule, req.Method(), msg.RequestURI(), decision.Action, decision.Target)
+
+	if req.Method() == "INVITE" {
+		s.startInviteTransaction(addr, req)
+	}
+	var resp *Message
+	switch decision.Action {
+	case "reject":
+		resp = NewResponse(strconv.Itoa(decision.Code), decision.Reason, req)
+	case "redirect":
+		resp = NewResponse("302", "Moved Temporarily", req)
+		resp.Headers["Contact"] = "<" + decision.Target + ">"
+	case "forward":
+		requestURI, target, err := s.locate(decision.Target)
+		if err != nil {
+			log.Printf("dial plan target %s: %v", decision.Target, err)
+			resp = NewResponse("404", "Not Found", req)
+			break
+		}
+		s.forwardPlanned(addr, req, func() error {
+			return s.forwardRequest(addr, req, requestURI, target)
+		})
+	case "trunk":
+		user := ""
+		if uri, err := ParseURI(req.RequestURI()); err == nil {
+			user = uri.User
+		}
+		s.forwardPlanned(addr, req, func() error {
+			return s.forwardToTrunks(addr, req, trunkNames(decision.Target), user)
+		})
+	}
+	if resp != nil && (req.Method() != "INVITE" || s.finalizeInvite(req)) {
+		s.sendResponse(addr, resp)
+	}
+	return nil
+}
+
+// forwardPlanned forwards a request as the dial plan decided, keeping the
+// state of calls, and answers 503 when it cannot be sent
+func (s *Server) forwardPlanned(addr net.Addr, req *Message, forward func() error) {
+	isInvite := req.Method() == "INVITE"
+	if isInvite {
+		s.sendResponse(addr, NewResponse("100", "Trying", req))
+		s.setCallState(req, "trying")
+	}
+	if err := forward(); err != nil {
+		log.Printf("%s forwarding error: %v", req.Method(), err)
+		if isInvite {
+			s.setCallState(req, "")
+		}
+		if !isInvite || s.finalizeInvite(req) {
+			s.sendResponse(addr, NewResponse("503", "Service Unavailable", req))
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package sip
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func testDialPlan(t *testing.T) *DialPlan {
+	t.Helper()
+	plan, err := NewDialPlan([]Rule{
+		{Name: "blocked", From: "^sip:spam@", Action: "reject", Code: 603, Reason: "Decline"},
+		{Name: "emergency", User: "^(911|112)$", Action: "forward", Target: "sip:psap@example.com"},
+		{Name: "outside-line", Prefix: "9", Rewrite: "sip:$1@example.com"},
+		{Name: "international", User: "^00(\\d+)$", Action: "trunk", Target: "carrier", Rewrite: "sip:+$1@example.com",
+			AddHeaders: map[string]string{"X-Route": "intl"}, RemoveHeaders: []string{"Subject"}},
+		{Name: "office-hours", User: "^100$", Time: "08:00-18:00", Days: []string{"mon", "tue", "wed", "thu", "fri"},
+			Action: "forward", Target: "sip:reception@example.com"},
+		{Name: "after-hours", User: "^100$", Action: "redirect", Target: "sip:voicemail@example.com"},
+		{Name: "moved", User: "^200$", Action: "redirect", Target: "sip:carol@example.net"},
+		{Name: "lan-only", Methods: []string{"MESSAGE"}, Prefix: "lab", Sources: []string{"10.0.0.0/8"},
+			Headers: map[string]string{"Content-Type": "^text/"}, Action: "forward", Target: "sip:${1}@lab.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("NewDialPlan failed: %v", err)
+	}
+	return plan
+}
+
+func TestDialPlanEvaluate(t *testing.T) {
+	plan := testDialPlan(t)
+	monday := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	sunday := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	lan := &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5060}
+	wan := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5060}
+
+	tests := []struct {
+		name   string
+		msg    *Message
+		source net.Addr
+		now    time.Time
+		rule   string
+		action string
+		target string
+	}{
+		{"emergency", newTestInvite("sip:911@example.com", "dp1"), wan, monday, "emergency", "forward", "sip:psap@example.com"},
+		{"rewritten then matched", newTestInvite("sip:90049301234@example.com", "dp2"), wan, monday, "international", "trunk", "carrier"},
+		{"office hours", newTestInvite("sip:100@example.com", "dp3"), wan, monday, "office-hours", "forward", "sip:reception@example.com"},
+		{"weekend", newTestInvite("sip:100@example.com", "dp4"), wan, sunday, "after-hours", "redirect", "sip:voicemail@example.com"},
+		{"source and headers", newTestMessage("sip:lab7@example.com", "hi"), lan, monday, "lan-only", "forward", "sip:7@lab.example.com"},
+		{"wrong source", newTestMessage("sip:lab7@example.com", "hi"), wan, monday, "", "continue", ""},
+		{"wrong method", newTestInvite("sip:lab7@example.com", "dp5"), lan, monday, "", "continue", ""},
+		{"no match", newTestInvite("sip:bob@example.com", "dp6"), wan, monday, "", "continue", ""},
+	}
+	for _, tt := range tests {
+		decision := plan.Evaluate(tt.msg, tt.source, tt.now)
+		if decision.Rule != tt.rule || decision.Action != tt.action || decision.Target != tt.target {
+			t.Errorf("%s: got rule %q action %q target %q", tt.name, decision.Rule, decision.Action, decision.Target)
+		}
+	}
+
+	// Rewrites of earlier rules and header changes are applied to a copy
+	invite := newTestInvite("sip:90049301234@example.com", "dp7")
+	invite.Headers["Subject"] = "hello"
+	decision := plan.Evaluate(invite, wan, monday)
+	req := decision.Request
+	if req.RequestURI() != "sip:+49301234@example.com" || req.Headers["X-Route"] != "intl" || req.Headers["Subject"] != "" {
+		t.Errorf("Wrong rewritten request: %s", req.String())
+	}
+	if invite.RequestURI() != "sip:90049301234@example.com" || invite.Headers["Subject"] != "hello" {
+		t.Error("Evaluate modified the request")
+	}
+
+	spam := newTestInvite("sip:bob@example.com", "dp8")
+	spam.Headers["From"] = "<sip:spam@example.net>;tag=1"
+	if decision := plan.Evaluate(spam, wan, monday); decision.Action != "reject" || decision.Code != 603 || decision.Reason != "Decline" {
+		t.Errorf("Wrong rejection: %+v", decision)
+	}
+}
+
+func TestNewDialPlanErrors(t *testing.T) {
+	tests := []Rule{
+		{Name: "regex", User: "("},
+		{Name: "action", Action: "drop"},
+		{Name: "target", Action: "forward"},
+		{Name: "time", Time: "8-18", Action: "reject"},
+		{Name: "day", Days: []string{"someday"}},
+		{Name: "source", Sources: []string{"10.0.0.300"}},
+		{Name: "code", Action: "reject", Code: 200},
+		{Name: "header", Headers: map[string]string{"Subject": "["}},
+	}
+	for _, rule := range tests {
+		if _, err := NewDialPlan([]Rule{rule}); err == nil {
+			t.Errorf("Rule %s accepted", rule.Name)
+		}
+	}
+
+	// Defaults of reject and unnamed rules
+	plan, err := NewDialPlan([]Rule{{Action: "reject"}})
+	if err != nil {
+		t.Fatalf("NewDialPlan failed: %v", err)
+	}
+	decision := plan.Evaluate(newTestInvite("sip:bob@example.com", "dp9"), nil, time.Now())
+	if decision.Code != 403 || decision.Reason != "Rejected" {
+		t.Errorf("Wrong default rejection: %+v", decision)
+	}
+	if _, err := NewDialPlan([]Rule{{}, {User: "("}}); err == nil || err.Error()[:7] != "rule #2" {
+		t.Errorf("Unnamed rule not numbered: %v", err)
+	}
+}
+
+func TestDialPlanActions(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetDialPlan(testDialPlan(t))
+	server.AddTrunk(Trunk{Name: "carrier", Domain: "carrier.example", Proxy: "sip:127.0.0.7:5090"})
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	trunkAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.7"), Port: 5090}
+	psapAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.4"), Port: 5064}
+
+	server.handleMessage(addr, []byte(newTestInvite("sip:90049301234@example.com", "dp-trunk").String()))
+	forwarded := sentTo(t, mockConn, trunkAddr)
+	if len(forwarded) != 1 || forwarded[0].RequestURI() != "sip:+49301234@carrier.example" || forwarded[0].Headers["X-Route"] != "intl" {
+		t.Fatalf("INVITE not sent over the trunk: %v", forwarded)
+	}
+
+	// Forwarding to a user that is not registered fails
+	server.handleMessage(addr, []byte(newTestInvite("sip:911@example.com", "dp-psap").String()))
+	if code := lastSent(t, mockConn).StatusCode(); code != 404 {
+		t.Errorf("Expected 404, got %d", code)
+	}
+	register := newOutboundRegister("<sip:psap@127.0.0.4:5064>")
+	register.Headers["From"] = "<sip:psap@example.com>;tag=9"
+	server.handleRegister(psapAddr, register)
+	invite := newTestInvite("sip:911@example.com", "dp-psap2")
+	invite.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKpsap2"
+	server.handleMessage(addr, []byte(invite.String()))
+	forwarded = sentTo(t, mockConn, psapAddr)
+	if last := forwarded[len(forwarded)-1]; last.Method() != "INVITE" || last.RequestURI() != "sip:psap@127.0.0.4:5064" {
+		t.Errorf("INVITE not forwarded to the registered target: %s", last.String())
+	}
+
+	invite = newTestInvite("sip:200@example.com", "dp-redirect")
+	invite.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKredir"
+	server.handleMessage(addr, []byte(invite.String()))
+	if resp := lastSent(t, mockConn); resp.StatusCode() != 302 || resp.Headers["Contact"] != "<sip:carol@example.net>" {
+		t.Errorf("Expected a redirect, got %s", resp.String())
+	}
+}
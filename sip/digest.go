@@ -0,0 +1,144 @@
+package sip
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// challenge is an authentication challenge of a WWW-Authenticate or
+// Proxy-Authenticate header
+type challenge struct {
+	scheme string
+	params map[string]string // lower-cased names, unquoted values
+}
+
+// parseChallenges parses the challenges of an authentication header. A
+// header may carry several of them, such as one per digest algorithm.
+func parseChallenges(value string) []challenge {
+	var challenges []challenge
+	i := 0
+	for i < len(value) {
+		// Skip separators
+		for i < len(value) && (value[i] == ' ' || value[i] == ',' || value[i] == '\t') {
+			i++
+		}
+		start := i
+		for i < len(value) && value[i] != '=' && value[i] != ' ' && value[i] != ',' {
+			i++
+		}
+		token := value[start:i]
+		if token == "" {
+			i++
+			continue
+		}
+		j := i
+		for j < len(value) && value[j] == ' ' {
+			j++
+		}
+		if j >= len(value) || value[j] != '=' {
+			// A token that is not a parameter starts a new challenge
+			challenges = append(challenges, challenge{scheme: token, params: make(map[string]string)})
+			continue
+		}
+
+		i = j + 1
+		for i < len(value) && value[i] == ' ' {
+			i++
+		}
+		var val strings.Builder
+		if i < len(value) && value[i] == '"' {
+			for i++; i < len(value) && value[i] != '"'; i++ {
+				if value[i] == '\\' && i+1 < len(value) {
+					i++
+				}
+				val.WriteByte(value[i])
+			}
+			i++
+		} else {
+			for ; i < len(value) && value[i] != ','; i++ {
+				val.WriteByte(value[i])
+			}
+		}
+		if len(challenges) > 0 {
+			challenges[len(challenges)-1].params[strings.ToLower(token)] = strings.TrimSpace(val.String())
+		}
+	}
+	return challenges
+}
+
+// digestHash returns the hash function of a digest algorithm, nil when the
+// algorithm is not supported
+func digestHash(algorithm string) func() hash.Hash {
+	switch strings.ToUpper(strings.TrimSuffix(strings.ToLower(algorithm), "-sess")) {
+	case "", "MD5":
+		return md5.New
+	case "SHA-256":
+		return sha256.New
+	}
+	return nil
+}
+
+// hashHex returns the hex digest of the values joined by colons
+func hashHex(newHash func() hash.Hash, values ...string) string {
+	h := newHash()
+	h.Write([]byte(strings.Join(values, ":")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// digestAuthorization answers the first supported Digest challenge of an
+// authentication header (RFC 2617, RFC 8760) for a request with the given
+// method and Request-URI. It returns the value of the Authorization or
+// Proxy-Authorization header.
+func digestAuthorization(header, method, uri, username, password string) (string, error) {
+	for _, c := range parseChallenges(header) {
+		if !strings.EqualFold(c.scheme, "Digest") {
+			continue
+		}
+		algorithm := c.params["algorithm"]
+		newHash := digestHash(algorithm)
+		if newHash == nil {
+			continue
+		}
+		realm, nonce := c.params["realm"], c.params["nonce"]
+
+		cnonce := randomToken(8)
+		ha1 := hashHex(newHash, username, realm, password)
+		if strings.HasSuffix(strings.ToLower(algorithm), "-sess") {
+			ha1 = hashHex(newHash, ha1, nonce, cnonce)
+		}
+		ha2 := hashHex(newHash, method, uri)
+
+		qop := ""
+		if options, ok := c.params["qop"]; ok {
+			for _, option := range strings.Split(options, ",") {
+				if strings.TrimSpace(option) == "auth" {
+					qop = "auth"
+				}
+			}
+			if qop == "" {
+				return "", fmt.Errorf("unsupported qop %q", options)
+			}
+		}
+
+		auth := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, username, realm, nonce, uri)
+		if qop != "" {
+			const nc = "00000001"
+			auth += fmt.Sprintf(`, response="%s", qop=auth, nc=%s, cnonce="%s"`,
+				hashHex(newHash, ha1, nonce, nc, cnonce, qop, ha2), nc, cnonce)
+		} else {
+			auth += fmt.Sprintf(`, response="%s"`, hashHex(newHash, ha1, nonce, ha2))
+		}
+		if algorithm != "" {
+			auth += ", algorithm=" + algorithm
+		}
+		if opaque, ok := c.params["opaque"]; ok {
+			auth += fmt.Sprintf(`, opaque="%s"`, opaque)
+		}
+		return auth, nil
+	}
+	return "", fmt.Errorf("no supported digest challenge")
+}
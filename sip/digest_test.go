@@ -0,0 +1,59 @@
+package sip
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestParseChallenges(t *testing.T) {
+	header := `Digest realm="carrier, inc.", nonce="abc\"d", algorithm=SHA-256, qop="auth,auth-int", Digest realm="carrier", nonce="xyz"`
+	challenges := parseChallenges(header)
+	if len(challenges) != 2 {
+		t.Fatalf("Expected 2 challenges, got %+v", challenges)
+	}
+	first := challenges[0].params
+	if first["realm"] != "carrier, inc." || first["nonce"] != `abc"d` || first["algorithm"] != "SHA-256" || first["qop"] != "auth,auth-int" {
+		t.Errorf("Wrong first challenge: %+v", first)
+	}
+	if challenges[1].scheme != "Digest" || challenges[1].params["nonce"] != "xyz" {
+		t.Errorf("Wrong second challenge: %+v", challenges[1])
+	}
+}
+
+func TestDigestAuthorization(t *testing.T) {
+	md5Hex := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+
+	// Without qop (RFC 2069 compatibility)
+	auth, err := digestAuthorization(`Digest realm="example.com", nonce="n1", opaque="op"`, "REGISTER", "sip:example.com", "alice", "secret")
+	if err != nil {
+		t.Fatalf("digestAuthorization failed: %v", err)
+	}
+	params := parseChallenges(auth)[0].params
+	ha1 := md5Hex("alice:example.com:secret")
+	ha2 := md5Hex("REGISTER:sip:example.com")
+	if params["response"] != md5Hex(ha1+":n1:"+ha2) || params["opaque"] != "op" || params["uri"] != "sip:example.com" {
+		t.Errorf("Wrong authorization: %s", auth)
+	}
+
+	// With qop=auth the client nonce and count are part of the response
+	auth, err = digestAuthorization(`Digest realm="example.com", nonce="n2", qop="auth-int,auth"`, "REGISTER", "sip:example.com", "alice", "secret")
+	if err != nil {
+		t.Fatalf("digestAuthorization failed: %v", err)
+	}
+	params = parseChallenges(auth)[0].params
+	want := md5Hex(strings.Join([]string{ha1, "n2", params["nc"], params["cnonce"], "auth", ha2}, ":"))
+	if params["qop"] != "auth" || params["cnonce"] == "" || params["response"] != want {
+		t.Errorf("Wrong authorization: %s", auth)
+	}
+
+	for _, header := range []string{`Basic realm="x"`, `Digest realm="x", nonce="y", algorithm=AKAv1-MD5`, `Digest realm="x", nonce="y", qop="auth-int"`} {
+		if _, err := digestAuthorization(header, "REGISTER", "sip:x", "alice", "secret"); err == nil {
+			t.Errorf("Challenge %s answered", header)
+		}
+	}
+}
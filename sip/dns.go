@@ -0,0 +1,466 @@
+package sip
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// DNS resource record types used for locating SIP servers
+const (
+	dnsTypeA     uint16 = 1
+	dnsTypeAAAA  uint16 = 28
+	dnsTypeSRV   uint16 = 33
+	dnsTypeNAPTR uint16 = 35
+	dnsClassINET uint16 = 1
+
+	dnsFlagTC uint16 = 0x0200 // the response was truncated
+)
+
+// errDNSFormat is returned for malformed DNS messages
+var errDNSFormat = errors.New("malformed DNS message")
+
+// NAPTR is a naming authority pointer record (RFC 3403)
+type NAPTR struct {
+	Order       uint16
+	Preference  uint16
+	Flags       string
+	Service     string
+	Regexp      string
+	Replacement string
+}
+
+// DNSClient performs the lookups needed to locate SIP servers. It is
+// pluggable so that the resolver can be pointed at any DNS implementation.
+type DNSClient interface {
+	LookupNAPTR(ctx context.Context, name string) ([]NAPTR, error)
+	LookupSRV(ctx context.Context, name string) ([]*net.SRV, error)
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// dnsQuestion is the question section entry of a DNS message
+type dnsQuestion struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// dnsRecord is a resource record of a DNS message. Only the record types
+// needed for SIP are decoded into their typed fields.
+type dnsRecord struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	IP    net.IP
+	SRV   *net.SRV
+	NAPTR *NAPTR
+}
+
+// dnsMessage is a minimal DNS message (RFC 1035)
+type dnsMessage struct {
+	ID        uint16
+	Flags     uint16
+	Questions []dnsQuestion
+	Answers   []dnsRecord
+}
+
+// pack encodes the message in wire format
+func (m *dnsMessage) pack() ([]byte, error) {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint16(buf[0:], m.ID)
+	binary.BigEndian.PutUint16(buf[2:], m.Flags)
+	binary.BigEndian.PutUint16(buf[4:], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(buf[6:], uint16(len(m.Answers)))
+
+	var err error
+	for _, q := range m.Questions {
+		if buf, err = packDNSName(buf, q.Name); err != nil {
+			return nil, err
+		}
+		buf = binary.BigEndian.AppendUint16(buf, q.Type)
+		buf = binary.BigEndian.AppendUint16(buf, q.Class)
+	}
+
+	for _, rr := range m.Answers {
+		if buf, err = packDNSName(buf, rr.Name); err != nil {
+			return nil, err
+		}
+		buf = binary.BigEndian.AppendUint16(buf, rr.Type)
+		buf = binary.BigEndian.AppendUint16(buf, rr.Class)
+		buf = binary.BigEndian.AppendUint32(buf, rr.TTL)
+
+		var rdata []byte
+		switch {
+		case rr.Type == dnsTypeA && rr.IP.To4() != nil:
+			rdata = rr.IP.To4()
+		case rr.Type == dnsTypeAAAA && rr.IP.To16() != nil:
+			rdata = rr.IP.To16()
+		case rr.Type == dnsTypeSRV && rr.SRV != nil:
+			rdata = binary.BigEndian.AppendUint16(rdata, rr.SRV.Priority)
+			rdata = binary.BigEndian.AppendUint16(rdata, rr.SRV.Weight)
+			rdata = binary.BigEndian.AppendUint16(rdata, rr.SRV.Port)
+			if rdata, err = packDNSName(rdata, rr.SRV.Target); err != nil {
+				return nil, err
+			}
+		case rr.Type == dnsTypeNAPTR && rr.NAPTR != nil:
+			rdata = binary.BigEndian.AppendUint16(rdata, rr.NAPTR.Order)
+			rdata = binary.BigEndian.AppendUint16(rdata, rr.NAPTR.Preference)
+			for _, s := range []string{rr.NAPTR.Flags, rr.NAPTR.Service, rr.NAPTR.Regexp} {
+				if len(s) > 255 {
+					return nil, fmt.Errorf("character string too long: %s", s)
+				}
+				rdata = append(rdata, byte(len(s)))
+				rdata = append(rdata, s...)
+			}
+			if rdata, err = packDNSName(rdata, rr.NAPTR.Replacement); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("cannot encode DNS record type %d", rr.Type)
+		}
+
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(rdata)))
+		buf = append(buf, rdata...)
+	}
+
+	return buf, nil
+}
+
+// unpackDNSMessage decodes a wire format DNS message
+func unpackDNSMessage(data []byte) (*dnsMessage, error) {
+	if len(data) < 12 {
+		return nil, errDNSFormat
+	}
+
+	m := &dnsMessage{
+		ID:    binary.BigEndian.Uint16(data[0:]),
+		Flags: binary.BigEndian.Uint16(data[2:]),
+	}
+	qdcount := int(binary.BigEndian.Uint16(data[4:]))
+	ancount := int(binary.BigEndian.Uint16(data[6:]))
+	offset := 12
+
+	for i := 0; i < qdcount; i++ {
+		name, next, err := unpackDNSName(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(data) {
+			return nil, errDNSFormat
+		}
+		m.Questions = append(m.Questions, dnsQuestion{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(data[next:]),
+			Class: binary.BigEndian.Uint16(data[next+2:]),
+		})
+		offset = next + 4
+	}
+
+	for i := 0; i < ancount; i++ {
+		name, next, err := unpackDNSName(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+10 > len(data) {
+			return nil, errDNSFormat
+		}
+		rr := dnsRecord{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(data[next:]),
+			Class: binary.BigEndian.Uint16(data[next+2:]),
+			TTL:   binary.BigEndian.Uint32(data[next+4:]),
+		}
+		rdlength := int(binary.BigEndian.Uint16(data[next+8:]))
+		start := next + 10
+		end := start + rdlength
+		if end > len(data) {
+			return nil, errDNSFormat
+		}
+
+		switch rr.Type {
+		case dnsTypeA, dnsTypeAAAA:
+			rr.IP = net.IP(append([]byte(nil), data[start:end]...))
+		case dnsTypeSRV:
+			if rdlength < 7 {
+				return nil, errDNSFormat
+			}
+			target, _, err := unpackDNSName(data, start+6)
+			if err != nil {
+				return nil, err
+			}
+			rr.SRV = &net.SRV{
+				Priority: binary.BigEndian.Uint16(data[start:]),
+				Weight:   binary.BigEndian.Uint16(data[start+2:]),
+				Port:     binary.BigEndian.Uint16(data[start+4:]),
+				Target:   target,
+			}
+		case dnsTypeNAPTR:
+			if rdlength < 4 {
+				return nil, errDNSFormat
+			}
+			naptr := &NAPTR{
+				Order:      binary.BigEndian.Uint16(data[start:]),
+				Preference: binary.BigEndian.Uint16(data[start+2:]),
+			}
+			pos := start + 4
+			var strs [3]string
+			for j := range strs {
+				if pos >= end || pos+1+int(data[pos]) > end {
+					return nil, errDNSFormat
+				}
+				strs[j] = string(data[pos+1 : pos+1+int(data[pos])])
+				pos += 1 + int(data[pos])
+			}
+			naptr.Flags, naptr.Service, naptr.Regexp = strs[0], strs[1], strs[2]
+			if naptr.Replacement, _, err = unpackDNSName(data, pos); err != nil {
+				return nil, err
+			}
+			rr.NAPTR = naptr
+		}
+
+		m.Answers = append(m.Answers, rr)
+		offset = end
+	}
+
+	return m, nil
+}
+
+// packDNSName appends a domain name in uncompressed wire format
+func packDNSName(buf []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if label == "" || len(label) > 63 {
+				return nil, fmt.Errorf("invalid domain name: %s", name)
+			}
+			buf = append(buf, byte(len(label)))
+			buf = append(buf, label...)
+		}
+	}
+	return append(buf, 0), nil
+}
+
+// unpackDNSName decodes a possibly compressed domain name starting at
+// offset and returns it together with the offset following it
+func unpackDNSName(data []byte, offset int) (string, int, error) {
+	var labels []string
+	next := -1
+
+	for jumps := 0; ; {
+		if offset >= len(data) {
+			return "", 0, errDNSFormat
+		}
+		length := int(data[offset])
+
+		switch {
+		case length == 0:
+			if next == -1 {
+				next = offset + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xC0 == 0xC0:
+			if offset+1 >= len(data) || jumps > 10 {
+				return "", 0, errDNSFormat
+			}
+			if next == -1 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(data[offset:]) & 0x3FFF)
+			jumps++
+		default:
+			if offset+1+length > len(data) {
+				return "", 0, errDNSFormat
+			}
+			labels = append(labels, string(data[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+// dnsClient is a DNSClient that queries a single DNS server over UDP
+type dnsClient struct {
+	server  string
+	timeout time.Duration
+}
+
+// NewDNSClient creates a DNS client that sends queries to the given server (host:port)
+func NewDNSClient(server string) DNSClient {
+	return &dnsClient{
+		server:  server,
+		timeout: 5 * time.Second,
+	}
+}
+
+// SystemDNSServer returns the first nameserver configured in /etc/resolv.conf
+func SystemDNSServer() string {
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "127.0.0.1:53"
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// query sends a single question and returns the answers of the given type
+func (c *dnsClient) query(ctx context.Context, name string, qtype uint16) ([]dnsRecord, error) {
+	query := &dnsMessage{
+		ID:        uint16(rand.Intn(1 << 16)),
+		Flags:     0x0100, // recursion desired
+		Questions: []dnsQuestion{{Name: name, Type: qtype, Class: dnsClassINET}},
+	}
+	packet, err := query.pack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.exchange(ctx, "udp", query.ID, packet)
+	if err == nil && resp.Flags&dnsFlagTC != 0 {
+		// Truncated answers are repeated over TCP (RFC 7766)
+		resp, err = c.exchange(ctx, "tcp", query.ID, packet)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// NXDOMAIN is not an error for SIP server location, it just means no records
+	if rcode := resp.Flags & 0x000F; rcode != 0 && rcode != 3 {
+		return nil, fmt.Errorf("DNS query for %s failed with rcode %d", name, rcode)
+	}
+
+	var answers []dnsRecord
+	for _, rr := range resp.Answers {
+		if rr.Type == qtype {
+			answers = append(answers, rr)
+		}
+	}
+	return answers, nil
+}
+
+// exchange sends a query packet over UDP or TCP and returns the response
+// with the given ID
+func (c *dnsClient) exchange(ctx context.Context, network string, id uint16, packet []byte) (*dnsMessage, error) {
+	dialer := net.Dialer{Timeout: c.timeout}
+	conn, err := dialer.DialContext(ctx, network, c.server)
+	if err != nil {
+		return nil, fmt.Errorf("DNS connection error: %v", err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	if network == "tcp" {
+		// Messages over TCP are preceded by their length (RFC 1035 4.2.2)
+		packet = append(binary.BigEndian.AppendUint16(nil, uint16(len(packet))), packet...)
+	}
+	if _, err := conn.Write(packet); err != nil {
+		return nil, fmt.Errorf("DNS query error: %v", err)
+	}
+
+	if network == "tcp" {
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, fmt.Errorf("DNS response error: %v", err)
+		}
+		buffer := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, buffer); err != nil {
+			return nil, fmt.Errorf("DNS response error: %v", err)
+		}
+		resp, err := unpackDNSMessage(buffer)
+		if err != nil {
+			return nil, err
+		}
+		if resp.ID != id {
+			return nil, errors.New("DNS response ID mismatch")
+		}
+		return resp, nil
+	}
+
+	buffer := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("DNS response error: %v", err)
+		}
+		resp, err := unpackDNSMessage(buffer[:n])
+		if err != nil || resp.ID != id {
+			continue // ignore stray or malformed packets
+		}
+		return resp, nil
+	}
+}
+
+// LookupNAPTR returns the NAPTR records of name
+func (c *dnsClient) LookupNAPTR(ctx context.Context, name string) ([]NAPTR, error) {
+	answers, err := c.query(ctx, name, dnsTypeNAPTR)
+	if err != nil {
+		return nil, err
+	}
+	var records []NAPTR
+	for _, rr := range answers {
+		if rr.NAPTR != nil {
+			records = append(records, *rr.NAPTR)
+		}
+	}
+	return records, nil
+}
+
+// LookupSRV returns the SRV records of name
+func (c *dnsClient) LookupSRV(ctx context.Context, name string) ([]*net.SRV, error) {
+	answers, err := c.query(ctx, name, dnsTypeSRV)
+	if err != nil {
+		return nil, err
+	}
+	var records []*net.SRV
+	for _, rr := range answers {
+		if rr.SRV != nil {
+			records = append(records, rr.SRV)
+		}
+	}
+	return records, nil
+}
+
+// LookupIP returns the IPv4 and IPv6 addresses of host. It fails only
+// when neither lookup succeeds.
+func (c *dnsClient) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	var ips []net.IP
+	var lastErr error
+	failed := 0
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		answers, err := c.query(ctx, host, qtype)
+		if err != nil {
+			lastErr = err
+			failed++
+			continue
+		}
+		for _, rr := range answers {
+			ips = append(ips, rr.IP)
+		}
+	}
+	if failed == 2 {
+		return nil, lastErr
+	}
+	return ips, nil
+}
@@ -0,0 +1,214 @@
+package sip
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// startStubDNS runs an in-process DNS server answering from records,
+// keyed by lower-case name and record type
+func startStubDNS(t *testing.T, records []dnsRecord) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start stub DNS server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			query, err := unpackDNSMessage(buffer[:n])
+			if err != nil || len(query.Questions) != 1 {
+				continue
+			}
+
+			resp := stubDNSResponse(query, records)
+			packet, err := resp.pack()
+			if err != nil {
+				t.Errorf("Failed to pack DNS response: %v", err)
+				continue
+			}
+			conn.WriteTo(packet, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// stubDNSResponse answers a query from records
+func stubDNSResponse(query *dnsMessage, records []dnsRecord) *dnsMessage {
+	q := query.Questions[0]
+	resp := &dnsMessage{ID: query.ID, Flags: 0x8180, Questions: query.Questions}
+	for _, rr := range records {
+		if strings.EqualFold(rr.Name, q.Name) && rr.Type == q.Type {
+			rr.Class = dnsClassINET
+			rr.TTL = 60
+			resp.Answers = append(resp.Answers, rr)
+		}
+	}
+	if len(resp.Answers) == 0 {
+		resp.Flags |= 3 // NXDOMAIN
+	}
+	return resp
+}
+
+func TestDNSMessageRoundTrip(t *testing.T) {
+	msg := &dnsMessage{
+		ID:        42,
+		Flags:     0x8180,
+		Questions: []dnsQuestion{{Name: "example.com", Type: dnsTypeNAPTR, Class: dnsClassINET}},
+		Answers: []dnsRecord{
+			{Name: "example.com", Type: dnsTypeNAPTR, Class: dnsClassINET, TTL: 60, NAPTR: &NAPTR{
+				Order: 10, Preference: 20, Flags: "s", Service: "SIP+D2T", Replacement: "_sip._tcp.example.com",
+			}},
+			{Name: "_sip._tcp.example.com", Type: dnsTypeSRV, Class: dnsClassINET, TTL: 60, SRV: &net.SRV{
+				Priority: 1, Weight: 5, Port: 5060, Target: "sip1.example.com",
+			}},
+			{Name: "sip1.example.com", Type: dnsTypeA, Class: dnsClassINET, TTL: 60, IP: net.ParseIP("192.0.2.1")},
+			{Name: "sip1.example.com", Type: dnsTypeAAAA, Class: dnsClassINET, TTL: 60, IP: net.ParseIP("2001:db8::1")},
+		},
+	}
+
+	packet, err := msg.pack()
+	if err != nil {
+		t.Fatalf("Failed to pack message: %v", err)
+	}
+	decoded, err := unpackDNSMessage(packet)
+	if err != nil {
+		t.Fatalf("Failed to unpack message: %v", err)
+	}
+
+	if decoded.ID != 42 || len(decoded.Questions) != 1 || len(decoded.Answers) != 4 {
+		t.Fatalf("Wrong decoded message: %+v", decoded)
+	}
+	if *decoded.Answers[0].NAPTR != *msg.Answers[0].NAPTR {
+		t.Errorf("Wrong NAPTR: %+v", decoded.Answers[0].NAPTR)
+	}
+	if *decoded.Answers[1].SRV != *msg.Answers[1].SRV {
+		t.Errorf("Wrong SRV: %+v", decoded.Answers[1].SRV)
+	}
+	if !decoded.Answers[2].IP.Equal(net.ParseIP("192.0.2.1")) || !decoded.Answers[3].IP.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("Wrong addresses: %v %v", decoded.Answers[2].IP, decoded.Answers[3].IP)
+	}
+
+	if _, err := unpackDNSMessage(packet[:len(packet)-3]); err == nil {
+		t.Error("Expected error for truncated message")
+	}
+}
+
+func TestUnpackCompressedName(t *testing.T) {
+	// "example.com" at offset 0, then "www" followed by a pointer to offset 0
+	data := []byte{7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 3, 'w', 'w', 'w', 0xC0, 0}
+	name, next, err := unpackDNSName(data, 13)
+	if err != nil {
+		t.Fatalf("Failed to unpack name: %v", err)
+	}
+	if name != "www.example.com" || next != len(data) {
+		t.Errorf("Got %q next=%d", name, next)
+	}
+}
+
+func TestDNSClient(t *testing.T) {
+	server := startStubDNS(t, []dnsRecord{
+		{Name: "example.com", Type: dnsTypeNAPTR, NAPTR: &NAPTR{Order: 10, Flags: "s", Service: "SIP+D2U", Replacement: "_sip._udp.example.com"}},
+		{Name: "_sip._udp.example.com", Type: dnsTypeSRV, SRV: &net.SRV{Priority: 1, Weight: 1, Port: 5070, Target: "sip.example.com"}},
+		{Name: "sip.example.com", Type: dnsTypeA, IP: net.ParseIP("192.0.2.10")},
+	})
+	client := NewDNSClient(server)
+	ctx := context.Background()
+
+	naptrs, err := client.LookupNAPTR(ctx, "example.com")
+	if err != nil || len(naptrs) != 1 || naptrs[0].Service != "SIP+D2U" {
+		t.Errorf("Wrong NAPTR result: %v %v", naptrs, err)
+	}
+
+	srvs, err := client.LookupSRV(ctx, "_sip._udp.example.com")
+	if err != nil || len(srvs) != 1 || srvs[0].Port != 5070 {
+		t.Errorf("Wrong SRV result: %v %v", srvs, err)
+	}
+
+	ips, err := client.LookupIP(ctx, "sip.example.com")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.10")) {
+		t.Errorf("Wrong address result: %v %v", ips, err)
+	}
+
+	ips, err = client.LookupIP(ctx, "missing.example.com")
+	if err != nil || len(ips) != 0 {
+		t.Errorf("Expected no addresses for missing name, got %v %v", ips, err)
+	}
+}
+
+func TestDNSClientTCPFallback(t *testing.T) {
+	records := []dnsRecord{
+		{Name: "sip.example.com", Type: dnsTypeA, IP: net.ParseIP("192.0.2.10")},
+		{Name: "sip.example.com", Type: dnsTypeA, IP: net.ParseIP("192.0.2.11")},
+	}
+
+	// Over UDP the server only answers with the TC bit set
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start stub DNS server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	listener, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		t.Skipf("TCP port of the stub DNS server taken: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			query, err := unpackDNSMessage(buffer[:n])
+			if err != nil {
+				continue
+			}
+			resp := &dnsMessage{ID: query.ID, Flags: 0x8180 | dnsFlagTC, Questions: query.Questions}
+			packet, _ := resp.pack()
+			conn.WriteTo(packet, addr)
+		}
+	}()
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			var length [2]byte
+			if _, err := io.ReadFull(c, length[:]); err != nil {
+				c.Close()
+				continue
+			}
+			buffer := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(c, buffer); err != nil {
+				c.Close()
+				continue
+			}
+			query, err := unpackDNSMessage(buffer)
+			if err == nil {
+				packet, _ := stubDNSResponse(query, records).pack()
+				c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packet))), packet...))
+			}
+			c.Close()
+		}
+	}()
+
+	ips, err := NewDNSClient(conn.LocalAddr().String()).LookupIP(context.Background(), "sip.example.com")
+	if err != nil || len(ips) != 2 {
+		t.Errorf("Truncated answer not repeated over TCP: %v %v", ips, err)
+	}
+}
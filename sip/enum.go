@@ -0,0 +1,174 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultENUMSuffix is the public ENUM tree (RFC 6116)
+	defaultENUMSuffix = "e164.arpa"
+	// enumTimeout bounds the ENUM lookup of a request
+	enumTimeout = 2 * time.Second
+	// maxENUMReferrals limits how many non-terminal NAPTR records are followed
+	maxENUMReferrals = 5
+)
+
+// ENUM maps E.164 numbers to SIP URIs with NAPTR lookups (RFC 6116)
+type ENUM struct {
+	client DNSClient
+	suffix string
+}
+
+// NewENUM creates an ENUM resolver querying NAPTR records under suffix
+// ("e164.arpa" when empty) through the given DNS client
+func NewENUM(client DNSClient, suffix string) *ENUM {
+	suffix = strings.Trim(suffix, ".")
+	if suffix == "" {
+		suffix = defaultENUMSuffix
+	}
+	return &ENUM{client: client, suffix: suffix}
+}
+
+// SetENUM sets the ENUM resolver that E.164 numbers which are not
+// registered users are looked up with; nil disables ENUM
+func (s *Server) SetENUM(enum *ENUM) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enum = enum
+}
+
+// Domain returns the ENUM domain of an E.164 number: its digits reversed
+// and separated by dots, followed by the suffix
+func (e *ENUM) Domain(number string) string {
+	digits := strings.TrimPrefix(number, "+")
+	labels := make([]string, 0, len(digits)+1)
+	for i := len(digits) - 1; i >= 0; i-- {
+		labels = append(labels, digits[i:i+1])
+	}
+	return strings.Join(append(labels, e.suffix), ".")
+}
+
+// Lookup returns the SIP URI of an E.164 number ("+" and digits), or ""
+// when the number has no SIP record
+func (e *ENUM) Lookup(ctx context.Context, number string) (string, error) {
+	if !strings.HasPrefix(number, "+") || !isDigits(number[1:]) {
+		return "", fmt.Errorf("not an E.164 number: %s", number)
+	}
+
+	name := e.Domain(number)
+	for i := 0; i <= maxENUMReferrals; i++ {
+		records, err := e.client.LookupNAPTR(ctx, name)
+		if err != nil {
+			return "", fmt.Errorf("NAPTR lookup for %s failed: %v", name, err)
+		}
+		sort.SliceStable(records, func(i, j int) bool {
+			if records[i].Order != records[j].Order {
+				return records[i].Order < records[j].Order
+			}
+			return records[i].Preference < records[j].Preference
+		})
+
+		next := ""
+		for _, record := range records {
+			switch {
+			case strings.EqualFold(record.Flags, "u") && isSIPService(record.Service):
+				uri, err := applyNAPTRRegexp(record.Regexp, number)
+				if err != nil {
+					return "", err
+				}
+				if strings.HasPrefix(uri, "sip:") || strings.HasPrefix(uri, "sips:") {
+					return uri, nil
+				}
+			case record.Flags == "" && next == "" && record.Replacement != "" && record.Replacement != ".":
+				// A non-terminal record refers to another domain
+				next = strings.TrimSuffix(record.Replacement, ".")
+			}
+		}
+		if next == "" {
+			return "", nil
+		}
+		name = next
+	}
+	return "", fmt.Errorf("too many ENUM referrals for %s", number)
+}
+
+// isSIPService reports whether a NAPTR service is the ENUM SIP service
+// (RFC 3764), also in the obsolete order of RFC 2916
+func isSIPService(service string) bool {
+	return strings.EqualFold(service, "E2U+sip") || strings.EqualFold(service, "sip+E2U")
+}
+
+// applyNAPTRRegexp applies the substitution expression of a NAPTR record,
+// such as "!^\+49(.*)$!sip:\1@example.com!", to a number (RFC 3402)
+func applyNAPTRRegexp(expression, number string) (string, error) {
+	if len(expression) < 3 {
+		return "", fmt.Errorf("invalid NAPTR regexp %q", expression)
+	}
+	parts := splitNAPTRRegexp(expression)
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid NAPTR regexp %q", expression)
+	}
+	pattern, replacement, flags := parts[0], parts[1], parts[2]
+	if flags == "i" {
+		pattern = "(?i)" + pattern
+	} else if flags != "" {
+		return "", fmt.Errorf("invalid NAPTR regexp flags %q", flags)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", fmt.Errorf("invalid NAPTR regexp %q: %v", expression, err)
+	}
+	match := re.FindStringSubmatchIndex(number)
+	if match == nil {
+		return "", nil
+	}
+
+	// Back-references are \1 to \9; a literal $ must not expand
+	var template strings.Builder
+	for i := 0; i < len(replacement); i++ {
+		c := replacement[i]
+		switch {
+		case c == '\\' && i+1 < len(replacement) && replacement[i+1] >= '1' && replacement[i+1] <= '9':
+			template.WriteString("${" + replacement[i+1:i+2] + "}")
+			i++
+		case c == '\\' && i+1 < len(replacement):
+			template.WriteByte(replacement[i+1])
+			i++
+		case c == '$':
+			template.WriteString("$$")
+		default:
+			template.WriteByte(c)
+		}
+	}
+	return string(re.ExpandString(nil, template.String(), number, match)), nil
+}
+
+// splitNAPTRRegexp splits a substitution expression at its delimiter, the
+// first character; an escaped delimiter is part of the text
+func splitNAPTRRegexp(expression string) []string {
+	delim := expression[0]
+	var parts []string
+	var part strings.Builder
+	for i := 1; i < len(expression); i++ {
+		c := expression[i]
+		switch {
+		case c == '\\' && i+1 < len(expression) && expression[i+1] == delim:
+			part.WriteByte(delim)
+			i++
+		case c == '\\' && i+1 < len(expression):
+			part.WriteString(expression[i : i+2])
+			i++
+		case c == delim:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(c)
+		}
+	}
+	return append(parts, part.String())
+}
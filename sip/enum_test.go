@@ -0,0 +1,93 @@
+package sip
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestENUMLookup(t *testing.T) {
+	server := startStubDNS(t, []dnsRecord{
+		{Name: "4.3.2.1.0.3.9.4.e164.example", Type: dnsTypeNAPTR, NAPTR: &NAPTR{Order: 10, Preference: 10, Flags: "u", Service: "E2U+email", Regexp: "!^.*$!mailto:info@example.com!"}},
+		{Name: "4.3.2.1.0.3.9.4.e164.example", Type: dnsTypeNAPTR, NAPTR: &NAPTR{Order: 10, Preference: 20, Flags: "u", Service: "E2U+sip", Regexp: `!^\+49(.*)$!sip:\1@example.de!`}},
+		{Name: "4.3.2.1.0.3.9.4.e164.example", Type: dnsTypeNAPTR, NAPTR: &NAPTR{Order: 20, Preference: 10, Flags: "u", Service: "E2U+sip", Regexp: "!^.*$!sip:fallback@example.de!"}},
+		{Name: "5.5.5.5.1.e164.example", Type: dnsTypeNAPTR, NAPTR: &NAPTR{Order: 10, Preference: 10, Flags: "", Replacement: "numbers.example.net"}},
+		{Name: "numbers.example.net", Type: dnsTypeNAPTR, NAPTR: &NAPTR{Order: 10, Preference: 10, Flags: "U", Service: "sip+E2U", Regexp: "!^.*$!sip:pool@example.net!"}},
+		{Name: "6.6.6.6.1.e164.example", Type: dnsTypeNAPTR, NAPTR: &NAPTR{Order: 10, Preference: 10, Flags: "u", Service: "E2U+sip", Regexp: "!^(.*$!sip:x@y!"}},
+	})
+	enum := NewENUM(NewDNSClient(server), "e164.example.")
+
+	if domain := enum.Domain("+4930"); domain != "0.3.9.4.e164.example" {
+		t.Errorf("Wrong ENUM domain: %s", domain)
+	}
+	if domain := NewENUM(nil, "").Domain("+1"); domain != "1.e164.arpa" {
+		t.Errorf("Wrong default ENUM domain: %s", domain)
+	}
+
+	tests := []struct {
+		number string
+		want   string
+	}{
+		{"+49301234", "sip:301234@example.de"},
+		{"+15555", "sip:pool@example.net"},
+		{"+4412345", ""},
+	}
+	for _, tt := range tests {
+		uri, err := enum.Lookup(context.Background(), tt.number)
+		if err != nil || uri != tt.want {
+			t.Errorf("Lookup(%s) = %q, %v; want %q", tt.number, uri, err, tt.want)
+		}
+	}
+	for _, number := range []string{"+16666", "4930"} {
+		if _, err := enum.Lookup(context.Background(), number); err == nil {
+			t.Errorf("Lookup(%s) did not fail", number)
+		}
+	}
+}
+
+func TestApplyNAPTRRegexp(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       string
+	}{
+		{`!^\+(\d\d)(.*)$!sip:\2@cc\1.example.com!`, "sip:301234@cc49.example.com"},
+		{"/^.*$/sip:a$b@example.com/", "sip:a$b@example.com"},
+		{`!^\+49!sip:x\!y@example.com!i`, "sip:x!y@example.com"},
+		{"!^\\+1!sip:x@example.com!", ""},
+	}
+	for _, tt := range tests {
+		got, err := applyNAPTRRegexp(tt.expression, "+49301234")
+		if err != nil || got != tt.want {
+			t.Errorf("applyNAPTRRegexp(%s) = %q, %v; want %q", tt.expression, got, err, tt.want)
+		}
+	}
+	for _, expression := range []string{"", "!^.*$!sip:x@y", "!^.*$!sip:x@y!g"} {
+		if _, err := applyNAPTRRegexp(expression, "+49301234"); err == nil {
+			t.Errorf("applyNAPTRRegexp(%q) did not fail", expression)
+		}
+	}
+}
+
+func TestENUMRouting(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetDomains([]string{"example.com"})
+	server.SetNumberingPlan("", NumberingPlan{CountryCode: "49"})
+	server.SetENUM(NewENUM(NewDNSClient(startStubDNS(t, []dnsRecord{
+		{Name: "4.3.2.1.0.3.9.4.e164.arpa", Type: dnsTypeNAPTR, NAPTR: &NAPTR{Order: 10, Preference: 10, Flags: "u", Service: "E2U+sip", Regexp: "!^.*$!sip:bob@127.0.0.9:5080!"}},
+	})), ""))
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	bobAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.9"), Port: 5080}
+
+	server.handleMessage(addr, []byte(newTestMessage("sip:0301234@example.com", "hi").String()))
+	forwarded := sentTo(t, mockConn, bobAddr)
+	if len(forwarded) != 1 || forwarded[0].RequestURI() != "sip:bob@127.0.0.9:5080" {
+		t.Fatalf("MESSAGE not routed to the ENUM target: %v", forwarded)
+	}
+
+	// Numbers without a record are routed as dialed, in E.164
+	msg := server.normalizeNumber(newTestInvite("sip:0305555@example.com", "enum-miss"))
+	if msg.RequestURI() != "sip:+49305555@example.com" {
+		t.Errorf("Wrong Request-URI without ENUM record: %s", msg.RequestURI())
+	}
+}
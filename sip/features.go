@@ -0,0 +1,265 @@
+package sip
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CallFeatures are the settings of a user for handling incoming calls
+type CallFeatures struct {
+	ForwardAlways   string   `json:"forward_always,omitempty"`    // URI every call is forwarded to
+	ForwardBusy     string   `json:"forward_busy,omitempty"`      // URI calls go to when the user is busy or on DND
+	ForwardNoAnswer string   `json:"forward_no_answer,omitempty"` // URI calls go to when nobody answers
+	RingTimeout     int      `json:"ring_timeout,omitempty"`      // seconds each target rings, 20 by default
+	DND             bool     `json:"dnd,omitempty"`               // do not disturb: calls are rejected
+	DNDCode         int      `json:"dnd_code,omitempty"`          // 486 (default) or 480
+	FollowMe        []string `json:"follow_me,omitempty"`         // URIs tried in turn after the user's own phones
+}
+
+// validate checks the settings for values the server cannot apply
+func (f CallFeatures) validate() error {
+	if f.RingTimeout < 0 {
+		return fmt.Errorf("ring timeout must not be negative")
+	}
+	if f.DNDCode != 0 && f.DNDCode != 480 && f.DNDCode != 486 {
+		return fmt.Errorf("DND code must be 480 or 486")
+	}
+	for _, uri := range append([]string{f.ForwardAlways, f.ForwardBusy, f.ForwardNoAnswer}, f.FollowMe...) {
+		if uri == "" {
+			continue
+		}
+		if _, err := ParseURI(uri); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// empty reports whether no feature is set
+func (f CallFeatures) empty() bool {
+	return f.ForwardAlways == "" && f.ForwardBusy == "" && f.ForwardNoAnswer == "" &&
+		!f.DND && len(f.FollowMe) == 0
+}
+
+// featureStore persists the call features of all users in a JSON file
+type featureStore struct {
+	mu   sync.Mutex // serializes writes of the file
+	path string
+}
+
+// SetFeaturesFile loads the call features of users from a JSON file, an
+// object mapping AORs to their settings, and saves every later change to it.
+// A missing file is created on the first change.
+func (s *Server) SetFeaturesFile(path string) error {
+	features := make(map[string]CallFeatures)
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error reading call features: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &features); err != nil {
+			return fmt.Errorf("error parsing call features: %v", err)
+		}
+	}
+	for aor, f := range features {
+		if err := f.validate(); err != nil {
+			return fmt.Errorf("call features of %s: %v", aor, err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.featureStore = &featureStore{path: path}
+	for aor, f := range features {
+		if !f.empty() {
+			s.features[aor] = f
+		}
+	}
+	return nil
+}
+
+// SetCallFeatures sets the call features of a user; settings without any
+// feature remove them
+func (s *Server) SetCallFeatures(aor string, features CallFeatures) error {
+	if err := features.validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	store := s.featureStore
+	s.mu.Unlock()
+	if store != nil {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	if features.empty() {
+		delete(s.features, aor)
+	} else {
+		s.features[aor] = features
+	}
+	snapshot := make(map[string]CallFeatures, len(s.features))
+	for key, f := range s.features {
+		snapshot[key] = f
+	}
+	s.mu.Unlock()
+
+	log.Printf("call features of %s: %+v", aor, features)
+	if store == nil {
+		return nil
+	}
+	return store.save(snapshot)
+}
+
+// CallFeatures returns the call features of a user
+func (s *Server) CallFeatures(aor string) CallFeatures {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.features[aor]
+}
+
+// save writes the features of all users, replacing the file atomically.
+// The caller must hold f.mu.
+func (f *featureStore) save(features map[string]CallFeatures) error {
+	data, err := json.MarshalIndent(features, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("error saving call features: %v", err)
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		return fmt.Errorf("error saving call features: %v", err)
+	}
+	return nil
+}
+
+// applyCallFeatures handles an INVITE to a local user according to the
+// user's call features. It returns false when the user has none.
+func (s *Server) applyCallFeatures(addr net.Addr, msg *Message) bool {
+	aor := extractSIPURI(msg.RequestURI())
+	s.mu.Lock()
+	features, ok := s.features[aor]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	timeout := defaultRingTimeout
+	if features.RingTimeout > 0 {
+		timeout = time.Duration(features.RingTimeout) * time.Second
+	}
+	seq := &callSequence{upstream: addr, invite: msg}
+	switch {
+	case features.ForwardAlways != "":
+		log.Printf("call to %s forwarded to %s", aor, features.ForwardAlways)
+		seq.steps = []callStep{ring(features.ForwardAlways, 0)}
+	case features.DND && features.ForwardBusy != "":
+		log.Printf("call to %s on DND forwarded to %s", aor, features.ForwardBusy)
+		seq.steps = []callStep{ring(features.ForwardBusy, 0)}
+	case features.DND:
+		resp := NewResponse("486", "Busy Here", msg)
+		if features.DNDCode == 480 {
+			resp = NewResponse("480", "Temporarily Unavailable", msg)
+		}
+		log.Printf("call to %s rejected: DND", aor)
+		if s.finalizeInvite(msg) {
+			s.sendResponse(addr, resp)
+		}
+		return true
+	default:
+		seq.steps = append(seq.steps, ring(aor, timeout))
+		for _, uri := range features.FollowMe {
+			seq.steps = append(seq.steps, ring(uri, timeout))
+		}
+		if features.ForwardNoAnswer != "" {
+			seq.steps = append(seq.steps, ring(features.ForwardNoAnswer, 0))
+		}
+		// The last target rings until the caller gives up
+		seq.steps[len(seq.steps)-1][0].timeout = 0
+		seq.busy = features.ForwardBusy
+	}
+
+	s.startSequence(seq)
+	return true
+}
+
+// handleFeatureCode carries out a feature code, such as *72 followed by a
+// number to forward all calls to, that a local user dialed. It returns
+// false when the Request-URI is not a feature code.
+func (s *Server) handleFeatureCode(addr net.Addr, msg *Message) bool {
+	uri, err := ParseURI(msg.RequestURI())
+	if err != nil || !strings.HasPrefix(uri.User, "*") || len(uri.User) < 3 {
+		return false
+	}
+	code, number := uri.User[:3], uri.User[3:]
+	target := ""
+	if number != "" {
+		target = (&URI{Scheme: "sip", User: number, Host: uri.Host, Params: map[string]string{}}).String()
+	}
+
+	caller := extractSIPURI(msg.Headers["From"])
+	features := s.CallFeatures(caller)
+	activated := true
+	switch code {
+	case "*72":
+		features.ForwardAlways = target
+	case "*73":
+		features.ForwardAlways, activated = "", false
+	case "*90":
+		features.ForwardBusy = target
+	case "*91":
+		features.ForwardBusy, activated = "", false
+	case "*92":
+		features.ForwardNoAnswer = target
+	case "*93":
+		features.ForwardNoAnswer, activated = "", false
+	case "*78":
+		features.DND = true
+	case "*79":
+		features.DND, activated = false, false
+	default:
+		return false
+	}
+	if s.rejectUnsupported(addr, msg) {
+		return true
+	}
+
+	var resp *Message
+	// Only the caller's own phones may change its features; the From alone
+	// can be forged
+	s.mu.Lock()
+	registered := s.registeredFrom(caller, addr)
+	s.mu.Unlock()
+	switch {
+	case !registered:
+		resp = NewResponse("403", "Forbidden", msg)
+	case activated && code != "*78" && target == "":
+		resp = NewResponse("484", "Address Incomplete", msg)
+	default:
+		if err := s.SetCallFeatures(caller, features); err != nil {
+			log.Printf("feature code %s of %s: %v", code, caller, err)
+			resp = NewResponse("500", "Server Internal Error", msg)
+			break
+		}
+		// No call is set up; the reason phrase confirms the change
+		reason := "Feature Activated"
+		if !activated {
+			reason = "Feature Deactivated"
+		}
+		resp = NewResponse("603", reason, msg)
+	}
+	log.Printf("feature code %s of %s: %d", code, caller, resp.StatusCode())
+	if s.finalizeInvite(msg) {
+		s.sendResponse(addr, resp)
+	}
+	return true
+}
@@ -0,0 +1,266 @@
+package sip
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// registerFeatureUser registers user@example.com with a contact at addr
+func registerFeatureUser(server *Server, user string, addr *net.UDPAddr) {
+	register := newOutboundRegister(fmt.Sprintf("<sip:%s@%s>", user, addr.String()))
+	register.Headers["From"] = "<sip:" + user + "@example.com>;tag=1"
+	register.Headers["Call-ID"] = "register-" + user
+	server.handleRegister(addr, register)
+}
+
+// requestsTo returns the requests sent to addr
+func requestsTo(t *testing.T, mockConn *MockConn, addr net.Addr) []*Message {
+	t.Helper()
+	var requests []*Message
+	for _, msg := range sentTo(t, mockConn, addr) {
+		if !msg.IsResponse() {
+			requests = append(requests, msg)
+		}
+	}
+	return requests
+}
+
+// newFeatureInvite returns an INVITE with its own transaction
+func newFeatureInvite(requestURI, callID string) *Message {
+	invite := newTestInvite(requestURI, callID)
+	invite.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bK" + callID
+	return invite
+}
+
+func TestCallForwarding(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetDomains([]string{"example.com"})
+	mockConn := server.conn.(*MockConn)
+	aliceAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	bobAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.9"), Port: 5080}
+	carolAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.4"), Port: 5064}
+	registerFeatureUser(server, "bob", bobAddr)
+	registerFeatureUser(server, "carol", carolAddr)
+
+	server.SetCallFeatures("sip:bob@example.com", CallFeatures{ForwardAlways: "sip:carol@example.com"})
+	server.handleMessage(aliceAddr, []byte(newFeatureInvite("sip:bob@example.com", "cfu").String()))
+	if sent := requestsTo(t, mockConn, carolAddr); len(sent) != 1 || sent[0].RequestURI() != "sip:carol@127.0.0.4:5064" {
+		t.Fatalf("INVITE not forwarded to carol: %v", sent)
+	}
+
+	tests := []struct {
+		features CallFeatures
+		code     int
+	}{
+		{CallFeatures{DND: true}, 486},
+		{CallFeatures{DND: true, DNDCode: 480}, 480},
+	}
+	for i, tt := range tests {
+		server.SetCallFeatures("sip:bob@example.com", tt.features)
+		server.handleMessage(aliceAddr, []byte(newFeatureInvite("sip:bob@example.com", fmt.Sprintf("dnd%d", i)).String()))
+		if code := lastSent(t, mockConn).StatusCode(); code != tt.code {
+			t.Errorf("DND %+v answered %d, want %d", tt.features, code, tt.code)
+		}
+	}
+	if sent := requestsTo(t, mockConn, bobAddr); len(sent) != 0 {
+		t.Errorf("Calls reached bob: %v", sent)
+	}
+
+	// DND with a busy forward sends calls there
+	server.SetCallFeatures("sip:bob@example.com", CallFeatures{DND: true, ForwardBusy: "sip:carol@example.com"})
+	server.handleMessage(aliceAddr, []byte(newFeatureInvite("sip:bob@example.com", "dnd-busy").String()))
+	if sent := requestsTo(t, mockConn, carolAddr); len(sent) != 2 {
+		t.Errorf("INVITE on DND not forwarded to carol: %d", len(sent))
+	}
+
+	// A busy callee is forwarded
+	server.SetCallFeatures("sip:bob@example.com", CallFeatures{ForwardBusy: "sip:carol@example.com"})
+	server.handleMessage(aliceAddr, []byte(newFeatureInvite("sip:bob@example.com", "busy").String()))
+	toBob := requestsTo(t, mockConn, bobAddr)
+	if len(toBob) != 1 {
+		t.Fatalf("INVITE not sent to bob first: %d", len(toBob))
+	}
+	server.handleMessage(bobAddr, []byte(NewResponse("486", "Busy Here", toBob[0]).String()))
+	if sent := requestsTo(t, mockConn, carolAddr); len(sent) != 3 || sent[2].Headers["Call-ID"] != "busy" {
+		t.Errorf("Busy call not forwarded to carol")
+	}
+	for _, resp := range sentTo(t, mockConn, aliceAddr) {
+		if resp.Headers["Call-ID"] == "busy" && resp.StatusCode() == 486 {
+			t.Error("Busy response relayed to the caller")
+		}
+	}
+}
+
+func TestFollowMe(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetDomains([]string{"example.com"})
+	mockConn := server.conn.(*MockConn)
+	aliceAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	bobAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.9"), Port: 5080}
+	mobileAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.4"), Port: 5064}
+	voicemailAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.5"), Port: 5066}
+	registerFeatureUser(server, "bob", bobAddr)
+	registerFeatureUser(server, "bob-mobile", mobileAddr)
+	registerFeatureUser(server, "voicemail", voicemailAddr)
+	server.SetCallFeatures("sip:bob@example.com", CallFeatures{
+		RingTimeout:     1,
+		FollowMe:        []string{"sip:nobody@example.com", "sip:bob-mobile@example.com"},
+		ForwardNoAnswer: "sip:voicemail@example.com",
+	})
+
+	server.handleMessage(aliceAddr, []byte(newFeatureInvite("sip:bob@example.com", "follow-me").String()))
+	toBob := requestsTo(t, mockConn, bobAddr)
+	if len(toBob) != 1 {
+		t.Fatalf("INVITE not sent to bob: %d", len(toBob))
+	}
+	server.handleMessage(bobAddr, []byte(NewResponse("180", "Ringing", toBob[0]).String()))
+
+	// Unanswered, bob's phone is cancelled and the mobile rings; the
+	// unregistered target in between is skipped
+	waitFor(t, "mobile ringing", func() bool { return len(requestsTo(t, mockConn, mobileAddr)) == 1 })
+	toBob = requestsTo(t, mockConn, bobAddr)
+	if len(toBob) != 2 || toBob[1].Method() != "CANCEL" {
+		t.Fatalf("Bob's branch not cancelled: %v", toBob)
+	}
+	server.handleMessage(bobAddr, []byte(NewResponse("487", "Request Terminated", toBob[0]).String()))
+	for _, resp := range sentTo(t, mockConn, aliceAddr) {
+		if resp.StatusCode() == 487 {
+			t.Error("487 of the cancelled branch relayed to the caller")
+		}
+	}
+
+	// The mobile declining moves the call on to voicemail, which answers
+	toMobile := requestsTo(t, mockConn, mobileAddr)
+	server.handleMessage(mobileAddr, []byte(NewResponse("480", "Temporarily Unavailable", toMobile[0]).String()))
+	toVoicemail := requestsTo(t, mockConn, voicemailAddr)
+	if len(toVoicemail) != 1 || toVoicemail[0].RequestURI() != "sip:voicemail@127.0.0.5:5066" {
+		t.Fatalf("INVITE not sent to voicemail: %v", toVoicemail)
+	}
+	ok := NewResponse("200", "OK", toVoicemail[0])
+	ok.Headers["To"] += ";tag=vm"
+	server.handleMessage(voicemailAddr, []byte(ok.String()))
+	if resp := lastSent(t, mockConn); resp.StatusCode() != 200 || resp.Headers["Call-ID"] != "follow-me" {
+		t.Errorf("Expected 200 relayed to the caller, got %s", resp.StartLine)
+	}
+
+	// Voicemail is the last target, so no ring timeout applies to it
+	time.Sleep(1200 * time.Millisecond)
+	if len(requestsTo(t, mockConn, voicemailAddr)) != 1 {
+		t.Error("Answered call was cancelled")
+	}
+}
+
+func TestFollowMeCancelled(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetDomains([]string{"example.com"})
+	mockConn := server.conn.(*MockConn)
+	aliceAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	bobAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.9"), Port: 5080}
+	mobileAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.4"), Port: 5064}
+	registerFeatureUser(server, "bob", bobAddr)
+	registerFeatureUser(server, "bob-mobile", mobileAddr)
+	server.SetCallFeatures("sip:bob@example.com", CallFeatures{
+		RingTimeout: 1,
+		FollowMe:    []string{"sip:bob-mobile@example.com"},
+	})
+
+	invite := newFeatureInvite("sip:bob@example.com", "follow-me-cancel")
+	server.handleMessage(aliceAddr, []byte(invite.String()))
+	toBob := requestsTo(t, mockConn, bobAddr)
+	if len(toBob) != 1 {
+		t.Fatalf("INVITE not sent to bob: %d", len(toBob))
+	}
+	server.handleMessage(bobAddr, []byte(NewResponse("180", "Ringing", toBob[0]).String()))
+	server.handleMessage(aliceAddr, []byte(newTestCancel(invite).String()))
+
+	// Past the ring timeout, the mobile is not called and bob's branch was
+	// cancelled once
+	time.Sleep(1200 * time.Millisecond)
+	if sent := requestsTo(t, mockConn, mobileAddr); len(sent) != 0 {
+		t.Errorf("Cancelled call moved on to the mobile: %v", sent)
+	}
+	toBob = requestsTo(t, mockConn, bobAddr)
+	if len(toBob) != 2 || toBob[1].Method() != "CANCEL" {
+		t.Fatalf("Expected one CANCEL to bob, got %v", toBob)
+	}
+	server.handleMessage(bobAddr, []byte(NewResponse("487", "Request Terminated", toBob[0]).String()))
+	if resp := lastSent(t, mockConn); resp.StatusCode() != 487 || resp.Headers["Call-ID"] != "follow-me-cancel" {
+		t.Errorf("Expected 487 relayed to the caller, got %s", resp.StartLine)
+	}
+}
+
+func TestFeatureCodes(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetDomains([]string{"example.com"})
+	mockConn := server.conn.(*MockConn)
+	aliceAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	registerFeatureUser(server, "alice", aliceAddr)
+
+	tests := []struct {
+		user   string
+		code   int
+		reason string
+	}{
+		{"*72200", 603, "Feature Activated"},
+		{"*78", 603, "Feature Activated"},
+		{"*72", 484, "Address Incomplete"},
+		{"*79", 603, "Feature Deactivated"},
+	}
+	for i, tt := range tests {
+		server.handleMessage(aliceAddr, []byte(newFeatureInvite("sip:"+tt.user+"@example.com", fmt.Sprintf("code%d", i)).String()))
+		if resp := lastSent(t, mockConn); resp.StatusCode() != tt.code || resp.Reason() != tt.reason {
+			t.Errorf("%s answered %s", tt.user, resp.StartLine)
+		}
+	}
+	if f := server.CallFeatures("sip:alice@example.com"); f.ForwardAlways != "sip:200@example.com" || f.DND {
+		t.Errorf("Unexpected features: %+v", f)
+	}
+
+	server.handleMessage(aliceAddr, []byte(newFeatureInvite("sip:*73@example.com", "code-off").String()))
+	if f := server.CallFeatures("sip:alice@example.com"); !f.empty() {
+		t.Errorf("Features not cleared: %+v", f)
+	}
+
+	// Only registered users may change their features
+	invite := newFeatureInvite("sip:*78@example.com", "code-spoofed")
+	invite.Headers["From"] = "<sip:mallory@example.com>;tag=9"
+	server.handleMessage(aliceAddr, []byte(invite.String()))
+	if code := lastSent(t, mockConn).StatusCode(); code != 403 {
+		t.Errorf("Expected 403, got %d", code)
+	}
+
+	// ...and only from where they registered
+	malloryAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.66"), Port: 5060}
+	server.handleMessage(malloryAddr, []byte(newFeatureInvite("sip:*72666@example.com", "code-forged").String()))
+	if code := lastSent(t, mockConn).StatusCode(); code != 403 {
+		t.Errorf("Expected 403 for a forged From, got %d", code)
+	}
+	if f := server.CallFeatures("sip:alice@example.com"); !f.empty() {
+		t.Errorf("Forged feature code changed features: %+v", f)
+	}
+}
+
+func TestFeaturesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "features.json")
+	server := setupTestServer(t)
+	if err := server.SetFeaturesFile(path); err != nil {
+		t.Fatalf("SetFeaturesFile failed: %v", err)
+	}
+	if err := server.SetCallFeatures("sip:bob@example.com", CallFeatures{DND: true, DNDCode: 480}); err != nil {
+		t.Fatalf("SetCallFeatures failed: %v", err)
+	}
+	if err := server.SetCallFeatures("sip:carol@example.com", CallFeatures{FollowMe: []string{"bad uri"}}); err == nil {
+		t.Error("Invalid follow-me target accepted")
+	}
+
+	restarted := setupTestServer(t)
+	if err := restarted.SetFeaturesFile(path); err != nil {
+		t.Fatalf("SetFeaturesFile failed: %v", err)
+	}
+	if f := restarted.CallFeatures("sip:bob@example.com"); !f.DND || f.DNDCode != 480 {
+		t.Errorf("Features not loaded: %+v", f)
+	}
+}
@@ -0,0 +1,288 @@
+package sip
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultFlowTimer is the keepalive interval advertised in Flow-Timer (RFC 5626)
+	defaultFlowTimer = 120 * time.Second
+	// flowGracePeriod is added to the flow timer before a silent flow is considered dead
+	flowGracePeriod = 20 * time.Second
+)
+
+// Flow is a transport association between a client and the server (RFC 5626)
+type Flow struct {
+	Token     string
+	Transport string
+	Remote    net.Addr
+	conn      net.Conn // nil for UDP flows
+	lastSeen  time.Time
+}
+
+// flowKey identifies the flow a message was received on
+func flowKey(addr net.Addr) string {
+	return addr.Network() + ":" + addr.String()
+}
+
+// isKeepalivePing reports whether data is a double-CRLF keepalive
+func isKeepalivePing(data []byte) bool {
+	return string(data) == "\r\n\r\n"
+}
+
+// touchFlow records activity on the flow of the given address, creating it if needed
+func (s *Server) touchFlow(addr net.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := flowKey(addr)
+	flow, ok := s.flows[key]
+	if !ok {
+		// Stream flows are created when their connection is accepted
+		if addr.Network() != "udp" {
+			return
+		}
+		flow = &Flow{
+			Token:     randomToken(8),
+			Transport: addr.Network(),
+			Remote:    addr,
+		}
+		s.flows[key] = flow
+	}
+	flow.lastSeen = time.Now()
+}
+
+// lookupFlow returns the flow of the given address, if any
+func (s *Server) lookupFlow(addr net.Addr) *Flow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flows[flowKey(addr)]
+}
+
+// closeFlow forgets a flow and removes the SIP Outbound bindings registered over it
+func (s *Server) closeFlow(flow *Flow) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeFlow(flow)
+}
+
+// removeFlow is closeFlow without locking. The caller must hold s.mu.
+func (s *Server) removeFlow(flow *Flow) {
+	delete(s.flows, flowKey(flow.Remote))
+
+	for aor, bindings := range s.bindings {
+		kept := bindings[:0]
+		for _, binding := range bindings {
+			if binding.FlowToken == flow.Token {
+				log.Printf("flow %s failed, removing binding %s", flow.Token, binding.Contact)
+				continue
+			}
+			kept = append(kept, binding)
+		}
+		if len(kept) == 0 {
+			delete(s.bindings, aor)
+			if s.registrar[aor] == flow.Remote.String() {
+				delete(s.registrar, aor)
+			}
+		} else {
+			s.bindings[aor] = kept
+		}
+	}
+}
+
+// expireFlows removes UDP flows that have been silent for longer than the
+// flow timer plus a grace period. Stream flows are detected by their read
+// deadline instead.
+func (s *Server) expireFlows(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, flow := range s.flows {
+		if flow.conn == nil && now.Sub(flow.lastSeen) > s.flowTimer+flowGracePeriod {
+			s.removeFlow(flow)
+		}
+	}
+}
+
+// reapFlows periodically expires dead UDP flows and idle outbound connections
+func (s *Server) reapFlows() {
+	ticker := time.NewTicker(s.flowTimer / 2)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		s.expireFlows(now)
+		s.pool.CloseIdle(now)
+	}
+}
+
+// serveTCP accepts SIP over TCP connections
+func (s *Server) serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("TCP accept error: %v", err)
+			continue
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// handleConn serves an inbound stream connection as a client flow
+func (s *Server) handleConn(conn net.Conn) {
+	addr := conn.RemoteAddr()
+	flow := &Flow{
+		Token:     randomToken(8),
+		Transport: addr.Network(),
+		Remote:    addr,
+		conn:      conn,
+		lastSeen:  time.Now(),
+	}
+	s.mu.Lock()
+	s.flows[flowKey(addr)] = flow
+	s.mu.Unlock()
+
+	defer func() {
+		conn.Close()
+		s.closeFlow(flow)
+	}()
+
+	// A client that stops sending keepalives has lost its flow
+	s.readConn(conn, addr, s.flowTimer+flowGracePeriod)
+}
+
+// readOutbound reads messages arriving on a pooled outbound connection
+func (s *Server) readOutbound(conn net.Conn, addr net.Addr) {
+	defer func() {
+		s.pool.Remove(conn)
+		conn.Close()
+	}()
+
+	s.readConn(conn, addr, 0)
+}
+
+// readConn reads SIP messages and keepalives from a stream connection until
+// it fails. A non-zero timeout ends connections that stay silent that long.
+func (s *Server) readConn(conn net.Conn, addr net.Addr, timeout time.Duration) {
+	reader := bufio.NewReader(conn)
+	for {
+		if timeout > 0 {
+			if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+				log.Printf("read deadline error: %v", err)
+				return
+			}
+		}
+
+		data, ping, err := readStreamMessage(reader)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("connection reading error: %v", err)
+			}
+			return
+		}
+		s.pool.Touch(conn)
+
+		if ping {
+			s.touchFlow(addr)
+			if _, err := conn.Write([]byte("\r\n")); err != nil {
+				log.Printf("keepalive pong error: %v", err)
+				return
+			}
+			continue
+		}
+
+		s.handleMessage(addr, data)
+	}
+}
+
+// maxStreamBody bounds the Content-Length of messages read from a stream, so
+// that a peer cannot make the server allocate arbitrary amounts of memory
+const maxStreamBody = 64 << 10
+
+// maxStreamLine and maxStreamHead bound the length of a header line and of
+// all header lines of a message read from a stream
+const (
+	maxStreamLine = 8 << 10
+	maxStreamHead = 64 << 10
+)
+
+// readStreamLine reads one line of at most maxStreamLine bytes
+func readStreamLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxStreamLine {
+			return "", fmt.Errorf("header line exceeds %d bytes", maxStreamLine)
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+// readStreamMessage reads one SIP message framed by Content-Length from a
+// stream. A double CRLF received between messages is reported as a keepalive
+// ping. Header lines over maxStreamLine, headers over maxStreamHead and
+// bodies over maxStreamBody are an error; the connection cannot be framed
+// after one and is closed.
+func readStreamMessage(reader *bufio.Reader) ([]byte, bool, error) {
+	var head strings.Builder
+	blankLines := 0
+	contentLength := 0
+
+	for {
+		line, err := readStreamLine(reader)
+		if err != nil {
+			return nil, false, err
+		}
+		if head.Len()+len(line) > maxStreamHead {
+			return nil, false, fmt.Errorf("headers exceed %d bytes", maxStreamHead)
+		}
+
+		if strings.TrimRight(line, "\r\n") == "" {
+			if head.Len() == 0 {
+				blankLines++
+				if blankLines == 2 {
+					return nil, true, nil
+				}
+				continue
+			}
+			head.WriteString(line)
+			break
+		}
+		head.WriteString(line)
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 {
+			name := strings.TrimSpace(parts[0])
+			if strings.EqualFold(name, "Content-Length") || name == "l" {
+				n, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+				if err != nil || n < 0 {
+					return nil, false, fmt.Errorf("invalid Content-Length: %s", strings.TrimSpace(parts[1]))
+				}
+				if n > maxStreamBody {
+					return nil, false, fmt.Errorf("Content-Length %d exceeds %d bytes", n, maxStreamBody)
+				}
+				contentLength = n
+			}
+		}
+	}
+
+	body := make([]byte, contentLength)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, false, err
+	}
+
+	return append([]byte(head.String()), body...), false, nil
+}
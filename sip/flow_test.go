@@ -0,0 +1,243 @@
+package sip
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const outboundContact = `<sip:bob@10.0.0.5:5070;transport=tcp;ob>;reg-id=1;+sip.instance="<urn:uuid:00000000-0000-1000-8000-AABBCCDDEEFF>"`
+
+func newOutboundRegister(contact string) *Message {
+	msg := NewMessage()
+	msg.StartLine = "REGISTER sip:example.com SIP/2.0"
+	msg.Headers["Via"] = "SIP/2.0/TCP 10.0.0.5:5070;branch=z9hG4bKreg1"
+	msg.Headers["From"] = "<sip:bob@example.com>;tag=111"
+	msg.Headers["To"] = "<sip:bob@example.com>"
+	msg.Headers["Call-ID"] = "outbound-register-1"
+	msg.Headers["CSeq"] = "1 REGISTER"
+	msg.Headers["Supported"] = "outbound, path"
+	msg.Headers["Contact"] = contact
+	msg.Headers["Content-Length"] = "0"
+	return msg
+}
+
+func newTestInvite(requestURI, callID string) *Message {
+	msg := NewMessage()
+	msg.StartLine = "INVITE " + requestURI + " SIP/2.0"
+	msg.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKinv1"
+	msg.Headers["From"] = "<sip:alice@example.com>;tag=123"
+	msg.Headers["To"] = "<" + requestURI + ">"
+	msg.Headers["Call-ID"] = callID
+	msg.Headers["CSeq"] = "1 INVITE"
+	msg.Headers["Contact"] = "<sip:alice@127.0.0.1:12345>"
+	msg.Headers["Max-Forwards"] = "70"
+	msg.Headers["Content-Length"] = "0"
+	return msg
+}
+
+func readTestMessage(t *testing.T, conn net.Conn, reader *bufio.Reader) *Message {
+	t.Helper()
+	if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("Failed to set deadline: %v", err)
+	}
+	data, ping, err := readStreamMessage(reader)
+	if err != nil || ping {
+		t.Fatalf("Failed to read message: ping=%v err=%v", ping, err)
+	}
+	msg, err := ParseMessage(string(data))
+	if err != nil {
+		t.Fatalf("Failed to parse message: %v", err)
+	}
+	return msg
+}
+
+func TestReadStreamMessage(t *testing.T) {
+	stream := "\r\n\r\n" +
+		"OPTIONS sip:example.com SIP/2.0\r\nContent-Length: 5\r\n\r\nhello" +
+		"\r\nSIP/2.0 200 OK\r\nl: 0\r\n\r\n"
+	reader := bufio.NewReader(strings.NewReader(stream))
+
+	_, ping, err := readStreamMessage(reader)
+	if err != nil || !ping {
+		t.Fatalf("Expected keepalive ping, got ping=%v err=%v", ping, err)
+	}
+
+	data, ping, err := readStreamMessage(reader)
+	if err != nil || ping {
+		t.Fatalf("Expected message, got ping=%v err=%v", ping, err)
+	}
+	if !strings.HasSuffix(string(data), "\r\n\r\nhello") {
+		t.Errorf("Body not framed by Content-Length: %q", data)
+	}
+
+	// A single CRLF before a message is not a ping
+	data, ping, err = readStreamMessage(reader)
+	if err != nil || ping {
+		t.Fatalf("Expected message, got ping=%v err=%v", ping, err)
+	}
+	if !strings.HasPrefix(string(data), "SIP/2.0 200 OK") {
+		t.Errorf("Wrong message: %q", data)
+	}
+}
+
+func TestReadStreamMessageTooLarge(t *testing.T) {
+	stream := "MESSAGE sip:bob@example.com SIP/2.0\r\nContent-Length: 4000000000\r\n\r\nhello"
+	reader := bufio.NewReader(strings.NewReader(stream))
+	if data, _, err := readStreamMessage(reader); err == nil {
+		t.Fatalf("Oversized body accepted: %d bytes", len(data))
+	}
+}
+
+func TestReadStreamMessageLongLine(t *testing.T) {
+	stream := "MESSAGE sip:bob@example.com SIP/2.0\r\nSubject: " + strings.Repeat("a", 2*maxStreamLine) + "\r\n\r\n"
+	reader := bufio.NewReader(strings.NewReader(stream))
+	if data, _, err := readStreamMessage(reader); err == nil {
+		t.Fatalf("Oversized header line accepted: %d bytes", len(data))
+	}
+
+	// A line longer than the reader's buffer but within the limit is read whole
+	stream = "MESSAGE sip:bob@example.com SIP/2.0\r\nSubject: " + strings.Repeat("a", 6000) + "\r\nl: 0\r\n\r\n"
+	reader = bufio.NewReaderSize(strings.NewReader(stream), 16)
+	if data, _, err := readStreamMessage(reader); err != nil || !strings.Contains(string(data), "\r\nl: 0\r\n") {
+		t.Fatalf("Long header line not read: %v", err)
+	}
+
+	stream = "MESSAGE sip:bob@example.com SIP/2.0\r\n" + strings.Repeat("Subject: "+strings.Repeat("a", 1000)+"\r\n", 100)
+	reader = bufio.NewReader(strings.NewReader(stream))
+	if _, _, err := readStreamMessage(reader); err == nil || !strings.Contains(err.Error(), "headers exceed") {
+		t.Fatalf("Oversized headers accepted: %v", err)
+	}
+}
+
+func TestUDPKeepalive(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	clientAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	server.handleMessage(clientAddr, []byte("\r\n\r\n"))
+
+	if string(mockConn.GetSentData()) != "\r\n" {
+		t.Errorf("Expected CRLF pong, got %q", mockConn.GetSentData())
+	}
+}
+
+func TestOutboundUDPFlowExpiry(t *testing.T) {
+	server := setupTestServer(t)
+	clientAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	server.handleMessage(clientAddr, []byte(newOutboundRegister(outboundContact).String()))
+
+	sent := string(server.conn.(*MockConn).GetSentData())
+	if !strings.Contains(sent, "Require: outbound") {
+		t.Error("Response to outbound REGISTER lacks Require: outbound")
+	}
+	if !strings.Contains(sent, "Flow-Timer: 120") {
+		t.Error("Response to outbound REGISTER lacks Flow-Timer")
+	}
+	if binding, flow := server.outboundTarget("sip:bob@example.com"); binding == nil || flow == nil {
+		t.Fatal("Outbound binding not bound to a flow")
+	}
+
+	// Keepalives keep the flow alive
+	server.expireFlows(time.Now().Add(server.flowTimer))
+	if _, flow := server.outboundTarget("sip:bob@example.com"); flow == nil {
+		t.Fatal("Flow expired too early")
+	}
+
+	server.expireFlows(time.Now().Add(server.flowTimer + flowGracePeriod + time.Second))
+	if binding, _ := server.outboundTarget("sip:bob@example.com"); binding != nil {
+		t.Error("Binding of a dead flow was not removed")
+	}
+	if _, exists := server.registrar["sip:bob@example.com"]; exists {
+		t.Error("Registrar entry of a dead flow was not removed")
+	}
+}
+
+func TestOutboundTCPFlow(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go server.serveTCP(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+
+	// Keepalive ping is answered with a single CRLF
+	if _, err := conn.Write([]byte("\r\n\r\n")); err != nil {
+		t.Fatalf("Failed to send ping: %v", err)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("Failed to set deadline: %v", err)
+	}
+	pong := make([]byte, 2)
+	if _, err := reader.Read(pong); err != nil || string(pong) != "\r\n" {
+		t.Fatalf("Expected CRLF pong, got %q (%v)", pong, err)
+	}
+
+	// Register over the flow
+	if _, err := conn.Write([]byte(newOutboundRegister(outboundContact).String())); err != nil {
+		t.Fatalf("Failed to send REGISTER: %v", err)
+	}
+	resp := readTestMessage(t, conn, reader)
+	if resp.StatusCode() != 200 || resp.Headers["Require"] != "outbound" {
+		t.Fatalf("Unexpected REGISTER response: %s", resp.String())
+	}
+
+	// An INVITE for the user is routed over the registered flow
+	callerAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	server.handleInvite(callerAddr, newTestInvite("sip:bob@example.com", "outbound-call-1"))
+
+	invite := readTestMessage(t, conn, reader)
+	if invite.StartLine != "INVITE sip:bob@10.0.0.5:5070;transport=tcp;ob SIP/2.0" {
+		t.Errorf("Wrong forwarded start line: %s", invite.StartLine)
+	}
+	if !strings.HasPrefix(invite.Headers["Via"], "SIP/2.0/TCP ") {
+		t.Errorf("Server Via missing on forwarded INVITE: %s", invite.Headers["Via"])
+	}
+	if invite.Headers["Max-Forwards"] != "69" {
+		t.Errorf("Max-Forwards not decremented: %s", invite.Headers["Max-Forwards"])
+	}
+
+	// Responses over the flow are relayed back to the caller
+	ringing := NewResponse("180", "Ringing", invite)
+	if _, err := conn.Write([]byte(ringing.String())); err != nil {
+		t.Fatalf("Failed to send 180: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(mockConn.GetSentPackets()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	packets := mockConn.GetSentPackets()
+	if len(packets) < 2 {
+		t.Fatal("180 Ringing was not relayed to the caller")
+	}
+	relayed, err := ParseMessage(string(packets[1].Data))
+	if err != nil {
+		t.Fatalf("Failed to parse relayed response: %v", err)
+	}
+	if relayed.StatusCode() != 180 || relayed.Headers["Via"] != "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKinv1" {
+		t.Errorf("Wrong relayed response: %s", relayed.String())
+	}
+
+	// Closing the connection removes the binding
+	conn.Close()
+	deadline = time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if binding, _ := server.outboundTarget("sip:bob@example.com"); binding == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Binding was not removed after the flow failed")
+}
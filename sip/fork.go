@@ -0,0 +1,305 @@
+package sip
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// defaultRingTimeout is how long each target of a call rings before the
+// next one is tried
+const defaultRingTimeout = 20 * time.Second
+
+// callTarget is a URI a call rings, for timeout unless zero
+type callTarget struct {
+	uri     string
+	timeout time.Duration
+}
+
+// callStep is a set of targets that ring in parallel
+type callStep []callTarget
+
+// ring returns a step ringing a single target
+func ring(uri string, timeout time.Duration) callStep {
+	return callStep{{uri: uri, timeout: timeout}}
+}
+
+// ringingBranch is a branch of a call sequence that has not ended yet
+type ringingBranch struct {
+	uri   string      // target the branch rings
+	timer *time.Timer // ring timeout, nil for none
+}
+
+// callSequence rings the steps of a call one after another, forking the
+// call to every contact of the targets of a step. Its fields are guarded by
+// the server's mutex.
+type callSequence struct {
+	upstream net.Addr
+	invite   *Message
+	steps    []callStep                           // steps still to ring
+	busy     string                               // target after a busy response, "" for none
+	ringing  map[*proxyTransaction]*ringingBranch // branches of the current step
+	answered func(uri string)                     // called with the target that answered, may be nil
+	// cancelled is set once the caller cancelled the call; no step starts after
+	cancelled bool
+}
+
+// forkTarget is where one branch of a call is sent
+type forkTarget struct {
+	requestURI string
+	addr       net.Addr
+}
+
+// forkTargets returns where a call to uri is forked to: every registered
+// contact of a local user, one per instance, or the located target of any
+// other URI
+func (s *Server) forkTargets(uri string) ([]forkTarget, error) {
+	if parsed, err := ParseURI(uri); err == nil && s.isLocalDomain(parsed.Host) {
+		bindings := s.lookup(extractSIPURI(uri))
+		instances := make(map[string]bool)
+		var targets []forkTarget
+		// The most recent flow of an instance is used (RFC 5626 5.3)
+		for i := len(bindings) - 1; i >= 0; i-- {
+			binding := bindings[i]
+			if binding.InstanceID != "" {
+				if instances[binding.InstanceID] {
+					continue
+				}
+				instances[binding.InstanceID] = true
+			}
+			targets = append(targets, forkTarget{requestURI: contactURI(binding.Contact), addr: binding.Source})
+		}
+		if len(targets) > 0 {
+			return targets, nil
+		}
+	}
+
+	requestURI, addr, err := s.locate(uri)
+	if err != nil {
+		return nil, err
+	}
+	return []forkTarget{{requestURI: requestURI, addr: addr}}, nil
+}
+
+// startSequence rings the first step of a call sequence that can be
+// reached; calls that cannot reach any target are rejected with 480
+func (s *Server) startSequence(seq *callSequence) {
+	s.mu.Lock()
+	seq.ringing = make(map[*proxyTransaction]*ringingBranch)
+	s.mu.Unlock()
+
+	s.setCallState(seq.invite, "trying")
+	if !s.nextStep(seq) {
+		s.sequenceEnded(seq)
+	}
+}
+
+// sequenceEnded rejects a call none of whose targets answered, or that the
+// caller cancelled before any target rang
+func (s *Server) sequenceEnded(seq *callSequence) {
+	s.mu.Lock()
+	cancelled := seq.cancelled
+	s.mu.Unlock()
+
+	resp := NewResponse("480", "Temporarily Unavailable", seq.invite)
+	if cancelled {
+		resp = NewResponse("487", "Request Terminated", seq.invite)
+	}
+	s.setCallState(seq.invite, "")
+	if s.finalizeInvite(seq.invite) {
+		s.sendResponse(seq.upstream, resp)
+	}
+}
+
+// cancelSequence stops a call sequence the caller cancelled: ring timers
+// are stopped and no further step starts. It returns the branches ringing.
+func (s *Server) cancelSequence(seq *callSequence) []*proxyTransaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq.cancelled = true
+	seq.steps = nil
+	seq.busy = ""
+	var branches []*proxyTransaction
+	for branch, ringing := range seq.ringing {
+		if ringing.timer != nil {
+			ringing.timer.Stop()
+		}
+		branches = append(branches, branch)
+	}
+	return branches
+}
+
+// nextStep forks the call of a sequence to the targets of its next step
+// that can be located. It returns false when no step is left, or the caller
+// cancelled the call.
+func (s *Server) nextStep(seq *callSequence) bool {
+	for {
+		s.mu.Lock()
+		if len(seq.steps) == 0 || seq.cancelled {
+			s.mu.Unlock()
+			return false
+		}
+		step := seq.steps[0]
+		seq.steps = seq.steps[1:]
+		txn, ok := s.invites[serverTransactionKey(seq.invite)]
+		answered := ok && txn.final
+		s.mu.Unlock()
+		if answered {
+			return true // the caller cancelled meanwhile
+		}
+
+		var branches []*proxyTransaction
+		var rings []*ringingBranch
+		var timeouts []time.Duration
+		for _, target := range step {
+			forks, err := s.forkTargets(target.uri)
+			if err != nil {
+				log.Printf("skipping %s: %v", target.uri, err)
+				continue
+			}
+			for _, fork := range forks {
+				branches = append(branches, &proxyTransaction{
+					original:   seq.invite,
+					requestURI: fork.requestURI,
+					upstream:   seq.upstream,
+					target:     fork.addr,
+					sequence:   seq,
+				})
+				rings = append(rings, &ringingBranch{uri: target.uri})
+				timeouts = append(timeouts, target.timeout)
+			}
+		}
+		if len(branches) == 0 {
+			continue
+		}
+
+		// Every branch is ringing before a response can end the step
+		s.mu.Lock()
+		if seq.cancelled {
+			s.mu.Unlock()
+			return false
+		}
+		for i, branch := range branches {
+			if timeouts[i] > 0 {
+				branch := branch
+				rings[i].timer = time.AfterFunc(timeouts[i], func() {
+					s.ringTimedOut(seq, branch)
+				})
+			}
+			seq.ringing[branch] = rings[i]
+		}
+		s.mu.Unlock()
+
+		var failed []*proxyTransaction
+		for i, branch := range branches {
+			log.Printf("ringing %s for %s", rings[i].uri, seq.invite.RequestURI())
+			if err := s.forwardTransaction(branch); err != nil {
+				log.Printf("forwarding to %s failed: %v", rings[i].uri, err)
+				failed = append(failed, branch)
+			}
+		}
+		if len(failed) == len(branches) {
+			s.mu.Lock()
+			for _, branch := range failed {
+				if ringing, ok := seq.ringing[branch]; ok && ringing.timer != nil {
+					ringing.timer.Stop()
+				}
+				delete(seq.ringing, branch)
+			}
+			s.mu.Unlock()
+			continue
+		}
+		for _, branch := range failed {
+			if !s.sequenceResponse(branch, nil) {
+				s.sequenceEnded(seq)
+			}
+		}
+		return true
+	}
+}
+
+// ringTimedOut gives up a branch that was not answered in time. The last
+// branch of a step moves the call on to the next step, or ends it.
+func (s *Server) ringTimedOut(seq *callSequence, txn *proxyTransaction) {
+	s.mu.Lock()
+	_, ok := seq.ringing[txn]
+	if seq.cancelled {
+		// The branch ends with the 487 the caller gets
+		ok = false
+	}
+	if ok {
+		delete(seq.ringing, txn)
+	}
+	remaining := len(seq.ringing)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	// The next step starts before the branch is cancelled, so that its 487
+	// is not taken for the end of the call
+	if remaining == 0 && !s.nextStep(seq) {
+		s.sequenceEnded(seq)
+	}
+	s.cancelBranch(txn)
+}
+
+// sequenceResponse handles a final response to, or the timeout (nil) of,
+// a branch of a call sequence. An answer cancels the other branches. It
+// returns true when the response is consumed: it belongs to a branch given
+// up already, other branches still ring, or the call moved on to the next
+// step.
+func (s *Server) sequenceResponse(txn *proxyTransaction, resp *Message) bool {
+	seq := txn.sequence
+	s.mu.Lock()
+	branch, ok := seq.ringing[txn]
+	if !ok {
+		s.mu.Unlock()
+		return resp == nil || resp.StatusCode() >= 300
+	}
+	delete(seq.ringing, txn)
+	if branch.timer != nil {
+		branch.timer.Stop()
+	}
+
+	if resp != nil && resp.StatusCode() < 300 {
+		// Pending branches are cancelled once one answered (RFC 3261 16.7)
+		var others []*proxyTransaction
+		for other, ringing := range seq.ringing {
+			if ringing.timer != nil {
+				ringing.timer.Stop()
+			}
+			others = append(others, other)
+		}
+		seq.ringing = make(map[*proxyTransaction]*ringingBranch)
+		seq.steps = nil
+		answered := seq.answered
+		s.mu.Unlock()
+
+		for _, other := range others {
+			s.cancelBranch(other)
+		}
+		if answered != nil {
+			answered(branch.uri)
+		}
+		return false
+	}
+
+	if resp != nil && (resp.StatusCode() == 486 || resp.StatusCode() == 600) && seq.busy != "" {
+		seq.steps = []callStep{ring(seq.busy, 0)}
+		seq.busy = ""
+	}
+	remaining := len(seq.ringing)
+	cancelled := txn.cancelled
+	s.mu.Unlock()
+
+	// A call the caller cancelled ends with the 487 of its branch
+	if cancelled {
+		return false
+	}
+	if remaining > 0 {
+		return true
+	}
+	return s.nextStep(seq)
+}
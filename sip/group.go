@@ -0,0 +1,145 @@
+package sip
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+)
+
+// Strategies of a group: how calls to it ring its members
+const (
+	RingAll     = "ring-all"     // all members at once
+	Linear      = "linear"       // one after another in the configured order
+	RoundRobin  = "round-robin"  // one after another, starting after the member the last call started with
+	LeastRecent = "least-recent" // one after another, the member who answered longest ago first
+)
+
+// GroupMember is a member of a group
+type GroupMember struct {
+	URI     string        // AOR of a user, or any other URI
+	Timeout time.Duration // how long the member rings, the group's timeout when zero
+}
+
+// Group is an AOR, such as a support line, that rings a set of members
+type Group struct {
+	AOR      string
+	Strategy string // ring-all (default), linear, round-robin or least-recent
+	Members  []GroupMember
+	Timeout  time.Duration // how long each member rings, 20 seconds by default
+	Overflow string        // URI calls go to when no member answers, "" to reject them
+}
+
+// groupState is a group with the state its strategy keeps
+type groupState struct {
+	Group
+	next     int                  // member the next round-robin call starts with
+	answered map[string]time.Time // member URI -> last time the member answered
+}
+
+// AddGroup adds a group; calls to its AOR ring the members registered at
+// the time according to its strategy
+func (s *Server) AddGroup(group Group) error {
+	switch group.Strategy {
+	case "":
+		group.Strategy = RingAll
+	case RingAll, Linear, RoundRobin, LeastRecent:
+	default:
+		return fmt.Errorf("unknown group strategy %q", group.Strategy)
+	}
+	if len(group.Members) == 0 {
+		return fmt.Errorf("group %s has no members", group.AOR)
+	}
+	if group.Timeout <= 0 {
+		group.Timeout = defaultRingTimeout
+	}
+	uris := []string{group.AOR, group.Overflow}
+	for _, member := range group.Members {
+		if member.Timeout < 0 {
+			return fmt.Errorf("member %s of group %s: timeout must not be negative", member.URI, group.AOR)
+		}
+		uris = append(uris, member.URI)
+	}
+	for _, uri := range uris {
+		if uri == "" {
+			continue
+		}
+		if _, err := ParseURI(uri); err != nil {
+			return fmt.Errorf("group %s: %v", group.AOR, err)
+		}
+	}
+	aor := extractSIPURI(group.AOR)
+	if aor == "" {
+		return fmt.Errorf("invalid group AOR %s", group.AOR)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groups[aor] = &groupState{Group: group, answered: make(map[string]time.Time)}
+	return nil
+}
+
+// ringGroup handles an INVITE to a group by ringing its members. It returns
+// false when the Request-URI is not a group.
+func (s *Server) ringGroup(addr net.Addr, msg *Message) bool {
+	aor := extractSIPURI(msg.RequestURI())
+	s.mu.Lock()
+	state, ok := s.groups[aor]
+	if !ok {
+		s.mu.Unlock()
+		return false
+	}
+	members := state.order()
+	overflow := state.Overflow
+	s.mu.Unlock()
+
+	seq := &callSequence{
+		upstream: addr,
+		invite:   msg,
+		answered: func(uri string) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			state.answered[uri] = time.Now()
+		},
+	}
+	var targets []callTarget
+	for _, member := range members {
+		timeout := member.Timeout
+		if timeout == 0 {
+			timeout = state.Timeout
+		}
+		targets = append(targets, callTarget{uri: member.URI, timeout: timeout})
+	}
+	if state.Strategy == RingAll {
+		seq.steps = []callStep{targets}
+	} else {
+		for _, target := range targets {
+			seq.steps = append(seq.steps, callStep{target})
+		}
+	}
+	if overflow != "" {
+		seq.steps = append(seq.steps, ring(overflow, 0))
+	}
+
+	log.Printf("call to group %s rings %d members (%s)", aor, len(members), state.Strategy)
+	s.startSequence(seq)
+	return true
+}
+
+// order returns the members in the order a call rings them and advances
+// the round-robin position. The caller must hold s.mu.
+func (g *groupState) order() []GroupMember {
+	members := append([]GroupMember(nil), g.Members...)
+	switch g.Strategy {
+	case RoundRobin:
+		start := g.next % len(members)
+		members = append(members[start:], members[:start]...)
+		g.next = start + 1
+	case LeastRecent:
+		sort.SliceStable(members, func(i, j int) bool {
+			return g.answered[members[i].URI].Before(g.answered[members[j].URI])
+		})
+	}
+	return members
+}
@@ -0,0 +1,170 @@
+package sip
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAddGroup(t *testing.T) {
+	server := setupTestServer(t)
+	tests := []struct {
+		group Group
+		valid bool
+	}{
+		{Group{AOR: "sip:support@example.com", Members: []GroupMember{{URI: "sip:bob@example.com"}}}, true},
+		{Group{AOR: "sip:sales@example.com", Strategy: LeastRecent, Members: []GroupMember{{URI: "sip:bob@example.com"}}}, true},
+		{Group{AOR: "sip:support@example.com", Strategy: "random", Members: []GroupMember{{URI: "sip:bob@example.com"}}}, false},
+		{Group{AOR: "sip:support@example.com"}, false},
+		{Group{AOR: "sip:support@example.com", Members: []GroupMember{{URI: "bob"}}}, false},
+		{Group{AOR: "sip:support@example.com", Members: []GroupMember{{URI: "sip:bob@example.com", Timeout: -time.Second}}}, false},
+	}
+	for _, tt := range tests {
+		if err := server.AddGroup(tt.group); (err == nil) != tt.valid {
+			t.Errorf("AddGroup(%+v) = %v", tt.group, err)
+		}
+	}
+	if strategy := server.groups["sip:support@example.com"].Strategy; strategy != RingAll {
+		t.Errorf("Expected ring-all by default, got %s", strategy)
+	}
+}
+
+func TestGroupOrder(t *testing.T) {
+	members := []GroupMember{{URI: "sip:a@example.com"}, {URI: "sip:b@example.com"}, {URI: "sip:c@example.com"}}
+	uris := func(members []GroupMember) string {
+		var s string
+		for _, member := range members {
+			s += member.URI[4:5]
+		}
+		return s
+	}
+
+	group := &groupState{Group: Group{Strategy: RoundRobin, Members: members}, answered: make(map[string]time.Time)}
+	for _, want := range []string{"abc", "bca", "cab", "abc"} {
+		if got := uris(group.order()); got != want {
+			t.Errorf("Round-robin order %s, want %s", got, want)
+		}
+	}
+
+	group = &groupState{Group: Group{Strategy: LeastRecent, Members: members}, answered: make(map[string]time.Time)}
+	group.answered["sip:a@example.com"] = time.Now()
+	group.answered["sip:c@example.com"] = time.Now().Add(-time.Minute)
+	if got := uris(group.order()); got != "bca" {
+		t.Errorf("Least-recent order %s, want bca", got)
+	}
+}
+
+func TestRingAllGroup(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetDomains([]string{"example.com"})
+	mockConn := server.conn.(*MockConn)
+	aliceAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	bobAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.9"), Port: 5080}
+	carolAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.4"), Port: 5064}
+	registerFeatureUser(server, "bob", bobAddr)
+	registerFeatureUser(server, "carol", carolAddr)
+	server.AddGroup(Group{
+		AOR:      "sip:support@example.com",
+		Strategy: RingAll,
+		Members: []GroupMember{
+			{URI: "sip:bob@example.com"},
+			{URI: "sip:dave@example.com"},
+			{URI: "sip:carol@example.com"},
+		},
+	})
+
+	// Both registered members ring at once; dave is not registered
+	server.handleMessage(aliceAddr, []byte(newFeatureInvite("sip:support@example.com", "ring-all").String()))
+	toBob, toCarol := requestsTo(t, mockConn, bobAddr), requestsTo(t, mockConn, carolAddr)
+	if len(toBob) != 1 || len(toCarol) != 1 {
+		t.Fatalf("INVITE not forked to both members: %d, %d", len(toBob), len(toCarol))
+	}
+	server.handleMessage(bobAddr, []byte(NewResponse("180", "Ringing", toBob[0]).String()))
+	server.handleMessage(carolAddr, []byte(NewResponse("180", "Ringing", toCarol[0]).String()))
+
+	// Carol answering cancels bob's branch, whose 487 stays here
+	ok := NewResponse("200", "OK", toCarol[0])
+	ok.Headers["To"] += ";tag=carol"
+	server.handleMessage(carolAddr, []byte(ok.String()))
+	if resp := lastSent(t, mockConn); resp.StatusCode() != 200 || resp.Headers["Call-ID"] != "ring-all" {
+		t.Fatalf("Expected 200 relayed to the caller, got %s", resp.StartLine)
+	}
+	toBob = requestsTo(t, mockConn, bobAddr)
+	if len(toBob) != 2 || toBob[1].Method() != "CANCEL" {
+		t.Fatalf("Bob's branch not cancelled: %v", toBob)
+	}
+	server.handleMessage(bobAddr, []byte(NewResponse("487", "Request Terminated", toBob[0]).String()))
+	for _, resp := range sentTo(t, mockConn, aliceAddr) {
+		if resp.StatusCode() == 487 {
+			t.Error("487 of the cancelled branch relayed to the caller")
+		}
+	}
+	if answered := server.groups["sip:support@example.com"].answered; answered["sip:carol@example.com"].IsZero() {
+		t.Error("Answer of carol not recorded")
+	}
+}
+
+func TestGroupOverflow(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetDomains([]string{"example.com"})
+	mockConn := server.conn.(*MockConn)
+	aliceAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	bobAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.9"), Port: 5080}
+	carolAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.4"), Port: 5064}
+	voicemailAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.5"), Port: 5066}
+	registerFeatureUser(server, "bob", bobAddr)
+	registerFeatureUser(server, "carol", carolAddr)
+	registerFeatureUser(server, "voicemail", voicemailAddr)
+	server.AddGroup(Group{
+		AOR:      "sip:support@example.com",
+		Strategy: Linear,
+		Members: []GroupMember{
+			{URI: "sip:bob@example.com", Timeout: 500 * time.Millisecond},
+			{URI: "sip:carol@example.com"},
+		},
+		Timeout:  time.Second,
+		Overflow: "sip:voicemail@example.com",
+	})
+
+	server.handleMessage(aliceAddr, []byte(newFeatureInvite("sip:support@example.com", "linear").String()))
+	if len(requestsTo(t, mockConn, bobAddr)) != 1 || len(requestsTo(t, mockConn, carolAddr)) != 0 {
+		t.Fatal("Linear group did not ring bob alone first")
+	}
+
+	// Bob rings for his own timeout, carol for the group's, then the call
+	// overflows to voicemail
+	start := time.Now()
+	waitFor(t, "carol ringing", func() bool { return len(requestsTo(t, mockConn, carolAddr)) == 1 })
+	waitFor(t, "overflow", func() bool { return len(requestsTo(t, mockConn, voicemailAddr)) == 1 })
+	if elapsed := time.Since(start); elapsed < 1400*time.Millisecond {
+		t.Errorf("Overflow after %v, want the timeouts of both members", elapsed)
+	}
+	ok := NewResponse("200", "OK", requestsTo(t, mockConn, voicemailAddr)[0])
+	ok.Headers["To"] += ";tag=vm"
+	server.handleMessage(voicemailAddr, []byte(ok.String()))
+	if resp := lastSent(t, mockConn); resp.StatusCode() != 200 {
+		t.Errorf("Expected 200 relayed to the caller, got %s", resp.StartLine)
+	}
+
+	// Without an overflow, a group nobody can answer rejects the call
+	server.AddGroup(Group{AOR: "sip:sales@example.com", Members: []GroupMember{{URI: "sip:dave@example.com"}}})
+	server.handleMessage(aliceAddr, []byte(newFeatureInvite("sip:sales@example.com", "nobody").String()))
+	if resp := lastSent(t, mockConn); resp.StatusCode() != 480 {
+		t.Errorf("Expected 480, got %s", resp.StartLine)
+	}
+
+	// Round-robin calls start with the next member each time
+	server.AddGroup(Group{
+		AOR:      "sip:hotline@example.com",
+		Strategy: RoundRobin,
+		Members:  []GroupMember{{URI: "sip:bob@example.com"}, {URI: "sip:carol@example.com"}},
+	})
+	for i, addr := range []*net.UDPAddr{bobAddr, carolAddr} {
+		before := len(requestsTo(t, mockConn, addr))
+		server.handleMessage(aliceAddr, []byte(newFeatureInvite("sip:hotline@example.com", fmt.Sprintf("rr%d", i)).String()))
+		if sent := requestsTo(t, mockConn, addr); len(sent) != before+1 || sent[before].Headers["Call-ID"] != fmt.Sprintf("rr%d", i) {
+			t.Errorf("Round-robin call %d did not start with %s", i, addr)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package sip
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+// branchMagicCookie prefixes every RFC 3261 compliant Via branch
+const branchMagicCookie = "z9hG4bK"
+
+// splitHeaderValues splits a comma separated header value, ignoring commas
+// inside quoted strings and angle brackets
+func splitHeaderValues(value string) []string {
+	var values []string
+	inQuotes := false
+	inAngle := false
+	start := 0
+
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '"':
+			inQuotes = !inQuotes
+		case '<':
+			if !inQuotes {
+				inAngle = true
+			}
+		case '>':
+			if !inQuotes {
+				inAngle = false
+			}
+		case ',':
+			if !inQuotes && !inAngle {
+				if v := strings.TrimSpace(value[start:i]); v != "" {
+					values = append(values, v)
+				}
+				start = i + 1
+			}
+		}
+	}
+
+	if v := strings.TrimSpace(value[start:]); v != "" {
+		values = append(values, v)
+	}
+	return values
+}
+
+// topHeaderValue returns the first value of a comma separated header
+func topHeaderValue(value string) string {
+	values := splitHeaderValues(value)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// removeTopHeaderValue drops the first value of a comma separated header
+func removeTopHeaderValue(value string) string {
+	values := splitHeaderValues(value)
+	if len(values) <= 1 {
+		return ""
+	}
+	return strings.Join(values[1:], ", ")
+}
+
+// headerParams parses the parameters of a single header value. Parameters of
+// a name-addr (e.g. <sip:alice@host;ob>;expires=60) are those after the
+// closing angle bracket; otherwise everything after the first semicolon.
+// Parameter names are lower-cased and surrounding quotes are removed.
+func headerParams(value string) map[string]string {
+	params := make(map[string]string)
+
+	rest := value
+	angle := strings.Index(value, "<")
+	semicolon := strings.Index(value, ";")
+	if angle != -1 && (semicolon == -1 || angle < semicolon) {
+		if end := strings.Index(value[angle:], ">"); end != -1 {
+			rest = value[angle+end+1:]
+		}
+	}
+	semicolon = strings.Index(rest, ";")
+	if semicolon == -1 {
+		return params
+	}
+	rest = rest[semicolon+1:]
+
+	inQuotes := false
+	start := 0
+	for i := 0; i <= len(rest); i++ {
+		if i < len(rest) && rest[i] == '"' {
+			inQuotes = !inQuotes
+		}
+		if i < len(rest) && (rest[i] != ';' || inQuotes) {
+			continue
+		}
+
+		param := strings.TrimSpace(rest[start:i])
+		start = i + 1
+		if param == "" {
+			continue
+		}
+
+		name, val := param, ""
+		if eq := strings.Index(param, "="); eq != -1 {
+			name = strings.TrimSpace(param[:eq])
+			val = strings.Trim(strings.TrimSpace(param[eq+1:]), "\"")
+		}
+		params[strings.ToLower(name)] = val
+	}
+
+	return params
+}
+
+// headerParam returns a single parameter of a header value
+func headerParam(value, name string) (string, bool) {
+	val, ok := headerParams(value)[strings.ToLower(name)]
+	return val, ok
+}
+
+// randomToken returns a random hex string of n bytes
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// newBranch generates a unique Via branch parameter
+func newBranch() string {
+	return branchMagicCookie + randomToken(8)
+}
+
+// newTag generates a From/To tag
+func newTag() string {
+	return randomToken(4)
+}
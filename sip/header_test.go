@@ -0,0 +1,60 @@
+package sip
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitHeaderValues(t *testing.T) {
+	value := `"Doe, John" <sip:john@example.com>;q=0.5, <sip:john@10.0.0.1;ob>;expires=60`
+	values := splitHeaderValues(value)
+	if len(values) != 2 {
+		t.Fatalf("Expected 2 values, got %d: %v", len(values), values)
+	}
+	if values[0] != `"Doe, John" <sip:john@example.com>;q=0.5` {
+		t.Errorf("Wrong first value: %s", values[0])
+	}
+	if values[1] != "<sip:john@10.0.0.1;ob>;expires=60" {
+		t.Errorf("Wrong second value: %s", values[1])
+	}
+
+	if topHeaderValue(value) != values[0] {
+		t.Errorf("Wrong top value: %s", topHeaderValue(value))
+	}
+	if removeTopHeaderValue(value) != values[1] {
+		t.Errorf("Wrong remaining values: %s", removeTopHeaderValue(value))
+	}
+}
+
+func TestHeaderParams(t *testing.T) {
+	testCases := []struct {
+		value    string
+		name     string
+		expected string
+		found    bool
+	}{
+		{"SIP/2.0/UDP 127.0.0.1:5060;branch=z9hG4bK123;rport", "branch", "z9hG4bK123", true},
+		{"SIP/2.0/UDP 127.0.0.1:5060;branch=z9hG4bK123;rport", "rport", "", true},
+		{"<sip:alice@10.0.0.1;ob>;reg-id=1", "ob", "", false},
+		{"<sip:alice@10.0.0.1;ob>;reg-id=1", "reg-id", "1", true},
+		{`<sip:alice@10.0.0.1>;+sip.instance="<urn:uuid:1234>"`, "+sip.instance", "<urn:uuid:1234>", true},
+		{`sip:alice@10.0.0.1;+sip.instance="<urn:uuid:1234>";Expires=30`, "expires", "30", true},
+	}
+
+	for i, tc := range testCases {
+		value, found := headerParam(tc.value, tc.name)
+		if found != tc.found || value != tc.expected {
+			t.Errorf("Test case %d: expected (%q, %v), got (%q, %v)", i, tc.expected, tc.found, value, found)
+		}
+	}
+}
+
+func TestNewBranch(t *testing.T) {
+	branch := newBranch()
+	if !strings.HasPrefix(branch, branchMagicCookie) {
+		t.Errorf("Branch %s does not start with the magic cookie", branch)
+	}
+	if branch == newBranch() {
+		t.Error("Branches should be unique")
+	}
+}
@@ -0,0 +1,134 @@
+package sip
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SetMessageStore enables store-and-forward of messages for offline users
+func (s *Server) SetMessageStore(store *MessageStore) {
+	s.messages = store
+}
+
+// handleInstantMessage processes MESSAGE requests (RFC 3428). Messages for
+// registered users are proxied to their most recent contact; messages for
+// offline users are queued until they register again.
+func (s *Server) handleInstantMessage(addr net.Addr, msg *Message) {
+	if s.routeToUser(addr, msg) || s.rejectUnsupported(addr, msg) {
+		return
+	}
+
+	aor := extractSIPURI(msg.RequestURI())
+	if s.messages == nil {
+		s.sendResponse(addr, NewResponse("480", "Temporarily Unavailable", msg))
+		return
+	}
+
+	err := s.messages.Store(aor, StoredMessage{
+		ID:          msg.Headers["Call-ID"] + " " + msg.Headers["CSeq"],
+		From:        msg.Headers["From"],
+		To:          msg.Headers["To"],
+		ContentType: msg.Headers["Content-Type"],
+		Body:        msg.Body,
+	})
+	switch {
+	case errors.Is(err, ErrQuotaExceeded):
+		log.Printf("message queue of %s is full", aor)
+		s.sendResponse(addr, NewResponse("480", "Temporarily Unavailable", msg))
+	case err != nil:
+		log.Printf("message storing error: %v", err)
+		s.sendResponse(addr, NewResponse("500", "Server Internal Error", msg))
+	default:
+		log.Printf("message for offline user %s stored", aor)
+		s.sendResponse(addr, NewResponse("202", "Accepted", msg))
+	}
+}
+
+// deliverStoredMessages sends the messages queued for a user who has registered
+func (s *Server) deliverStoredMessages(aor string) {
+	if s.messages == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.delivering[aor] {
+		s.mu.Unlock()
+		return
+	}
+	s.delivering[aor] = true
+	s.mu.Unlock()
+
+	pending, err := s.messages.Pending(aor)
+	if err != nil {
+		log.Printf("message queue reading error: %v", err)
+	}
+	s.deliverNext(aor, pending)
+}
+
+// deliverNext sends the first pending message and continues with the rest
+// once it is accepted. Delivery stops at the first failure; the remaining
+// messages are retried at the next registration.
+func (s *Server) deliverNext(aor string, pending []StoredMessage) {
+	requestURI, target, ok := s.contactTarget(aor)
+	if len(pending) == 0 || !ok {
+		s.mu.Lock()
+		delete(s.delivering, aor)
+		s.mu.Unlock()
+		return
+	}
+
+	stored := pending[0]
+	req := s.newRequest("MESSAGE", requestURI, "", stored.To)
+	req.Headers["From"] = stored.From
+	req.Headers["Date"] = stored.Received.UTC().Format(time.RFC1123)
+	if stored.ContentType != "" {
+		req.Headers["Content-Type"] = stored.ContentType
+	}
+	req.Body = stored.Body
+	req.Headers["Content-Length"] = strconv.Itoa(len(stored.Body))
+
+	err := s.sendRequest(target, req, func(resp *Message) {
+		if resp != nil && resp.StatusCode() < 200 {
+			return
+		}
+		if resp == nil || resp.StatusCode() >= 300 {
+			log.Printf("stored message delivery to %s failed", aor)
+			s.deliverNext(aor, nil)
+			return
+		}
+		if err := s.messages.Remove(aor, stored.ID); err != nil {
+			log.Printf("message queue writing error: %v", err)
+		}
+		s.deliverNext(aor, pending[1:])
+	})
+	if err != nil {
+		log.Printf("stored message sending error: %v", err)
+		s.deliverNext(aor, nil)
+	}
+}
+
+// routeToUser proxies a request to the servers of another domain or to the
+// most recent contact of a registered user. It returns false, without
+// responding, when the request is for a local user who is not registered.
+func (s *Server) routeToUser(addr net.Addr, msg *Message) bool {
+	if uri, err := ParseURI(msg.RequestURI()); err == nil && !s.isLocalDomain(uri.Host) {
+		if err := s.forwardToURI(addr, msg, msg.RequestURI()); err != nil {
+			log.Printf("%s forwarding error: %v", msg.Method(), err)
+			s.sendResponse(addr, NewResponse("503", "Service Unavailable", msg))
+		}
+		return true
+	}
+
+	requestURI, target, ok := s.contactTarget(extractSIPURI(msg.RequestURI()))
+	if !ok {
+		return false
+	}
+	if err := s.forwardRequest(addr, msg, requestURI, target); err != nil {
+		log.Printf("%s forwarding error: %v", msg.Method(), err)
+		s.sendResponse(addr, NewResponse("503", "Service Unavailable", msg))
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package sip
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestMessage(requestURI, body string) *Message {
+	msg := NewMessage()
+	msg.StartLine = "MESSAGE " + requestURI + " SIP/2.0"
+	msg.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKmsg1"
+	msg.Headers["From"] = "<sip:alice@example.com>;tag=123"
+	msg.Headers["To"] = "<" + requestURI + ">"
+	msg.Headers["Call-ID"] = "message-test-1"
+	msg.Headers["CSeq"] = "1 MESSAGE"
+	msg.Headers["Max-Forwards"] = "70"
+	msg.Headers["Content-Type"] = "text/plain"
+	msg.Body = body
+	return msg
+}
+
+func TestMessageToRegisteredUser(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+
+	bobAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 5062}
+	register := newOutboundRegister("<sip:bob@127.0.0.2:5062>")
+	server.handleRegister(bobAddr, register)
+
+	aliceAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	server.handleInstantMessage(aliceAddr, newTestMessage("sip:bob@example.com", "hi"))
+
+	packets := mockConn.GetSentPackets()
+	last := packets[len(packets)-1]
+	if last.Addr.String() != bobAddr.String() {
+		t.Fatalf("MESSAGE sent to %s, want %s", last.Addr, bobAddr)
+	}
+	forwarded, err := ParseMessage(string(last.Data))
+	if err != nil {
+		t.Fatalf("Failed to parse forwarded message: %v", err)
+	}
+	if forwarded.RequestURI() != "sip:bob@127.0.0.2:5062" {
+		t.Errorf("Unexpected Request-URI: %s", forwarded.RequestURI())
+	}
+	if forwarded.Body != "hi" {
+		t.Errorf("Unexpected body: %q", forwarded.Body)
+	}
+}
+
+func TestMessageStoreAndForward(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	store, err := NewMessageStore(t.TempDir(), 10, time.Hour)
+	if err != nil {
+		t.Fatalf("NewMessageStore failed: %v", err)
+	}
+	server.SetMessageStore(store)
+
+	aliceAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	server.handleInstantMessage(aliceAddr, newTestMessage("sip:bob@example.com", "are you there?"))
+
+	msgs := sentMessages(t, mockConn)
+	if len(msgs) != 1 || msgs[0].StatusCode() != 202 {
+		t.Fatalf("Expected 202 Accepted for an offline user, got %v", msgs)
+	}
+
+	// Bob comes online and receives the stored message
+	bobAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 5062}
+	server.handleRegister(bobAddr, newOutboundRegister("<sip:bob@127.0.0.2:5062>"))
+
+	var delivered *Message
+	waitFor(t, "stored message delivery", func() bool {
+		for _, msg := range sentMessages(t, mockConn) {
+			if msg.Method() == "MESSAGE" {
+				delivered = msg
+				return true
+			}
+		}
+		return false
+	})
+	if delivered.Body != "are you there?" || delivered.Headers["From"] != "<sip:alice@example.com>;tag=123" {
+		t.Errorf("Unexpected delivered message: %s", delivered.String())
+	}
+
+	// The queue is emptied once bob accepts the message
+	resp := NewResponse("200", "OK", delivered)
+	server.handleMessage(bobAddr, []byte(resp.String()))
+	waitFor(t, "queue to empty", func() bool {
+		pending, err := store.Pending("sip:bob@example.com")
+		return err == nil && len(pending) == 0
+	})
+}
+
+func TestMessageToOfflineUserWithoutStore(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+
+	aliceAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	server.handleInstantMessage(aliceAddr, newTestMessage("sip:bob@example.com", "hi"))
+
+	msgs := sentMessages(t, mockConn)
+	if len(msgs) != 1 || msgs[0].StatusCode() != 480 {
+		t.Fatalf("Expected 480 Temporarily Unavailable, got %v", msgs)
+	}
+}
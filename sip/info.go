@@ -0,0 +1,264 @@
+package sip
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// dtmfRelayContentType is the common body type of DTMF sent in INFO
+	dtmfRelayContentType = "application/dtmf-relay"
+	// dtmfContentType carries a single DTMF digit as the whole body
+	dtmfContentType = "application/dtmf"
+)
+
+// InfoEvent is the application data of an INFO request received within a
+// call the server is a party of (RFC 6086)
+type InfoEvent struct {
+	CallID      string
+	Package     string // Info-Package, empty for legacy INFO
+	ContentType string
+	Body        string
+}
+
+// InfoHandler receives the INFO requests of an info package
+type InfoHandler func(InfoEvent)
+
+// DTMFEvent is a key press received in an INFO request within a call the
+// server is a party of
+type DTMFEvent struct {
+	CallID   string
+	Signal   string        // 0-9, *, #, A-D, or 16 for a hook flash
+	Duration time.Duration // zero when not given
+}
+
+// DTMFHandler receives the key presses reported in INFO requests
+type DTMFHandler func(DTMFEvent)
+
+// RegisterInfoPackage makes the server accept INFO requests of an info
+// package and pass them to handler. The package is listed in the Recv-Info
+// header of the server's answers to calls.
+func (s *Server) RegisterInfoPackage(name string, handler InfoHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.infoPackages[strings.ToLower(name)] = handler
+}
+
+// SetDTMFHandler installs the function that receives DTMF from INFO
+// requests with an application/dtmf-relay or application/dtmf body. It is
+// called on the goroutine handling the request, after the 200 OK is sent.
+func (s *Server) SetDTMFHandler(handler DTMFHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dtmfHandler = handler
+}
+
+// recvInfoHeader returns the Recv-Info value listing the info packages the
+// server accepts
+func (s *Server) recvInfoHeader() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.infoPackages))
+	for name := range s.infoPackages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// addRecvInfo advertises the server's info packages in a response to a
+// request that opens or modifies a call. Peers that use the framework of
+// RFC 6086 get the header even when the list is empty.
+func (s *Server) addRecvInfo(req, resp *Message) {
+	recvInfo := s.recvInfoHeader()
+	if _, ok := req.Headers["Recv-Info"]; ok || recvInfo != "" {
+		resp.Headers["Recv-Info"] = recvInfo
+	}
+}
+
+// parseRecvInfo returns the info packages listed in a Recv-Info header
+func parseRecvInfo(value string) []string {
+	var packages []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			packages = append(packages, name)
+		}
+	}
+	return packages
+}
+
+// updateRecvInfo records the info packages the peer of a dialog accepts
+// when a request or response within it lists them
+func (s *Server) updateRecvInfo(d *Dialog, msg *Message) {
+	value, ok := msg.Headers["Recv-Info"]
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d.recvInfo = parseRecvInfo(value)
+}
+
+// parseDTMF reads the key press of an application/dtmf-relay or
+// application/dtmf body
+func parseDTMF(contentType, body string) (string, time.Duration, error) {
+	var signal string
+	var duration time.Duration
+
+	if contentType == dtmfContentType {
+		signal = strings.TrimSpace(body)
+	} else {
+		for _, line := range strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n") {
+			parts := strings.SplitN(line, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			value := strings.TrimSpace(parts[1])
+			switch strings.ToLower(strings.TrimSpace(parts[0])) {
+			case "signal":
+				signal = value
+			case "duration":
+				ms, err := strconv.Atoi(value)
+				if err != nil || ms < 0 {
+					return "", 0, fmt.Errorf("invalid DTMF duration %q", value)
+				}
+				duration = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+
+	signal = strings.ToUpper(signal)
+	if signal != "16" && (len(signal) != 1 || !strings.Contains("0123456789*#ABCD", signal)) {
+		return "", 0, fmt.Errorf("invalid DTMF signal %q", signal)
+	}
+	return signal, duration, nil
+}
+
+// handleInfo processes INFO requests. INFO within a call the server is a
+// party of is checked against the server's info packages and passed to the
+// application; INFO within other calls is relayed toward the peer.
+func (s *Server) handleInfo(addr net.Addr, msg *Message) {
+	d := s.dialogSession(msg)
+	if d == nil {
+		if _, inDialog := headerParam(msg.Headers["To"], "tag"); inDialog && s.relayInDialog(addr, msg) {
+			return
+		}
+		// INFO is only allowed within a dialog (RFC 6086 4.2.1)
+		s.sendResponse(addr, NewResponse("481", "Call/Transaction Does Not Exist", msg))
+		return
+	}
+	if s.rejectUnsupported(addr, msg) {
+		return
+	}
+
+	pkg := strings.ToLower(strings.TrimSpace(msg.Headers["Info-Package"]))
+	contentType := strings.ToLower(strings.TrimSpace(strings.SplitN(msg.Headers["Content-Type"], ";", 2)[0]))
+
+	s.mu.Lock()
+	handler, known := s.infoPackages[pkg]
+	dtmfHandler := s.dtmfHandler
+	s.mu.Unlock()
+
+	if pkg != "" && !known {
+		resp := NewResponse("469", "Bad Info Package", msg)
+		resp.Headers["Recv-Info"] = s.recvInfoHeader()
+		s.sendResponse(addr, resp)
+		return
+	}
+
+	// Legacy INFO without a package is only understood for DTMF
+	isDTMF := contentType == dtmfRelayContentType || contentType == dtmfContentType
+	if pkg == "" && msg.Body != "" && !isDTMF {
+		resp := NewResponse("415", "Unsupported Media Type", msg)
+		resp.Headers["Accept"] = dtmfRelayContentType + ", " + dtmfContentType
+		s.sendResponse(addr, resp)
+		return
+	}
+
+	var dtmf *DTMFEvent
+	if isDTMF && msg.Body != "" {
+		signal, duration, err := parseDTMF(contentType, msg.Body)
+		if err != nil {
+			log.Printf("INFO of %s: %v", d.CallID, err)
+			s.sendResponse(addr, NewResponse("400", "Bad Request", msg))
+			return
+		}
+		dtmf = &DTMFEvent{CallID: d.CallID, Signal: signal, Duration: duration}
+	}
+
+	s.sendResponse(addr, NewResponse("200", "OK", msg))
+
+	if handler != nil {
+		handler(InfoEvent{
+			CallID:      d.CallID,
+			Package:     pkg,
+			ContentType: contentType,
+			Body:        msg.Body,
+		})
+	}
+	if dtmf != nil {
+		log.Printf("DTMF %s received in %s", dtmf.Signal, d.CallID)
+		if dtmfHandler != nil {
+			dtmfHandler(*dtmf)
+		}
+	}
+}
+
+// SendInfo sends an INFO request of an info package the peer accepts
+// within a call the server is a party of
+func (s *Server) SendInfo(callID, pkg, contentType, body string) error {
+	d := s.lookupSession(callID)
+	if d == nil {
+		return fmt.Errorf("no call %s", callID)
+	}
+
+	s.mu.Lock()
+	accepted := false
+	for _, name := range d.recvInfo {
+		accepted = accepted || strings.EqualFold(name, pkg)
+	}
+	s.mu.Unlock()
+	if !accepted {
+		return fmt.Errorf("peer of %s does not accept info package %s", callID, pkg)
+	}
+
+	req := s.newDialogRequest(d, "INFO")
+	req.Headers["Info-Package"] = pkg
+	req.Headers["Content-Type"] = contentType
+	req.Headers["Content-Disposition"] = "Info-Package"
+	req.Body = body
+	req.Headers["Content-Length"] = strconv.Itoa(len(body))
+
+	return s.sendRequest(d.target, req, func(resp *Message) {
+		if resp == nil {
+			log.Printf("INFO in %s timed out", callID)
+		} else if resp.StatusCode() >= 300 {
+			log.Printf("INFO in %s failed: %s", callID, resp.StartLine)
+		}
+	})
+}
+
+// relayInDialog passes on a request within a call the server is not a
+// party of: to the domain or registered user named by its Request-URI, or
+// to the registered contact it is addressed to
+func (s *Server) relayInDialog(addr net.Addr, msg *Message) bool {
+	if s.routeToUser(addr, msg) {
+		return true
+	}
+
+	target := s.contactSource(msg.RequestURI())
+	if target == nil {
+		return false
+	}
+	if err := s.forwardRequest(addr, msg, msg.RequestURI(), target); err != nil {
+		log.Printf("%s forwarding error: %v", msg.Method(), err)
+		s.sendResponse(addr, NewResponse("503", "Service Unavailable", msg))
+	}
+	return true
+}
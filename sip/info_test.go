@@ -0,0 +1,146 @@
+package sip
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestInfo builds an INFO from alice within an answered call
+func newTestInfo(ok *Message, cseq, pkg, contentType, body string) *Message {
+	msg := NewMessage()
+	msg.StartLine = "INFO sip:127.0.0.1:5060 SIP/2.0"
+	msg.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKinfo" + cseq
+	msg.Headers["From"] = "<sip:alice@example.com>;tag=123"
+	msg.Headers["To"] = ok.Headers["To"]
+	msg.Headers["Call-ID"] = ok.Headers["Call-ID"]
+	msg.Headers["CSeq"] = cseq + " INFO"
+	if pkg != "" {
+		msg.Headers["Info-Package"] = pkg
+	}
+	if contentType != "" {
+		msg.Headers["Content-Type"] = contentType
+	}
+	msg.Body = body
+	return msg
+}
+
+func TestInfoDTMF(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	var events []DTMFEvent
+	server.SetDTMFHandler(func(event DTMFEvent) {
+		events = append(events, event)
+	})
+	ok := answeredTestCall(t, server, addr, "dtmf-call")
+
+	server.handleInfo(addr, newTestInfo(ok, "2", "", "application/dtmf-relay", "Signal=5\r\nDuration=160\r\n"))
+	if code := lastSent(t, mockConn).StatusCode(); code != 200 {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	server.handleInfo(addr, newTestInfo(ok, "3", "", "application/dtmf", "#"))
+
+	want := []DTMFEvent{
+		{CallID: "dtmf-call", Signal: "5", Duration: 160 * time.Millisecond},
+		{CallID: "dtmf-call", Signal: "#"},
+	}
+	if len(events) != len(want) || events[0] != want[0] || events[1] != want[1] {
+		t.Errorf("Wrong DTMF events: %+v", events)
+	}
+
+	server.handleInfo(addr, newTestInfo(ok, "4", "", "application/dtmf-relay", "Signal=X\r\n"))
+	if code := lastSent(t, mockConn).StatusCode(); code != 400 {
+		t.Errorf("Expected 400 for an invalid signal, got %d", code)
+	}
+	server.handleInfo(addr, newTestInfo(ok, "5", "", "text/plain", "hello"))
+	if code := lastSent(t, mockConn).StatusCode(); code != 415 {
+		t.Errorf("Expected 415 for legacy INFO with another body, got %d", code)
+	}
+}
+
+func TestInfoPackages(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	var received []InfoEvent
+	server.RegisterInfoPackage("foo", func(event InfoEvent) {
+		received = append(received, event)
+	})
+
+	invite := newTestInvite("sip:bob@example.com", "info-call")
+	invite.Headers["Recv-Info"] = "bar"
+	server.handleInvite(addr, invite)
+	ok := lastSent(t, mockConn)
+	if ok.Headers["Recv-Info"] != "foo" {
+		t.Errorf("Wrong Recv-Info: %q", ok.Headers["Recv-Info"])
+	}
+
+	server.handleInfo(addr, newTestInfo(ok, "2", "foo", "application/foo", "data"))
+	if code := lastSent(t, mockConn).StatusCode(); code != 200 {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	if len(received) != 1 || received[0].Package != "foo" || received[0].Body != "data" {
+		t.Errorf("Wrong info events: %+v", received)
+	}
+
+	server.handleInfo(addr, newTestInfo(ok, "3", "baz", "application/baz", "data"))
+	resp := lastSent(t, mockConn)
+	if resp.StatusCode() != 469 || resp.Headers["Recv-Info"] != "foo" {
+		t.Errorf("Expected 469 with Recv-Info, got %s", resp.String())
+	}
+
+	// The server only sends packages the peer accepts
+	if err := server.SendInfo("info-call", "baz", "application/baz", "x"); err == nil {
+		t.Error("INFO of a package the peer does not accept was sent")
+	}
+	if err := server.SendInfo("info-call", "bar", "application/bar", "x"); err != nil {
+		t.Fatalf("SendInfo failed: %v", err)
+	}
+	info := lastSent(t, mockConn)
+	if info.Method() != "INFO" || info.Headers["Info-Package"] != "bar" || info.Headers["Content-Disposition"] != "Info-Package" {
+		t.Errorf("Wrong INFO: %s", info.String())
+	}
+}
+
+func TestInfoRelay(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	aliceAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	carolAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.4"), Port: 5064}
+
+	register := newOutboundRegister("<sip:carol@127.0.0.4:5064>")
+	register.Headers["From"] = "<sip:carol@example.com>;tag=777"
+	server.handleRegister(carolAddr, register)
+
+	// INFO within a call between alice and carol is relayed to carol's contact
+	info := NewMessage()
+	info.StartLine = "INFO sip:carol@127.0.0.4:5064 SIP/2.0"
+	info.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKrelay1"
+	info.Headers["From"] = "<sip:alice@example.com>;tag=123"
+	info.Headers["To"] = "<sip:carol@example.com>;tag=456"
+	info.Headers["Call-ID"] = "relayed-call"
+	info.Headers["CSeq"] = "2 INFO"
+	info.Headers["Content-Type"] = "application/dtmf-relay"
+	info.Body = "Signal=1\r\nDuration=100\r\n"
+	server.handleInfo(aliceAddr, info)
+
+	packets := mockConn.GetSentPackets()
+	last := packets[len(packets)-1]
+	relayed, err := ParseMessage(string(last.Data))
+	if err != nil {
+		t.Fatalf("Failed to parse relayed INFO: %v", err)
+	}
+	if relayed.Method() != "INFO" || last.Addr.String() != carolAddr.String() || relayed.Body != info.Body {
+		t.Errorf("INFO not relayed to carol: %s to %s", relayed.StartLine, last.Addr)
+	}
+
+	// INFO within an unknown call the server cannot route is refused
+	info.StartLine = "INFO sip:dave@127.0.0.9:5060 SIP/2.0"
+	server.handleInfo(aliceAddr, info)
+	if code := lastSent(t, mockConn).StatusCode(); code != 481 {
+		t.Errorf("Expected 481, got %d", code)
+	}
+}
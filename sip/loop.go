@@ -0,0 +1,115 @@
+package sip
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxForwards is the Max-Forwards of requests that arrive without one
+const defaultMaxForwards = 70
+
+// loopParam is the Via parameter carrying the loop hash of requests
+// forwarded statelessly, whose branch cannot include it
+const loopParam = "loop"
+
+// Errors for requests checkForwarding rejects
+var (
+	errTooManyHops        = errors.New("too many hops")
+	errLoopDetected       = errors.New("loop detected")
+	errInvalidMaxForwards = errors.New("invalid Max-Forwards")
+)
+
+// loopHash hashes everything that affects how the server routes a request:
+// its Request-URI, the fields identifying it, and its Route and proxy
+// headers. A request coming back with the same hash in the server's Via has
+// looped; one with a different hash is spiraling (RFC 3261 16.6 step 8).
+func loopHash(msg *Message) string {
+	toTag, _ := headerParam(msg.Headers["To"], "tag")
+	fromTag, _ := headerParam(msg.Headers["From"], "tag")
+	number := ""
+	if cseq := strings.Fields(msg.Headers["CSeq"]); len(cseq) > 0 {
+		number = cseq[0]
+	}
+	key := strings.Join([]string{
+		msg.RequestURI(), toTag, fromTag, msg.Headers["Call-ID"], number,
+		msg.Headers["Route"], msg.Headers["Proxy-Require"], msg.Headers["Proxy-Authorization"],
+	}, "|")
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// proxyBranch returns a new branch for a request the server forwards. It
+// starts with the loop hash of the request, followed by a unique part.
+func proxyBranch(msg *Message) string {
+	return branchMagicCookie + loopHash(msg) + "." + randomToken(4)
+}
+
+// looped reports whether a request carries a Via of the server with the
+// loop hash the request has now (RFC 3261 16.3 step 4)
+func (s *Server) looped(msg *Message) bool {
+	hash := loopHash(msg)
+	for _, via := range splitHeaderValues(msg.Headers["Via"]) {
+		fields := strings.Fields(via)
+		if len(fields) < 2 || strings.SplitN(fields[1], ";", 2)[0] != s.viaSentBy() {
+			continue
+		}
+		branch, _ := headerParam(via, "branch")
+		if strings.HasPrefix(branch, statelessBranchPrefix) {
+			if previous, _ := headerParam(via, loopParam); previous == hash {
+				return true
+			}
+			continue
+		}
+		branch = strings.TrimPrefix(branch, branchMagicCookie)
+		if previous, _, ok := strings.Cut(branch, "."); ok && previous == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// checkForwarding validates a request the server is about to forward
+// (RFC 3261 16.3). It returns the response rejecting it: 483 Too Many Hops
+// when its Max-Forwards ran out, 482 Loop Detected when it has been here
+// before unchanged, or nil when it may be forwarded.
+func (s *Server) checkForwarding(msg *Message) *Message {
+	if value, ok := msg.Headers["Max-Forwards"]; ok {
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || n < 0 {
+			return NewResponse("400", "Invalid Max-Forwards", msg)
+		}
+		if n == 0 {
+			return NewResponse("483", "Too Many Hops", msg)
+		}
+	}
+	if s.looped(msg) {
+		return NewResponse("482", "Loop Detected", msg)
+	}
+	return nil
+}
+
+// forwardingError returns the error for a rejection of checkForwarding
+func forwardingError(resp *Message) error {
+	switch resp.StatusCode() {
+	case 482:
+		return errLoopDetected
+	case 483:
+		return errTooManyHops
+	}
+	return errInvalidMaxForwards
+}
+
+// decrementMaxForwards sets the Max-Forwards of a forwarded request to one
+// less than that of the received request, adding it when absent
+func decrementMaxForwards(fwd, received *Message) {
+	n := defaultMaxForwards
+	if value, ok := received.Headers["Max-Forwards"]; ok {
+		if v, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && v > 0 {
+			n = v - 1
+		}
+	}
+	fwd.Headers["Max-Forwards"] = strconv.Itoa(n)
+}
@@ -0,0 +1,132 @@
+package sip
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestMaxForwards(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetDomains([]string{"example.com"})
+	mockConn := server.conn.(*MockConn)
+	aliceAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	bobAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.9"), Port: 5080}
+
+	tests := []struct {
+		maxForwards string
+		want        string
+	}{
+		{"5", "4"},
+		{"", "70"},
+	}
+	for _, tt := range tests {
+		msg := newTestMessage("sip:bob@127.0.0.9:5080", "hi")
+		if tt.maxForwards == "" {
+			delete(msg.Headers, "Max-Forwards")
+		} else {
+			msg.Headers["Max-Forwards"] = tt.maxForwards
+		}
+		server.handleMessage(aliceAddr, []byte(msg.String()))
+		forwarded := sentTo(t, mockConn, bobAddr)
+		if got := forwarded[len(forwarded)-1].Headers["Max-Forwards"]; got != tt.want {
+			t.Errorf("Max-Forwards %q forwarded as %q, want %q", tt.maxForwards, got, tt.want)
+		}
+	}
+
+	invite := newTestInvite("sip:bob@127.0.0.9:5080", "max-forwards")
+	invite.Headers["Max-Forwards"] = "0"
+	server.handleMessage(aliceAddr, []byte(invite.String()))
+	if code := lastSent(t, mockConn).StatusCode(); code != 483 {
+		t.Errorf("Expected 483, got %d", code)
+	}
+	if forwarded := sentTo(t, mockConn, bobAddr); len(forwarded) != 2 {
+		t.Errorf("INVITE without hops left was forwarded")
+	}
+
+	// Requests for the server itself are still answered
+	options := newTestMessage("sip:example.com", "")
+	options.StartLine = "OPTIONS sip:example.com SIP/2.0"
+	options.Headers["CSeq"] = "1 OPTIONS"
+	options.Headers["Max-Forwards"] = "0"
+	server.handleMessage(aliceAddr, []byte(options.String()))
+	if code := lastSent(t, mockConn).StatusCode(); code != 200 {
+		t.Errorf("Expected 200 to OPTIONS, got %d", code)
+	}
+}
+
+func TestLoopDetection(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetDomains([]string{"example.com"})
+	mockConn := server.conn.(*MockConn)
+	aliceAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	bobAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.9"), Port: 5080}
+
+	server.handleMessage(aliceAddr, []byte(newTestMessage("sip:bob@127.0.0.9:5080", "hi").String()))
+	forwarded := sentTo(t, mockConn, bobAddr)
+	if len(forwarded) != 1 {
+		t.Fatalf("Expected a forwarded MESSAGE, got %d", len(forwarded))
+	}
+
+	// The same request coming back unchanged has looped
+	server.handleMessage(bobAddr, []byte(forwarded[0].String()))
+	if resp := lastSent(t, mockConn); resp.StatusCode() != 482 {
+		t.Fatalf("Expected 482, got %s", resp.StartLine)
+	}
+
+	// Coming back retargeted it is spiraling and forwarded again
+	spiral := forwarded[0].Clone()
+	spiral.StartLine = "MESSAGE sip:carol@127.0.0.9:5080 SIP/2.0"
+	server.handleMessage(bobAddr, []byte(spiral.String()))
+	forwarded = sentTo(t, mockConn, bobAddr)
+	if last := forwarded[len(forwarded)-1]; last.RequestURI() != "sip:carol@127.0.0.9:5080" {
+		t.Errorf("Spiraling request not forwarded: %s", last.StartLine)
+	}
+}
+
+func TestStatelessLoopDetection(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetStateless(true)
+	mockConn := server.conn.(*MockConn)
+	aliceAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	target := &net.UDPAddr{IP: net.ParseIP("127.0.0.9"), Port: 5080}
+	server.SetRouter(func(req *Message) (string, net.Addr, error) {
+		return req.RequestURI(), target, nil
+	})
+
+	server.handleMessage(aliceAddr, []byte(newTestMessage("sip:bob@example.com", "hi").String()))
+	forwarded := sentTo(t, mockConn, target)
+	if len(forwarded) != 1 {
+		t.Fatalf("Expected a forwarded MESSAGE, got %d", len(forwarded))
+	}
+	server.handleMessage(target, []byte(forwarded[0].String()))
+	if resp := lastSent(t, mockConn); resp.StatusCode() != 482 {
+		t.Errorf("Expected 482, got %s", resp.StartLine)
+	}
+}
+
+func TestB2BUAMaxForwards(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetB2BUA(Bridge{})
+	mockConn := server.conn.(*MockConn)
+
+	register := newOutboundRegister("<sip:carol@127.0.0.4:5064>")
+	register.Headers["From"] = "<sip:carol@example.com>;tag=777"
+	server.handleRegister(b2buaCarolAddr, register)
+
+	for i, tc := range []struct {
+		maxForwards string
+		code        int
+	}{{"0", 483}, {" 0", 483}, {"00", 483}, {"-1", 400}, {"many", 400}} {
+		invite := newTestInvite("sip:carol@example.com", fmt.Sprintf("b2bua-hops%d", i))
+		invite.Headers["Via"] = fmt.Sprintf("SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKhops%d", i)
+		invite.Headers["Max-Forwards"] = tc.maxForwards
+		server.handleMessage(b2buaAliceAddr, []byte(invite.String()))
+		if code := lastSent(t, mockConn).StatusCode(); code != tc.code {
+			t.Errorf("Max-Forwards %q: expected %d, got %d", tc.maxForwards, tc.code, code)
+		}
+	}
+	if invites := sentRequests(t, mockConn, "INVITE"); len(invites) != 0 {
+		t.Errorf("Calls out of hops were bridged: %v", invites)
+	}
+}
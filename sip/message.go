@@ -2,6 +2,7 @@ package sip
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -61,6 +62,11 @@ func ParseMessage(data string) (*Message, error) {
 
 		headerName := strings.TrimSpace(parts[0])
 		headerValue := strings.TrimSpace(parts[1])
+
+		// Repeated headers (Via, Route, Contact...) are folded into one comma separated value
+		if existing, ok := msg.Headers[headerName]; ok {
+			headerValue = existing + ", " + headerValue
+		}
 		msg.Headers[headerName] = headerValue
 	}
 
@@ -72,6 +78,68 @@ func ParseMessage(data string) (*Message, error) {
 	return msg, nil
 }
 
+// IsResponse reports whether the message is a SIP response
+func (m *Message) IsResponse() bool {
+	return strings.HasPrefix(m.StartLine, "SIP/2.0 ")
+}
+
+// Method returns the request method, or an empty string for responses
+func (m *Message) Method() string {
+	if m.IsResponse() {
+		return ""
+	}
+	parts := strings.SplitN(m.StartLine, " ", 2)
+	return parts[0]
+}
+
+// RequestURI returns the Request-URI of a request
+func (m *Message) RequestURI() string {
+	parts := strings.Split(m.StartLine, " ")
+	if m.IsResponse() || len(parts) < 3 {
+		return ""
+	}
+	return parts[1]
+}
+
+// StatusCode returns the status code of a response, or 0 for requests
+func (m *Message) StatusCode() int {
+	if !m.IsResponse() {
+		return 0
+	}
+	parts := strings.SplitN(m.StartLine, " ", 3)
+	if len(parts) < 2 {
+		return 0
+	}
+	code, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0
+	}
+	return code
+}
+
+// Reason returns the reason phrase of a response, or an empty string for requests
+func (m *Message) Reason() string {
+	if !m.IsResponse() {
+		return ""
+	}
+	parts := strings.SplitN(m.StartLine, " ", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[2]
+}
+
+// Clone returns a deep copy of the message
+func (m *Message) Clone() *Message {
+	clone := NewMessage()
+	clone.StartLine = m.StartLine
+	for name, value := range m.Headers {
+		clone.Headers[name] = value
+	}
+	clone.Body = m.Body
+	return clone
+}
+
 // String converts the message to a string representation
 func (m *Message) String() string {
 	var sb strings.Builder
@@ -94,8 +162,9 @@ func NewResponse(statusCode string, statusText string, request *Message) *Messag
 	resp := NewMessage()
 	resp.StartLine = fmt.Sprintf("SIP/2.0 %s %s", statusCode, statusText)
 
-	// Copy headers from request
-	headersToCopy := []string{"Call-ID", "From", "To", "CSeq", "Via"}
+	// Copy headers from request; Record-Route is returned so that dialogs
+	// established by the response use it (RFC 3261 12.1.1)
+	headersToCopy := []string{"Call-ID", "From", "To", "CSeq", "Via", "Record-Route"}
 	for _, header := range headersToCopy {
 		if val, ok := request.Headers[header]; ok {
 			resp.Headers[header] = val
@@ -178,3 +178,59 @@ func TestNewResponse(t *testing.T) {
 		t.Error("Date header not set")
 	}
 }
+
+func TestParseRepeatedHeaders(t *testing.T) {
+	data := "SIP/2.0 180 Ringing\r\n" +
+		"Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bKaaa\r\n" +
+		"Via: SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bKbbb\r\n" +
+		"CSeq: 1 INVITE\r\n" +
+		"Content-Length: 0\r\n\r\n"
+
+	msg, err := ParseMessage(data)
+	if err != nil {
+		t.Fatalf("Failed to parse message: %v", err)
+	}
+
+	expected := "SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bKaaa, SIP/2.0/UDP 10.0.0.2:5060;branch=z9hG4bKbbb"
+	if msg.Headers["Via"] != expected {
+		t.Errorf("Wrong Via: %s", msg.Headers["Via"])
+	}
+}
+
+func TestMessageAccessors(t *testing.T) {
+	request := NewMessage()
+	request.StartLine = "INVITE sip:bob@example.com SIP/2.0"
+
+	if request.IsResponse() {
+		t.Error("Request reported as response")
+	}
+	if request.Method() != "INVITE" {
+		t.Errorf("Wrong method: %s", request.Method())
+	}
+	if request.RequestURI() != "sip:bob@example.com" {
+		t.Errorf("Wrong Request-URI: %s", request.RequestURI())
+	}
+	if request.StatusCode() != 0 {
+		t.Errorf("Request should not have a status code, got %d", request.StatusCode())
+	}
+
+	response := NewResponse("486", "Busy Here", request)
+	if !response.IsResponse() {
+		t.Error("Response not reported as response")
+	}
+	if response.Method() != "" {
+		t.Errorf("Response should not have a method, got %s", response.Method())
+	}
+	if response.StatusCode() != 486 {
+		t.Errorf("Wrong status code: %d", response.StatusCode())
+	}
+	if response.Reason() != "Busy Here" || request.Reason() != "" {
+		t.Errorf("Wrong reason phrases: %q, %q", response.Reason(), request.Reason())
+	}
+
+	clone := request.Clone()
+	clone.Headers["Call-ID"] = "changed"
+	if _, exists := request.Headers["Call-ID"]; exists {
+		t.Error("Clone shares headers with the original")
+	}
+}
@@ -0,0 +1,176 @@
+package sip
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// defaultMessageTTL is how long messages are kept when no TTL is configured
+const defaultMessageTTL = 7 * 24 * time.Hour
+
+// ErrQuotaExceeded is returned when a user has too many stored messages
+var ErrQuotaExceeded = errors.New("message quota exceeded")
+
+// StoredMessage is an instant message waiting for an offline user
+type StoredMessage struct {
+	ID          string    `json:"id"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	ContentType string    `json:"content_type"`
+	Body        string    `json:"body"`
+	Received    time.Time `json:"received"`
+	Expires     time.Time `json:"expires"`
+}
+
+// MessageStore is a file-backed queue of messages for offline users. Each
+// user's queue is kept in its own JSON file in the store directory.
+type MessageStore struct {
+	mu    sync.Mutex
+	dir   string
+	quota int           // maximum stored messages per user
+	ttl   time.Duration // how long a message is kept
+}
+
+// NewMessageStore creates a message store in dir. Messages are kept for
+// ttl, or 7 days when ttl is zero.
+func NewMessageStore(dir string, quota int, ttl time.Duration) (*MessageStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating message store: %v", err)
+	}
+	if ttl <= 0 {
+		ttl = defaultMessageTTL
+	}
+	return &MessageStore{dir: dir, quota: quota, ttl: ttl}, nil
+}
+
+// Store queues a message for a user. A message whose ID is already queued,
+// such as a retransmission, is ignored.
+func (m *MessageStore) Store(aor string, msg StoredMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	messages, err := m.load(aor)
+	if err != nil {
+		return err
+	}
+	messages = unexpired(messages, time.Now())
+	for _, queued := range messages {
+		if msg.ID != "" && queued.ID == msg.ID {
+			return nil
+		}
+	}
+	if m.quota > 0 && len(messages) >= m.quota {
+		return ErrQuotaExceeded
+	}
+
+	if msg.ID == "" {
+		msg.ID = randomToken(8)
+	}
+	if msg.Received.IsZero() {
+		msg.Received = time.Now()
+	}
+	if msg.Expires.IsZero() {
+		msg.Expires = msg.Received.Add(m.ttl)
+	}
+
+	return m.save(aor, append(messages, msg))
+}
+
+// Pending returns the unexpired messages queued for a user, oldest first
+func (m *MessageStore) Pending(aor string) ([]StoredMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	messages, err := m.load(aor)
+	if err != nil {
+		return nil, err
+	}
+	valid := unexpired(messages, time.Now())
+	if len(valid) != len(messages) {
+		if err := m.save(aor, valid); err != nil {
+			return nil, err
+		}
+	}
+	return valid, nil
+}
+
+// Remove deletes a delivered message
+func (m *MessageStore) Remove(aor, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	messages, err := m.load(aor)
+	if err != nil {
+		return err
+	}
+	kept := messages[:0]
+	for _, msg := range messages {
+		if msg.ID != id {
+			kept = append(kept, msg)
+		}
+	}
+	return m.save(aor, kept)
+}
+
+// path returns the queue file of a user
+func (m *MessageStore) path(aor string) string {
+	return filepath.Join(m.dir, url.PathEscape(aor)+".json")
+}
+
+// load reads a user's queue. The caller must hold m.mu.
+func (m *MessageStore) load(aor string) ([]StoredMessage, error) {
+	data, err := os.ReadFile(m.path(aor))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading message queue: %v", err)
+	}
+
+	var messages []StoredMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, fmt.Errorf("error parsing message queue: %v", err)
+	}
+	return messages, nil
+}
+
+// save writes a user's queue atomically. The caller must hold m.mu.
+func (m *MessageStore) save(aor string, messages []StoredMessage) error {
+	path := m.path(aor)
+	if len(messages) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing message queue: %v", err)
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(messages, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding message queue: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("error writing message queue: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("error writing message queue: %v", err)
+	}
+	return nil
+}
+
+// unexpired filters out messages past their expiry
+func unexpired(messages []StoredMessage, now time.Time) []StoredMessage {
+	var valid []StoredMessage
+	for _, msg := range messages {
+		if now.Before(msg.Expires) {
+			valid = append(valid, msg)
+		}
+	}
+	return valid
+}
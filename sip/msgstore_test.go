@@ -0,0 +1,89 @@
+package sip
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMessageStoreQuota(t *testing.T) {
+	store, err := NewMessageStore(t.TempDir(), 2, time.Hour)
+	if err != nil {
+		t.Fatalf("NewMessageStore failed: %v", err)
+	}
+
+	aor := "sip:bob@example.com"
+	for _, id := range []string{"a", "b"} {
+		if err := store.Store(aor, StoredMessage{ID: id, Body: id}); err != nil {
+			t.Fatalf("Store(%s) failed: %v", id, err)
+		}
+	}
+	// A retransmission does not count against the quota
+	if err := store.Store(aor, StoredMessage{ID: "b", Body: "b"}); err != nil {
+		t.Errorf("Storing a duplicate failed: %v", err)
+	}
+	if err := store.Store(aor, StoredMessage{ID: "c"}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+	}
+
+	if err := store.Remove(aor, "a"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	pending, err := store.Pending(aor)
+	if err != nil {
+		t.Fatalf("Pending failed: %v", err)
+	}
+	if len(pending) != 1 || pending[0].Body != "b" {
+		t.Errorf("Unexpected pending messages: %+v", pending)
+	}
+}
+
+func TestMessageStoreDefaultTTL(t *testing.T) {
+	store, err := NewMessageStore(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatalf("NewMessageStore failed: %v", err)
+	}
+
+	aor := "sip:bob@example.com"
+	received := time.Now()
+	if err := store.Store(aor, StoredMessage{ID: "a", Received: received}); err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	pending, err := store.Pending(aor)
+	if err != nil {
+		t.Fatalf("Pending failed: %v", err)
+	}
+	if len(pending) != 1 || !pending[0].Expires.Equal(received.Add(7*24*time.Hour)) {
+		t.Errorf("Expected the message kept for 7 days, got %+v", pending)
+	}
+}
+
+func TestMessageStoreExpiryAndPersistence(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewMessageStore(dir, 0, time.Hour)
+	if err != nil {
+		t.Fatalf("NewMessageStore failed: %v", err)
+	}
+
+	aor := "sip:bob@example.com"
+	expired := StoredMessage{ID: "old", Received: time.Now().Add(-2 * time.Hour)}
+	if err := store.Store(aor, expired); err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	if err := store.Store(aor, StoredMessage{ID: "new", Body: "hello"}); err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+
+	// A new store on the same directory sees the queued messages
+	reopened, err := NewMessageStore(dir, 0, time.Hour)
+	if err != nil {
+		t.Fatalf("NewMessageStore failed: %v", err)
+	}
+	pending, err := reopened.Pending(aor)
+	if err != nil {
+		t.Fatalf("Pending failed: %v", err)
+	}
+	if len(pending) != 1 || pending[0].ID != "new" {
+		t.Errorf("Expected only the unexpired message, got %+v", pending)
+	}
+}
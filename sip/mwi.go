@@ -0,0 +1,136 @@
+package sip
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+)
+
+// messageSummaryContentType is the body type of message-summary NOTIFYs (RFC 3842)
+const messageSummaryContentType = "application/simple-message-summary"
+
+// mailbox holds the voicemail counts of a user
+type mailbox struct {
+	New int `json:"new"`
+	Old int `json:"old"`
+}
+
+// messageSummaryPackage is the message-summary event package that drives
+// message-waiting lamps. Counts are set through the server's API.
+type messageSummaryPackage struct {
+	server      *Server
+	mu          sync.Mutex
+	mailboxes   map[string]mailbox // user -> voicemail counts
+	unsolicited bool               // also notify registered contacts without a subscription
+}
+
+// newMessageSummaryPackage creates the message-summary event package of a server
+func newMessageSummaryPackage(server *Server) *messageSummaryPackage {
+	return &messageSummaryPackage{
+		server:    server,
+		mailboxes: make(map[string]mailbox),
+	}
+}
+
+// Name implements EventPackage
+func (m *messageSummaryPackage) Name() string {
+	return "message-summary"
+}
+
+// ContentType implements EventPackage
+func (m *messageSummaryPackage) ContentType() string {
+	return messageSummaryContentType
+}
+
+// State implements EventPackage
+func (m *messageSummaryPackage) State(sub *Subscription) string {
+	return m.summary(sub.Resource)
+}
+
+// summary renders the message summary of a user
+func (m *messageSummaryPackage) summary(aor string) string {
+	m.mu.Lock()
+	box := m.mailboxes[aor]
+	m.mu.Unlock()
+
+	waiting := "no"
+	if box.New > 0 {
+		waiting = "yes"
+	}
+	return fmt.Sprintf("Messages-Waiting: %s\r\nMessage-Account: %s\r\nVoice-Message: %d/%d\r\n", waiting, aor, box.New, box.Old)
+}
+
+// SetMessageWaiting sets the voicemail counts of a user and notifies the
+// user's message-summary subscribers
+func (s *Server) SetMessageWaiting(aor string, newMessages, oldMessages int) {
+	s.mwi.mu.Lock()
+	changed := s.mwi.mailboxes[aor] != mailbox{New: newMessages, Old: oldMessages}
+	if newMessages == 0 && oldMessages == 0 {
+		delete(s.mwi.mailboxes, aor)
+	} else {
+		s.mwi.mailboxes[aor] = mailbox{New: newMessages, Old: oldMessages}
+	}
+	unsolicited := s.mwi.unsolicited
+	s.mwi.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	log.Printf("messages waiting for %s: %d new, %d old", aor, newMessages, oldMessages)
+	s.NotifySubscribers(s.mwi.Name(), aor)
+	if unsolicited {
+		s.mwi.notifyContacts(aor)
+	}
+}
+
+// MessageWaiting returns the voicemail counts of a user
+func (s *Server) MessageWaiting(aor string) (newMessages, oldMessages int) {
+	s.mwi.mu.Lock()
+	defer s.mwi.mu.Unlock()
+
+	box := s.mwi.mailboxes[aor]
+	return box.New, box.Old
+}
+
+// SetUnsolicitedMWI enables NOTIFYs to the registered contacts of users
+// whose counts change, for phones that do not subscribe to message-summary
+func (s *Server) SetUnsolicitedMWI(enabled bool) {
+	s.mwi.mu.Lock()
+	defer s.mwi.mu.Unlock()
+	s.mwi.unsolicited = enabled
+}
+
+// registered sends the current summary to a user who came online, if
+// unsolicited NOTIFYs are enabled and messages are waiting
+func (m *messageSummaryPackage) registered(aor string) {
+	m.mu.Lock()
+	_, waiting := m.mailboxes[aor]
+	send := m.unsolicited && waiting
+	m.mu.Unlock()
+
+	if send {
+		m.notifyContacts(aor)
+	}
+}
+
+// notifyContacts sends an out-of-dialog NOTIFY with the message summary to
+// every registered contact of a user
+func (m *messageSummaryPackage) notifyContacts(aor string) {
+	s := m.server
+	body := m.summary(aor)
+
+	for _, binding := range s.lookup(aor) {
+		req := s.newRequest("NOTIFY", contactURI(binding.Contact), "<"+aor+">", "<"+aor+">")
+		req.Headers["Event"] = m.Name()
+		req.Headers["Subscription-State"] = "active"
+		req.Headers["Contact"] = s.contactHeader()
+		req.Headers["Content-Type"] = messageSummaryContentType
+		req.Body = body
+		req.Headers["Content-Length"] = strconv.Itoa(len(body))
+
+		if err := s.sendRequest(binding.Source, req, nil); err != nil {
+			log.Printf("unsolicited NOTIFY sending error: %v", err)
+		}
+	}
+}
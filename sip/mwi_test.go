@@ -0,0 +1,60 @@
+package sip
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestMessageSummarySubscription(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	server.handleSubscribe(addr, newTestSubscribe("message-summary", "600"))
+	notify := lastSent(t, mockConn)
+	if notify.Headers["Content-Type"] != "application/simple-message-summary" || !strings.Contains(notify.Body, "Messages-Waiting: no") {
+		t.Fatalf("Unexpected initial summary: %s", notify.String())
+	}
+
+	server.SetMessageWaiting("sip:bob@example.com", 2, 8)
+	notify = lastSent(t, mockConn)
+	if !strings.Contains(notify.Body, "Messages-Waiting: yes") || !strings.Contains(notify.Body, "Voice-Message: 2/8") {
+		t.Errorf("Unexpected summary after update: %s", notify.Body)
+	}
+
+	// Setting the same counts again does not notify
+	before := len(sentMessages(t, mockConn))
+	server.SetMessageWaiting("sip:bob@example.com", 2, 8)
+	if len(sentMessages(t, mockConn)) != before {
+		t.Error("Unchanged counts were notified")
+	}
+	if n, o := server.MessageWaiting("sip:bob@example.com"); n != 2 || o != 8 {
+		t.Errorf("MessageWaiting = %d/%d, want 2/8", n, o)
+	}
+}
+
+func TestUnsolicitedMessageSummary(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	server.SetUnsolicitedMWI(true)
+	server.SetMessageWaiting("sip:bob@example.com", 1, 0)
+
+	// Registering delivers the waiting summary to the new contact
+	bobAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 5062}
+	server.handleRegister(bobAddr, newOutboundRegister("<sip:bob@127.0.0.2:5062>"))
+
+	notify := lastSent(t, mockConn)
+	if notify.Method() != "NOTIFY" || notify.RequestURI() != "sip:bob@127.0.0.2:5062" {
+		t.Fatalf("Expected an unsolicited NOTIFY to the contact, got %s", notify.StartLine)
+	}
+	if notify.Headers["Event"] != "message-summary" || !strings.Contains(notify.Body, "Voice-Message: 1/0") {
+		t.Errorf("Unexpected unsolicited NOTIFY: %s", notify.String())
+	}
+
+	// Count changes are pushed as well
+	server.SetMessageWaiting("sip:bob@example.com", 0, 1)
+	if body := lastSent(t, mockConn).Body; !strings.Contains(body, "Messages-Waiting: no") {
+		t.Errorf("Expected a cleared summary, got %s", body)
+	}
+}
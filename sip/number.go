@@ -0,0 +1,156 @@
+package sip
+
+import (
+	"context"
+	"log"
+	"strings"
+)
+
+// NumberingPlan describes how users of a domain dial telephone numbers, so
+// that the numbers can be normalized to E.164
+type NumberingPlan struct {
+	CountryCode         string // country calling code without "+", such as "49"
+	AreaCode            string // area code without the national prefix, such as "30"
+	NationalPrefix      string // trunk prefix of national numbers, "0" by default
+	InternationalPrefix string // prefix of international numbers, "00" by default
+	LocalLength         int    // length of local numbers dialed without the area code, 0 when not allowed
+}
+
+// visualSeparators are removed from dialed numbers (RFC 3966)
+var visualSeparators = strings.NewReplacer("-", "", ".", "", "(", "", ")", "", " ", "")
+
+// Normalize converts a dialed number to E.164 ("+" and digits). ok is false
+// when number is not a telephone number of the plan, such as an extension
+// or a name, and must be left as it is.
+func (p NumberingPlan) Normalize(number string) (string, bool) {
+	nationalPrefix, internationalPrefix := p.NationalPrefix, p.InternationalPrefix
+	if nationalPrefix == "" {
+		nationalPrefix = "0"
+	}
+	if internationalPrefix == "" {
+		internationalPrefix = "00"
+	}
+
+	number = visualSeparators.Replace(number)
+	if rest, ok := strings.CutPrefix(number, "+"); ok {
+		if !isDigits(rest) {
+			return "", false
+		}
+		return number, true
+	}
+	if !isDigits(number) {
+		return "", false
+	}
+
+	switch {
+	case strings.HasPrefix(number, internationalPrefix):
+		number = strings.TrimPrefix(number, internationalPrefix)
+	case strings.HasPrefix(number, nationalPrefix) && p.CountryCode != "":
+		number = p.CountryCode + strings.TrimPrefix(number, nationalPrefix)
+	case p.LocalLength > 0 && len(number) == p.LocalLength && p.CountryCode != "" && p.AreaCode != "":
+		number = p.CountryCode + p.AreaCode + number
+	default:
+		return "", false
+	}
+	if number == "" {
+		return "", false
+	}
+	return "+" + number, true
+}
+
+// isDigits reports whether s is a non-empty string of decimal digits
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// SetNumberingPlan sets the numbering plan of the users of a domain. The
+// plan of the empty domain applies to local domains without one of their own.
+func (s *Server) SetNumberingPlan(domain string, plan NumberingPlan) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.numbering[strings.ToLower(domain)] = plan
+}
+
+// NumberingPlanFor returns the numbering plan numbers dialed to a domain are
+// normalized under: the plan of the domain, or for local domains the plan of
+// the empty domain
+func (s *Server) NumberingPlanFor(domain string) (NumberingPlan, bool) {
+	local := s.isLocalDomain(domain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	plan, ok := s.numbering[strings.ToLower(domain)]
+	if !ok && local {
+		plan, ok = s.numbering[""]
+	}
+	return plan, ok
+}
+
+// normalizeNumber rewrites the Request-URI user of a request outside of a
+// dialog to E.164 under the numbering plan of its domain, then retargets
+// E.164 numbers that are not registered users to the URI found through
+// ENUM. It returns the request to route, a rewritten copy when changed.
+func (s *Server) normalizeNumber(msg *Message) *Message {
+	switch msg.Method() {
+	case "REGISTER", "ACK", "CANCEL":
+		return msg
+	}
+	if _, inDialog := headerParam(msg.Headers["To"], "tag"); inDialog {
+		return msg
+	}
+	uri, err := ParseURI(msg.RequestURI())
+	if err != nil || uri.User == "" {
+		return msg
+	}
+
+	local := s.isLocalDomain(uri.Host)
+	plan, ok := s.NumberingPlanFor(uri.Host)
+	s.mu.Lock()
+	enum := s.enum
+	s.mu.Unlock()
+
+	number := uri.User
+	if ok {
+		if e164, valid := plan.Normalize(number); valid {
+			number = e164
+		}
+	}
+	if number != uri.User {
+		log.Printf("normalized %s to %s", uri.User, number)
+		uri.User = number
+		msg = msg.Clone()
+		msg.StartLine = msg.Method() + " " + uri.String() + " SIP/2.0"
+	}
+
+	// Numbers of local users are not looked up
+	if enum == nil || !local || !strings.HasPrefix(number, "+") {
+		return msg
+	}
+	s.mu.Lock()
+	registered := s.registered(extractSIPURI(msg.RequestURI()))
+	s.mu.Unlock()
+	if registered {
+		return msg
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), enumTimeout)
+	defer cancel()
+	target, err := enum.Lookup(ctx, number)
+	if err != nil {
+		log.Printf("ENUM lookup for %s: %v", number, err)
+		return msg
+	}
+	if target == "" {
+		return msg
+	}
+	log.Printf("ENUM: %s -> %s", number, target)
+	msg = msg.Clone()
+	msg.StartLine = msg.Method() + " " + target + " SIP/2.0"
+	return msg
+}
@@ -0,0 +1,73 @@
+package sip
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	plan := NumberingPlan{CountryCode: "49", AreaCode: "30", LocalLength: 7}
+	us := NumberingPlan{CountryCode: "1", NationalPrefix: "1", InternationalPrefix: "011"}
+
+	tests := []struct {
+		plan   NumberingPlan
+		number string
+		want   string
+		ok     bool
+	}{
+		{plan, "+49301234567", "+49301234567", true},
+		{plan, "0049301234567", "+49301234567", true},
+		{plan, "0301234567", "+49301234567", true},
+		{plan, "030 123-45(67)", "+49301234567", true},
+		{plan, "1234567", "+49301234567", true},
+		{plan, "100", "", false},
+		{plan, "alice", "", false},
+		{plan, "+49abc", "", false},
+		{plan, "00", "", false},
+		{us, "12125551234", "+12125551234", true},
+		{us, "011442071234567", "+442071234567", true},
+		{us, "5551234", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := tt.plan.Normalize(tt.number)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Normalize(%q) = %q, %v; want %q, %v", tt.number, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNormalizeRequestURI(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetDomains([]string{"example.com", "example.net"})
+	server.SetNumberingPlan("", NumberingPlan{CountryCode: "49", AreaCode: "30", LocalLength: 7})
+	server.SetNumberingPlan("example.net", NumberingPlan{CountryCode: "44"})
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	bobAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.9"), Port: 5080}
+
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"sip:0301234567@example.com;user=phone", "sip:+49301234567@example.com;user=phone"},
+		{"sip:02071234567@example.net", "sip:+442071234567@example.net"},
+		{"sip:0301234567@example.org", "sip:0301234567@example.org"},
+		{"sip:100@example.com", "sip:100@example.com"},
+	}
+	for _, tt := range tests {
+		msg := newTestInvite(tt.uri, "normalize")
+		if got := server.normalizeNumber(msg).RequestURI(); got != tt.want {
+			t.Errorf("%s normalized to %s, want %s", tt.uri, got, tt.want)
+		}
+	}
+
+	// Users registered under their E.164 number are reached by local dialing
+	register := newOutboundRegister("<sip:+49301234567@127.0.0.9:5080>")
+	register.Headers["From"] = "<sip:+49301234567@example.com>;tag=1"
+	server.handleRegister(bobAddr, register)
+	server.handleMessage(addr, []byte(newTestMessage("sip:1234567@example.com", "hi").String()))
+	forwarded := sentTo(t, mockConn, bobAddr)
+	if last := forwarded[len(forwarded)-1]; last.Method() != "MESSAGE" || last.RequestURI() != "sip:+49301234567@127.0.0.9:5080" {
+		t.Errorf("MESSAGE not delivered to the E.164 user: %s", last.String())
+	}
+}
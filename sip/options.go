@@ -0,0 +1,158 @@
+package sip
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultPingInterval is used for peers configured without an interval
+const defaultPingInterval = 30 * time.Second
+
+// Peer is a remote SIP element monitored with OPTIONS pings
+type Peer struct {
+	Name     string
+	URI      string
+	Interval time.Duration
+}
+
+// peerState is the monitoring state of a peer
+type peerState struct {
+	Peer
+	up bool
+}
+
+// handleOptions answers OPTIONS requests with the server's capabilities
+func (s *Server) handleOptions(addr net.Addr, msg *Message) {
+	resp := NewResponse("200", "OK", msg)
+	resp.Headers["Allow"] = s.allowHeader()
+	resp.Headers["Accept"] = strings.Join(s.contentTypes, ", ")
+	resp.Headers["Accept-Encoding"] = "identity"
+	resp.Headers["Accept-Language"] = "en"
+	if len(s.extensions) > 0 {
+		resp.Headers["Supported"] = s.supportedHeader()
+	}
+	if events := s.allowEventsHeader(); events != "" {
+		resp.Headers["Allow-Events"] = events
+	}
+	s.sendResponse(addr, resp)
+}
+
+// allowHeader lists the methods the server has handlers for
+func (s *Server) allowHeader() string {
+	methods := make([]string, 0, len(s.handlers))
+	for method := range s.handlers {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+// supportedHeader lists the option tags the server supports
+func (s *Server) supportedHeader() string {
+	tags := append([]string(nil), s.extensions...)
+	sort.Strings(tags)
+	return strings.Join(tags, ", ")
+}
+
+// AddPeer registers a peer to monitor with OPTIONS pings once the server
+// starts. Peers are considered up until a ping fails; a trunk of the same
+// name is skipped while its peer is down.
+func (s *Server) AddPeer(peer Peer) {
+	if peer.Interval <= 0 {
+		peer.Interval = defaultPingInterval
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers[peer.Name] = &peerState{Peer: peer, up: true}
+}
+
+// PeerUp reports whether the named peer answered its last OPTIONS ping
+func (s *Server) PeerUp(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.peers[name]
+	return ok && state.up
+}
+
+// peerDown reports whether a monitored peer of the given name is down. The
+// server's mutex must be held.
+func (s *Server) peerDown(name string) bool {
+	state, ok := s.peers[name]
+	return ok && !state.up
+}
+
+// startPingers starts monitoring every configured peer
+func (s *Server) startPingers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, state := range s.peers {
+		go s.runPinger(state.Name, state.Interval)
+	}
+}
+
+// runPinger pings a peer at its interval
+func (s *Server) runPinger(name string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.pingPeer(name)
+		<-ticker.C
+	}
+}
+
+// pingPeer sends one OPTIONS request to a peer and records the outcome
+func (s *Server) pingPeer(name string) {
+	s.mu.Lock()
+	state, ok := s.peers[name]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	targets, err := s.resolver.Resolve(context.Background(), state.URI)
+	if err != nil || len(targets) == 0 {
+		log.Printf("cannot resolve peer %s: %v", name, err)
+		s.setPeerUp(name, false)
+		return
+	}
+
+	req := s.newRequest("OPTIONS", state.URI, "<sip:ping@"+s.viaSentBy()+">", "<"+state.URI+">")
+	err = s.sendRequest(targets[0].Addr(), req, func(resp *Message) {
+		if resp != nil && resp.StatusCode() < 200 {
+			return
+		}
+		// Any final response shows the peer is alive, unless it reports overload
+		s.setPeerUp(name, resp != nil && resp.StatusCode() != 503 && resp.StatusCode() != 408)
+	})
+	if err != nil {
+		log.Printf("OPTIONS to peer %s failed: %v", name, err)
+		s.setPeerUp(name, false)
+	}
+}
+
+// setPeerUp records the state of a peer and logs changes
+func (s *Server) setPeerUp(name string, up bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.peers[name]
+	if !ok {
+		return
+	}
+	if state.up != up {
+		if up {
+			log.Printf("peer %s is up", name)
+		} else {
+			log.Printf("peer %s is down", name)
+		}
+	}
+	state.up = up
+}
@@ -0,0 +1,117 @@
+package sip
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleOptions(t *testing.T) {
+	server := setupTestServer(t)
+	clientAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	options := NewMessage()
+	options.StartLine = "OPTIONS sip:example.com SIP/2.0"
+	options.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKopt1"
+	options.Headers["From"] = "<sip:monitor@example.com>;tag=1"
+	options.Headers["To"] = "<sip:example.com>"
+	options.Headers["Call-ID"] = "options-test-1"
+	options.Headers["CSeq"] = "1 OPTIONS"
+	options.Headers["Content-Length"] = "0"
+
+	server.handleMessage(clientAddr, []byte(options.String()))
+
+	resp, err := ParseMessage(string(server.conn.(*MockConn).GetSentData()))
+	if err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if resp.StatusCode() != 200 {
+		t.Fatalf("Expected 200 OK, got %s", resp.StartLine)
+	}
+	if resp.Headers["Allow"] != "ACK, BYE, CANCEL, INFO, INVITE, MESSAGE, OPTIONS, PRACK, PUBLISH, REFER, REGISTER, SUBSCRIBE, UPDATE" {
+		t.Errorf("Wrong Allow: %s", resp.Headers["Allow"])
+	}
+	if resp.Headers["Supported"] != "100rel, outbound, replaces, timer" {
+		t.Errorf("Wrong Supported: %s", resp.Headers["Supported"])
+	}
+	if resp.Headers["Accept"] != "application/sdp, text/plain, application/dtmf-relay, application/dtmf, application/pidf+xml" {
+		t.Errorf("Wrong Accept: %s", resp.Headers["Accept"])
+	}
+	if resp.Headers["Accept-Encoding"] == "" {
+		t.Error("Accept-Encoding missing")
+	}
+
+	// Capabilities follow what is registered
+	server.registerMethod("FOO", func(addr net.Addr, msg *Message) {})
+	server.registerExtension("foo")
+	if !strings.Contains(server.allowHeader(), "FOO") {
+		t.Error("Registered method missing from Allow")
+	}
+	if server.supportedHeader() != "100rel, foo, outbound, replaces, timer" {
+		t.Errorf("Wrong Supported: %s", server.supportedHeader())
+	}
+}
+
+func TestUnknownMethod(t *testing.T) {
+	server := setupTestServer(t)
+	clientAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	request := newTestInvite("sip:bob@example.com", "unknown-method-1")
+	request.StartLine = "FROBNICATE sip:bob@example.com SIP/2.0"
+	request.Headers["CSeq"] = "1 FROBNICATE"
+	server.handleMessage(clientAddr, []byte(request.String()))
+
+	resp, err := ParseMessage(string(server.conn.(*MockConn).GetSentData()))
+	if err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if resp.StatusCode() != 405 || resp.Headers["Allow"] == "" {
+		t.Errorf("Expected 405 with Allow, got %s", resp.String())
+	}
+}
+
+func TestPeerPinger(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	server.transactionTimeout = 50 * time.Millisecond
+	server.AddPeer(Peer{Name: "carrier", URI: "sip:192.0.2.9:5070"})
+
+	if !server.PeerUp("carrier") {
+		t.Error("Peers should start up")
+	}
+	if server.PeerUp("unknown") {
+		t.Error("Unknown peer reported up")
+	}
+
+	// No answer marks the peer down
+	server.pingPeer("carrier")
+	packets := mockConn.GetSentPackets()
+	if len(packets) != 1 || packets[0].Addr.String() != "192.0.2.9:5070" {
+		t.Fatalf("OPTIONS not sent to the peer: %v", packets)
+	}
+	ping, err := ParseMessage(string(packets[0].Data))
+	if err != nil || ping.Method() != "OPTIONS" {
+		t.Fatalf("Expected OPTIONS, got %v %v", ping, err)
+	}
+	waitFor(t, "peer down", func() bool { return !server.PeerUp("carrier") })
+
+	// Any final response brings it back up
+	server.pingPeer("carrier")
+	ping, err = ParseMessage(string(mockConn.GetSentData()))
+	if err != nil {
+		t.Fatalf("Failed to parse OPTIONS: %v", err)
+	}
+	server.handleResponse(packets[0].Addr, NewResponse("404", "Not Found", ping))
+	if !server.PeerUp("carrier") {
+		t.Error("Peer answering OPTIONS should be up")
+	}
+
+	// 503 means the peer is unavailable
+	server.pingPeer("carrier")
+	ping, _ = ParseMessage(string(mockConn.GetSentData()))
+	server.handleResponse(packets[0].Addr, NewResponse("503", "Service Unavailable", ping))
+	if server.PeerUp("carrier") {
+		t.Error("Peer answering 503 should be down")
+	}
+}
@@ -0,0 +1,197 @@
+package sip
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reliableProvisional is a provisional response sent reliably and waiting
+// for its PRACK (RFC 3262)
+type reliableProvisional struct {
+	resp     *Message
+	addr     net.Addr
+	invite   string // server transaction key of the INVITE
+	interval time.Duration
+	deadline time.Time
+	timer    *time.Timer
+	result   chan error // receives nil on PRACK, an error otherwise
+	// acked is set by the first PRACK, done once the result was delivered
+	acked bool
+	done  bool
+}
+
+// errNotAcknowledged is returned when a reliable provisional response got
+// no PRACK in time
+var errNotAcknowledged = errors.New("provisional response was not acknowledged")
+
+// hasOptionTag reports whether a Supported or Require style header lists an option tag
+func hasOptionTag(value, tag string) bool {
+	for _, option := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(option), tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// unsupportedExtensions returns the option tags of a Require or
+// Proxy-Require header value that the server does not support
+func (s *Server) unsupportedExtensions(value string) []string {
+	var unsupported []string
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !hasOptionTag(strings.Join(s.extensions, ","), tag) {
+			unsupported = append(unsupported, tag)
+		}
+	}
+	return unsupported
+}
+
+// rejectUnsupported answers 420 to a request the server handles as UAS when
+// its Require header names extensions the server lacks (RFC 3261 8.2.2.3).
+// Proxied requests are not checked, as Require concerns the UAS only. It
+// reports whether the request was rejected.
+func (s *Server) rejectUnsupported(addr net.Addr, msg *Message) bool {
+	if method := msg.Method(); method == "ACK" || method == "CANCEL" {
+		return false
+	}
+	unsupported := s.unsupportedExtensions(msg.Headers["Require"])
+	if len(unsupported) == 0 {
+		return false
+	}
+	resp := NewResponse("420", "Bad Extension", msg)
+	resp.Headers["Unsupported"] = strings.Join(unsupported, ", ")
+	if msg.Method() == "INVITE" {
+		s.setCallState(msg, "")
+		if s.finalizeInvite(msg) {
+			s.sendResponse(addr, resp)
+		}
+		return true
+	}
+	s.sendResponse(addr, resp)
+	return true
+}
+
+// wantsReliable reports whether provisional responses to a request should be sent reliably
+func wantsReliable(msg *Message) bool {
+	return hasOptionTag(msg.Headers["Require"], "100rel") || hasOptionTag(msg.Headers["Supported"], "100rel")
+}
+
+// reliableKey identifies a reliable provisional response the way the RAck
+// header of its PRACK names it
+func reliableKey(callID, rseq, cseq string) string {
+	return callID + " " + rseq + " " + cseq
+}
+
+// sendReliable sends a provisional response reliably and waits until it is
+// acknowledged with PRACK. It retransmits the response with exponential
+// backoff and gives up after the transaction timeout, returning
+// errNotAcknowledged, or once the INVITE got a final response, returning
+// errCallCancelled.
+func (s *Server) sendReliable(addr net.Addr, resp *Message) error {
+	rseq := strconv.Itoa(rand.Intn(1<<31-1) + 1)
+	resp.Headers["Require"] = "100rel"
+	resp.Headers["RSeq"] = rseq
+
+	key := reliableKey(resp.Headers["Call-ID"], rseq, resp.Headers["CSeq"])
+	p := &reliableProvisional{
+		resp:     resp,
+		addr:     addr,
+		invite:   serverTransactionKey(resp),
+		interval: timerT1,
+		deadline: time.Now().Add(s.transactionTimeout),
+		result:   make(chan error, 1),
+	}
+
+	s.mu.Lock()
+	s.reliable[key] = p
+	p.timer = time.AfterFunc(p.interval, func() {
+		s.retransmitReliable(key)
+	})
+	s.mu.Unlock()
+
+	s.sendResponse(addr, resp)
+	return <-p.result
+}
+
+// retransmitReliable resends a reliable provisional response that has not
+// been acknowledged yet
+func (s *Server) retransmitReliable(key string) {
+	s.mu.Lock()
+	p, ok := s.reliable[key]
+	if !ok || p.done {
+		s.mu.Unlock()
+		return
+	}
+	if time.Now().After(p.deadline) {
+		p.done = true
+		s.mu.Unlock()
+		log.Printf("no PRACK for %s", p.resp.StartLine)
+		p.result <- errNotAcknowledged
+		return
+	}
+	p.interval *= 2
+	p.timer = time.AfterFunc(p.interval, func() {
+		s.retransmitReliable(key)
+	})
+	s.mu.Unlock()
+
+	s.sendResponse(p.addr, p.resp)
+}
+
+// handlePrack processes PRACK requests acknowledging reliable provisional responses
+func (s *Server) handlePrack(addr net.Addr, msg *Message) {
+	rack := strings.Fields(msg.Headers["RAck"])
+	if len(rack) != 3 {
+		s.sendResponse(addr, NewResponse("400", "Bad Request", msg))
+		return
+	}
+	key := reliableKey(msg.Headers["Call-ID"], rack[0], rack[1]+" "+rack[2])
+
+	// Retransmitted PRACKs are answered again until the INVITE transaction ends
+	s.mu.Lock()
+	p, ok := s.reliable[key]
+	first := ok && !p.done
+	if first {
+		p.acked = true
+		p.done = true
+		p.timer.Stop()
+	}
+	s.mu.Unlock()
+
+	if !ok || !p.acked {
+		s.sendResponse(addr, NewResponse("481", "Call/Transaction Does Not Exist", msg))
+		return
+	}
+	s.sendResponse(addr, NewResponse("200", "OK", msg))
+	if first {
+		p.result <- nil
+	}
+}
+
+// endReliable stops the retransmission of the reliable provisional
+// responses to an INVITE once it got its final response, and forgets them
+// when the transaction ends. The server's mutex must be held.
+func (s *Server) endReliable(invite string) {
+	for key, p := range s.reliable {
+		if p.invite != invite {
+			continue
+		}
+		if !p.done {
+			p.done = true
+			p.timer.Stop()
+			p.result <- errCallCancelled
+		}
+		key := key
+		time.AfterFunc(s.transactionTimeout, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			delete(s.reliable, key)
+		})
+	}
+}
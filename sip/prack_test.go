@@ -0,0 +1,183 @@
+package sip
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReliableProvisional(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	invite := newTestInvite("sip:bob@example.com", "prack-call")
+	invite.Headers["Supported"] = "100rel"
+	done := make(chan struct{})
+	go func() {
+		server.handleInvite(addr, invite)
+		close(done)
+	}()
+
+	// The 180 is retransmitted until it is acknowledged
+	var ringing []*Message
+	waitFor(t, "180 retransmission", func() bool {
+		ringing = nil
+		for _, msg := range sentMessages(t, mockConn) {
+			if msg.StatusCode() == 180 {
+				ringing = append(ringing, msg)
+			}
+		}
+		return len(ringing) >= 2
+	})
+	if ringing[0].Headers["Require"] != "100rel" || ringing[0].Headers["RSeq"] == "" {
+		t.Fatalf("180 is not reliable: %s", ringing[0].String())
+	}
+	if code := lastSent(t, mockConn).StatusCode(); code == 200 {
+		t.Fatal("Call was answered before the PRACK")
+	}
+
+	prack := NewMessage()
+	prack.StartLine = "PRACK sip:127.0.0.1:5060 SIP/2.0"
+	prack.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKprack1"
+	prack.Headers["From"] = invite.Headers["From"]
+	prack.Headers["To"] = ringing[0].Headers["To"]
+	prack.Headers["Call-ID"] = "prack-call"
+	prack.Headers["CSeq"] = "2 PRACK"
+	prack.Headers["RAck"] = ringing[0].Headers["RSeq"] + " 1 INVITE"
+	server.handleMessage(addr, []byte(prack.String()))
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("INVITE was not answered after the PRACK")
+	}
+
+	var prackOK, inviteOK bool
+	for _, msg := range sentMessages(t, mockConn) {
+		if msg.StatusCode() == 200 && msg.Headers["CSeq"] == "2 PRACK" {
+			prackOK = true
+		}
+		if msg.StatusCode() == 200 && msg.Headers["CSeq"] == "1 INVITE" {
+			inviteOK = true
+		}
+	}
+	if !prackOK || !inviteOK {
+		t.Errorf("Expected 200 OK to PRACK (%v) and INVITE (%v)", prackOK, inviteOK)
+	}
+
+	// A retransmitted PRACK is answered again, a PRACK for nothing sent is rejected
+	server.handleMessage(addr, []byte(prack.String()))
+	if resp := lastSent(t, mockConn); resp.StatusCode() != 200 || resp.Headers["CSeq"] != "2 PRACK" {
+		t.Errorf("Expected 200 for a retransmitted PRACK, got %s", resp.StartLine)
+	}
+	prack.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKprack2"
+	prack.Headers["CSeq"] = "3 PRACK"
+	prack.Headers["RAck"] = "1 1 INVITE"
+	server.handleMessage(addr, []byte(prack.String()))
+	if code := lastSent(t, mockConn).StatusCode(); code != 481 {
+		t.Errorf("Expected 481 for an unknown RSeq, got %d", code)
+	}
+}
+
+func TestReliableProvisionalCancelled(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	invite := newTestInvite("sip:bob@example.com", "prack-cancel")
+	invite.Headers["Supported"] = "100rel"
+	done := make(chan struct{})
+	go func() {
+		server.handleInvite(addr, invite)
+		close(done)
+	}()
+	ringing := func() int {
+		n := 0
+		for _, msg := range sentMessages(t, mockConn) {
+			if msg.StatusCode() == 180 {
+				n++
+			}
+		}
+		return n
+	}
+	waitFor(t, "180", func() bool { return ringing() > 0 })
+
+	// The CANCEL ends the INVITE, which stops the 180 and returns from Ring
+	server.handleCancel(addr, newTestCancel(invite))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Ring still waits for a PRACK after the CANCEL")
+	}
+	sent := ringing()
+	time.Sleep(3 * timerT1)
+	if ringing() != sent {
+		t.Error("180 retransmitted after the CANCEL")
+	}
+	for _, msg := range sentMessages(t, mockConn) {
+		if code := msg.StatusCode(); code == 504 || code == 200 && msg.Headers["CSeq"] == "1 INVITE" {
+			t.Errorf("Unexpected final response after the CANCEL: %s", msg.StartLine)
+		}
+	}
+}
+
+func TestReliableProvisionalTimeout(t *testing.T) {
+	server := setupTestServer(t)
+	server.transactionTimeout = 100 * time.Millisecond
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	invite := newTestInvite("sip:bob@example.com", "prack-timeout")
+	invite.Headers["Require"] = "100rel"
+	server.handleInvite(addr, invite)
+
+	if code := lastSent(t, mockConn).StatusCode(); code != 504 {
+		t.Errorf("Expected 504 without PRACK, got %d", code)
+	}
+	if _, exists := server.calls["prack-timeout"]; exists {
+		t.Error("Call is still tracked")
+	}
+}
+
+func TestUnsupportedRequire(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	invite := newTestInvite("sip:bob@example.com", "require-call")
+	invite.Headers["Require"] = "100rel, foo"
+	server.handleMessage(addr, []byte(invite.String()))
+
+	resp := lastSent(t, mockConn)
+	if resp.StatusCode() != 420 || resp.Headers["Unsupported"] != "foo" {
+		t.Errorf("Expected 420 with Unsupported: foo, got %s", resp.String())
+	}
+}
+
+func TestProxiedRequire(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetDomains([]string{"example.com"})
+	mockConn := server.conn.(*MockConn)
+	aliceAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	bobAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.9"), Port: 5080}
+	registerFeatureUser(server, "bob", bobAddr)
+	server.AddGroup(Group{AOR: "sip:support@example.com", Members: []GroupMember{{URI: "sip:bob@example.com"}}})
+
+	// Require concerns the UAS; a proxy passes it on (RFC 3261 16.3)
+	invite := newFeatureInvite("sip:support@example.com", "require-proxied")
+	invite.Headers["Require"] = "foo"
+	server.handleMessage(aliceAddr, []byte(invite.String()))
+	forwarded := requestsTo(t, mockConn, bobAddr)
+	if len(forwarded) != 1 || forwarded[0].Headers["Require"] != "foo" {
+		t.Fatalf("INVITE with Require not forwarded: %v", forwarded)
+	}
+
+	// Proxy-Require still needs the extension at the server
+	invite = newFeatureInvite("sip:support@example.com", "proxy-require")
+	invite.Headers["Proxy-Require"] = "foo"
+	server.handleMessage(aliceAddr, []byte(invite.String()))
+	if resp := lastSent(t, mockConn); resp.StatusCode() != 420 || resp.Headers["Unsupported"] != "foo" {
+		t.Errorf("Expected 420, got %s", resp.StartLine)
+	}
+}
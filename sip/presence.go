@@ -0,0 +1,333 @@
+package sip
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// pidfContentType is the body type of presence documents (RFC 3863)
+	pidfContentType = "application/pidf+xml"
+	// defaultPublicationExpires is used when a PUBLISH has no Expires header;
+	// longer requested durations are shortened to it
+	defaultPublicationExpires = 3600
+	// minPublicationExpires is the shortest publication the server accepts
+	minPublicationExpires = 60
+)
+
+// pidfDocument is the root element of a PIDF document. Its content is kept
+// as raw XML, so that extensions such as RPID (RFC 4480) survive.
+type pidfDocument struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"` // namespace declarations and entity
+	Inner   string     `xml:",innerxml"`
+}
+
+// publication is presence state published by one device (RFC 3903)
+type publication struct {
+	etag  string
+	body  string       // document as published
+	doc   pidfDocument // parsed body, for composing with other publications
+	timer *time.Timer
+}
+
+// presenceAgent is the presence event package. It keeps the state published
+// for each user and falls back to registrations for users who publish nothing.
+type presenceAgent struct {
+	server       *Server
+	mu           sync.Mutex
+	publications map[string]map[string]*publication // user -> entity tag -> publication
+}
+
+// newPresenceAgent creates the presence event package of a server
+func newPresenceAgent(server *Server) *presenceAgent {
+	return &presenceAgent{
+		server:       server,
+		publications: make(map[string]map[string]*publication),
+	}
+}
+
+// Name implements EventPackage
+func (p *presenceAgent) Name() string {
+	return "presence"
+}
+
+// ContentType implements EventPackage
+func (p *presenceAgent) ContentType() string {
+	return pidfContentType
+}
+
+// State implements EventPackage. A single publication is passed on as
+// published; those of several devices are composed into one document. A
+// user who publishes nothing is open while registered. Unregistered users
+// are reported closed.
+func (p *presenceAgent) State(sub *Subscription) string {
+	bindings := p.server.lookup(sub.Resource)
+	p.server.mu.Lock()
+	registered := p.server.registered(sub.Resource)
+	p.server.mu.Unlock()
+
+	var bodies []string
+	var docs []pidfDocument
+	if registered {
+		p.mu.Lock()
+		for _, pub := range p.publications[sub.Resource] {
+			bodies = append(bodies, pub.body)
+			docs = append(docs, pub.doc)
+		}
+		p.mu.Unlock()
+	}
+	switch {
+	case len(bodies) == 1:
+		return bodies[0]
+	case len(bodies) > 1:
+		return composePIDF(sub.Resource, docs)
+	}
+
+	status := "closed"
+	contact := ""
+	if registered {
+		status = "open"
+		if len(bindings) > 0 {
+			contact = "<contact>" + xmlEscape(contactURI(bindings[len(bindings)-1].Contact)) + "</contact>"
+		}
+	}
+	return "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n" +
+		"<presence xmlns=\"urn:ietf:params:xml:ns:pidf\" entity=\"" + xmlEscape(sub.Resource) + "\">\n" +
+		fmt.Sprintf("  <tuple id=\"reg\"><status><basic>%s</basic></status>%s</tuple>", status, contact) +
+		"\n</presence>\n"
+}
+
+// composePIDF combines the documents published by several devices into one
+// (RFC 3903 section 6). The content of each document is copied verbatim,
+// except for ids already used by another document; the namespaces they
+// declare are declared on the new root, the first declaration of a prefix
+// winning.
+func composePIDF(entity string, docs []pidfDocument) string {
+	var sb strings.Builder
+	sb.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<presence xmlns=\"urn:ietf:params:xml:ns:pidf\"")
+	declared := make(map[string]bool)
+	for _, doc := range docs {
+		for _, attr := range doc.Attrs {
+			if attr.Name.Space != "xmlns" || declared[attr.Name.Local] {
+				continue
+			}
+			declared[attr.Name.Local] = true
+			fmt.Fprintf(&sb, " xmlns:%s=\"%s\"", attr.Name.Local, xmlEscape(attr.Value))
+		}
+	}
+	fmt.Fprintf(&sb, " entity=\"%s\">", xmlEscape(entity))
+	used := make(map[string]bool)
+	for _, doc := range docs {
+		sb.WriteString(uniqueIDs(doc.Inner, used))
+	}
+	sb.WriteString("</presence>\n")
+	return sb.String()
+}
+
+// idAttr matches the id attribute in the start tag of an element
+var idAttr = regexp.MustCompile(`(\sid\s*=\s*)("[^"]*"|'[^']*')`)
+
+// uniqueIDs renames the id attributes of the elements of PIDF content, such
+// as tuples and persons, that are in used already, and adds the ids it
+// keeps to used
+func uniqueIDs(inner string, used map[string]bool) string {
+	var sb strings.Builder
+	dec := xml.NewDecoder(strings.NewReader(inner))
+	copied, depth := 0, 0
+	for {
+		start := int(dec.InputOffset())
+		tok, err := dec.RawToken()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth > 1 {
+				continue
+			}
+			for _, attr := range t.Attr {
+				if attr.Name.Space != "" || attr.Name.Local != "id" {
+					continue
+				}
+				id := attr.Value
+				for n := 2; used[id]; n++ {
+					id = fmt.Sprintf("%s-%d", attr.Value, n)
+				}
+				used[id] = true
+				end := int(dec.InputOffset())
+				if loc := idAttr.FindStringSubmatchIndex(inner[start:end]); id != attr.Value && loc != nil {
+					sb.WriteString(inner[copied : start+loc[4]])
+					sb.WriteString(`"` + xmlEscape(id) + `"`)
+					copied = start + loc[5]
+				}
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+	sb.WriteString(inner[copied:])
+	return sb.String()
+}
+
+// handlePublish processes PUBLISH requests of the presence event package.
+// Initial publications carry a PIDF body; refreshes, modifications and
+// removals name the publication with SIP-If-Match.
+func (p *presenceAgent) handlePublish(addr net.Addr, msg *Message) {
+	s := p.server
+
+	if uri, err := ParseURI(msg.RequestURI()); err == nil && !s.isLocalDomain(uri.Host) {
+		if err := s.forwardToURI(addr, msg, msg.RequestURI()); err != nil {
+			log.Printf("PUBLISH forwarding error: %v", err)
+			s.sendResponse(addr, NewResponse("503", "Service Unavailable", msg))
+		}
+		return
+	}
+	if s.rejectUnsupported(addr, msg) {
+		return
+	}
+
+	event := strings.TrimSpace(strings.SplitN(msg.Headers["Event"], ";", 2)[0])
+	if event != p.Name() {
+		resp := NewResponse("489", "Bad Event", msg)
+		resp.Headers["Allow-Events"] = s.allowEventsHeader()
+		s.sendResponse(addr, resp)
+		return
+	}
+
+	expires := defaultPublicationExpires
+	if value, ok := msg.Headers["Expires"]; ok {
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || n < 0 {
+			s.sendResponse(addr, NewResponse("400", "Bad Request", msg))
+			return
+		}
+		expires = n
+	}
+	if expires > 0 && expires < minPublicationExpires {
+		resp := NewResponse("423", "Interval Too Brief", msg)
+		resp.Headers["Min-Expires"] = strconv.Itoa(minPublicationExpires)
+		s.sendResponse(addr, resp)
+		return
+	}
+	if expires > defaultPublicationExpires {
+		expires = defaultPublicationExpires
+	}
+
+	var doc pidfDocument
+	if msg.Body != "" {
+		if contentType := strings.TrimSpace(strings.SplitN(msg.Headers["Content-Type"], ";", 2)[0]); !strings.EqualFold(contentType, pidfContentType) {
+			resp := NewResponse("415", "Unsupported Media Type", msg)
+			resp.Headers["Accept"] = pidfContentType
+			s.sendResponse(addr, resp)
+			return
+		}
+		if err := xml.Unmarshal([]byte(msg.Body), &doc); err != nil || doc.XMLName.Local != "presence" {
+			log.Printf("invalid PIDF document: %v", err)
+			s.sendResponse(addr, NewResponse("400", "Bad Request", msg))
+			return
+		}
+	}
+
+	// Users exist while registered, and only publish from where they
+	// registered; publications are removed by their entity tag alone
+	aor := extractSIPURI(msg.RequestURI())
+	s.mu.Lock()
+	registered, registeredFrom := s.registered(aor), s.registeredFrom(aor, addr)
+	s.mu.Unlock()
+	if expires > 0 && !registered {
+		s.sendResponse(addr, NewResponse("404", "Not Found", msg))
+		return
+	}
+	if expires > 0 && !registeredFrom {
+		log.Printf("PUBLISH for %s from %s refused", aor, addr)
+		s.sendResponse(addr, NewResponse("403", "Forbidden", msg))
+		return
+	}
+
+	etag, conditional := msg.Headers["SIP-If-Match"]
+	etag = strings.TrimSpace(etag)
+	if !conditional && msg.Body == "" {
+		s.sendResponse(addr, NewResponse("400", "Bad Request", msg))
+		return
+	}
+
+	p.mu.Lock()
+	pub := p.publications[aor][etag]
+	if conditional && pub == nil {
+		p.mu.Unlock()
+		s.sendResponse(addr, NewResponse("412", "Conditional Request Failed", msg))
+		return
+	}
+	if pub != nil {
+		pub.timer.Stop()
+		delete(p.publications[aor], pub.etag)
+	}
+	changed := expires == 0 || msg.Body != ""
+	current := ""
+	if expires > 0 {
+		if pub == nil {
+			pub = &publication{}
+		}
+		if msg.Body != "" {
+			pub.body = msg.Body
+			pub.doc = doc
+		}
+		pub.etag = randomToken(8)
+		current = pub.etag
+		if p.publications[aor] == nil {
+			p.publications[aor] = make(map[string]*publication)
+		}
+		p.publications[aor][pub.etag] = pub
+		pub.timer = time.AfterFunc(time.Duration(expires)*time.Second, func() {
+			p.expire(aor, current)
+		})
+	}
+	if len(p.publications[aor]) == 0 {
+		delete(p.publications, aor)
+	}
+	p.mu.Unlock()
+
+	resp := NewResponse("200", "OK", msg)
+	resp.Headers["Expires"] = strconv.Itoa(expires)
+	if current != "" {
+		resp.Headers["SIP-ETag"] = current
+	}
+	s.sendResponse(addr, resp)
+
+	if changed {
+		log.Printf("presence of %s published", aor)
+		s.NotifySubscribers(p.Name(), aor)
+	}
+}
+
+// expire removes a publication that was not refreshed in time
+func (p *presenceAgent) expire(aor, etag string) {
+	p.mu.Lock()
+	_, ok := p.publications[aor][etag]
+	delete(p.publications[aor], etag)
+	if len(p.publications[aor]) == 0 {
+		delete(p.publications, aor)
+	}
+	p.mu.Unlock()
+
+	if ok {
+		log.Printf("presence publication of %s expired", aor)
+		p.server.NotifySubscribers(p.Name(), aor)
+	}
+}
+
+// xmlEscape escapes text for use in XML content and attributes
+func xmlEscape(text string) string {
+	var sb strings.Builder
+	xml.EscapeText(&sb, []byte(text))
+	return sb.String()
+}
@@ -0,0 +1,201 @@
+package sip
+
+import (
+	"encoding/xml"
+	"net"
+	"strings"
+	"testing"
+)
+
+func newTestPublish(etag, body string) *Message {
+	msg := NewMessage()
+	msg.StartLine = "PUBLISH sip:bob@example.com SIP/2.0"
+	msg.Headers["Via"] = "SIP/2.0/UDP 127.0.0.2:5062;branch=z9hG4bK" + randomToken(4)
+	msg.Headers["From"] = "<sip:bob@example.com>;tag=456"
+	msg.Headers["To"] = "<sip:bob@example.com>"
+	msg.Headers["Call-ID"] = "publish-" + randomToken(4)
+	msg.Headers["CSeq"] = "1 PUBLISH"
+	msg.Headers["Event"] = "presence"
+	msg.Headers["Expires"] = "600"
+	if etag != "" {
+		msg.Headers["SIP-If-Match"] = etag
+	}
+	if body != "" {
+		msg.Headers["Content-Type"] = "application/pidf+xml"
+		msg.Body = body
+	}
+	return msg
+}
+
+func pidfBody(tupleID, basic string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<presence xmlns="urn:ietf:params:xml:ns:pidf" entity="sip:bob@example.com">
+  <tuple id="` + tupleID + `"><status><basic>` + basic + `</basic></status><note>` + tupleID + `</note></tuple>
+</presence>`
+}
+
+// lastSent returns the most recent message the server sent
+func lastSent(t *testing.T, mockConn *MockConn) *Message {
+	t.Helper()
+	msgs := sentMessages(t, mockConn)
+	if len(msgs) == 0 {
+		t.Fatal("No message was sent")
+	}
+	return msgs[len(msgs)-1]
+}
+
+func TestPresence(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	aliceAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	bobAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 5062}
+
+	// Bob is offline when alice starts watching
+	server.handleSubscribe(aliceAddr, newTestSubscribe("presence", "600"))
+	notify := lastSent(t, mockConn)
+	if notify.Headers["Content-Type"] != "application/pidf+xml" || !strings.Contains(notify.Body, "<basic>closed</basic>") {
+		t.Fatalf("Expected a closed PIDF document, got %s", notify.String())
+	}
+
+	// Registering makes him open
+	register := newOutboundRegister("<sip:bob@127.0.0.2:5062>")
+	server.handleRegister(bobAddr, register)
+	notify = lastSent(t, mockConn)
+	if notify.Method() != "NOTIFY" || !strings.Contains(notify.Body, "<basic>open</basic>") {
+		t.Fatalf("Expected an open NOTIFY after registration, got %s", notify.String())
+	}
+
+	// Publications from two devices are aggregated
+	server.presence.handlePublish(bobAddr, newTestPublish("", pidfBody("phone", "open")))
+	resp := sentMessages(t, mockConn)[len(sentMessages(t, mockConn))-2]
+	phoneTag := resp.Headers["SIP-ETag"]
+	if resp.StatusCode() != 200 || phoneTag == "" || resp.Headers["Expires"] != "600" {
+		t.Fatalf("Unexpected PUBLISH response: %s", resp.String())
+	}
+	server.presence.handlePublish(bobAddr, newTestPublish("", pidfBody("desk", "closed")))
+	notify = lastSent(t, mockConn)
+	if !strings.Contains(notify.Body, `<tuple id="phone">`) || !strings.Contains(notify.Body, `<tuple id="desk">`) {
+		t.Fatalf("Expected both tuples in NOTIFY, got %s", notify.Body)
+	}
+
+	// A refresh gets a new entity tag and does not notify
+	before := len(sentMessages(t, mockConn))
+	server.presence.handlePublish(bobAddr, newTestPublish(phoneTag, ""))
+	msgs := sentMessages(t, mockConn)
+	if len(msgs) != before+1 || msgs[before].StatusCode() != 200 {
+		t.Fatalf("Expected only a 200 OK to the refresh")
+	}
+	refreshedTag := msgs[before].Headers["SIP-ETag"]
+	if refreshedTag == "" || refreshedTag == phoneTag {
+		t.Errorf("Refresh did not issue a new entity tag: %q", refreshedTag)
+	}
+
+	// The old entity tag is no longer valid
+	server.presence.handlePublish(bobAddr, newTestPublish(phoneTag, ""))
+	if code := lastSent(t, mockConn).StatusCode(); code != 412 {
+		t.Errorf("Expected 412 for a stale entity tag, got %d", code)
+	}
+
+	// Removing a publication drops its tuple
+	remove := newTestPublish(refreshedTag, "")
+	remove.Headers["Expires"] = "0"
+	server.presence.handlePublish(bobAddr, remove)
+	notify = lastSent(t, mockConn)
+	if strings.Contains(notify.Body, `<tuple id="phone">`) || !strings.Contains(notify.Body, `<tuple id="desk">`) {
+		t.Errorf("Removed tuple still present: %s", notify.Body)
+	}
+}
+
+func TestPublishRejected(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 5062}
+
+	wrongEvent := newTestPublish("", pidfBody("phone", "open"))
+	wrongEvent.Headers["Event"] = "dialog"
+	server.presence.handlePublish(addr, wrongEvent)
+	if code := lastSent(t, mockConn).StatusCode(); code != 489 {
+		t.Errorf("Expected 489 for an unknown event, got %d", code)
+	}
+
+	server.presence.handlePublish(addr, newTestPublish("", "<presence"))
+	if code := lastSent(t, mockConn).StatusCode(); code != 400 {
+		t.Errorf("Expected 400 for an invalid document, got %d", code)
+	}
+
+	wrongType := newTestPublish("", "hello")
+	wrongType.Headers["Content-Type"] = "text/plain"
+	server.presence.handlePublish(addr, wrongType)
+	if code := lastSent(t, mockConn).StatusCode(); code != 415 {
+		t.Errorf("Expected 415 for a non-PIDF body, got %d", code)
+	}
+
+	// Users who are not registered cannot publish
+	server.presence.handlePublish(addr, newTestPublish("", pidfBody("phone", "open")))
+	if code := lastSent(t, mockConn).StatusCode(); code != 404 {
+		t.Errorf("Expected 404 for an unregistered publisher, got %d", code)
+	}
+}
+
+func TestPublishExtensions(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	aliceAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	bobAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 5062}
+	server.handleRegister(bobAddr, newOutboundRegister("<sip:bob@127.0.0.2:5062>"))
+	server.handleSubscribe(aliceAddr, newTestSubscribe("presence", "600"))
+
+	// A single publication reaches watchers exactly as published
+	rpid := `<?xml version="1.0" encoding="UTF-8"?>
+<presence xmlns="urn:ietf:params:xml:ns:pidf" xmlns:dm="urn:ietf:params:xml:ns:pidf:data-model" xmlns:rpid="urn:ietf:params:xml:ns:pidf:rpid" entity="sip:bob@example.com">
+  <tuple id="phone"><status><basic>open</basic></status></tuple>
+  <dm:person id="bob"><rpid:activities><rpid:on-the-phone/></rpid:activities></dm:person>
+</presence>`
+	server.presence.handlePublish(bobAddr, newTestPublish("", rpid))
+	if notify := lastSent(t, mockConn); notify.Body != strings.ReplaceAll(rpid, "\n", "\r\n") {
+		t.Fatalf("Publication not passed on verbatim: %s", notify.Body)
+	}
+
+	// Composed documents keep the namespaces of each publication
+	server.presence.handlePublish(bobAddr, newTestPublish("", pidfBody("desk", "closed")))
+	body := lastSent(t, mockConn).Body
+	var doc struct {
+		Person struct {
+			Activities struct {
+				OnThePhone *struct{} `xml:"urn:ietf:params:xml:ns:pidf:rpid on-the-phone"`
+			} `xml:"urn:ietf:params:xml:ns:pidf:rpid activities"`
+		} `xml:"urn:ietf:params:xml:ns:pidf:data-model person"`
+		Tuples []struct {
+			ID string `xml:"id,attr"`
+		} `xml:"urn:ietf:params:xml:ns:pidf tuple"`
+	}
+	if err := xml.Unmarshal([]byte(body), &doc); err != nil {
+		t.Fatalf("Composed document is invalid: %v\n%s", err, body)
+	}
+	if doc.Person.Activities.OnThePhone == nil || len(doc.Tuples) != 2 {
+		t.Errorf("Composed document lost published elements: %s", body)
+	}
+
+	// Tuples of different devices with the same id get unique ones
+	server.presence.handlePublish(bobAddr, newTestPublish("", pidfBody("phone", "closed")))
+	body = lastSent(t, mockConn).Body
+	doc.Tuples = nil
+	if err := xml.Unmarshal([]byte(body), &doc); err != nil {
+		t.Fatalf("Composed document is invalid: %v\n%s", err, body)
+	}
+	ids := make(map[string]bool)
+	for _, tuple := range doc.Tuples {
+		ids[tuple.ID] = true
+	}
+	if len(doc.Tuples) != 3 || len(ids) != 3 || !ids["phone"] || !ids["desk"] {
+		t.Errorf("Expected 3 tuples with unique ids, got %v: %s", ids, body)
+	}
+
+	// Nobody else may publish for bob
+	before := len(sentMessages(t, mockConn))
+	server.presence.handlePublish(aliceAddr, newTestPublish("", pidfBody("fake", "open")))
+	msgs := sentMessages(t, mockConn)
+	if len(msgs) != before+1 || msgs[before].StatusCode() != 403 {
+		t.Errorf("Expected only a 403 to a PUBLISH from elsewhere, got %s", msgs[len(msgs)-1].StartLine)
+	}
+}
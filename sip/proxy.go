@@ -0,0 +1,451 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// timerT1 is the RFC 3261 round-trip time estimate
+	timerT1 = 500 * time.Millisecond
+	// timerT2 caps the retransmission interval of responses (RFC 3261 17.1.2.2)
+	timerT2 = 4 * time.Second
+	// defaultTransactionTimeout is the RFC 3261 Timer B/F value (64*T1)
+	defaultTransactionTimeout = 64 * timerT1
+	// defaultTimerC bounds how long a proxied INVITE may stay in the
+	// proceeding state; RFC 3261 16.6 requires more than 3 minutes
+	defaultTimerC = 3*time.Minute + 30*time.Second
+)
+
+// proxyTransaction tracks a request forwarded by the server so that
+// responses can be relayed back to the client that sent it
+type proxyTransaction struct {
+	branch     string
+	original   *Message // request as received from upstream
+	request    *Message // request as forwarded downstream
+	requestURI string
+	upstream   net.Addr      // where the original request came from
+	target     net.Addr      // where the request was forwarded to
+	alternates []Target      // remaining targets to fail over to
+	trunks     []string      // remaining trunks to fail over to once targets run out
+	trunk      string        // trunk the request went over, "" for none
+	authorized bool          // the request carries the trunk's credentials
+	sequence   *callSequence // call the branch rings for, nil for other requests
+	timer      *time.Timer
+	// provisional is set once a provisional response arrived, cancelled once
+	// the upstream client cancelled the request
+	provisional bool
+	cancelled   bool
+}
+
+// viaSentBy returns the host:port the server puts in its Via headers, and
+// in Record-Route, Contact and SDP. A wildcard bind address is not
+// routable; without an advertised address the address of the interface
+// toward other hosts is used instead.
+func (s *Server) viaSentBy() string {
+	host := s.AdvertisedAddr
+	if host == "" {
+		host = s.BindAddr
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		s.localHostOnce.Do(func() {
+			s.localHost = localIP()
+			log.Printf("bound to a wildcard address, advertising %s", s.localHost)
+		})
+		host = s.localHost
+	}
+	return net.JoinHostPort(host, s.Port)
+}
+
+// localIP returns the address of the interface the host reaches other hosts
+// through, falling back to the first global unicast address and then to the
+// loopback address. Connecting a UDP socket sends nothing.
+func localIP() string {
+	if conn, err := net.Dial("udp", "192.0.2.1:9"); err == nil {
+		defer conn.Close()
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && !addr.IP.IsUnspecified() {
+			return addr.IP.String()
+		}
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+				return ipNet.IP.String()
+			}
+		}
+	}
+	return "127.0.0.1"
+}
+
+// viaTransport returns the Via transport token for the given address
+func viaTransport(addr net.Addr) string {
+	return strings.ToUpper(addr.Network())
+}
+
+// applyAlias lets requests to the sender reuse the TLS connection a request
+// with an alias Via parameter arrived on (RFC 5923). The alias is keyed by
+// the source IP and the Via sent-by port. Plain TCP is not aliased because
+// the peer's identity cannot be verified.
+func (s *Server) applyAlias(addr net.Addr, msg *Message) {
+	source, ok := addr.(*tlsAddr)
+	if !ok {
+		return
+	}
+	via := topHeaderValue(msg.Headers["Via"])
+	if _, ok := headerParam(via, "alias"); !ok {
+		return
+	}
+	conn := s.pool.Lookup(addr)
+	if conn == nil {
+		return
+	}
+
+	host, port := viaSentByHostPort(via)
+	if port == 0 {
+		port = defaultPort("tls")
+	}
+	alias := &tlsAddr{
+		TCPAddr:    &net.TCPAddr{IP: source.IP, Port: port},
+		ServerName: host,
+	}
+	s.pool.Alias(alias, conn)
+}
+
+// viaSentByHostPort returns the sent-by host and port of a Via header value
+func viaSentByHostPort(via string) (string, int) {
+	fields := strings.Fields(via)
+	if len(fields) < 2 {
+		return "", 0
+	}
+	sentBy := strings.SplitN(fields[1], ";", 2)[0]
+	host, portStr, err := net.SplitHostPort(sentBy)
+	if err != nil {
+		return strings.Trim(sentBy, "[]"), 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
+
+// forwardRequest sends a copy of the request to target with the Request-URI
+// replaced by requestURI and the server's Via on top
+func (s *Server) forwardRequest(from net.Addr, msg *Message, requestURI string, target net.Addr) error {
+	return s.forwardTransaction(&proxyTransaction{
+		original:   msg,
+		requestURI: requestURI,
+		upstream:   from,
+		target:     target,
+	})
+}
+
+// forwardToURI locates the servers for requestURI (RFC 3263) and forwards
+// the request, failing over to the next target on 503 or timeout
+func (s *Server) forwardToURI(from net.Addr, msg *Message, requestURI string) error {
+	targets, err := s.resolver.Resolve(context.Background(), requestURI)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("no targets found for %s", requestURI)
+	}
+
+	return s.forwardTransaction(&proxyTransaction{
+		original:   msg,
+		requestURI: requestURI,
+		upstream:   from,
+		target:     targets[0].Addr(),
+		alternates: targets[1:],
+	})
+}
+
+// proxyRequest returns the copy of a request forwarded to target: its
+// Request-URI replaced by requestURI, the server's Via with the given branch
+// on top and Max-Forwards decremented, or added when absent
+func (s *Server) proxyRequest(msg *Message, requestURI string, target net.Addr, branch string) *Message {
+	fwd := msg.Clone()
+	fwd.StartLine = fmt.Sprintf("%s %s SIP/2.0", msg.Method(), requestURI)
+
+	via := fmt.Sprintf("SIP/2.0/%s %s;branch=%s", viaTransport(target), s.viaSentBy(), branch)
+	if target.Network() == "tls" {
+		// Let the peer send its requests back over this connection (RFC 5923)
+		via += ";alias"
+	}
+	if existing, ok := fwd.Headers["Via"]; ok && existing != "" {
+		via += ", " + existing
+	}
+	fwd.Headers["Via"] = via
+	decrementMaxForwards(fwd, msg)
+	return fwd
+}
+
+// rejectForwarding answers a request the server refuses to forward
+func (s *Server) rejectForwarding(upstream net.Addr, msg, resp *Message) {
+	log.Printf("not forwarding %s: %s", msg.Method(), resp.StartLine)
+	switch msg.Method() {
+	case "ACK":
+	case "INVITE":
+		s.setCallState(msg, "")
+		if s.finalizeInvite(msg) {
+			s.sendResponse(upstream, resp)
+		}
+	default:
+		s.sendResponse(upstream, resp)
+	}
+}
+
+// forwardTransaction sends the transaction's request to its target under a new branch
+func (s *Server) forwardTransaction(txn *proxyTransaction) error {
+	msg := txn.original
+	if resp := s.checkForwarding(msg); resp != nil {
+		s.rejectForwarding(txn.upstream, msg, resp)
+		return nil
+	}
+	target := txn.target
+	branch := proxyBranch(msg)
+	fwd := s.proxyRequest(msg, txn.requestURI, target, branch)
+	s.addRecordRoute(fwd, txn.upstream, target)
+	s.renumber(fwd)
+
+	// ACK has no response, so no transaction is kept for it
+	if msg.Method() == "ACK" {
+		return s.send(target, fwd)
+	}
+
+	txn.branch = branch
+	txn.request = fwd
+	s.mu.Lock()
+	s.proxied[branch] = txn
+	txn.timer = time.AfterFunc(s.transactionTimeout, func() {
+		s.transactionTimedOut(branch)
+	})
+	s.mu.Unlock()
+
+	log.Printf("forwarding %s to %s", msg.Method(), target.String())
+	if err := s.send(target, fwd); err != nil {
+		log.Printf("forwarding to %s failed: %v", target.String(), err)
+		s.mu.Lock()
+		delete(s.proxied, branch)
+		txn.timer.Stop()
+		s.mu.Unlock()
+		if s.failover(txn) {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// failover retries the transaction's request on its next alternate target
+func (s *Server) failover(txn *proxyTransaction) bool {
+	s.mu.Lock()
+	cancelled := txn.cancelled
+	s.mu.Unlock()
+	if cancelled {
+		return false
+	}
+	if len(txn.alternates) == 0 {
+		if len(txn.trunks) == 0 {
+			return false
+		}
+		user := ""
+		if uri, err := ParseURI(txn.requestURI); err == nil {
+			user = uri.User
+		}
+		log.Printf("failing over %s to trunk %s", txn.original.Method(), txn.trunks[0])
+		return s.forwardToTrunks(txn.upstream, txn.original, txn.trunks, user) == nil
+	}
+
+	next := txn.alternates[0]
+	log.Printf("failing over %s to %s", txn.original.Method(), next.String())
+	err := s.forwardTransaction(&proxyTransaction{
+		original:   txn.original,
+		requestURI: txn.requestURI,
+		upstream:   txn.upstream,
+		target:     next.Addr(),
+		alternates: txn.alternates[1:],
+		trunks:     txn.trunks,
+		trunk:      txn.trunk,
+	})
+	return err == nil
+}
+
+// transactionTimedOut handles a forwarded request that got no response in time
+func (s *Server) transactionTimedOut(branch string) {
+	s.mu.Lock()
+	txn, ok := s.proxied[branch]
+	delete(s.proxied, branch)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	log.Printf("%s to %s timed out", txn.original.Method(), txn.target.String())
+	if txn.sequence != nil && s.sequenceResponse(txn, nil) {
+		return
+	}
+	if s.failover(txn) {
+		return
+	}
+
+	if txn.original.Method() != "ACK" && s.finalizeInvite(txn.original) {
+		s.sendResponse(txn.upstream, NewResponse("408", "Request Timeout", txn.original))
+	}
+	if txn.original.Method() == "INVITE" {
+		s.setCallState(txn.original, "")
+	}
+}
+
+// timerCFired gives up on a forwarded INVITE that rang too long without a
+// final response (RFC 3261 16.8): the branch is cancelled and the caller
+// gets 408 unless another branch or step takes over
+func (s *Server) timerCFired(branch string) {
+	s.mu.Lock()
+	txn, ok := s.proxied[branch]
+	if ok {
+		// The transaction stays until the 487 to the CANCEL, or Timer B
+		txn.timer = time.AfterFunc(s.transactionTimeout, func() {
+			s.mu.Lock()
+			if s.proxied[branch] == txn {
+				delete(s.proxied, branch)
+			}
+			s.mu.Unlock()
+		})
+	}
+	cancelled := txn != nil && txn.cancelled
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	log.Printf("INVITE to %s got no final response in time, cancelling", txn.target.String())
+	if !cancelled {
+		s.sendCancel(txn)
+	}
+	if txn.sequence != nil && s.sequenceResponse(txn, nil) {
+		return
+	}
+
+	s.mu.Lock()
+	txn.cancelled = true
+	s.mu.Unlock()
+	if s.finalizeInvite(txn.original) {
+		s.sendResponse(txn.upstream, NewResponse("408", "Request Timeout", txn.original))
+	}
+	s.setCallState(txn.original, "")
+}
+
+// handleResponse dispatches responses to requests the server sent and
+// relays responses to forwarded requests back upstream
+func (s *Server) handleResponse(addr net.Addr, msg *Message) {
+	if s.relayStateless(msg) {
+		return
+	}
+	// Responses to CANCELs the server sent end here; they share the branch
+	// of the cancelled request
+	if strings.HasSuffix(msg.Headers["CSeq"], "CANCEL") {
+		log.Printf("CANCEL answered: %s", msg.StartLine)
+		return
+	}
+	if s.handleClientResponse(msg) {
+		return
+	}
+
+	branch, _ := headerParam(topHeaderValue(msg.Headers["Via"]), "branch")
+
+	code := msg.StatusCode()
+	isInvite := strings.HasSuffix(msg.Headers["CSeq"], "INVITE")
+
+	s.mu.Lock()
+	txn, ok := s.proxied[branch]
+	if ok && code >= 200 {
+		delete(s.proxied, branch)
+	}
+	// A final response, or any response to an INVITE, stops the timeout;
+	// provisional responses to an INVITE (re)start Timer C instead
+	if ok && (code >= 200 || isInvite) {
+		txn.timer.Stop()
+	}
+	if ok && isInvite && code < 200 {
+		txn.timer = time.AfterFunc(s.timerC, func() {
+			s.timerCFired(branch)
+		})
+	}
+	// A CANCEL held back until the first provisional response goes out now
+	sendCancel := false
+	if ok && code < 200 && !txn.provisional {
+		txn.provisional = true
+		sendCancel = txn.cancelled
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		log.Printf("response does not match any transaction: %s", msg.StartLine)
+		return
+	}
+	if sendCancel {
+		s.sendCancel(txn)
+	}
+
+	// ACK for a non-2xx final response is generated hop by hop
+	if isInvite && code >= 300 {
+		s.ackFailure(txn.request, msg, txn.target)
+	}
+
+	// Challenges of a provider are answered with the trunk's credentials
+	if (code == 401 || code == 407) && txn.trunk != "" && s.authorizeTrunkRequest(txn, msg) {
+		return
+	}
+
+	// Calls ringing targets in turn move on to the next one
+	if isInvite && code >= 200 && txn.sequence != nil && s.sequenceResponse(txn, msg) {
+		return
+	}
+
+	// A 503 from one target is not relayed while alternates remain (RFC 3263
+	// 4.3); over trunks, any server failure or timeout tries the next trunk
+	trunkFailure := len(txn.trunks) > 0 && (code == 408 || code >= 500 && code < 600)
+	if (code == 503 || trunkFailure) && s.failover(txn) {
+		return
+	}
+
+	if isInvite && code >= 300 && txn.authorized {
+		s.forgetRenumbering(msg.Headers["Call-ID"])
+	}
+	if isInvite {
+		// Only one non-2xx final response goes upstream; forked 2xx are all relayed
+		if code >= 200 && !s.finalizeInvite(txn.original) && code >= 300 {
+			return
+		}
+		s.updateCallState(msg)
+	}
+	if code >= 200 && code < 300 && (isInvite || strings.HasSuffix(msg.Headers["CSeq"], "UPDATE")) {
+		s.trackProxiedSession(txn, msg)
+	}
+
+	resp := msg.Clone()
+	resp.Headers["Via"] = removeTopHeaderValue(resp.Headers["Via"])
+	if cseqNumber(txn.request) != cseqNumber(txn.original) {
+		// The caller knows the request under its own CSeq
+		resp.Headers["CSeq"] = txn.original.Headers["CSeq"]
+	}
+	s.sendResponse(txn.upstream, resp)
+}
+
+// updateCallState tracks the state of proxied calls from INVITE responses
+func (s *Server) updateCallState(resp *Message) {
+	code := resp.StatusCode()
+
+	switch {
+	case code >= 180 && code < 200:
+		s.setCallState(resp, "ringing")
+	case code >= 200 && code < 300:
+		s.setCallState(resp, "connected")
+		log.Printf("call established: %s", resp.Headers["Call-ID"])
+	case code >= 300:
+		s.setCallState(resp, "")
+	}
+}
@@ -0,0 +1,118 @@
+package sip
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SetRedirect switches the server to redirect mode: requests for users are
+// answered with their registered contacts instead of being proxied
+// (RFC 3261 8.3)
+func (s *Server) SetRedirect(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.redirect = enabled
+}
+
+// redirectRequest answers a request outside of a dialog addressed to a user
+// in redirect mode. It reports whether the request was answered.
+func (s *Server) redirectRequest(addr net.Addr, msg *Message) bool {
+	s.mu.Lock()
+	redirect := s.redirect
+	s.mu.Unlock()
+	if !redirect {
+		return false
+	}
+	switch msg.Method() {
+	case "REGISTER", "ACK", "CANCEL":
+		return false
+	}
+	if _, inDialog := headerParam(msg.Headers["To"], "tag"); inDialog {
+		return false
+	}
+	// Requests for the server itself, such as OPTIONS pings, are answered as usual
+	uri, err := ParseURI(msg.RequestURI())
+	if err != nil || uri.User == "" {
+		return false
+	}
+
+	if msg.Method() == "INVITE" {
+		s.startInviteTransaction(addr, msg)
+		if !s.finalizeInvite(msg) {
+			return true
+		}
+	}
+
+	aor := extractSIPURI(msg.RequestURI())
+	var contacts []string
+	if s.isLocalDomain(uri.Host) {
+		contacts = s.redirectContacts(aor)
+	}
+	var resp *Message
+	switch len(contacts) {
+	case 0:
+		resp = NewResponse("404", "Not Found", msg)
+	case 1:
+		resp = NewResponse("302", "Moved Temporarily", msg)
+	default:
+		resp = NewResponse("300", "Multiple Choices", msg)
+	}
+	if len(contacts) > 0 {
+		resp.Headers["Contact"] = strings.Join(contacts, ", ")
+	}
+	log.Printf("%s for %s redirected to %d contacts", msg.Method(), aor, len(contacts))
+	s.sendResponse(addr, resp)
+	return true
+}
+
+// redirectContacts returns the Contact header values listing where a user
+// can be reached, highest q-value first and most recent first among equal
+// ones, each with its q-value and remaining lifetime
+func (s *Server) redirectContacts(aor string) []string {
+	type contact struct {
+		uri     string
+		q       float64
+		expires int
+	}
+
+	now := time.Now()
+	var found []contact
+	bindings := s.lookup(aor)
+	for i := len(bindings) - 1; i >= 0; i-- {
+		binding := bindings[i]
+		q := 1.0
+		if value, ok := headerParam(binding.Contact, "q"); ok {
+			if n, err := strconv.ParseFloat(value, 64); err == nil && n >= 0 && n <= 1 {
+				q = n
+			}
+		}
+		expires := int(binding.Expires.Sub(now).Seconds())
+		found = append(found, contact{uri: contactURI(binding.Contact), q: q, expires: expires})
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].q > found[j].q })
+
+	var contacts []string
+	for _, c := range found {
+		contacts = append(contacts, fmt.Sprintf("<%s>;q=%s;expires=%d", c.uri, strconv.FormatFloat(c.q, 'f', -1, 64), c.expires))
+	}
+	if len(contacts) > 0 {
+		return contacts
+	}
+
+	// Users registered without a Contact are reached at the address they registered from
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.registered(aor) {
+		return nil
+	}
+	uri, err := ParseURI(aor)
+	if err != nil {
+		return nil
+	}
+	return []string{fmt.Sprintf("<sip:%s@%s>", uri.User, s.registrar[aor])}
+}
@@ -0,0 +1,59 @@
+package sip
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRedirectContacts(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetRedirect(true)
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	server.handleRegister(addr, newOutboundRegister("<sip:bob@10.0.0.5:5070>;q=0.5, <sip:bob@10.0.0.6:5060>;q=0.9;expires=600"))
+	server.handleMessage(addr, []byte(newTestInvite("sip:bob@example.com", "redirect-1").String()))
+
+	resp := lastSent(t, mockConn)
+	if resp.StatusCode() != 300 {
+		t.Fatalf("Expected 300, got %s", resp.StartLine)
+	}
+	contacts := splitHeaderValues(resp.Headers["Contact"])
+	if len(contacts) != 2 || !strings.HasPrefix(contacts[0], "<sip:bob@10.0.0.6:5060>;q=0.9;expires=") ||
+		!strings.HasPrefix(contacts[1], "<sip:bob@10.0.0.5:5070>;q=0.5;expires=") {
+		t.Errorf("Wrong Contact list: %q", resp.Headers["Contact"])
+	}
+	if sentRequests(t, mockConn, "INVITE") != nil {
+		t.Error("INVITE proxied in redirect mode")
+	}
+
+	// A single contact gets 302, for any method
+	server.handleRegister(addr, newOutboundRegister("<sip:bob@10.0.0.6:5060>;expires=0"))
+	server.handleMessage(addr, []byte(newTestMessage("sip:bob@example.com", "hi").String()))
+	resp = lastSent(t, mockConn)
+	if resp.StatusCode() != 302 || !strings.HasPrefix(resp.Headers["Contact"], "<sip:bob@10.0.0.5:5070>;q=0.5;") {
+		t.Errorf("Expected 302 to the remaining contact, got %s", resp.String())
+	}
+}
+
+func TestRedirectUnknownUser(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetRedirect(true)
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	server.handleMessage(addr, []byte(newTestInvite("sip:nobody@example.com", "redirect-2").String()))
+	if code := lastSent(t, mockConn).StatusCode(); code != 404 {
+		t.Errorf("Expected 404, got %d", code)
+	}
+
+	// Requests for the server itself are not redirected
+	options := newTestInvite("sip:127.0.0.1:5060", "redirect-3")
+	options.StartLine = "OPTIONS sip:127.0.0.1:5060 SIP/2.0"
+	options.Headers["CSeq"] = "1 OPTIONS"
+	server.handleMessage(addr, []byte(options.String()))
+	if code := lastSent(t, mockConn).StatusCode(); code != 200 {
+		t.Errorf("Expected 200 to OPTIONS, got %d", code)
+	}
+}
@@ -0,0 +1,332 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// sipfragContentType is the body type of refer NOTIFYs (RFC 3420)
+	sipfragContentType = "message/sipfrag;version=2.0"
+	// referSubscriptionExpires bounds the implicit subscription of a REFER
+	referSubscriptionExpires = 180
+)
+
+// referPackage is the refer event package of the implicit subscriptions
+// created by REFER requests (RFC 3515). The state of a subscription is the
+// status line of the latest response to the request the REFER triggered.
+type referPackage struct {
+	mu     sync.Mutex
+	status map[string]string // subscription ID -> status line
+}
+
+// newReferPackage creates the refer event package
+func newReferPackage() *referPackage {
+	return &referPackage{status: make(map[string]string)}
+}
+
+// Name implements EventPackage
+func (r *referPackage) Name() string {
+	return "refer"
+}
+
+// ContentType implements EventPackage
+func (r *referPackage) ContentType() string {
+	return sipfragContentType
+}
+
+// State implements EventPackage
+func (r *referPackage) State(sub *Subscription) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status[sub.id] + "\r\n"
+}
+
+// setStatus records the status line reported to a refer subscription
+func (r *referPackage) setStatus(id, status string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status[id] = status
+}
+
+// handleRefer processes REFER requests. REFERs outside a dialog are routed
+// to their target like other requests; REFERs within a call the server is a
+// party of make the server call the Refer-To target and report the progress
+// of that call in NOTIFYs of the implicit refer subscription.
+func (s *Server) handleRefer(addr net.Addr, msg *Message) {
+	toTag, inDialog := headerParam(msg.Headers["To"], "tag")
+	if !inDialog {
+		if !s.routeToUser(addr, msg) {
+			s.sendResponse(addr, NewResponse("404", "Not Found", msg))
+		}
+		return
+	}
+
+	d := s.lookupSession(msg.Headers["Call-ID"])
+	if d == nil || d.LocalTag != toTag {
+		s.sendResponse(addr, NewResponse("481", "Call/Transaction Does Not Exist", msg))
+		return
+	}
+
+	referTo := splitHeaderValues(msg.Headers["Refer-To"])
+	if len(referTo) != 1 {
+		s.sendResponse(addr, NewResponse("400", "Bad Request", msg))
+		return
+	}
+	target, replaces, err := parseReferTo(referTo[0])
+	if err != nil {
+		log.Printf("invalid Refer-To: %v", err)
+		s.sendResponse(addr, NewResponse("400", "Bad Request", msg))
+		return
+	}
+
+	eventID := strconv.Itoa(cseqNumber(msg))
+	sub := &Subscription{
+		Event:      "refer",
+		Resource:   extractSIPURI(d.LocalURI),
+		Subscriber: msg.Headers["From"],
+		Expires:    time.Now().Add(referSubscriptionExpires * time.Second),
+		id:         d.ID() + ";refer=" + eventID,
+		eventID:    eventID,
+		callID:     d.CallID,
+		localTag:   d.LocalTag,
+		remoteURI:  d.RemoteTarget,
+		target:     addr,
+		dialog:     d,
+	}
+	s.refers.setStatus(sub.id, "SIP/2.0 100 Trying")
+
+	s.mu.Lock()
+	s.subscriptions[sub.id] = sub
+	sub.timer = time.AfterFunc(referSubscriptionExpires*time.Second, func() {
+		s.expireSubscription(sub.id)
+	})
+	s.mu.Unlock()
+
+	resp := NewResponse("202", "Accepted", msg)
+	resp.Headers["Contact"] = s.contactHeader()
+	s.sendResponse(addr, resp)
+	log.Printf("call %s referred to %s", d.CallID, target)
+
+	s.notify(s.refers, sub, "active")
+	s.followRefer(sub, d, target, replaces, msg)
+}
+
+// followRefer places the call a REFER asked for and reports its progress
+func (s *Server) followRefer(sub *Subscription, d *Dialog, target, replaces string, refer *Message) {
+	requestURI, addr, err := s.locate(target)
+	if err != nil {
+		log.Printf("cannot reach refer target: %v", err)
+		s.finishRefer(sub, "SIP/2.0 404 Not Found")
+		return
+	}
+
+	invite := s.newRequest("INVITE", requestURI, d.LocalURI, "<"+target+">")
+	invite.Headers["Contact"] = s.contactHeader()
+	if referredBy := refer.Headers["Referred-By"]; referredBy != "" {
+		invite.Headers["Referred-By"] = referredBy
+	} else {
+		invite.Headers["Referred-By"] = withoutTag(refer.Headers["From"])
+	}
+	if replaces != "" {
+		invite.Headers["Replaces"] = replaces
+	}
+
+	s.setCallState(invite, "trying")
+	err = s.sendRequest(addr, invite, func(resp *Message) {
+		if resp == nil {
+			s.setCallState(invite, "")
+			s.finishRefer(sub, "SIP/2.0 408 Request Timeout")
+			return
+		}
+
+		code := resp.StatusCode()
+		switch {
+		case code == 100:
+		case code < 200:
+			s.setCallState(resp, "ringing")
+			s.refers.setStatus(sub.id, resp.StartLine)
+			if s.referActive(sub) {
+				s.notify(s.refers, sub, "active")
+			}
+		case code < 300:
+			// The INVITE carried no offer, so the 2xx does and the ACK
+			// answers it (RFC 3261 13.2.1)
+			dialog := newUACDialog(addr, invite, resp)
+			ack := s.successAck(invite, resp)
+			if offer := sdpBody(resp); offer != "" {
+				answer, err := s.answerOffer(dialog, offer)
+				if err != nil {
+					log.Printf("cannot answer offer of transferred call: %v", err)
+					s.sendAck(addr, ack)
+					s.sendBye(dialog)
+					s.setCallState(invite, "")
+					s.finishRefer(sub, "SIP/2.0 488 Not Acceptable Here")
+					return
+				}
+				setSDPBody(ack, answer)
+			}
+			s.sendAck(addr, ack)
+			s.mu.Lock()
+			s.sessions[invite.Headers["Call-ID"]] = dialog
+			s.mu.Unlock()
+			s.setCallState(resp, "connected")
+			s.finishRefer(sub, resp.StartLine)
+		default:
+			s.setCallState(invite, "")
+			s.finishRefer(sub, resp.StartLine)
+		}
+	})
+	if err != nil {
+		log.Printf("INVITE sending error: %v", err)
+		s.setCallState(invite, "")
+		s.finishRefer(sub, "SIP/2.0 503 Service Unavailable")
+	}
+}
+
+// finishRefer sends the final NOTIFY of a refer subscription
+func (s *Server) finishRefer(sub *Subscription, status string) {
+	s.refers.setStatus(sub.id, status)
+
+	active := s.referActive(sub)
+	s.mu.Lock()
+	s.removeSubscription(sub)
+	s.mu.Unlock()
+
+	// A subscriber that unsubscribed already got its final NOTIFY
+	if active {
+		s.notify(s.refers, sub, "terminated;reason=noresource")
+	}
+
+	s.refers.mu.Lock()
+	delete(s.refers.status, sub.id)
+	s.refers.mu.Unlock()
+}
+
+// referActive reports whether the subscriber of a refer subscription has
+// not ended it
+func (s *Server) referActive(sub *Subscription) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.subscriptions[sub.id]
+	return ok
+}
+
+// ackSuccess acknowledges a 2xx response to an INVITE the server sent. Unlike
+// the ACK of a failure it is a new transaction sent to the callee's Contact.
+func (s *Server) ackSuccess(target net.Addr, invite, resp *Message) {
+	s.sendAck(target, s.successAck(invite, resp))
+}
+
+// successAck builds the ACK of a 2xx response to an INVITE the server sent
+func (s *Server) successAck(invite, resp *Message) *Message {
+	requestURI := invite.RequestURI()
+	if contact := topHeaderValue(resp.Headers["Contact"]); contact != "" {
+		requestURI = contactURI(contact)
+	}
+
+	ack := NewMessage()
+	ack.StartLine = fmt.Sprintf("ACK %s SIP/2.0", requestURI)
+	ack.Headers["From"] = invite.Headers["From"]
+	ack.Headers["To"] = resp.Headers["To"]
+	ack.Headers["Call-ID"] = invite.Headers["Call-ID"]
+	ack.Headers["CSeq"] = fmt.Sprintf("%d ACK", cseqNumber(invite))
+	ack.Headers["Max-Forwards"] = "70"
+	ack.Headers["Content-Length"] = "0"
+	return ack
+}
+
+// sendAck sends an ACK built by successAck
+func (s *Server) sendAck(target net.Addr, ack *Message) {
+	if err := s.sendRequest(target, ack, nil); err != nil {
+		log.Printf("ACK sending error: %v", err)
+	}
+}
+
+// parseReferTo splits a Refer-To value into the target URI and the Replaces
+// header embedded in it, if any
+func parseReferTo(value string) (string, string, error) {
+	uri := contactURI(value)
+	replaces := ""
+	if i := strings.Index(uri, "?"); i != -1 {
+		for _, header := range strings.Split(uri[i+1:], "&") {
+			parts := strings.SplitN(header, "=", 2)
+			if len(parts) != 2 || !strings.EqualFold(parts[0], "Replaces") {
+				continue
+			}
+			unescaped, err := url.PathUnescape(parts[1])
+			if err != nil {
+				return "", "", fmt.Errorf("invalid Replaces in Refer-To: %v", err)
+			}
+			replaces = unescaped
+		}
+		uri = uri[:i]
+	}
+
+	if _, err := ParseURI(uri); err != nil {
+		return "", "", err
+	}
+	return uri, replaces, nil
+}
+
+// replacedSession returns the call an INVITE with a Replaces header replaces
+// (RFC 3891). It returns the failure response to send when the header does
+// not name a call that may be replaced, and nil for INVITEs without one.
+func (s *Server) replacedSession(msg *Message) (*Dialog, *Message) {
+	replaces, ok := msg.Headers["Replaces"]
+	if !ok {
+		return nil, nil
+	}
+
+	callID := strings.TrimSpace(strings.SplitN(replaces, ";", 2)[0])
+	params := headerParams(replaces)
+	d := s.lookupSession(callID)
+	// The tags are given from the point of view of the replaced call's peer
+	if d == nil || d.LocalTag != params["to-tag"] || d.RemoteTag != params["from-tag"] {
+		return nil, NewResponse("481", "Call/Transaction Does Not Exist", msg)
+	}
+	if _, earlyOnly := params["early-only"]; earlyOnly {
+		// Only established calls are tracked as sessions
+		return nil, NewResponse("486", "Busy Here", msg)
+	}
+	return d, nil
+}
+
+// Errors of locate
+var (
+	errNotRegistered = errors.New("not registered")
+	errUnresolvable  = errors.New("cannot resolve")
+)
+
+// locate finds where to send a request for a URI: the contact of a
+// registered local user or a server of another domain
+func (s *Server) locate(uri string) (string, net.Addr, error) {
+	parsed, err := ParseURI(uri)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if !s.isLocalDomain(parsed.Host) {
+		targets, err := s.resolver.Resolve(context.Background(), uri)
+		if err != nil {
+			return "", nil, fmt.Errorf("%w %s: %v", errUnresolvable, uri, err)
+		}
+		if len(targets) == 0 {
+			return "", nil, fmt.Errorf("%w %s: no servers found", errUnresolvable, uri)
+		}
+		return uri, targets[0].Addr(), nil
+	}
+
+	if requestURI, target, ok := s.contactTarget(extractSIPURI(uri)); ok {
+		return requestURI, target, nil
+	}
+	return "", nil, fmt.Errorf("%s is %w", uri, errNotRegistered)
+}
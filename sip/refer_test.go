@@ -0,0 +1,247 @@
+package sip
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// answeredTestCall lets the server answer a call from alice and returns the 200 OK
+func answeredTestCall(t *testing.T, server *Server, addr net.Addr, callID string) *Message {
+	t.Helper()
+	invite := newTestInvite("sip:bob@example.com", callID)
+	invite.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bK" + callID
+	server.handleInvite(addr, invite)
+	for _, msg := range sentMessages(t, server.conn.(*MockConn)) {
+		if msg.StatusCode() == 200 && msg.Headers["Call-ID"] == callID {
+			return msg
+		}
+	}
+	t.Fatalf("Call %s was not answered", callID)
+	return nil
+}
+
+// sentRequests returns the requests with the given method the server sent
+func sentRequests(t *testing.T, mockConn *MockConn, method string) []*Message {
+	t.Helper()
+	var requests []*Message
+	for _, msg := range sentMessages(t, mockConn) {
+		if !msg.IsResponse() && msg.Method() == method {
+			requests = append(requests, msg)
+		}
+	}
+	return requests
+}
+
+func TestBlindTransfer(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	aliceAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	carolAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.4"), Port: 5064}
+
+	register := newOutboundRegister("<sip:carol@127.0.0.4:5064>")
+	register.Headers["From"] = "<sip:carol@example.com>;tag=777"
+	server.handleRegister(carolAddr, register)
+	ok := answeredTestCall(t, server, aliceAddr, "transfer-call-1")
+
+	refer := NewMessage()
+	refer.StartLine = "REFER sip:127.0.0.1:5060 SIP/2.0"
+	refer.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKrefer1"
+	refer.Headers["From"] = "<sip:alice@example.com>;tag=123"
+	refer.Headers["To"] = ok.Headers["To"]
+	refer.Headers["Call-ID"] = "transfer-call-1"
+	refer.Headers["CSeq"] = "2 REFER"
+	refer.Headers["Refer-To"] = "<sip:carol@example.com>"
+	server.handleRefer(aliceAddr, refer)
+
+	resp := sentMessages(t, mockConn)
+	if accepted := resp[len(resp)-3]; accepted.StatusCode() != 202 {
+		t.Fatalf("Expected 202 Accepted, got %s", accepted.StartLine)
+	}
+	notifies := sentRequests(t, mockConn, "NOTIFY")
+	if len(notifies) != 1 || notifies[0].Headers["Event"] != "refer;id=2" || notifies[0].Body != "SIP/2.0 100 Trying\r\n" {
+		t.Fatalf("Expected a 100 Trying NOTIFY, got %v", notifies)
+	}
+	if notifies[0].Headers["Content-Type"] != "message/sipfrag;version=2.0" {
+		t.Errorf("Wrong NOTIFY Content-Type: %s", notifies[0].Headers["Content-Type"])
+	}
+
+	invites := sentRequests(t, mockConn, "INVITE")
+	if len(invites) != 1 || invites[0].RequestURI() != "sip:carol@127.0.0.4:5064" {
+		t.Fatalf("Expected an INVITE to carol, got %v", invites)
+	}
+	invite := invites[0]
+	if invite.Headers["Referred-By"] != "<sip:alice@example.com>" {
+		t.Errorf("Wrong Referred-By: %s", invite.Headers["Referred-By"])
+	}
+
+	// Carol rings and answers
+	ringing := NewResponse("180", "Ringing", invite)
+	ringing.Headers["To"] += ";tag=carol1"
+	server.handleMessage(carolAddr, []byte(ringing.String()))
+	answer := NewResponse("200", "OK", invite)
+	answer.Headers["To"] += ";tag=carol1"
+	answer.Headers["Contact"] = "<sip:carol@127.0.0.4:5064>"
+	setSDPBody(answer, testOffer("sendrecv"))
+	server.handleMessage(carolAddr, []byte(answer.String()))
+
+	notifies = sentRequests(t, mockConn, "NOTIFY")
+	if len(notifies) != 3 {
+		t.Fatalf("Expected 3 NOTIFYs, got %d", len(notifies))
+	}
+	if notifies[1].Body != "SIP/2.0 180 Ringing\r\n" || notifies[1].Headers["Subscription-State"] == "" {
+		t.Errorf("Unexpected ringing NOTIFY: %s", notifies[1].String())
+	}
+	if notifies[2].Body != "SIP/2.0 200 OK\r\n" || notifies[2].Headers["Subscription-State"] != "terminated;reason=noresource" {
+		t.Errorf("Unexpected final NOTIFY: %s", notifies[2].String())
+	}
+	if notifies[0].Headers["CSeq"] != "1 NOTIFY" || notifies[2].Headers["CSeq"] != "3 NOTIFY" {
+		t.Errorf("NOTIFY CSeqs do not follow the dialog: %s, %s", notifies[0].Headers["CSeq"], notifies[2].Headers["CSeq"])
+	}
+
+	acks := sentRequests(t, mockConn, "ACK")
+	if len(acks) != 1 || acks[0].RequestURI() != "sip:carol@127.0.0.4:5064" {
+		t.Fatalf("Expected an ACK to carol, got %v", acks)
+	}
+	// The INVITE had no offer, so the ACK answers the one of the 2xx
+	if invite.Body != "" || sdpBody(acks[0]) == "" || !strings.Contains(acks[0].Body, "m=audio") {
+		t.Errorf("Expected an SDP answer in the ACK, got %q", acks[0].Body)
+	}
+	if acks[0].Headers["Content-Length"] != strconv.Itoa(len(acks[0].Body)) {
+		t.Errorf("Wrong ACK Content-Length: %s", acks[0].Headers["Content-Length"])
+	}
+	server.mu.Lock()
+	state := server.calls[invite.Headers["Call-ID"]]
+	server.mu.Unlock()
+	if state != "connected" {
+		t.Errorf("Transferred call state = %q, want connected", state)
+	}
+}
+
+func TestReferSubscriptionRefresh(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	aliceAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	carolAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.4"), Port: 5064}
+
+	register := newOutboundRegister("<sip:carol@127.0.0.4:5064>")
+	register.Headers["From"] = "<sip:carol@example.com>;tag=777"
+	server.handleRegister(carolAddr, register)
+	ok := answeredTestCall(t, server, aliceAddr, "refresh-call")
+
+	refer := NewMessage()
+	refer.StartLine = "REFER sip:127.0.0.1:5060 SIP/2.0"
+	refer.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKrefresh1"
+	refer.Headers["From"] = "<sip:alice@example.com>;tag=123"
+	refer.Headers["To"] = ok.Headers["To"]
+	refer.Headers["Call-ID"] = "refresh-call"
+	refer.Headers["CSeq"] = "2 REFER"
+	refer.Headers["Refer-To"] = "<sip:carol@example.com>"
+	server.handleRefer(aliceAddr, refer)
+
+	subscribe := func(cseq, expires string) {
+		msg := NewMessage()
+		msg.StartLine = "SUBSCRIBE sip:127.0.0.1:5060 SIP/2.0"
+		msg.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKrefresh" + cseq
+		msg.Headers["From"] = "<sip:alice@example.com>;tag=123"
+		msg.Headers["To"] = ok.Headers["To"]
+		msg.Headers["Call-ID"] = "refresh-call"
+		msg.Headers["CSeq"] = cseq + " SUBSCRIBE"
+		msg.Headers["Event"] = "refer;id=2"
+		msg.Headers["Expires"] = expires
+		server.handleMessage(aliceAddr, []byte(msg.String()))
+	}
+
+	// A refresh of the implicit subscription is accepted and notified
+	subscribe("3", "120")
+	var resp *Message
+	for _, msg := range sentTo(t, mockConn, aliceAddr) {
+		if msg.IsResponse() {
+			resp = msg
+		}
+	}
+	if resp.StatusCode() != 200 || resp.Headers["CSeq"] != "3 SUBSCRIBE" || resp.Headers["Expires"] != "120" {
+		t.Fatalf("Expected 200 for the refresh, got %s", resp.String())
+	}
+	notifies := sentRequests(t, mockConn, "NOTIFY")
+	if len(notifies) != 2 || notifies[1].Body != "SIP/2.0 100 Trying\r\n" || !strings.HasPrefix(notifies[1].Headers["Subscription-State"], "active;expires=1") {
+		t.Fatalf("Expected an active NOTIFY after the refresh, got %v", notifies)
+	}
+
+	// After unsubscribing, progress of the transfer is no longer notified
+	subscribe("4", "0")
+	notifies = sentRequests(t, mockConn, "NOTIFY")
+	if len(notifies) != 3 || !strings.HasPrefix(notifies[2].Headers["Subscription-State"], "terminated") {
+		t.Fatalf("Expected a final NOTIFY after unsubscribing, got %v", notifies)
+	}
+	invite := sentRequests(t, mockConn, "INVITE")[0]
+	ringing := NewResponse("180", "Ringing", invite)
+	ringing.Headers["To"] += ";tag=carol1"
+	server.handleMessage(carolAddr, []byte(ringing.String()))
+	if notifies = sentRequests(t, mockConn, "NOTIFY"); len(notifies) != 3 {
+		t.Errorf("NOTIFY sent after unsubscribing: %v", notifies[3:])
+	}
+}
+
+func TestInviteWithReplaces(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	aliceAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	carolAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.4"), Port: 5064}
+
+	ok := answeredTestCall(t, server, aliceAddr, "replaced-call")
+	localTag, _ := headerParam(ok.Headers["To"], "tag")
+
+	unknown := newTestInvite("sip:bob@example.com", "replacing-call-0")
+	unknown.Headers["Replaces"] = "no-such-call;to-tag=1;from-tag=2"
+	server.handleInvite(carolAddr, unknown)
+	if code := lastSent(t, mockConn).StatusCode(); code != 481 {
+		t.Errorf("Expected 481 for an unknown call, got %d", code)
+	}
+
+	before := len(sentMessages(t, mockConn))
+	replacing := newTestInvite("sip:bob@example.com", "replacing-call")
+	replacing.Headers["Via"] = "SIP/2.0/UDP 127.0.0.4:5064;branch=z9hG4bKreplacing"
+	replacing.Headers["Replaces"] = "replaced-call;to-tag=" + localTag + ";from-tag=123"
+	server.handleInvite(carolAddr, replacing)
+
+	var codes []int
+	var bye *Message
+	for _, msg := range sentMessages(t, mockConn)[before:] {
+		if msg.IsResponse() {
+			codes = append(codes, msg.StatusCode())
+		} else if msg.Method() == "BYE" {
+			bye = msg
+		}
+	}
+	if len(codes) != 2 || codes[0] != 100 || codes[1] != 200 {
+		t.Errorf("Expected 100 and 200 without ringing, got %v", codes)
+	}
+	if bye == nil || bye.Headers["Call-ID"] != "replaced-call" || bye.RequestURI() != "sip:alice@127.0.0.1:12345" {
+		t.Fatalf("Expected a BYE for the replaced call, got %v", bye)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if _, exists := server.calls["replaced-call"]; exists {
+		t.Error("Replaced call is still tracked")
+	}
+	if server.calls["replacing-call"] != "connected" {
+		t.Errorf("Replacing call state = %q, want connected", server.calls["replacing-call"])
+	}
+}
+
+func TestParseReferTo(t *testing.T) {
+	uri, replaces, err := parseReferTo("<sip:carol@example.com?Replaces=abc%40host%3Bto-tag%3D1%3Bfrom-tag%3D2>")
+	if err != nil {
+		t.Fatalf("parseReferTo failed: %v", err)
+	}
+	if uri != "sip:carol@example.com" || replaces != "abc@host;to-tag=1;from-tag=2" {
+		t.Errorf("Got %q, %q", uri, replaces)
+	}
+
+	if _, _, err := parseReferTo("<tel:+15551234567>"); err == nil {
+		t.Error("Expected an error for a non-SIP target")
+	}
+}
@@ -0,0 +1,241 @@
+package sip
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultExpires is the registration lifetime used when the client does not ask for one
+const defaultExpires = 3600
+
+// Binding is a contact registered for a user
+type Binding struct {
+	AOR        string
+	Contact    string
+	InstanceID string   // +sip.instance Contact parameter
+	RegID      string   // reg-id Contact parameter
+	FlowToken  string   // flow the registration arrived on (SIP Outbound only)
+	Source     net.Addr // address the registration was received from
+	Expires    time.Time
+}
+
+// IsOutbound reports whether the binding was registered using SIP Outbound (RFC 5626)
+func (b *Binding) IsOutbound() bool {
+	return b.InstanceID != "" && b.RegID != ""
+}
+
+// isWildcard reports whether a REGISTER asks to remove all bindings of the
+// user with "Contact: *" (RFC 3261 10.2.2)
+func isWildcard(msg *Message) bool {
+	for _, contact := range splitHeaderValues(msg.Headers["Contact"]) {
+		if strings.TrimSpace(contact) == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// validWildcard reports whether a wildcard REGISTER is well-formed: "*" is
+// the only contact and the expiry is zero (RFC 3261 10.3 step 6)
+func validWildcard(msg *Message) bool {
+	return len(splitHeaderValues(msg.Headers["Contact"])) == 1 &&
+		strings.TrimSpace(msg.Headers["Expires"]) == "0"
+}
+
+// updateBindings applies the Contact headers of a REGISTER request to the
+// user's bindings and reports whether any of them uses SIP Outbound.
+// The caller must hold s.mu.
+func (s *Server) updateBindings(aor string, addr net.Addr, msg *Message) bool {
+	outbound := false
+	now := time.Now()
+
+	if isWildcard(msg) {
+		delete(s.bindings, aor)
+		return false
+	}
+	for _, contact := range splitHeaderValues(msg.Headers["Contact"]) {
+		params := headerParams(contact)
+		binding := &Binding{
+			AOR:        aor,
+			Contact:    contact,
+			InstanceID: params["+sip.instance"],
+			RegID:      params["reg-id"],
+			Source:     addr,
+		}
+
+		expires := defaultExpires
+		if value, ok := msg.Headers["Expires"]; ok {
+			if n, err := strconv.Atoi(value); err == nil {
+				expires = n
+			}
+		}
+		if value, ok := params["expires"]; ok {
+			if n, err := strconv.Atoi(value); err == nil {
+				expires = n
+			}
+		}
+		binding.Expires = now.Add(time.Duration(expires) * time.Second)
+
+		if binding.IsOutbound() {
+			outbound = true
+			if flow := s.flows[flowKey(addr)]; flow != nil {
+				binding.FlowToken = flow.Token
+			}
+		}
+
+		// Drop the binding this one replaces, then store it unless it is a removal
+		s.removeBinding(binding)
+		if expires > 0 {
+			s.bindings[aor] = append(s.bindings[aor], binding)
+		}
+	}
+
+	if len(s.bindings[aor]) == 0 {
+		delete(s.bindings, aor)
+	}
+	return outbound
+}
+
+// removeBinding deletes an existing binding matching the given one. Outbound
+// bindings match on instance and reg-id, others on the contact URI.
+// The caller must hold s.mu.
+func (s *Server) removeBinding(binding *Binding) {
+	existing := s.bindings[binding.AOR]
+	for i, b := range existing {
+		same := false
+		if binding.IsOutbound() {
+			same = b.InstanceID == binding.InstanceID && b.RegID == binding.RegID
+		} else {
+			same = !b.IsOutbound() && contactURI(b.Contact) == contactURI(binding.Contact)
+		}
+		if same {
+			s.bindings[binding.AOR] = append(existing[:i:i], existing[i+1:]...)
+			return
+		}
+	}
+}
+
+// contactURI returns the URI of a Contact header value including its URI parameters
+func contactURI(contact string) string {
+	if start := strings.Index(contact, "<"); start != -1 {
+		if end := strings.Index(contact[start:], ">"); end != -1 {
+			return contact[start+1 : start+end]
+		}
+	}
+	if semicolon := strings.Index(contact, ";"); semicolon != -1 {
+		return strings.TrimSpace(contact[:semicolon])
+	}
+	return strings.TrimSpace(contact)
+}
+
+// outboundTarget returns an unexpired SIP Outbound binding of the user
+// together with the flow it was registered over
+func (s *Server) outboundTarget(aor string) (*Binding, *Flow) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, binding := range s.bindings[aor] {
+		if binding.FlowToken == "" || now.After(binding.Expires) {
+			continue
+		}
+		for _, flow := range s.flows {
+			if flow.Token == binding.FlowToken {
+				return binding, flow
+			}
+		}
+	}
+	return nil, nil
+}
+
+// lookup returns the unexpired bindings of a user, most recent last
+func (s *Server) lookup(aor string) []*Binding {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var bindings []*Binding
+	for _, binding := range s.bindings[aor] {
+		if now.Before(binding.Expires) {
+			bindings = append(bindings, binding)
+		}
+	}
+	return bindings
+}
+
+// contactSource returns the address a registered contact was registered
+// from, for requests addressed to the contact itself
+func (s *Server) contactSource(uri string) net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, bindings := range s.bindings {
+		for _, binding := range bindings {
+			if now.Before(binding.Expires) && strings.EqualFold(contactURI(binding.Contact), uri) {
+				return binding.Source
+			}
+		}
+	}
+	return nil
+}
+
+// contactTarget returns where requests for a registered user are sent: the
+// most recent binding, or the registrar entry of a user registered without
+// a Contact. ok is false when the user is not registered.
+func (s *Server) contactTarget(aor string) (requestURI string, target net.Addr, ok bool) {
+	if bindings := s.lookup(aor); len(bindings) > 0 {
+		binding := bindings[len(bindings)-1]
+		return contactURI(binding.Contact), binding.Source, true
+	}
+
+	s.mu.Lock()
+	addr := s.registrar[aor]
+	registered := s.registered(aor)
+	s.mu.Unlock()
+	if !registered {
+		return "", nil, false
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return "", nil, false
+	}
+	return aor, udpAddr, true
+}
+
+// registeredFrom reports whether a request from addr comes from where a
+// user registered: the source of an unexpired binding or of its flow, or of
+// a registration without a Contact. The caller must hold s.mu.
+func (s *Server) registeredFrom(aor string, addr net.Addr) bool {
+	source := flowKey(addr)
+	now := time.Now()
+	for _, binding := range s.bindings[aor] {
+		if !now.Before(binding.Expires) {
+			continue
+		}
+		if binding.Source != nil && flowKey(binding.Source) == source {
+			return true
+		}
+		for _, flow := range s.flows {
+			if binding.FlowToken != "" && flow.Token == binding.FlowToken && flowKey(flow.Remote) == source {
+				return true
+			}
+		}
+	}
+	return len(s.bindings[aor]) == 0 && s.registered(aor) && s.registrar[aor] == addr.String()
+}
+
+// registered reports whether a user has an unexpired binding, or registered
+// without a Contact. The caller must hold s.mu.
+func (s *Server) registered(aor string) bool {
+	now := time.Now()
+	for _, binding := range s.bindings[aor] {
+		if now.Before(binding.Expires) {
+			return true
+		}
+	}
+	_, ok := s.registrar[aor]
+	return ok && len(s.bindings[aor]) == 0
+}
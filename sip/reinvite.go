@@ -0,0 +1,282 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ErrRequestPending is returned when a session modification collides with
+// another one that has not completed yet (RFC 3261 14.1)
+var ErrRequestPending = errors.New("request pending")
+
+// glareDelay returns how long to wait before retrying a re-INVITE that got
+// 491: longer for the side that owns the Call-ID so both do not retry at
+// once (RFC 3261 14.1)
+func glareDelay(d *Dialog) time.Duration {
+	if d.owner {
+		return time.Duration(210+rand.Intn(190)) * 10 * time.Millisecond
+	}
+	return time.Duration(rand.Intn(200)) * 10 * time.Millisecond
+}
+
+// handleReinvite answers an INVITE within a call the server is a party of.
+// An offer in it is answered in the 2xx; without one the 2xx carries the
+// server's session description as an offer, answered in the ACK.
+func (s *Server) handleReinvite(addr net.Addr, msg *Message) {
+	d := s.dialogSession(msg)
+	if d == nil {
+		if s.finalizeInvite(msg) {
+			s.sendResponse(addr, NewResponse("481", "Call/Transaction Does Not Exist", msg))
+		}
+		return
+	}
+
+	// Glare: both sides tried to modify the session at the same time
+	s.mu.Lock()
+	var pending *Message
+	switch {
+	case d.inviteSent || d.offerSent:
+		pending = NewResponse("491", "Request Pending", msg)
+	case d.inviteReceived:
+		pending = NewResponse("500", "Server Internal Error", msg)
+		pending.Headers["Retry-After"] = strconv.Itoa(rand.Intn(11))
+	default:
+		d.inviteReceived = true
+	}
+	s.mu.Unlock()
+	if pending != nil {
+		if s.finalizeInvite(msg) {
+			s.sendResponse(addr, pending)
+		}
+		return
+	}
+	defer func() {
+		s.mu.Lock()
+		d.inviteReceived = false
+		s.mu.Unlock()
+	}()
+
+	resp := NewResponse("200", "OK", msg)
+	resp.Headers["Contact"] = s.contactHeader()
+	if offer := sdpBody(msg); offer != "" {
+		answer, err := s.answerOffer(d, offer)
+		if err != nil {
+			log.Printf("offer in re-INVITE of %s rejected: %v", d.CallID, err)
+			if s.finalizeInvite(msg) {
+				s.sendResponse(addr, NewResponse("488", "Not Acceptable Here", msg))
+			}
+			return
+		}
+		setSDPBody(resp, answer)
+		log.Printf("call %s modified, media %s", d.CallID, sdpDirection(offer))
+	} else {
+		s.mu.Lock()
+		local := d.LocalSDP
+		d.offerSent = local != ""
+		s.mu.Unlock()
+		if local != "" {
+			setSDPBody(resp, local)
+		}
+	}
+	s.updateRecvInfo(d, msg)
+	s.addRecvInfo(msg, resp)
+	s.negotiateSessionTimer(msg, resp)
+
+	if !s.finalizeInvite(msg) {
+		return
+	}
+	s.sendResponse(addr, resp)
+	if sdpBody(msg) == "" && sdpBody(resp) != "" {
+		s.awaitAck(d, addr, resp)
+	}
+	s.sessionRefreshed(msg.Headers["Call-ID"], resp, false)
+}
+
+// awaitAck retransmits a 2xx carrying an offer of the server until the ACK
+// with the answer arrives (RFC 3261 13.3.1.4). Without an ACK within the
+// transaction timeout the offer is given up, so that the session can be
+// modified again.
+func (s *Server) awaitAck(d *Dialog, addr net.Addr, resp *Message) {
+	deadline := time.Now().Add(s.transactionTimeout)
+	interval := timerT1
+	var retransmit func()
+	retransmit = func() {
+		s.mu.Lock()
+		if d.ackPending != resp {
+			s.mu.Unlock()
+			return
+		}
+		if time.Now().After(deadline) {
+			d.ackPending = nil
+			d.offerSent = false
+			s.mu.Unlock()
+			log.Printf("no ACK for the offer of call %s", d.CallID)
+			return
+		}
+		interval *= 2
+		if interval > timerT2 {
+			interval = timerT2
+		}
+		time.AfterFunc(interval, retransmit)
+		s.mu.Unlock()
+		s.sendResponse(addr, resp)
+	}
+
+	s.mu.Lock()
+	d.ackPending = resp
+	time.AfterFunc(interval, retransmit)
+	s.mu.Unlock()
+}
+
+// sessionAcknowledged takes the answer to an offer the server sent in the
+// 2xx of an offerless re-INVITE from the ACK
+func (s *Server) sessionAcknowledged(msg *Message) {
+	d := s.dialogSession(msg)
+	if d == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !d.offerSent {
+		return
+	}
+	d.offerSent = false
+	d.ackPending = nil
+	if answer := sdpBody(msg); answer != "" {
+		d.RemoteSDP = answer
+	}
+}
+
+// handleUpdate answers UPDATE requests within a call the server is a party
+// of (RFC 3311). They refresh its session timer and may carry an offer.
+func (s *Server) handleUpdate(addr net.Addr, msg *Message) {
+	d := s.dialogSession(msg)
+	if d == nil {
+		s.sendResponse(addr, NewResponse("481", "Call/Transaction Does Not Exist", msg))
+		return
+	}
+	if resp := s.checkSessionInterval(msg); resp != nil {
+		s.sendResponse(addr, resp)
+		return
+	}
+
+	resp := NewResponse("200", "OK", msg)
+	resp.Headers["Contact"] = s.contactHeader()
+	if offer := sdpBody(msg); offer != "" {
+		// An offer crossing one of the server's is refused (RFC 3311 5.2)
+		s.mu.Lock()
+		glare := d.offerSent
+		s.mu.Unlock()
+		if glare {
+			s.sendResponse(addr, NewResponse("491", "Request Pending", msg))
+			return
+		}
+
+		answer, err := s.answerOffer(d, offer)
+		if err != nil {
+			log.Printf("offer in UPDATE of %s rejected: %v", d.CallID, err)
+			s.sendResponse(addr, NewResponse("488", "Not Acceptable Here", msg))
+			return
+		}
+		setSDPBody(resp, answer)
+		log.Printf("call %s updated, media %s", d.CallID, sdpDirection(offer))
+	}
+	s.updateRecvInfo(d, msg)
+	s.addRecvInfo(msg, resp)
+	s.negotiateSessionTimer(msg, resp)
+	s.sendResponse(addr, resp)
+	s.sessionRefreshed(msg.Headers["Call-ID"], resp, false)
+}
+
+// sendReinvite sends a re-INVITE within a call the server is a party of,
+// keeping the offer/answer state of the dialog. It returns ErrRequestPending
+// while another re-INVITE or offer of the dialog is outstanding. onResponse
+// gets every response, or nil on timeout; 2xx responses are acknowledged.
+func (s *Server) sendReinvite(d *Dialog, req *Message, onResponse responseHandler) error {
+	offer := sdpBody(req)
+
+	s.mu.Lock()
+	if d.inviteSent || d.inviteReceived || d.offerSent {
+		s.mu.Unlock()
+		return ErrRequestPending
+	}
+	d.inviteSent = true
+	d.offerSent = offer != ""
+	s.mu.Unlock()
+
+	finish := func() {
+		s.mu.Lock()
+		d.inviteSent = false
+		d.offerSent = false
+		s.mu.Unlock()
+	}
+
+	err := s.sendRequest(d.target, req, func(resp *Message) {
+		if resp != nil && resp.StatusCode() < 200 {
+			onResponse(resp)
+			return
+		}
+		finish()
+		if resp != nil && resp.StatusCode() < 300 {
+			s.ackSuccess(d.target, req, resp)
+			if answer := sdpBody(resp); offer != "" && answer != "" {
+				s.mu.Lock()
+				d.LocalSDP = offer
+				d.RemoteSDP = answer
+				s.mu.Unlock()
+			}
+		}
+		onResponse(resp)
+	})
+	if err != nil {
+		finish()
+	}
+	return err
+}
+
+// ModifySession sends a re-INVITE with a new offer within a call the
+// server is a party of, for example to put it on hold, and returns the
+// answer. A re-INVITE colliding with one from the peer is retried once
+// after the delay of RFC 3261 14.1.
+func (s *Server) ModifySession(callID, offer string) (string, error) {
+	d := s.lookupSession(callID)
+	if d == nil {
+		return "", fmt.Errorf("no call %s", callID)
+	}
+
+	for attempt := 0; ; attempt++ {
+		req := s.newDialogRequest(d, "INVITE")
+		setSDPBody(req, offer)
+
+		result := make(chan *Message, 1)
+		err := s.sendReinvite(d, req, func(resp *Message) {
+			if resp == nil || resp.StatusCode() >= 200 {
+				result <- resp
+			}
+		})
+		if err != nil {
+			return "", err
+		}
+
+		resp := <-result
+		switch {
+		case resp == nil:
+			return "", fmt.Errorf("re-INVITE of %s timed out", callID)
+		case resp.StatusCode() < 300:
+			s.sessionRefreshed(callID, resp, true)
+			return sdpBody(resp), nil
+		case resp.StatusCode() == 491 && attempt == 0:
+			time.Sleep(glareDelay(d))
+		case resp.StatusCode() == 491:
+			return "", ErrRequestPending
+		default:
+			return "", fmt.Errorf("re-INVITE of %s rejected: %s", callID, resp.StartLine)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package sip
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testOffer returns an SDP offer for one audio stream in the given direction
+func testOffer(direction string) string {
+	return "v=0\r\no=alice 1 1 IN IP4 127.0.0.1\r\ns=-\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\n" +
+		"m=audio 49170 RTP/AVP 0\r\na=rtpmap:0 PCMU/8000\r\na=" + direction + "\r\n"
+}
+
+// newTestReinvite builds a re-INVITE from alice within an answered call
+func newTestReinvite(ok *Message, cseq, branch, offer string) *Message {
+	msg := newTestInvite("sip:127.0.0.1:5060", ok.Headers["Call-ID"])
+	msg.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=" + branch
+	msg.Headers["To"] = ok.Headers["To"]
+	msg.Headers["CSeq"] = cseq + " INVITE"
+	if offer != "" {
+		setSDPBody(msg, offer)
+	}
+	return msg
+}
+
+func TestReinviteHold(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	invite := newTestInvite("sip:bob@example.com", "hold-call")
+	setSDPBody(invite, testOffer("sendrecv"))
+	server.handleInvite(addr, invite)
+	ok := lastSent(t, mockConn)
+	if ok.StatusCode() != 200 || !strings.Contains(ok.Body, "a=sendrecv") {
+		t.Fatalf("Offer of the INVITE not answered: %s", ok.String())
+	}
+
+	server.handleInvite(addr, newTestReinvite(ok, "2", "z9hG4bKhold1", testOffer("sendonly")))
+	resp := lastSent(t, mockConn)
+	if resp.StatusCode() != 200 || resp.Headers["Content-Type"] != "application/sdp" {
+		t.Fatalf("Wrong re-INVITE response: %s", resp.String())
+	}
+	if !strings.Contains(resp.Body, "a=recvonly") || !strings.Contains(resp.Body, "m=audio ") || strings.Contains(resp.Body, "49170") {
+		t.Errorf("Hold not answered with recvonly: %s", resp.Body)
+	}
+
+	d := server.lookupSession("hold-call")
+	if d.RemoteSDP != testOffer("sendonly") || d.LocalSDP != resp.Body {
+		t.Errorf("Dialog session descriptions not updated: %q / %q", d.RemoteSDP, d.LocalSDP)
+	}
+}
+
+func TestOfferlessReinvite(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	invite := newTestInvite("sip:bob@example.com", "offerless-call")
+	setSDPBody(invite, testOffer("sendrecv"))
+	server.handleInvite(addr, invite)
+	ok := lastSent(t, mockConn)
+
+	// The 2xx to an offerless re-INVITE carries the server's offer
+	server.handleInvite(addr, newTestReinvite(ok, "2", "z9hG4bKofferless1", ""))
+	resp := lastSent(t, mockConn)
+	if resp.StatusCode() != 200 || resp.Body != ok.Body {
+		t.Fatalf("Expected the current session description as offer, got %s", resp.String())
+	}
+
+	ack := NewMessage()
+	ack.StartLine = "ACK sip:127.0.0.1:5060 SIP/2.0"
+	ack.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKofferless2"
+	ack.Headers["From"] = invite.Headers["From"]
+	ack.Headers["To"] = ok.Headers["To"]
+	ack.Headers["Call-ID"] = "offerless-call"
+	ack.Headers["CSeq"] = "2 ACK"
+	setSDPBody(ack, testOffer("inactive"))
+	server.handleAck(addr, ack)
+
+	d := server.lookupSession("offerless-call")
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if d.RemoteSDP != testOffer("inactive") || d.offerSent {
+		t.Errorf("Answer in the ACK not applied: %q", d.RemoteSDP)
+	}
+}
+
+func TestOfferlessReinviteLostAck(t *testing.T) {
+	server := setupTestServer(t)
+	server.transactionTimeout = 1200 * time.Millisecond
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	invite := newTestInvite("sip:bob@example.com", "lost-ack-call")
+	setSDPBody(invite, testOffer("sendrecv"))
+	server.handleInvite(addr, invite)
+	ok := lastSent(t, mockConn)
+
+	server.handleInvite(addr, newTestReinvite(ok, "2", "z9hG4bKlostack1", ""))
+	offers := func() int {
+		n := 0
+		for _, msg := range sentMessages(t, mockConn) {
+			if msg.StatusCode() == 200 && msg.Headers["CSeq"] == "2 INVITE" {
+				n++
+			}
+		}
+		return n
+	}
+	// Without the ACK the 2xx is retransmitted
+	waitFor(t, "2xx retransmission", func() bool { return offers() > 1 })
+
+	// After the timeout the offer is given up and the session can be modified again
+	d := server.lookupSession("lost-ack-call")
+	waitFor(t, "offer given up", func() bool {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return !d.offerSent
+	})
+	server.handleInvite(addr, newTestReinvite(ok, "3", "z9hG4bKlostack2", testOffer("sendonly")))
+	if resp := lastSent(t, mockConn); resp.StatusCode() != 200 {
+		t.Errorf("Re-INVITE after a lost ACK not accepted: %s", resp.String())
+	}
+}
+
+func TestReinviteGlare(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	invite := newTestInvite("sip:bob@example.com", "glare-call")
+	setSDPBody(invite, testOffer("sendrecv"))
+	server.handleInvite(addr, invite)
+	ok := lastSent(t, mockConn)
+
+	type result struct {
+		answer string
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		answer, err := server.ModifySession("glare-call", testOffer("sendonly"))
+		done <- result{answer, err}
+	}()
+
+	var reinvite *Message
+	waitFor(t, "re-INVITE from the server", func() bool {
+		if invites := sentRequests(t, mockConn, "INVITE"); len(invites) > 0 {
+			reinvite = invites[0]
+		}
+		return reinvite != nil
+	})
+	if reinvite.Headers["CSeq"] != "1 INVITE" || reinvite.Body != testOffer("sendonly") {
+		t.Errorf("Wrong re-INVITE: %s", reinvite.String())
+	}
+
+	// A re-INVITE from the caller crosses ours
+	server.handleInvite(addr, newTestReinvite(ok, "2", "z9hG4bKglare1", testOffer("sendrecv")))
+	if code := lastSent(t, mockConn).StatusCode(); code != 491 {
+		t.Fatalf("Expected 491 Request Pending, got %d", code)
+	}
+	if _, err := server.ModifySession("glare-call", testOffer("inactive")); err != ErrRequestPending {
+		t.Errorf("Expected ErrRequestPending, got %v", err)
+	}
+
+	answered := NewResponse("200", "OK", reinvite)
+	setSDPBody(answered, testOffer("recvonly"))
+	server.handleMessage(addr, []byte(answered.String()))
+
+	select {
+	case r := <-done:
+		if r.err != nil || r.answer != testOffer("recvonly") {
+			t.Fatalf("Wrong result: %q, %v", r.answer, r.err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ModifySession did not return")
+	}
+	if acks := sentRequests(t, mockConn, "ACK"); len(acks) != 1 {
+		t.Errorf("Expected the 2xx to be acknowledged, got %d ACKs", len(acks))
+	}
+	d := server.lookupSession("glare-call")
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if d.LocalSDP != testOffer("sendonly") || d.RemoteSDP != testOffer("recvonly") {
+		t.Errorf("Dialog session descriptions not updated: %q / %q", d.LocalSDP, d.RemoteSDP)
+	}
+}
+
+func TestUpdateOffer(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	ok := answeredTestCall(t, server, addr, "update-call")
+
+	update := NewMessage()
+	update.StartLine = "UPDATE sip:127.0.0.1:5060 SIP/2.0"
+	update.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKupdate2"
+	update.Headers["From"] = "<sip:alice@example.com>;tag=123"
+	update.Headers["To"] = ok.Headers["To"]
+	update.Headers["Call-ID"] = "update-call"
+	update.Headers["CSeq"] = "2 UPDATE"
+	setSDPBody(update, testOffer("recvonly"))
+	server.handleUpdate(addr, update)
+
+	resp := lastSent(t, mockConn)
+	if resp.StatusCode() != 200 || !strings.Contains(resp.Body, "a=sendonly") {
+		t.Fatalf("Wrong UPDATE response: %s", resp.String())
+	}
+
+	// An offer without streams cannot be answered
+	update.Headers["CSeq"] = "3 UPDATE"
+	setSDPBody(update, "v=0\r\ns=-\r\n")
+	server.handleUpdate(addr, update)
+	if code := lastSent(t, mockConn).StatusCode(); code != 488 {
+		t.Errorf("Expected 488, got %d", code)
+	}
+}
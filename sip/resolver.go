@@ -0,0 +1,300 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Target is a transport address a request can be sent to
+type Target struct {
+	Transport string // "udp", "tcp" or "tls"
+	IP        net.IP
+	Port      int
+	Host      string // domain name the target was resolved from
+}
+
+// Addr returns the network address of the target
+func (t Target) Addr() net.Addr {
+	switch t.Transport {
+	case "udp":
+		return &net.UDPAddr{IP: t.IP, Port: t.Port}
+	case "tls":
+		return &tlsAddr{TCPAddr: &net.TCPAddr{IP: t.IP, Port: t.Port}, ServerName: t.Host}
+	default:
+		return &net.TCPAddr{IP: t.IP, Port: t.Port}
+	}
+}
+
+// String formats the target for logging
+func (t Target) String() string {
+	return t.Transport + ":" + net.JoinHostPort(t.IP.String(), strconv.Itoa(t.Port))
+}
+
+// naptrServices maps RFC 3263 NAPTR services to transports
+var naptrServices = map[string]string{
+	"SIP+D2U":  "udp",
+	"SIP+D2T":  "tcp",
+	"SIPS+D2T": "tls",
+}
+
+// srvPrefixes maps transports to their SRV service names
+var srvPrefixes = map[string]string{
+	"udp": "_sip._udp.",
+	"tcp": "_sip._tcp.",
+	"tls": "_sips._tcp.",
+}
+
+// Resolver locates SIP servers for a URI as described in RFC 3263
+type Resolver struct {
+	client     DNSClient
+	timeout    time.Duration
+	transports []string // supported transports in order of preference
+	mu         sync.Mutex
+	rand       *rand.Rand
+}
+
+// NewResolver creates a resolver using the given DNS client
+func NewResolver(client DNSClient) *Resolver {
+	return &Resolver{
+		client:     client,
+		timeout:    5 * time.Second,
+		transports: []string{"udp", "tcp", "tls"},
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Resolve returns the targets for a SIP URI in the order they should be tried
+func (r *Resolver) Resolve(ctx context.Context, uri string) ([]Target, error) {
+	u, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	host := u.Host
+	if maddr, ok := u.Params["maddr"]; ok && maddr != "" {
+		host = maddr
+	}
+	transport := strings.ToLower(u.Params["transport"])
+	if u.Scheme == "sips" {
+		transport = "tls"
+	}
+
+	// Numeric IP addresses and explicit ports skip NAPTR and SRV (RFC 3263 4.1, 4.2)
+	if ip := net.ParseIP(host); ip != nil || u.Port != 0 {
+		if transport == "" {
+			transport = "udp"
+		}
+		port := u.Port
+		if port == 0 {
+			port = defaultPort(transport)
+		}
+		if ip != nil {
+			return []Target{{Transport: transport, IP: ip, Port: port, Host: host}}, nil
+		}
+		return r.lookupHost(ctx, host, transport, port)
+	}
+
+	// An explicit transport only needs an SRV lookup
+	if transport != "" {
+		return r.resolveTransport(ctx, host, transport)
+	}
+
+	targets, err := r.resolveNAPTR(ctx, host, u.Scheme == "sips")
+	if err != nil || len(targets) > 0 {
+		return targets, err
+	}
+
+	// Without NAPTR records, try SRV for every supported transport
+	for _, t := range r.transports {
+		if u.Scheme == "sips" && t != "tls" {
+			continue
+		}
+		srvTargets, err := r.lookupSRV(ctx, srvPrefixes[t]+host, t)
+		if err != nil {
+			log.Printf("Skipping %s for %s: %v", t, host, err)
+			continue
+		}
+		targets = append(targets, srvTargets...)
+	}
+	if len(targets) > 0 {
+		return targets, nil
+	}
+
+	// Finally fall back to address records
+	transport = "udp"
+	if u.Scheme == "sips" {
+		transport = "tls"
+	}
+	return r.lookupHost(ctx, host, transport, defaultPort(transport))
+}
+
+// resolveNAPTR follows NAPTR records to SRV records for the supported transports
+func (r *Resolver) resolveNAPTR(ctx context.Context, host string, secure bool) ([]Target, error) {
+	records, err := r.client.LookupNAPTR(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("NAPTR lookup for %s failed: %v", host, err)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Order != records[j].Order {
+			return records[i].Order < records[j].Order
+		}
+		return records[i].Preference < records[j].Preference
+	})
+
+	var targets []Target
+	var lastErr error
+	for _, record := range records {
+		transport, ok := naptrServices[strings.ToUpper(record.Service)]
+		if !ok || !r.supports(transport) || (secure && transport != "tls") {
+			continue
+		}
+		if !strings.EqualFold(record.Flags, "s") || record.Replacement == "" {
+			continue
+		}
+
+		srvTargets, err := r.lookupSRV(ctx, record.Replacement, transport)
+		if err != nil {
+			log.Printf("Skipping NAPTR record %s of %s: %v", record.Replacement, host, err)
+			lastErr = err
+			continue
+		}
+		targets = append(targets, srvTargets...)
+	}
+	if len(targets) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return targets, nil
+}
+
+// resolveTransport resolves a host for a known transport via SRV, falling
+// back to address records on the default port
+func (r *Resolver) resolveTransport(ctx context.Context, host, transport string) ([]Target, error) {
+	prefix, ok := srvPrefixes[transport]
+	if !ok {
+		return nil, fmt.Errorf("unsupported transport: %s", transport)
+	}
+
+	targets, err := r.lookupSRV(ctx, prefix+host, transport)
+	if err != nil || len(targets) > 0 {
+		return targets, err
+	}
+	return r.lookupHost(ctx, host, transport, defaultPort(transport))
+}
+
+// lookupSRV resolves an SRV name into targets ordered by priority and weight
+func (r *Resolver) lookupSRV(ctx context.Context, name, transport string) ([]Target, error) {
+	records, err := r.client.LookupSRV(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("SRV lookup for %s failed: %v", name, err)
+	}
+
+	var targets []Target
+	var lastErr error
+	for _, record := range r.orderSRV(records) {
+		host := strings.TrimSuffix(record.Target, ".")
+		if host == "" {
+			continue // "." means the service is not available
+		}
+		hostTargets, err := r.lookupHost(ctx, host, transport, int(record.Port))
+		if err != nil {
+			log.Printf("Skipping SRV target %s of %s: %v", host, name, err)
+			lastErr = err
+			continue
+		}
+		targets = append(targets, hostTargets...)
+	}
+	if len(targets) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return targets, nil
+}
+
+// lookupHost resolves the A and AAAA records of host
+func (r *Resolver) lookupHost(ctx context.Context, host, transport string, port int) ([]Target, error) {
+	ips, err := r.client.LookupIP(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("address lookup for %s failed: %v", host, err)
+	}
+
+	targets := make([]Target, 0, len(ips))
+	for _, ip := range ips {
+		targets = append(targets, Target{Transport: transport, IP: ip, Port: port, Host: host})
+	}
+	return targets, nil
+}
+
+// orderSRV sorts SRV records by priority and orders records of equal
+// priority by weighted random selection (RFC 2782)
+func (r *Resolver) orderSRV(records []*net.SRV) []*net.SRV {
+	sorted := append([]*net.SRV(nil), records...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ordered := make([]*net.SRV, 0, len(sorted))
+	for start := 0; start < len(sorted); {
+		end := start
+		for end < len(sorted) && sorted[end].Priority == sorted[start].Priority {
+			end++
+		}
+
+		group := append([]*net.SRV(nil), sorted[start:end]...)
+		for len(group) > 0 {
+			total := 0
+			for _, record := range group {
+				total += int(record.Weight)
+			}
+
+			pick := 0
+			if total > 0 {
+				n := r.rand.Intn(total + 1)
+				running := 0
+				for i, record := range group {
+					running += int(record.Weight)
+					if running >= n {
+						pick = i
+						break
+					}
+				}
+			}
+			ordered = append(ordered, group[pick])
+			group = append(group[:pick], group[pick+1:]...)
+		}
+		start = end
+	}
+
+	return ordered
+}
+
+// supports reports whether the resolver may return targets for transport
+func (r *Resolver) supports(transport string) bool {
+	for _, t := range r.transports {
+		if t == transport {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultPort returns the default port of a transport
+func defaultPort(transport string) int {
+	if transport == "tls" {
+		return 5061
+	}
+	return 5060
+}
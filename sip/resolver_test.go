@@ -0,0 +1,235 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newStubResolver(t *testing.T, records []dnsRecord) *Resolver {
+	t.Helper()
+	return NewResolver(NewDNSClient(startStubDNS(t, records)))
+}
+
+func targetStrings(targets []Target) string {
+	var parts []string
+	for _, target := range targets {
+		parts = append(parts, target.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestResolveNAPTR(t *testing.T) {
+	resolver := newStubResolver(t, []dnsRecord{
+		{Name: "example.com", Type: dnsTypeNAPTR, NAPTR: &NAPTR{Order: 20, Preference: 10, Flags: "s", Service: "SIP+D2U", Replacement: "_sip._udp.example.com"}},
+		{Name: "example.com", Type: dnsTypeNAPTR, NAPTR: &NAPTR{Order: 10, Preference: 10, Flags: "s", Service: "SIP+D2T", Replacement: "_sip._tcp.example.com"}},
+		{Name: "example.com", Type: dnsTypeNAPTR, NAPTR: &NAPTR{Order: 5, Preference: 10, Flags: "s", Service: "SIP+D2X", Replacement: "_sip._sctp.example.com"}},
+		{Name: "_sip._tcp.example.com", Type: dnsTypeSRV, SRV: &net.SRV{Priority: 1, Weight: 0, Port: 5080, Target: "tcp.example.com"}},
+		{Name: "_sip._udp.example.com", Type: dnsTypeSRV, SRV: &net.SRV{Priority: 1, Weight: 0, Port: 5070, Target: "udp.example.com"}},
+		{Name: "tcp.example.com", Type: dnsTypeA, IP: net.ParseIP("192.0.2.1")},
+		{Name: "udp.example.com", Type: dnsTypeA, IP: net.ParseIP("192.0.2.2")},
+	})
+
+	targets, err := resolver.Resolve(context.Background(), "sip:bob@example.com")
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if got := targetStrings(targets); got != "tcp:192.0.2.1:5080 udp:192.0.2.2:5070" {
+		t.Errorf("Wrong targets: %s", got)
+	}
+	if targets[0].Host != "tcp.example.com" {
+		t.Errorf("Wrong target host: %s", targets[0].Host)
+	}
+}
+
+func TestResolveSRVPriority(t *testing.T) {
+	resolver := newStubResolver(t, []dnsRecord{
+		{Name: "_sip._udp.example.com", Type: dnsTypeSRV, SRV: &net.SRV{Priority: 20, Weight: 10, Port: 5060, Target: "backup.example.com"}},
+		{Name: "_sip._udp.example.com", Type: dnsTypeSRV, SRV: &net.SRV{Priority: 10, Weight: 50, Port: 5060, Target: "primary1.example.com"}},
+		{Name: "_sip._udp.example.com", Type: dnsTypeSRV, SRV: &net.SRV{Priority: 10, Weight: 50, Port: 5060, Target: "primary2.example.com"}},
+		{Name: "primary1.example.com", Type: dnsTypeA, IP: net.ParseIP("192.0.2.1")},
+		{Name: "primary2.example.com", Type: dnsTypeA, IP: net.ParseIP("192.0.2.2")},
+		{Name: "backup.example.com", Type: dnsTypeA, IP: net.ParseIP("192.0.2.3")},
+	})
+
+	targets, err := resolver.Resolve(context.Background(), "sip:example.com;transport=udp")
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if len(targets) != 3 {
+		t.Fatalf("Expected 3 targets, got %s", targetStrings(targets))
+	}
+	if targets[2].IP.String() != "192.0.2.3" {
+		t.Errorf("Lower priority target should be last: %s", targetStrings(targets))
+	}
+	if targets[0].IP.Equal(targets[1].IP) {
+		t.Errorf("Equal priority targets should both be present: %s", targetStrings(targets))
+	}
+}
+
+// failingDNS is a DNS client whose lookups of some names fail
+type failingDNS struct {
+	DNSClient
+	failing map[string]bool
+}
+
+func (c *failingDNS) LookupSRV(ctx context.Context, name string) ([]*net.SRV, error) {
+	if c.failing[name] {
+		return nil, errors.New("server failure")
+	}
+	return c.DNSClient.LookupSRV(ctx, name)
+}
+
+func (c *failingDNS) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if c.failing[host] {
+		return nil, errors.New("server failure")
+	}
+	return c.DNSClient.LookupIP(ctx, host)
+}
+
+func TestResolveSkipsFailures(t *testing.T) {
+	client := &failingDNS{
+		DNSClient: NewDNSClient(startStubDNS(t, []dnsRecord{
+			{Name: "_sip._udp.example.com", Type: dnsTypeSRV, SRV: &net.SRV{Priority: 10, Weight: 0, Port: 5060, Target: "broken.example.com"}},
+			{Name: "_sip._udp.example.com", Type: dnsTypeSRV, SRV: &net.SRV{Priority: 20, Weight: 0, Port: 5060, Target: "backup.example.com"}},
+			{Name: "_sip._tcp.example.com", Type: dnsTypeSRV, SRV: &net.SRV{Priority: 10, Weight: 0, Port: 5060, Target: "tcp.example.com"}},
+			{Name: "backup.example.com", Type: dnsTypeA, IP: net.ParseIP("192.0.2.3")},
+			{Name: "tcp.example.com", Type: dnsTypeA, IP: net.ParseIP("192.0.2.4")},
+		})),
+		failing: map[string]bool{"broken.example.com": true, "_sips._tcp.example.com": true},
+	}
+	resolver := NewResolver(client)
+	ctx := context.Background()
+
+	// A failing SRV target and a failing transport are skipped
+	targets, err := resolver.Resolve(ctx, "sip:bob@example.com")
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if got := targetStrings(targets); got != "udp:192.0.2.3:5060 tcp:192.0.2.4:5060" {
+		t.Errorf("Wrong targets: %s", got)
+	}
+
+	// Resolution fails when no target is left
+	client.failing["backup.example.com"] = true
+	if targets, err := resolver.Resolve(ctx, "sip:bob@example.com;transport=udp"); err == nil {
+		t.Errorf("Expected an error, got %s", targetStrings(targets))
+	}
+}
+
+func TestOrderSRVWeight(t *testing.T) {
+	resolver := NewResolver(nil)
+	records := []*net.SRV{
+		{Priority: 1, Weight: 1, Target: "light"},
+		{Priority: 1, Weight: 1000, Target: "heavy"},
+	}
+
+	heavyFirst := 0
+	for i := 0; i < 100; i++ {
+		if resolver.orderSRV(records)[0].Target == "heavy" {
+			heavyFirst++
+		}
+	}
+	if heavyFirst < 90 {
+		t.Errorf("Heavy target chosen first only %d/100 times", heavyFirst)
+	}
+}
+
+func TestResolveFallbacks(t *testing.T) {
+	resolver := newStubResolver(t, []dnsRecord{
+		{Name: "_sip._tcp.srv-only.com", Type: dnsTypeSRV, SRV: &net.SRV{Priority: 1, Weight: 1, Port: 5090, Target: "sip.srv-only.com"}},
+		{Name: "sip.srv-only.com", Type: dnsTypeA, IP: net.ParseIP("192.0.2.20")},
+		{Name: "a-only.com", Type: dnsTypeA, IP: net.ParseIP("192.0.2.30")},
+		{Name: "a-only.com", Type: dnsTypeAAAA, IP: net.ParseIP("2001:db8::30")},
+	})
+	ctx := context.Background()
+
+	testCases := []struct {
+		uri      string
+		expected string
+	}{
+		{"sip:alice@srv-only.com", "tcp:192.0.2.20:5090"},
+		{"sip:alice@a-only.com", "udp:192.0.2.30:5060 udp:[2001:db8::30]:5060"},
+		{"sips:alice@a-only.com", "tls:192.0.2.30:5061 tls:[2001:db8::30]:5061"},
+		{"sip:alice@a-only.com:5080;transport=tcp", "tcp:192.0.2.30:5080 tcp:[2001:db8::30]:5080"},
+		{"sip:alice@192.0.2.99", "udp:192.0.2.99:5060"},
+		{"sip:alice@192.0.2.99;transport=tcp", "tcp:192.0.2.99:5060"},
+		{"sip:alice@unknown.com;maddr=192.0.2.98", "udp:192.0.2.98:5060"},
+	}
+
+	for _, tc := range testCases {
+		targets, err := resolver.Resolve(ctx, tc.uri)
+		if err != nil {
+			t.Errorf("%s: Resolve failed: %v", tc.uri, err)
+			continue
+		}
+		if got := targetStrings(targets); got != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.uri, tc.expected, got)
+		}
+	}
+}
+
+func TestForwardFailover(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	server.SetDomains([]string{"example.com"})
+	server.SetResolver(newStubResolver(t, []dnsRecord{
+		{Name: "_sip._udp.remote.com", Type: dnsTypeSRV, SRV: &net.SRV{Priority: 1, Port: 5060, Target: "first.remote.com"}},
+		{Name: "_sip._udp.remote.com", Type: dnsTypeSRV, SRV: &net.SRV{Priority: 2, Port: 5060, Target: "second.remote.com"}},
+		{Name: "_sip._udp.remote.com", Type: dnsTypeSRV, SRV: &net.SRV{Priority: 3, Port: 5060, Target: "third.remote.com"}},
+		{Name: "first.remote.com", Type: dnsTypeA, IP: net.ParseIP("192.0.2.1")},
+		{Name: "second.remote.com", Type: dnsTypeA, IP: net.ParseIP("192.0.2.2")},
+		{Name: "third.remote.com", Type: dnsTypeA, IP: net.ParseIP("192.0.2.3")},
+	}))
+	server.transactionTimeout = 100 * time.Millisecond
+
+	callerAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	server.handleInvite(callerAddr, newTestInvite("sip:carol@remote.com", "failover-call-1"))
+
+	lastPacket := func() (*Message, *net.UDPAddr) {
+		packets := mockConn.GetSentPackets()
+		last := packets[len(packets)-1]
+		msg, err := ParseMessage(string(last.Data))
+		if err != nil {
+			t.Fatalf("Failed to parse sent message: %v", err)
+		}
+		return msg, last.Addr
+	}
+
+	invite, target := lastPacket()
+	if invite.Method() != "INVITE" || target.IP.String() != "192.0.2.1" {
+		t.Fatalf("INVITE not sent to first target: %s to %v", invite.StartLine, target)
+	}
+
+	// 503 from the first target fails over to the second without relaying the 503
+	server.handleResponse(target, NewResponse("503", "Service Unavailable", invite))
+	packets := mockConn.GetSentPackets()
+	for _, packet := range packets {
+		if packet.Addr.Port == 12345 && strings.HasPrefix(string(packet.Data), "SIP/2.0 503") {
+			t.Error("503 was relayed to the caller")
+		}
+	}
+	invite, target = lastPacket()
+	if invite.Method() != "INVITE" || target.IP.String() != "192.0.2.2" {
+		t.Fatalf("INVITE not failed over to second target: %s to %v", invite.StartLine, target)
+	}
+
+	// A timeout fails over to the third target
+	waitFor(t, "INVITE to third target", func() bool {
+		for _, packet := range mockConn.GetSentPackets() {
+			if packet.Addr.IP.String() == "192.0.2.3" && strings.HasPrefix(string(packet.Data), "INVITE") {
+				return true
+			}
+		}
+		return false
+	})
+
+	// With no targets left, the caller gets 408
+	waitFor(t, "408 to the caller", func() bool {
+		resp, target := lastPacket()
+		return resp.StatusCode() == 408 && target.Port == 12345
+	})
+}
@@ -0,0 +1,211 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SetRecordRoute makes the server insert Record-Route into the dialog
+// creating requests it forwards, so that the requests within the dialogs
+// pass through it as well (RFC 3261 16.6)
+func (s *Server) SetRecordRoute(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recordRoute = enabled
+}
+
+// ownURI reports whether a Route value or Request-URI names the server
+func (s *Server) ownURI(uri string) bool {
+	u, err := ParseURI(uri)
+	if err != nil {
+		return false
+	}
+	host, port, err := net.SplitHostPort(s.viaSentBy())
+	if err != nil {
+		return false
+	}
+	uriPort := u.Port
+	if uriPort == 0 {
+		transport := strings.ToLower(u.Params["transport"])
+		if u.Scheme == "sips" {
+			transport = "tls"
+		}
+		uriPort = defaultPort(transport)
+	}
+	return strings.EqualFold(u.Host, host) && strconv.Itoa(uriPort) == port
+}
+
+// processRoute applies the Route processing of RFC 3261 16.4 to a received
+// request. A Request-URI the server put into a Record-Route, placed there by
+// a strict router, is replaced with the last Route value, and the Route
+// values naming the server are removed. It reports whether the request
+// reached the server through its Record-Route.
+func (s *Server) processRoute(msg *Message) bool {
+	routes := splitHeaderValues(msg.Headers["Route"])
+	routed := false
+
+	if u, err := ParseURI(msg.RequestURI()); err == nil && len(routes) > 0 && s.ownURI(msg.RequestURI()) {
+		if _, lr := u.Params["lr"]; lr {
+			last := routes[len(routes)-1]
+			msg.StartLine = fmt.Sprintf("%s %s SIP/2.0", msg.Method(), contactURI(last))
+			routes = routes[:len(routes)-1]
+			routed = true
+		}
+	}
+	for len(routes) > 0 && s.ownURI(contactURI(routes[0])) {
+		routes = routes[1:]
+		routed = true
+	}
+
+	if len(routes) > 0 {
+		msg.Headers["Route"] = strings.Join(routes, ", ")
+	} else {
+		delete(msg.Headers, "Route")
+	}
+	return routed
+}
+
+// nextHop returns where a request goes after Route processing: the URI of
+// its top Route value, or else its Request-URI when it is a request within
+// a dialog that reached the server through its Record-Route. ok is false
+// when the request is for the server itself or its location service.
+func (s *Server) nextHop(msg *Message, routed bool) (uri string, ok bool) {
+	if route := topHeaderValue(msg.Headers["Route"]); route != "" {
+		return contactURI(route), true
+	}
+	if _, inDialog := headerParam(msg.Headers["To"], "tag"); !routed || !inDialog || s.ownURI(msg.RequestURI()) {
+		return "", false
+	}
+	return msg.RequestURI(), true
+}
+
+// nextHopAddr returns the address requests to a URI are sent to: the source
+// of a registered contact, or else the first server located through DNS
+func (s *Server) nextHopAddr(uri string) (net.Addr, error) {
+	if addr := s.contactSource(uri); addr != nil {
+		return addr, nil
+	}
+	targets, err := s.resolver.Resolve(context.Background(), uri)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no servers found for %s", uri)
+	}
+	return targets[0].Addr(), nil
+}
+
+// routeRequest forwards a request with Route values beyond the server's
+// own, or a request within a record-routed dialog, to its next hop with the
+// Request-URI unchanged (RFC 3261 16.6). It reports whether it did.
+func (s *Server) routeRequest(addr net.Addr, msg *Message, routed bool) bool {
+	uri, ok := s.nextHop(msg, routed)
+	if !ok {
+		return false
+	}
+	method := msg.Method()
+
+	// The ACK of a non-2xx response ends at the server's INVITE transaction
+	if method == "ACK" {
+		s.mu.Lock()
+		_, answered := s.invites[serverTransactionKey(msg)]
+		s.mu.Unlock()
+		if answered {
+			return false
+		}
+	}
+	if method == "INVITE" {
+		s.startInviteTransaction(addr, msg)
+		s.sendResponse(addr, NewResponse("100", "Trying", msg))
+	}
+
+	target, err := s.nextHopAddr(uri)
+	if err == nil {
+		err = s.forwardRequest(addr, msg, msg.RequestURI(), target)
+	}
+	if err != nil {
+		log.Printf("routing %s to %s failed: %v", method, uri, err)
+		if method != "ACK" && (method != "INVITE" || s.finalizeInvite(msg)) {
+			s.sendResponse(addr, NewResponse("503", "Service Unavailable", msg))
+		}
+		return true
+	}
+
+	if method == "BYE" {
+		s.forgetRenumbering(msg.Headers["Call-ID"])
+		s.stopSessionTimer(msg.Headers["Call-ID"])
+		s.setCallState(msg, "")
+	}
+	return true
+}
+
+// recordRouteURI returns the Record-Route value of the server for a transport
+func (s *Server) recordRouteURI(transport string) string {
+	uri := "<sip:" + s.viaSentBy()
+	if transport != "udp" {
+		uri += ";transport=" + transport
+	}
+	return uri + ";lr>"
+}
+
+// addRecordRoute inserts the server's Record-Route into a dialog creating
+// request forwarded from one address to another when enabled. Requests
+// crossing transports get one value for each, the upper one facing the
+// downstream side (RFC 5658).
+func (s *Server) addRecordRoute(fwd *Message, from, to net.Addr) {
+	s.mu.Lock()
+	recordRoute := s.recordRoute
+	s.mu.Unlock()
+	if !recordRoute {
+		return
+	}
+	switch fwd.Method() {
+	case "INVITE", "SUBSCRIBE", "REFER":
+	default:
+		return
+	}
+	if _, inDialog := headerParam(fwd.Headers["To"], "tag"); inDialog {
+		return
+	}
+	s.insertRecordRoute(fwd, from, to)
+}
+
+// insertRecordRoute puts the server's Record-Route values on top of those
+// of a forwarded request
+func (s *Server) insertRecordRoute(fwd *Message, from, to net.Addr) {
+	values := s.recordRouteURI(to.Network())
+	if from.Network() != to.Network() {
+		values += ", " + s.recordRouteURI(from.Network())
+	}
+	if existing := fwd.Headers["Record-Route"]; existing != "" {
+		values += ", " + existing
+	}
+	fwd.Headers["Record-Route"] = values
+}
+
+// routeSets splits the Record-Route of a response to a request the server
+// forwarded into the route sets of its two sides: the values downstream of
+// the server, in the order the server uses them, and the upstream ones
+func (s *Server) routeSets(resp *Message) (downstream, upstream []string) {
+	values := splitHeaderValues(resp.Headers["Record-Route"])
+	first, last := -1, -1
+	for i, value := range values {
+		if s.ownURI(contactURI(value)) {
+			if first == -1 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if first == -1 {
+		return nil, nil
+	}
+	for i := first - 1; i >= 0; i-- {
+		downstream = append(downstream, values[i])
+	}
+	return downstream, values[last+1:]
+}
@@ -0,0 +1,188 @@
+package sip
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// sentTo returns the messages the server sent to addr
+func sentTo(t *testing.T, mockConn *MockConn, addr net.Addr) []*Message {
+	t.Helper()
+	var msgs []*Message
+	for _, packet := range mockConn.GetSentPackets() {
+		if packet.Addr.String() != addr.String() {
+			continue
+		}
+		msg, err := ParseMessage(string(packet.Data))
+		if err != nil {
+			t.Fatalf("Failed to parse sent message: %v", err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func TestRecordRoute(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetDomains([]string{"example.com"})
+	server.SetRecordRoute(true)
+	mockConn := server.conn.(*MockConn)
+	aliceAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	bobAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.9"), Port: 5080}
+
+	invite := newTestInvite("sip:bob@127.0.0.9:5080", "record-route")
+	invite.Headers["Session-Expires"] = "1800"
+	server.handleMessage(aliceAddr, []byte(invite.String()))
+
+	forwarded := sentTo(t, mockConn, bobAddr)
+	if len(forwarded) != 1 || forwarded[0].Headers["Record-Route"] != "<sip:192.0.2.10:5060;lr>" {
+		t.Fatalf("Expected a record-routed INVITE, got %v", forwarded)
+	}
+
+	ok := NewResponse("200", "OK", forwarded[0])
+	ok.Headers["To"] += ";tag=bob1"
+	ok.Headers["Contact"] = "<sip:bob@127.0.0.9:5080>"
+	ok.Headers["Session-Expires"] = "1800;refresher=uac"
+	server.handleMessage(bobAddr, []byte(ok.String()))
+	relayed := lastSent(t, mockConn)
+	if relayed.StatusCode() != 200 || relayed.Headers["Record-Route"] != "<sip:192.0.2.10:5060;lr>" {
+		t.Fatalf("Wrong relayed 200: %s", relayed.String())
+	}
+	server.mu.Lock()
+	_, timed := server.sessionTimers["record-route"]
+	server.mu.Unlock()
+	if !timed {
+		t.Error("Session timer of the record-routed call not tracked")
+	}
+
+	// The BYE follows the route set through the server to bob's contact
+	bye := NewMessage()
+	bye.StartLine = "BYE sip:bob@127.0.0.9:5080 SIP/2.0"
+	bye.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKrrbye"
+	bye.Headers["Route"] = "<sip:192.0.2.10:5060;lr>"
+	bye.Headers["From"] = invite.Headers["From"]
+	bye.Headers["To"] = ok.Headers["To"]
+	bye.Headers["Call-ID"] = "record-route"
+	bye.Headers["CSeq"] = "2 BYE"
+	bye.Headers["Max-Forwards"] = "70"
+	server.handleMessage(aliceAddr, []byte(bye.String()))
+
+	forwarded = sentTo(t, mockConn, bobAddr)
+	fwd := forwarded[len(forwarded)-1]
+	if fwd.Method() != "BYE" || fwd.RequestURI() != "sip:bob@127.0.0.9:5080" {
+		t.Fatalf("BYE not routed to bob: %s", fwd.String())
+	}
+	if _, ok := fwd.Headers["Route"]; ok {
+		t.Errorf("Own Route not removed: %q", fwd.Headers["Route"])
+	}
+	server.mu.Lock()
+	_, timed = server.sessionTimers["record-route"]
+	server.mu.Unlock()
+	if timed {
+		t.Error("Session timer kept after BYE")
+	}
+}
+
+func TestLooseAndStrictRouting(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	aliceAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	proxyAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.8"), Port: 5070}
+	bobAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.9"), Port: 5080}
+
+	// A preloaded Route is followed after the server's own entry is removed
+	msg := newTestMessage("sip:bob@example.com", "hi")
+	msg.Headers["Route"] = "<sip:192.0.2.10:5060;lr>, <sip:127.0.0.8:5070;lr>"
+	server.handleMessage(aliceAddr, []byte(msg.String()))
+	forwarded := sentTo(t, mockConn, proxyAddr)
+	if len(forwarded) != 1 || forwarded[0].RequestURI() != "sip:bob@example.com" || forwarded[0].Headers["Route"] != "<sip:127.0.0.8:5070;lr>" {
+		t.Fatalf("Request not loose routed: %v", forwarded)
+	}
+
+	// A strict router put the server's Record-Route into the Request-URI
+	bye := newTestInfo(NewResponse("200", "OK", newTestInvite("sip:bob@example.com", "strict")), "2", "", "", "")
+	bye.StartLine = "BYE sip:192.0.2.10:5060;lr SIP/2.0"
+	bye.Headers["CSeq"] = "2 BYE"
+	bye.Headers["To"] += ";tag=bob1"
+	bye.Headers["Route"] = "<sip:bob@127.0.0.9:5080>"
+	server.handleMessage(aliceAddr, []byte(bye.String()))
+	forwarded = sentTo(t, mockConn, bobAddr)
+	if len(forwarded) != 1 || forwarded[0].RequestURI() != "sip:bob@127.0.0.9:5080" || forwarded[0].Headers["Route"] != "" {
+		t.Fatalf("Strict route not fixed up: %v", forwarded)
+	}
+}
+
+func TestDoubleRecordRoute(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetRecordRoute(true)
+	udp := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	tcp := &net.TCPAddr{IP: net.ParseIP("127.0.0.9"), Port: 5080}
+
+	fwd := newTestInvite("sip:bob@example.com", "double")
+	fwd.Headers["Record-Route"] = "<sip:p1.example.com;lr>"
+	server.addRecordRoute(fwd, udp, tcp)
+	want := "<sip:192.0.2.10:5060;transport=tcp;lr>, <sip:192.0.2.10:5060;lr>, <sip:p1.example.com;lr>"
+	if fwd.Headers["Record-Route"] != want {
+		t.Errorf("Record-Route = %q, want %q", fwd.Headers["Record-Route"], want)
+	}
+
+	// Each side of the server gets the route set beyond it
+	resp := NewResponse("200", "OK", fwd)
+	resp.Headers["Record-Route"] = "<sip:p2.example.com;lr>, " + want
+	downstream, upstream := server.routeSets(resp)
+	if len(downstream) != 1 || downstream[0] != "<sip:p2.example.com;lr>" {
+		t.Errorf("Wrong downstream route set: %v", downstream)
+	}
+	if len(upstream) != 1 || upstream[0] != "<sip:p1.example.com;lr>" {
+		t.Errorf("Wrong upstream route set: %v", upstream)
+	}
+
+	// In-dialog requests are not record-routed
+	bye := fwd.Clone()
+	bye.StartLine = "BYE sip:bob@127.0.0.9:5080 SIP/2.0"
+	bye.Headers["To"] += ";tag=bob1"
+	delete(bye.Headers, "Record-Route")
+	server.addRecordRoute(bye, udp, tcp)
+	if _, ok := bye.Headers["Record-Route"]; ok {
+		t.Error("BYE was record-routed")
+	}
+}
+
+func TestDialogRouteSet(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	invite := newTestInvite("sip:bob@example.com", "route-set")
+	invite.Headers["Record-Route"] = "<sip:p1.example.com;lr>, <sip:p2.example.com;lr>"
+	server.handleInvite(addr, invite)
+	if ok := lastSent(t, mockConn); ok.Headers["Record-Route"] != invite.Headers["Record-Route"] {
+		t.Errorf("Record-Route not returned in the 200: %s", ok.String())
+	}
+
+	server.endSession(server.lookupSession("route-set"))
+	bye := sentRequests(t, mockConn, "BYE")
+	if len(bye) != 1 || bye[0].Headers["Route"] != "<sip:p1.example.com;lr>, <sip:p2.example.com;lr>" {
+		t.Errorf("BYE does not use the route set: %v", bye)
+	}
+}
+
+func TestWildcardBindAddr(t *testing.T) {
+	// A server bound to every interface does not advertise the wildcard
+	server := NewServer("5060")
+	for _, value := range []string{server.recordRouteURI("udp"), server.contactHeader()} {
+		if strings.Contains(value, "0.0.0.0") {
+			t.Errorf("Unroutable address advertised: %s", value)
+		}
+	}
+	host, _, _ := net.SplitHostPort(server.viaSentBy())
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		t.Errorf("Expected an interface address, got %s", host)
+	}
+
+	server.SetAdvertisedAddr("pbx.example.com")
+	if uri := server.recordRouteURI("udp"); uri != "<sip:pbx.example.com:5060;lr>" {
+		t.Errorf("Advertised address not used: %s", uri)
+	}
+}
@@ -0,0 +1,190 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+)
+
+// sdpContentType is the body type of session descriptions (RFC 4566)
+const sdpContentType = "application/sdp"
+
+// OfferHandler produces the SDP answer to an offer received in a call the
+// server is a party of. Returning an error rejects the offer with 488.
+type OfferHandler func(d *Dialog, offer string) (string, error)
+
+// SetOfferHandler installs the function that answers SDP offers. By
+// default the server accepts every plain RTP stream of an offer with its
+// formats and the direction reversed, so that hold and resume work.
+func (s *Server) SetOfferHandler(handler OfferHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offerHandler = handler
+}
+
+// sdpBody returns the session description a message carries, if any
+func sdpBody(msg *Message) string {
+	contentType := strings.TrimSpace(strings.SplitN(msg.Headers["Content-Type"], ";", 2)[0])
+	if !strings.EqualFold(contentType, sdpContentType) {
+		return ""
+	}
+	return msg.Body
+}
+
+// setSDPBody puts a session description into a message
+func setSDPBody(msg *Message, sdp string) {
+	msg.Headers["Content-Type"] = sdpContentType
+	msg.Body = sdp
+	msg.Headers["Content-Length"] = fmt.Sprintf("%d", len(sdp))
+}
+
+// answerOffer answers an offer received in a dialog and records both
+// session descriptions on it once the offer is accepted
+func (s *Server) answerOffer(d *Dialog, offer string) (string, error) {
+	s.mu.Lock()
+	handler := s.offerHandler
+	s.mu.Unlock()
+
+	if handler == nil {
+		handler = s.defaultAnswer
+	}
+	answer, err := handler(d, offer)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	d.RemoteSDP = offer
+	d.LocalSDP = answer
+	s.mu.Unlock()
+	return answer, nil
+}
+
+// sdpDirections maps the direction attribute of an offered stream to the
+// one of its answer (RFC 3264 6.1)
+var sdpDirections = map[string]string{
+	"a=sendrecv": "a=sendrecv",
+	"a=sendonly": "a=recvonly",
+	"a=recvonly": "a=sendonly",
+	"a=inactive": "a=inactive",
+}
+
+// sdpAttributes lists the attributes that describe the formats of an
+// offered stream rather than the offerer, and are kept in the answer
+var sdpAttributes = []string{"a=rtpmap:", "a=fmtp:", "a=ptime:", "a=maxptime:"}
+
+// sdpSecureProtos are the transports whose keys the server cannot answer
+var sdpSecureProtos = map[string]bool{
+	"RTP/SAVP":          true,
+	"RTP/SAVPF":         true,
+	"UDP/TLS/RTP/SAVP":  true,
+	"UDP/TLS/RTP/SAVPF": true,
+}
+
+// rtpPortMin and rtpPortRange bound the ports of the server's media streams
+const (
+	rtpPortMin   = 16384
+	rtpPortRange = 8192
+)
+
+// defaultAnswer accepts every plain RTP stream of an offer with its formats,
+// reversing its direction, at the server's address and its own ports.
+// Attributes describing the offerer's transport, such as keys, ICE
+// candidates and a=setup, are dropped, and secure streams are rejected.
+func (s *Server) defaultAnswer(d *Dialog, offer string) (string, error) {
+	host, _, err := net.SplitHostPort(s.viaSentBy())
+	if err != nil {
+		host = s.viaSentBy()
+	}
+	addrType := "IP4"
+	if strings.Contains(host, ":") {
+		addrType = "IP6"
+	}
+
+	s.mu.Lock()
+	if d.sdpID == 0 {
+		d.sdpID = rand.Int63n(1<<62) + 1
+	}
+	if d.mediaPort == 0 {
+		d.mediaPort = rtpPortMin + 2*rand.Intn(rtpPortRange/2)
+	}
+	d.sdpVersion++
+	id, version, port := d.sdpID, d.sdpVersion, d.mediaPort
+	s.mu.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "v=0\r\no=- %d %d IN %s %s\r\ns=-\r\nc=IN %s %s\r\nt=0 0\r\n",
+		id, version, addrType, host, addrType, host)
+
+	streams, accepted := 0, 0
+	rejected := false
+	for _, line := range strings.Split(strings.ReplaceAll(offer, "\r\n", "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "m=") {
+			// m=<media> <port> <proto> <fmt> ...
+			fields := strings.Fields(strings.TrimPrefix(line, "m="))
+			if len(fields) < 4 {
+				return "", fmt.Errorf("malformed media line %q", line)
+			}
+			rejected = fields[1] == "0" || sdpSecureProtos[fields[2]]
+			fields[1] = "0"
+			if !rejected {
+				// Each stream gets an RTP port and the odd RTCP port above
+				fields[1] = fmt.Sprintf("%d", port+2*streams)
+				accepted++
+			}
+			streams++
+			b.WriteString("m=" + strings.Join(fields, " ") + "\r\n")
+			continue
+		}
+		// Session-level lines other than the direction describe the offerer
+		if streams == 0 && !sdpIsDirection(line) || rejected {
+			continue
+		}
+		if direction, ok := sdpDirections[line]; ok {
+			b.WriteString(direction + "\r\n")
+			continue
+		}
+		for _, prefix := range sdpAttributes {
+			if strings.HasPrefix(line, prefix) {
+				b.WriteString(line + "\r\n")
+				break
+			}
+		}
+	}
+	if streams == 0 {
+		return "", errors.New("offer has no media streams")
+	}
+	if accepted == 0 {
+		return "", errors.New("offer has no acceptable media streams")
+	}
+	return b.String(), nil
+}
+
+// sdpIsDirection reports whether an SDP line is a direction attribute
+func sdpIsDirection(line string) bool {
+	_, ok := sdpDirections[line]
+	return ok
+}
+
+// sdpDirection returns the direction of the first stream of a session
+// description, or of the whole session, defaulting to sendrecv
+func sdpDirection(sdp string) string {
+	direction := "sendrecv"
+	media := false
+	for _, line := range strings.Split(strings.ReplaceAll(sdp, "\r\n", "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "m=") {
+			if media {
+				break
+			}
+			media = true
+		}
+		if sdpIsDirection(line) {
+			direction = strings.TrimPrefix(line, "a=")
+		}
+	}
+	return direction
+}
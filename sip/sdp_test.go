@@ -0,0 +1,84 @@
+package sip
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDefaultAnswer(t *testing.T) {
+	server := setupTestServer(t)
+	d := &Dialog{CallID: "sdp-answer"}
+
+	answer, err := server.defaultAnswer(d, testOffer("sendonly"))
+	if err != nil {
+		t.Fatalf("Offer rejected: %v", err)
+	}
+	port := d.mediaPort
+	if port < rtpPortMin || port%2 != 0 {
+		t.Errorf("Wrong media port %d", port)
+	}
+	for _, line := range []string{"v=0", "c=IN IP4 192.0.2.10", fmt.Sprintf("m=audio %d RTP/AVP 0", port), "a=rtpmap:0 PCMU/8000", "a=recvonly"} {
+		if !strings.Contains(answer, line+"\r\n") {
+			t.Errorf("Answer lacks %q:\n%s", line, answer)
+		}
+	}
+	if strings.Contains(answer, "127.0.0.1") || strings.Contains(answer, "49170") {
+		t.Errorf("Answer carries the offerer's address:\n%s", answer)
+	}
+
+	// The version of the server's session description grows with each answer
+	again, _ := server.defaultAnswer(d, testOffer("sendrecv"))
+	if !strings.Contains(again, " 2 IN IP4 ") || sdpDirection(again) != "sendrecv" ||
+		!strings.Contains(again, fmt.Sprintf("m=audio %d ", port)) {
+		t.Errorf("Wrong second answer:\n%s", again)
+	}
+
+	if _, err := server.defaultAnswer(d, "v=0\r\ns=-\r\n"); err == nil {
+		t.Error("Offer without streams accepted")
+	}
+
+	// Transport attributes of the offerer are not echoed, secure streams
+	// are rejected and further streams get ports of their own
+	offer := "v=0\r\no=alice 1 1 IN IP4 127.0.0.1\r\ns=-\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\n" +
+		"a=ice-ufrag:F7gI\r\na=ice-pwd:x9cml/YzichV2+XlhiMu8g\r\n" +
+		"m=audio 49170 RTP/AVP 0 101\r\na=rtpmap:0 PCMU/8000\r\na=fmtp:101 0-15\r\na=ptime:20\r\n" +
+		"a=setup:actpass\r\na=rtcp:49171\r\na=candidate:1 1 UDP 2130706431 127.0.0.1 49170 typ host\r\n" +
+		"m=audio 49172 RTP/SAVP 0\r\na=crypto:1 AES_CM_128_HMAC_SHA1_80 inline:PS1uQCVeeCFCanVmcjkpPywjNWhcYD0mXXtxaVBR\r\n" +
+		"m=video 51372 RTP/AVP 31\r\na=rtpmap:31 H261/90000\r\n"
+	answer, err = server.defaultAnswer(d, offer)
+	if err != nil {
+		t.Fatalf("Offer rejected: %v", err)
+	}
+	for _, line := range []string{fmt.Sprintf("m=audio %d RTP/AVP 0 101", port), "a=fmtp:101 0-15", "a=ptime:20",
+		"m=audio 0 RTP/SAVP 0", fmt.Sprintf("m=video %d RTP/AVP 31", port+4)} {
+		if !strings.Contains(answer, line+"\r\n") {
+			t.Errorf("Answer lacks %q:\n%s", line, answer)
+		}
+	}
+	for _, attr := range []string{"a=ice-", "a=setup", "a=rtcp", "a=candidate", "a=crypto", "127.0.0.1"} {
+		if strings.Contains(answer, attr) {
+			t.Errorf("Answer carries %q of the offerer:\n%s", attr, answer)
+		}
+	}
+
+	secure := "v=0\r\ns=-\r\nt=0 0\r\nm=audio 49172 RTP/SAVP 0\r\na=crypto:1 AES_CM_128_HMAC_SHA1_80 inline:key\r\n"
+	if _, err := server.defaultAnswer(d, secure); err == nil {
+		t.Error("Offer with only secure streams accepted")
+	}
+}
+
+func TestSDPBody(t *testing.T) {
+	msg := NewMessage()
+	msg.Body = testOffer("sendrecv")
+	if sdpBody(msg) != "" {
+		t.Error("Body without Content-Type taken as SDP")
+	}
+	msg.Headers["Content-Type"] = "Application/SDP; charset=utf-8"
+	if sdpBody(msg) != msg.Body {
+		t.Error("SDP body not recognized")
+	}
+	if sdpDirection(testOffer("inactive")) != "inactive" {
+		t.Error("Wrong direction")
+	}
+}
@@ -1,10 +1,13 @@
 package sip
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"strings"
+	"sync"
+	"time"
 )
 
 // UDPConnInterface abstracts the UDP connection methods needed by the server
@@ -14,23 +17,155 @@ type UDPConnInterface interface {
 	Close() error
 }
 
+// requestHandler processes a request received from addr
+type requestHandler func(addr net.Addr, msg *Message)
+
 // Server represents a SIP server
 type Server struct {
-	Port      string
-	BindAddr  string
-	conn      UDPConnInterface
-	registrar map[string]string // user -> address mapping
-	calls     map[string]string // callID -> status mapping
+	Port           string
+	BindAddr       string
+	AdvertisedAddr string
+	conn           UDPConnInterface
+	localHost      string    // address advertised when bound to a wildcard address
+	localHostOnce  sync.Once // looks localHost up once
+	mu             sync.Mutex
+	registrar      map[string]string             // user -> address mapping
+	calls          map[string]string             // callID -> status mapping
+	bindings       map[string][]*Binding         // user -> registered contacts
+	flows          map[string]*Flow              // flow key -> client flow
+	proxied        map[string]*proxyTransaction  // branch -> forwarded request
+	invites        map[string]*inviteTransaction // transaction key -> INVITE server transaction
+	requests       map[string]*clientTransaction // branch -> request sent by the server
+	handlers       map[string]requestHandler     // method -> handler
+	extensions     []string                      // supported option tags
+	contentTypes   []string                      // accepted body types
+	peers          map[string]*peerState         // name -> monitored peer
+	subscriptions  map[string]*Subscription      // dialog ID -> subscription
+	eventPackages  map[string]EventPackage       // event name -> package
+	presence       *presenceAgent
+	dialogEvents   *dialogPackage
+	mwi            *messageSummaryPackage
+	refers         *referPackage
+	sessions       map[string]*Dialog              // Call-ID -> dialog of a call the server is a party of
+	reliable       map[string]*reliableProvisional // RAck -> provisional response awaiting PRACK
+	sessionTimers  map[string]*sessionTimer        // Call-ID -> session timer of a call
+	sessionExpires int                             // session interval the server asks for
+	minSE          int                             // smallest session interval the server accepts
+	offerHandler   OfferHandler                    // answers SDP offers, nil for the default
+	infoPackages   map[string]InfoHandler          // info package -> handler
+	dtmfHandler    DTMFHandler                     // receives DTMF from INFO requests
+	b2bua          CallHandler                     // B2BUA application, nil in proxy mode
+	bridgedCalls   map[string]*Call                // Call-ID of either leg -> B2BUA call
+	redirect       bool                            // answer requests for users with 3xx
+	stateless      bool                            // forward requests without transaction state
+	router         Router                          // routing of stateless mode, nil for the default
+	recordRoute    bool                            // insert Record-Route into forwarded requests
+	dialPlan       *DialPlan                       // routing rules, nil when disabled
+	trunks         map[string]*trunkState          // name -> trunk of a provider
+	renumbered     map[string]renumbering          // Call-ID -> CSeq offset of an authenticated trunk call
+	numbering      map[string]NumberingPlan        // domain -> numbering plan of its users
+	enum           *ENUM                           // ENUM resolver, nil when disabled
+	features       map[string]CallFeatures         // AOR -> call features of a user
+	featureStore   *featureStore                   // file the call features are saved to, nil when not saved
+	groups         map[string]*groupState          // AOR -> group ringing its members
+	flowTimer      time.Duration
+	domains        []string
+	resolver       *Resolver
+	pool           *ConnPool
+	messages       *MessageStore   // offline message queue, nil when disabled
+	delivering     map[string]bool // user -> stored messages being delivered
+	// transactionTimeout bounds how long a forwarded request waits for a response
+	transactionTimeout time.Duration
+	// timerC bounds how long a forwarded INVITE may ring after a provisional response
+	timerC time.Duration
 }
 
 // NewServer creates a new SIP server instance
 func NewServer(port string) *Server {
-	return &Server{
-		Port:      port,
-		BindAddr:  "0.0.0.0",
-		registrar: make(map[string]string),
-		calls:     make(map[string]string),
+	s := &Server{
+		Port:       port,
+		BindAddr:   "0.0.0.0",
+		registrar:  make(map[string]string),
+		calls:      make(map[string]string),
+		bindings:   make(map[string][]*Binding),
+		flows:      make(map[string]*Flow),
+		proxied:    make(map[string]*proxyTransaction),
+		invites:    make(map[string]*inviteTransaction),
+		requests:   make(map[string]*clientTransaction),
+		handlers:   make(map[string]requestHandler),
+		peers:      make(map[string]*peerState),
+		delivering: make(map[string]bool),
+		sessions:   make(map[string]*Dialog),
+		reliable:   make(map[string]*reliableProvisional),
+		minSE:      defaultMinSE,
+		refers:     newReferPackage(),
+		flowTimer:  defaultFlowTimer,
+		resolver:   NewResolver(NewDNSClient(SystemDNSServer())),
+		pool:       NewConnPool(),
+
+		subscriptions:      make(map[string]*Subscription),
+		eventPackages:      make(map[string]EventPackage),
+		sessionTimers:      make(map[string]*sessionTimer),
+		infoPackages:       make(map[string]InfoHandler),
+		bridgedCalls:       make(map[string]*Call),
+		trunks:             make(map[string]*trunkState),
+		renumbered:         make(map[string]renumbering),
+		numbering:          make(map[string]NumberingPlan),
+		features:           make(map[string]CallFeatures),
+		groups:             make(map[string]*groupState),
+		sessionExpires:     defaultSessionExpires,
+		transactionTimeout: defaultTransactionTimeout,
+		timerC:             defaultTimerC,
 	}
+
+	s.registerMethod("REGISTER", s.handleRegister)
+	s.registerMethod("INVITE", s.handleInvite)
+	s.registerMethod("ACK", s.handleAck)
+	s.registerMethod("CANCEL", s.handleCancel)
+	s.registerMethod("BYE", s.handleBye)
+	s.registerMethod("OPTIONS", s.handleOptions)
+	s.registerMethod("MESSAGE", s.handleInstantMessage)
+	s.registerMethod("SUBSCRIBE", s.handleSubscribe)
+	s.registerMethod("REFER", s.handleRefer)
+	s.registerMethod("PRACK", s.handlePrack)
+	s.registerMethod("UPDATE", s.handleUpdate)
+	s.registerMethod("INFO", s.handleInfo)
+	s.registerExtension("outbound")
+	s.registerExtension("replaces")
+	s.registerExtension("100rel")
+	s.registerExtension("timer")
+	s.registerContentType("application/sdp")
+	s.registerContentType("text/plain")
+	s.registerContentType(dtmfRelayContentType)
+	s.registerContentType(dtmfContentType)
+
+	s.presence = newPresenceAgent(s)
+	s.RegisterEventPackage(s.presence)
+	s.registerMethod("PUBLISH", s.presence.handlePublish)
+	s.registerContentType(pidfContentType)
+
+	s.dialogEvents = newDialogPackage(s)
+	s.RegisterEventPackage(s.dialogEvents)
+
+	s.mwi = newMessageSummaryPackage(s)
+	s.RegisterEventPackage(s.mwi)
+
+	return s
+}
+
+// registerMethod installs the handler of a request method
+func (s *Server) registerMethod(method string, handler requestHandler) {
+	s.handlers[method] = handler
+}
+
+// registerExtension advertises support for a SIP option tag
+func (s *Server) registerExtension(tag string) {
+	s.extensions = append(s.extensions, tag)
+}
+
+// registerContentType advertises a body type the server accepts
+func (s *Server) registerContentType(contentType string) {
+	s.contentTypes = append(s.contentTypes, contentType)
 }
 
 // SetBindAddr sets the bind address for the server
@@ -38,6 +173,42 @@ func (s *Server) SetBindAddr(addr string) {
 	s.BindAddr = addr
 }
 
+// SetAdvertisedAddr sets the address placed in Via headers of forwarded
+// requests. It defaults to the bind address.
+func (s *Server) SetAdvertisedAddr(addr string) {
+	s.AdvertisedAddr = addr
+}
+
+// SetDomains sets the domains the server is responsible for. Requests for
+// other domains are forwarded to the servers located through DNS. When no
+// domains are set, every domain is treated as local.
+func (s *Server) SetDomains(domains []string) {
+	s.domains = domains
+}
+
+// SetResolver replaces the resolver used to locate servers of other domains
+func (s *Server) SetResolver(resolver *Resolver) {
+	s.resolver = resolver
+}
+
+// SetTLSConfig sets the TLS configuration of outbound TLS connections
+func (s *Server) SetTLSConfig(config *tls.Config) {
+	s.pool.SetTLSConfig(config)
+}
+
+// isLocalDomain reports whether the server is responsible for host
+func (s *Server) isLocalDomain(host string) bool {
+	if len(s.domains) == 0 {
+		return true
+	}
+	for _, domain := range s.domains {
+		if strings.EqualFold(domain, host) {
+			return true
+		}
+	}
+	return false
+}
+
 // Start begins listening for SIP messages
 func (s *Server) Start() error {
 	// Combine bind address and port
@@ -53,6 +224,15 @@ func (s *Server) Start() error {
 	}
 	s.conn = conn
 
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return fmt.Errorf("TCP listening error: %v", err)
+	}
+	go s.serveTCP(listener)
+	go s.reapFlows()
+	s.startPingers()
+	s.startTrunks()
+
 	log.Printf("SIP server started on %s", listenAddr)
 
 	buffer := make([]byte, 65535)
@@ -64,12 +244,24 @@ func (s *Server) Start() error {
 		}
 
 		// Process received message in a separate goroutine
-		go s.handleMessage(addr, buffer[:n])
+		data := make([]byte, n)
+		copy(data, buffer[:n])
+		go s.handleMessage(addr, data)
 	}
 }
 
 // handleMessage processes incoming SIP messages
-func (s *Server) handleMessage(addr *net.UDPAddr, data []byte) {
+func (s *Server) handleMessage(addr net.Addr, data []byte) {
+	s.touchFlow(addr)
+
+	// Answer RFC 5626 CRLF keepalive pings with a single CRLF pong
+	if isKeepalivePing(data) {
+		if err := s.write(addr, []byte("\r\n")); err != nil {
+			log.Printf("keepalive pong error: %v", err)
+		}
+		return
+	}
+
 	msgStr := string(data)
 	log.Printf("received message: %s", msgStr)
 
@@ -79,68 +271,210 @@ func (s *Server) handleMessage(addr *net.UDPAddr, data []byte) {
 		return
 	}
 
+	if msg.IsResponse() {
+		s.handleResponse(addr, msg)
+		return
+	}
+	s.applyAlias(addr, msg)
+	routed := s.processRoute(msg)
+
+	// A stateless proxy forwards requests for users without further processing
+	if s.forwardStateless(addr, msg, routed) {
+		return
+	}
+	// Requests routed beyond the server go to their next hop
+	if s.routeRequest(addr, msg, routed) {
+		return
+	}
+
+	// Requests within a bridged call are passed on to its other leg
+	if s.bridgeRequest(addr, msg) {
+		return
+	}
+
 	// Process based on message type
-	if strings.HasPrefix(msg.StartLine, "REGISTER") {
-		s.handleRegister(addr, msg)
-	} else if strings.HasPrefix(msg.StartLine, "INVITE") {
-		s.handleInvite(addr, msg)
-	} else if strings.HasPrefix(msg.StartLine, "BYE") {
-		s.handleBye(addr, msg)
-	} else if strings.HasPrefix(msg.StartLine, "ACK") {
-		// ACK typically doesn't require a response
-		log.Printf("ACK received: %s", msg.Headers["Call-ID"])
-	} else {
+	handler, ok := s.handlers[msg.Method()]
+	if !ok {
 		log.Printf("unhandled message type: %s", msg.StartLine)
+		resp := NewResponse("405", "Method Not Allowed", msg)
+		resp.Headers["Allow"] = s.allowHeader()
+		s.sendResponse(addr, resp)
+		return
 	}
+
+	// Requests needing proxy extensions the server lacks are rejected (RFC
+	// 3261 16.3); Require is checked once the server handles a request as UAS
+	if method := msg.Method(); method != "ACK" && method != "CANCEL" {
+		if unsupported := s.unsupportedExtensions(msg.Headers["Proxy-Require"]); len(unsupported) > 0 {
+			resp := NewResponse("420", "Bad Extension", msg)
+			resp.Headers["Unsupported"] = strings.Join(unsupported, ", ")
+			s.sendResponse(addr, resp)
+			return
+		}
+	}
+
+	// Dialed numbers are routed in E.164, and the dial plan may rewrite the
+	// request or decide what happens to it
+	msg = s.normalizeNumber(msg)
+	if msg = s.applyDialPlan(addr, msg); msg == nil {
+		return
+	}
+
+	// In redirect mode requests for users are answered with their contacts
+	if s.redirectRequest(addr, msg) {
+		return
+	}
+	// Handlers of methods that may be proxied check Require themselves
+	switch msg.Method() {
+	case "INVITE", "MESSAGE", "SUBSCRIBE", "PUBLISH", "INFO":
+	default:
+		if s.rejectUnsupported(addr, msg) {
+			return
+		}
+	}
+	handler(addr, msg)
+}
+
+// handleAck processes ACK requests
+func (s *Server) handleAck(addr net.Addr, msg *Message) {
+	// ACK typically doesn't require a response
+	log.Printf("ACK received: %s", msg.Headers["Call-ID"])
+	s.sessionAcknowledged(msg)
 }
 
 // handleRegister processes REGISTER requests
-func (s *Server) handleRegister(addr *net.UDPAddr, msg *Message) {
+func (s *Server) handleRegister(addr net.Addr, msg *Message) {
 	// Extract user information from From header
 	fromHeader := msg.Headers["From"]
 	uri := extractSIPURI(fromHeader)
+	wildcard := isWildcard(msg)
+	if wildcard && !validWildcard(msg) {
+		s.sendResponse(addr, NewResponse("400", "Bad Request", msg))
+		return
+	}
 
 	// Register the user
+	s.mu.Lock()
+	wasRegistered := s.registered(uri)
 	s.registrar[uri] = addr.String()
+	outbound := s.updateBindings(uri, addr, msg)
+	// Removing every contact unregisters the user
+	_, hasContact := msg.Headers["Contact"]
+	online := !hasContact || len(s.bindings[uri]) > 0
+	if !online {
+		delete(s.registrar, uri)
+	}
+	changed := wasRegistered != s.registered(uri)
+	s.mu.Unlock()
 	log.Printf("user registered: %s -> %s", uri, addr.String())
 
 	// Send 200 OK response
 	resp := NewResponse("200", "OK", msg)
+	if contact, ok := msg.Headers["Contact"]; ok && !wildcard {
+		resp.Headers["Contact"] = contact
+	}
+	if outbound {
+		resp.Headers["Require"] = "outbound"
+		resp.Headers["Flow-Timer"] = fmt.Sprintf("%d", int(s.flowTimer.Seconds()))
+	}
 	s.sendResponse(addr, resp)
+
+	if online {
+		go s.deliverStoredMessages(uri)
+	}
+	// Watchers see users come online and go offline
+	if changed {
+		s.NotifySubscribers("presence", uri)
+		if online {
+			s.mwi.registered(uri)
+		}
+	}
 }
 
 // handleInvite processes INVITE requests
-func (s *Server) handleInvite(addr *net.UDPAddr, msg *Message) {
-	callID := msg.Headers["Call-ID"]
+func (s *Server) handleInvite(addr net.Addr, msg *Message) {
+	s.startInviteTransaction(addr, msg)
 
 	// Send 100 Trying response
 	tryingResp := NewResponse("100", "Trying", msg)
 	s.sendResponse(addr, tryingResp)
 
-	// Send 180 Ringing response
-	ringingResp := NewResponse("180", "Ringing", msg)
-	s.sendResponse(addr, ringingResp)
+	// Session intervals below the server's minimum are refused (RFC 4028)
+	if resp := s.checkSessionInterval(msg); resp != nil {
+		if s.finalizeInvite(msg) {
+			s.sendResponse(addr, resp)
+		}
+		return
+	}
+
+	// An INVITE within a call the server answered refreshes or modifies it
+	if _, inDialog := headerParam(msg.Headers["To"], "tag"); inDialog {
+		if !s.rejectUnsupported(addr, msg) {
+			s.handleReinvite(addr, msg)
+		}
+		return
+	}
+
+	// In B2BUA mode every new call is handed to the application
+	s.mu.Lock()
+	b2bua := s.b2bua
+	s.mu.Unlock()
+	if b2bua != nil {
+		if !s.rejectUnsupported(addr, msg) {
+			b2bua.HandleCall(s.newCall(addr, msg))
+		}
+		return
+	}
 
-	// Save call state
-	s.calls[callID] = "ringing"
+	// Calls to other domains are forwarded to their servers
+	if uri, err := ParseURI(msg.RequestURI()); err == nil && !s.isLocalDomain(uri.Host) {
+		s.setCallState(msg, "trying")
+		if err := s.forwardToURI(addr, msg, msg.RequestURI()); err != nil {
+			log.Printf("INVITE forwarding error: %v", err)
+			s.setCallState(msg, "")
+			if s.finalizeInvite(msg) {
+				s.sendResponse(addr, NewResponse("503", "Service Unavailable", msg))
+			}
+		}
+		return
+	}
 
-	// Send 200 OK response (normally sent after user accepts call)
-	okResp := NewResponse("200", "OK", msg)
-	s.sendResponse(addr, okResp)
+	// Feature codes change the call features of the caller; calls to groups
+	// ring their members, and the call features of the callee decide where
+	// other calls go
+	if s.handleFeatureCode(addr, msg) || s.ringGroup(addr, msg) || s.applyCallFeatures(addr, msg) {
+		return
+	}
 
-	// Update call state
-	s.calls[callID] = "connected"
-	log.Printf("call established: %s", callID)
+	// Route the call over the flow of a client registered with SIP Outbound
+	aor := extractSIPURI(msg.RequestURI())
+	if binding, flow := s.outboundTarget(aor); flow != nil {
+		s.setCallState(msg, "trying")
+		if err := s.forwardRequest(addr, msg, contactURI(binding.Contact), flow.Remote); err != nil {
+			log.Printf("INVITE forwarding error: %v", err)
+		}
+		return
+	}
+
+	// Calls to local users that cannot be proxied are answered by the server
+	if !s.rejectUnsupported(addr, msg) {
+		AutoAnswer{}.HandleCall(s.newCall(addr, msg))
+	}
 }
 
 // handleBye processes BYE requests
-func (s *Server) handleBye(addr *net.UDPAddr, msg *Message) {
+func (s *Server) handleBye(addr net.Addr, msg *Message) {
 	callID := msg.Headers["Call-ID"]
 
 	// Check call state
-	if _, exists := s.calls[callID]; exists {
+	s.mu.Lock()
+	_, exists := s.calls[callID]
+	delete(s.sessions, callID)
+	s.mu.Unlock()
+	s.stopSessionTimer(callID)
+	if exists {
 		// Terminate the call
-		delete(s.calls, callID)
+		s.setCallState(msg, "")
 		log.Printf("call terminated: %s", callID)
 	}
 
@@ -149,15 +483,70 @@ func (s *Server) handleBye(addr *net.UDPAddr, msg *Message) {
 	s.sendResponse(addr, resp)
 }
 
+// setCallState records the state of a call ("trying", "ringing" or
+// "connected"); an empty state ends the call. Watchers of the parties are
+// notified of changes through the dialog event package.
+func (s *Server) setCallState(msg *Message, state string) {
+	callID := msg.Headers["Call-ID"]
+
+	s.mu.Lock()
+	old, exists := s.calls[callID]
+	if state == "" {
+		delete(s.calls, callID)
+	} else {
+		s.calls[callID] = state
+	}
+	s.mu.Unlock()
+
+	if old == state || (state == "" && !exists) {
+		return
+	}
+	s.dialogEvents.callStateChanged(msg, state)
+}
+
 // sendResponse sends a SIP response message
-func (s *Server) sendResponse(addr *net.UDPAddr, msg *Message) {
-	msgStr := msg.String()
-	_, err := s.conn.WriteToUDP([]byte(msgStr), addr)
-	if err != nil {
+func (s *Server) sendResponse(addr net.Addr, msg *Message) {
+	if err := s.send(addr, msg); err != nil {
 		log.Printf("response sending error: %v", err)
 	}
 }
 
+// send writes a SIP message to the given address
+func (s *Server) send(addr net.Addr, msg *Message) error {
+	return s.write(addr, []byte(msg.String()))
+}
+
+// write sends raw data to the given address. Stream transports reuse the
+// client's flow or a pooled outbound connection.
+func (s *Server) write(addr net.Addr, data []byte) error {
+	if flow := s.lookupFlow(addr); flow != nil && flow.conn != nil {
+		_, err := flow.conn.Write(data)
+		return err
+	}
+
+	if network := addr.Network(); network == "tcp" || network == "tls" {
+		conn, dialed, err := s.pool.Get(addr)
+		if err != nil {
+			return err
+		}
+		if dialed {
+			go s.readOutbound(conn, addr)
+		}
+		if _, err := conn.Write(data); err != nil {
+			s.pool.Fail(addr, conn)
+			return err
+		}
+		return nil
+	}
+
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return fmt.Errorf("no connection to %s/%s", addr.Network(), addr.String())
+	}
+	_, err := s.conn.WriteToUDP(data, udpAddr)
+	return err
+}
+
 // extractSIPURI extracts SIP URI from header
 func extractSIPURI(header string) string {
 	// First search for sip: prefix
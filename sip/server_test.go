@@ -12,10 +12,17 @@ import (
 type MockConn struct {
 	receivedData []byte
 	sentData     []byte
+	sentPackets  []SentPacket
 	addr         *net.UDPAddr
 	mutex        sync.Mutex
 }
 
+// SentPacket is a datagram written through MockConn
+type SentPacket struct {
+	Data []byte
+	Addr *net.UDPAddr
+}
+
 // ReadFromUDP is a mock implementation that returns predefined data
 func (m *MockConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
 	m.mutex.Lock()
@@ -30,6 +37,7 @@ func (m *MockConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
 	defer m.mutex.Unlock()
 	m.sentData = make([]byte, len(b))
 	copy(m.sentData, b)
+	m.sentPackets = append(m.sentPackets, SentPacket{Data: m.sentData, Addr: addr})
 	return len(b), nil
 }
 
@@ -54,9 +62,30 @@ func (m *MockConn) GetSentData() []byte {
 	return m.sentData
 }
 
+// GetSentPackets returns every datagram that was "sent"
+func (m *MockConn) GetSentPackets() []SentPacket {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]SentPacket(nil), m.sentPackets...)
+}
+
+// waitFor polls cond until it holds or a timeout expires
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s", what)
+}
+
 func setupTestServer(t *testing.T) *Server {
 	// Create a server
 	server := NewServer("5060")
+	server.SetAdvertisedAddr("192.0.2.10")
 
 	// Create a mock connection
 	mockConn := &MockConn{}
@@ -117,6 +146,58 @@ func TestHandleRegister(t *testing.T) {
 	}
 }
 
+func TestRegisterWildcard(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	clientAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	register := func(contact, expires string) *Message {
+		msg := NewMessage()
+		msg.StartLine = "REGISTER sip:example.com SIP/2.0"
+		msg.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKwild"
+		msg.Headers["From"] = "<sip:alice@example.com>;tag=123"
+		msg.Headers["To"] = "<sip:alice@example.com>"
+		msg.Headers["Call-ID"] = "register-wildcard"
+		msg.Headers["CSeq"] = "1 REGISTER"
+		msg.Headers["Contact"] = contact
+		if expires != "" {
+			msg.Headers["Expires"] = expires
+		}
+		msg.Headers["Content-Length"] = "0"
+		server.handleRegister(clientAddr, msg)
+		return lastSent(t, mockConn)
+	}
+	register("<sip:alice@127.0.0.1:12345>, <sip:alice@127.0.0.1:12346>", "")
+	if n := len(server.lookup("sip:alice@example.com")); n != 2 {
+		t.Fatalf("Expected 2 bindings, got %d", n)
+	}
+
+	// "*" needs Expires: 0 and no other contact
+	for _, tc := range []struct{ contact, expires string }{
+		{"*", ""},
+		{"*", "3600"},
+		{"*, <sip:alice@127.0.0.1:12347>", "0"},
+	} {
+		if resp := register(tc.contact, tc.expires); resp.StatusCode() != 400 {
+			t.Errorf("%q with Expires %q: expected 400, got %s", tc.contact, tc.expires, resp.StartLine)
+		}
+	}
+	if n := len(server.lookup("sip:alice@example.com")); n != 2 {
+		t.Fatalf("Rejected wildcard changed the bindings: %d", n)
+	}
+
+	// A valid wildcard removes every binding and unregisters the user
+	resp := register("*", "0")
+	if resp.StatusCode() != 200 || resp.Headers["Contact"] != "" {
+		t.Errorf("Wrong response to the wildcard: %s", resp.String())
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.bindings["sip:alice@example.com"]) != 0 || server.registered("sip:alice@example.com") {
+		t.Error("User still registered after the wildcard")
+	}
+}
+
 func TestHandleInvite(t *testing.T) {
 	server := setupTestServer(t)
 	mockConn, ok := server.conn.(*MockConn)
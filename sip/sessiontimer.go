@@ -0,0 +1,333 @@
+package sip
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultSessionExpires is the session interval the server asks for, in seconds
+	defaultSessionExpires = 1800
+	// defaultMinSE is the smallest session interval the server accepts (RFC 4028 4)
+	defaultMinSE = 90
+)
+
+// sessionTimer keeps track of when a call was last refreshed and hangs it
+// up if it is not refreshed within the session interval (RFC 4028)
+type sessionTimer struct {
+	callID    string
+	interval  int       // session interval in seconds
+	refresher bool      // the server sends the refreshes itself
+	observed  bool      // the parties refresh the session through the server
+	call      *Call     // bridged call hung up when the session expires
+	refreshed time.Time // when the session was last refreshed
+	legs      []*Dialog // dialogs hung up when the session expires
+	timer     *time.Timer
+}
+
+// expiry returns when the session is torn down without a refresh, a little
+// before the interval ends to let the BYE arrive in time (RFC 4028 10)
+func (st *sessionTimer) expiry() time.Time {
+	margin := st.interval / 3
+	if margin > 32 {
+		margin = 32
+	}
+	return st.refreshed.Add(time.Duration(st.interval-margin) * time.Second)
+}
+
+// SetSessionTimer sets the session interval the server asks for and the
+// smallest one it accepts, both in seconds. Zero keeps the default.
+func (s *Server) SetSessionTimer(expires, minSE int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if expires > 0 {
+		s.sessionExpires = expires
+	}
+	if minSE > 0 {
+		s.minSE = minSE
+	}
+	if s.sessionExpires < s.minSE {
+		s.sessionExpires = s.minSE
+	}
+}
+
+// parseSessionExpires returns the interval and refresher parameter of a
+// message's Session-Expires header
+func parseSessionExpires(msg *Message) (int, string, bool) {
+	value, ok := msg.Headers["Session-Expires"]
+	if !ok {
+		return 0, "", false
+	}
+	interval, err := strconv.Atoi(strings.TrimSpace(strings.SplitN(value, ";", 2)[0]))
+	if err != nil {
+		return 0, "", false
+	}
+	refresher, _ := headerParam(value, "refresher")
+	return interval, strings.ToLower(refresher), true
+}
+
+// supportsSessionTimer reports whether the sender of a request supports session timers
+func supportsSessionTimer(msg *Message) bool {
+	return hasOptionTag(msg.Headers["Supported"], "timer") || hasOptionTag(msg.Headers["Require"], "timer")
+}
+
+// checkSessionInterval returns the 422 response for a request whose session
+// interval is smaller than the server accepts. Requests passed on to other
+// servers get the server's Min-SE so the callee does not go below it.
+func (s *Server) checkSessionInterval(msg *Message) *Message {
+	interval, _, ok := parseSessionExpires(msg)
+	if !ok {
+		return nil
+	}
+
+	s.mu.Lock()
+	minSE := s.minSE
+	s.mu.Unlock()
+
+	if interval < minSE {
+		resp := NewResponse("422", "Session Interval Too Small", msg)
+		resp.Headers["Min-SE"] = strconv.Itoa(minSE)
+		return resp
+	}
+	if requested, err := strconv.Atoi(strings.TrimSpace(msg.Headers["Min-SE"])); err != nil || requested < minSE {
+		msg.Headers["Min-SE"] = strconv.Itoa(minSE)
+	}
+	return nil
+}
+
+// negotiateSessionTimer picks the session interval and refresher for a
+// request the server answers and adds them to its 2xx response. The caller
+// refreshes when it supports session timers, otherwise the server does.
+func (s *Server) negotiateSessionTimer(req, resp *Message) (int, bool) {
+	s.mu.Lock()
+	interval := s.sessionExpires
+	s.mu.Unlock()
+
+	requested, refresher, ok := parseSessionExpires(req)
+	if ok && requested < interval {
+		interval = requested
+	}
+	if minSE, err := strconv.Atoi(strings.TrimSpace(req.Headers["Min-SE"])); err == nil && interval < minSE {
+		interval = minSE
+	}
+
+	supported := supportsSessionTimer(req)
+	if !supported {
+		refresher = "uas"
+	} else if refresher != "uac" && refresher != "uas" {
+		refresher = "uac"
+	}
+
+	resp.Headers["Session-Expires"] = fmt.Sprintf("%d;refresher=%s", interval, refresher)
+	if supported {
+		resp.Headers["Require"] = "timer"
+	}
+	return interval, refresher == "uas"
+}
+
+// startSessionTimer starts or restarts the session timer of a call
+func (s *Server) startSessionTimer(st *sessionTimer) {
+	st.refreshed = time.Now()
+
+	s.mu.Lock()
+	if old, ok := s.sessionTimers[st.callID]; ok {
+		old.timer.Stop()
+	}
+	s.sessionTimers[st.callID] = st
+	s.scheduleSessionTimer(st)
+	s.mu.Unlock()
+}
+
+// scheduleSessionTimer arms the next refresh when the server is the
+// refresher and the teardown otherwise. The caller holds s.mu.
+func (s *Server) scheduleSessionTimer(st *sessionTimer) {
+	if st.timer != nil {
+		st.timer.Stop()
+	}
+	if st.refresher {
+		st.timer = time.AfterFunc(time.Duration(st.interval)*time.Second/2, func() {
+			s.refreshSession(st.callID)
+		})
+		return
+	}
+	st.timer = time.AfterFunc(time.Until(st.expiry()), func() {
+		s.expireSession(st.callID)
+	})
+}
+
+// stopSessionTimer stops the session timer of a call that ended
+func (s *Server) stopSessionTimer(callID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st, ok := s.sessionTimers[callID]; ok {
+		st.timer.Stop()
+		delete(s.sessionTimers, callID)
+	}
+}
+
+// sessionRefreshed restarts the session timer of a call after a refresh
+// with the interval and refresher agreed in its 2xx response. The server
+// refreshes itself when it was the UAC of the refresh and the refresher
+// parameter says uac, or the other way round.
+func (s *Server) sessionRefreshed(callID string, resp *Message, sentByServer bool) {
+	interval, refresher, ok := parseSessionExpires(resp)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, exists := s.sessionTimers[callID]
+	if !exists {
+		return
+	}
+	if ok {
+		st.interval = interval
+		if !st.observed {
+			st.refresher = (refresher == "uac") == sentByServer
+		}
+	}
+	st.refreshed = time.Now()
+	s.scheduleSessionTimer(st)
+}
+
+// refreshSession sends a session refresh for a call the server refreshes.
+// A refresh that times out or finds no dialog ends the call; after other
+// failures the call lasts until the session interval ends.
+func (s *Server) refreshSession(callID string) {
+	s.mu.Lock()
+	st, ok := s.sessionTimers[callID]
+	if !ok || len(st.legs) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	d := st.legs[0]
+	interval := st.interval
+	s.mu.Unlock()
+
+	// Peers that accept UPDATE are refreshed without renegotiating media;
+	// a re-INVITE offers the current session description again
+	method := "INVITE"
+	if d.allowUpdate {
+		method = "UPDATE"
+	}
+	req := s.newDialogRequest(d, method)
+	req.Headers["Session-Expires"] = fmt.Sprintf("%d;refresher=uac", interval)
+	req.Headers["Supported"] = "timer"
+
+	onResponse := func(resp *Message) {
+		if resp == nil {
+			log.Printf("session refresh of %s timed out", callID)
+			s.expireSession(callID)
+			return
+		}
+
+		code := resp.StatusCode()
+		switch {
+		case code < 200:
+		case code < 300:
+			s.sessionRefreshed(callID, resp, true)
+		case code == 408 || code == 481:
+			s.expireSession(callID)
+		case code == 491:
+			// Retry after the request that crossed ours (RFC 3261 14.1)
+			time.AfterFunc(glareDelay(d), func() {
+				s.refreshSession(callID)
+			})
+		default:
+			log.Printf("session refresh of %s failed: %s", callID, resp.StartLine)
+			s.mu.Lock()
+			st.refresher = false
+			s.scheduleSessionTimer(st)
+			s.mu.Unlock()
+		}
+	}
+
+	var err error
+	if method == "INVITE" {
+		s.mu.Lock()
+		local := d.LocalSDP
+		s.mu.Unlock()
+		if local != "" {
+			setSDPBody(req, local)
+		}
+		err = s.sendReinvite(d, req, onResponse)
+	} else {
+		err = s.sendRequest(d.target, req, onResponse)
+	}
+	if err == ErrRequestPending {
+		// Retry once the exchange under way has completed
+		time.AfterFunc(glareDelay(d), func() {
+			s.refreshSession(callID)
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("session refresh sending error: %v", err)
+	}
+}
+
+// expireSession hangs up every leg of a call whose session was not refreshed in time
+func (s *Server) expireSession(callID string) {
+	s.mu.Lock()
+	st, ok := s.sessionTimers[callID]
+	delete(s.sessionTimers, callID)
+	s.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	log.Printf("session of %s expired", callID)
+	if st.call != nil {
+		st.call.end(nil)
+		return
+	}
+	for _, d := range st.legs {
+		s.endSession(d)
+	}
+}
+
+// recordRouted reports whether the server put itself on the route of a
+// dialog, so that the requests within it pass through the server
+func (s *Server) recordRouted(msg *Message) bool {
+	for _, route := range splitHeaderValues(msg.Headers["Record-Route"]) {
+		if s.ownURI(contactURI(route)) {
+			return true
+		}
+	}
+	return false
+}
+
+// trackProxiedSession follows the session timer of a call the server
+// proxies. It only does so when the server stays on the route of the call
+// and sees its refreshes; when the session expires both legs are hung up.
+func (s *Server) trackProxiedSession(txn *proxyTransaction, resp *Message) {
+	interval, refresher, ok := parseSessionExpires(resp)
+	if !ok || !s.recordRouted(resp) {
+		return
+	}
+	callID := resp.Headers["Call-ID"]
+
+	s.mu.Lock()
+	_, exists := s.sessionTimers[callID]
+	s.mu.Unlock()
+	if exists {
+		s.sessionRefreshed(callID, resp, false)
+		return
+	}
+	if txn.original.Method() != "INVITE" {
+		return
+	}
+
+	toTag, _ := headerParam(resp.Headers["To"], "tag")
+	upstream := newUASDialog(txn.upstream, txn.original, toTag)
+	downstream := newUACDialog(txn.target, txn.original, resp)
+	downstream.routeSet, upstream.routeSet = s.routeSets(resp)
+	log.Printf("session of %s expires after %ds, refreshed by the %s", callID, interval, refresher)
+	s.startSessionTimer(&sessionTimer{
+		callID:   callID,
+		interval: interval,
+		observed: true,
+		legs:     []*Dialog{upstream, downstream},
+	})
+}
@@ -0,0 +1,208 @@
+package sip
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSessionIntervalTooSmall(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	invite := newTestInvite("sip:bob@example.com", "timer-small")
+	invite.Headers["Session-Expires"] = "60"
+	server.handleInvite(addr, invite)
+
+	resp := lastSent(t, mockConn)
+	if resp.StatusCode() != 422 {
+		t.Fatalf("Expected 422, got %s", resp.StartLine)
+	}
+	if resp.Headers["Min-SE"] != "90" {
+		t.Errorf("Wrong Min-SE: %s", resp.Headers["Min-SE"])
+	}
+}
+
+func TestSessionTimerNegotiation(t *testing.T) {
+	server := setupTestServer(t)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	// A caller supporting timers refreshes the session itself
+	invite := newTestInvite("sip:bob@example.com", "timer-uac")
+	invite.Headers["Supported"] = "timer"
+	invite.Headers["Session-Expires"] = "600"
+	server.handleInvite(addr, invite)
+
+	var ok *Message
+	for _, msg := range sentMessages(t, server.conn.(*MockConn)) {
+		if msg.StatusCode() == 200 {
+			ok = msg
+		}
+	}
+	if ok == nil {
+		t.Fatal("Call was not answered")
+	}
+	if ok.Headers["Session-Expires"] != "600;refresher=uac" || ok.Headers["Require"] != "timer" {
+		t.Errorf("Wrong session timer headers: %q, %q", ok.Headers["Session-Expires"], ok.Headers["Require"])
+	}
+	server.mu.Lock()
+	st := server.sessionTimers["timer-uac"]
+	server.mu.Unlock()
+	if st == nil || st.refresher || st.interval != 600 {
+		t.Fatalf("Wrong session timer: %+v", st)
+	}
+
+	// Otherwise the server is the refresher
+	ok = answeredTestCall(t, server, addr, "timer-uas")
+	if ok.Headers["Session-Expires"] != "1800;refresher=uas" {
+		t.Errorf("Wrong Session-Expires: %s", ok.Headers["Session-Expires"])
+	}
+	if _, required := ok.Headers["Require"]; required {
+		t.Error("Require: timer sent to a caller without timer support")
+	}
+	server.mu.Lock()
+	st = server.sessionTimers["timer-uas"]
+	server.mu.Unlock()
+	if st == nil || !st.refresher {
+		t.Fatalf("Server is not the refresher: %+v", st)
+	}
+}
+
+func TestSessionRefresh(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	invite := newTestInvite("sip:bob@example.com", "timer-refresh")
+	invite.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKtimer1"
+	invite.Headers["Allow"] = "INVITE, ACK, BYE, UPDATE"
+	server.handleInvite(addr, invite)
+
+	server.refreshSession("timer-refresh")
+	updates := sentRequests(t, mockConn, "UPDATE")
+	if len(updates) != 1 {
+		t.Fatalf("Expected an UPDATE refresh, got %d", len(updates))
+	}
+	if updates[0].Headers["Session-Expires"] != "1800;refresher=uac" {
+		t.Errorf("Wrong Session-Expires: %s", updates[0].Headers["Session-Expires"])
+	}
+
+	// The caller takes over refreshing
+	resp := NewResponse("200", "OK", updates[0])
+	resp.Headers["Session-Expires"] = "900;refresher=uas"
+	server.handleMessage(addr, []byte(resp.String()))
+
+	server.mu.Lock()
+	st := server.sessionTimers["timer-refresh"]
+	refresher, interval := st.refresher, st.interval
+	server.mu.Unlock()
+	if refresher || interval != 900 {
+		t.Errorf("Refresh not applied: refresher %v, interval %d", refresher, interval)
+	}
+
+	// A refresh in an unknown dialog is rejected
+	update := NewMessage()
+	update.StartLine = "UPDATE sip:127.0.0.1:5060 SIP/2.0"
+	update.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKupdate1"
+	update.Headers["From"] = invite.Headers["From"]
+	update.Headers["To"] = "<sip:bob@example.com>;tag=unknown"
+	update.Headers["Call-ID"] = "timer-refresh"
+	update.Headers["CSeq"] = "2 UPDATE"
+	server.handleUpdate(addr, update)
+	if code := lastSent(t, mockConn).StatusCode(); code != 481 {
+		t.Errorf("Expected 481, got %d", code)
+	}
+}
+
+func TestSessionRefreshReinvite(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	ok := answeredTestCall(t, server, addr, "timer-reinvite")
+
+	reinvite := newTestInvite("sip:127.0.0.1:5060", "timer-reinvite")
+	reinvite.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKreinvite1"
+	reinvite.Headers["To"] = ok.Headers["To"]
+	reinvite.Headers["CSeq"] = "2 INVITE"
+	reinvite.Headers["Supported"] = "timer"
+	reinvite.Headers["Session-Expires"] = "300;refresher=uac"
+	server.handleInvite(addr, reinvite)
+
+	resp := lastSent(t, mockConn)
+	if resp.StatusCode() != 200 || resp.Headers["Session-Expires"] != "300;refresher=uac" {
+		t.Fatalf("Wrong re-INVITE response: %s", resp.String())
+	}
+	server.mu.Lock()
+	st := server.sessionTimers["timer-reinvite"]
+	server.mu.Unlock()
+	if st == nil || st.refresher || st.interval != 300 {
+		t.Errorf("Refresh not applied: %+v", st)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	answeredTestCall(t, server, addr, "timer-expire")
+	server.expireSession("timer-expire")
+
+	byes := sentRequests(t, mockConn, "BYE")
+	if len(byes) != 1 || byes[0].Headers["Call-ID"] != "timer-expire" {
+		t.Fatalf("Expected a BYE for the expired call, got %v", byes)
+	}
+	server.mu.Lock()
+	_, active := server.calls["timer-expire"]
+	_, timer := server.sessionTimers["timer-expire"]
+	server.mu.Unlock()
+	if active || timer {
+		t.Error("Expired call is still tracked")
+	}
+}
+
+func TestProxiedSessionExpiry(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	callerAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	calleeAddr := &net.UDPAddr{IP: net.ParseIP("192.0.2.5"), Port: 5060}
+
+	invite := newTestInvite("sip:carol@example.net", "timer-proxied")
+	invite.Headers["Contact"] = "<sip:alice@127.0.0.1:12345>"
+	txn := &proxyTransaction{original: invite, upstream: callerAddr, target: calleeAddr}
+
+	resp := NewResponse("200", "OK", invite)
+	resp.Headers["To"] += ";tag=carol1"
+	resp.Headers["Contact"] = "<sip:carol@192.0.2.5>"
+	resp.Headers["Session-Expires"] = "1800;refresher=uac"
+
+	// Without Record-Route the server does not see refreshes
+	server.trackProxiedSession(txn, resp)
+	server.mu.Lock()
+	_, tracked := server.sessionTimers["timer-proxied"]
+	server.mu.Unlock()
+	if tracked {
+		t.Fatal("Session tracked without Record-Route")
+	}
+
+	resp.Headers["Record-Route"] = "<sip:" + server.viaSentBy() + ";lr>"
+	server.trackProxiedSession(txn, resp)
+	server.expireSession("timer-proxied")
+
+	byes := sentRequests(t, mockConn, "BYE")
+	if len(byes) != 2 {
+		t.Fatalf("Expected a BYE to each leg, got %d", len(byes))
+	}
+	packets := mockConn.GetSentPackets()
+	targets := map[string]bool{}
+	for _, packet := range packets[len(packets)-2:] {
+		targets[packet.Addr.String()] = true
+	}
+	if !targets[callerAddr.String()] || !targets[calleeAddr.String()] {
+		t.Errorf("BYEs not sent to both legs: %v", targets)
+	}
+	if byes[0].RequestURI() != "sip:alice@127.0.0.1:12345" || byes[1].RequestURI() != "sip:carol@192.0.2.5" {
+		t.Errorf("Wrong BYE targets: %s, %s", byes[0].RequestURI(), byes[1].RequestURI())
+	}
+}
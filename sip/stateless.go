@@ -0,0 +1,226 @@
+package sip
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// statelessBranchPrefix marks the branches of requests forwarded statelessly,
+// so their responses can be recognized without transaction state
+const statelessBranchPrefix = branchMagicCookie + "sl"
+
+// Router chooses where a stateless proxy sends a request: the Request-URI
+// of the forwarded request and the address it is sent to. It must return
+// the same target for an INVITE, its CANCEL and its ACK.
+type Router func(req *Message) (requestURI string, target net.Addr, err error)
+
+// SetStateless switches the server to stateless proxying (RFC 3261 16.11):
+// requests are forwarded by the router and responses relayed along their
+// Via headers, without keeping transaction state
+func (s *Server) SetStateless(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stateless = enabled
+}
+
+// SetRouter sets the routing function of stateless proxying. By default
+// requests go to the registered contact of local users and to the servers
+// of other domains found through DNS.
+func (s *Server) SetRouter(router Router) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.router = router
+}
+
+// defaultRoute is the router used when the application has not set one
+func (s *Server) defaultRoute(req *Message) (string, net.Addr, error) {
+	return s.locate(req.RequestURI())
+}
+
+// statelessBranch computes the branch of a statelessly forwarded request: a
+// hash of the top Via. It only depends on values an INVITE shares with its
+// retransmissions, its CANCEL and its non-2xx ACK, so they all get the same
+// branch (RFC 3261 16.11).
+func statelessBranch(msg *Message) string {
+	via := topHeaderValue(msg.Headers["Via"])
+	key := via
+	if branch, _ := headerParam(via, "branch"); !strings.HasPrefix(branch, branchMagicCookie) {
+		// Requests of RFC 2543 clients are identified by their fields; the To
+		// tag is left out, as the non-2xx ACK carries one the INVITE lacked
+		fromTag, _ := headerParam(msg.Headers["From"], "tag")
+		cseq := strings.Fields(msg.Headers["CSeq"])
+		number := ""
+		if len(cseq) > 0 {
+			number = cseq[0]
+		}
+		key = strings.Join([]string{msg.RequestURI(), fromTag, msg.Headers["Call-ID"], number, via}, "|")
+	}
+	sum := sha256.Sum256([]byte(key))
+	return statelessBranchPrefix + hex.EncodeToString(sum[:8])
+}
+
+// forwardStateless forwards a request in stateless mode. Requests with a
+// next hop after Route processing go there; other requests without a user
+// part, such as REGISTER or OPTIONS pings of the server, are left to the
+// usual handlers. It reports whether the request was handled.
+func (s *Server) forwardStateless(addr net.Addr, msg *Message, routed bool) bool {
+	s.mu.Lock()
+	stateless := s.stateless
+	router := s.router
+	s.mu.Unlock()
+	if !stateless {
+		return false
+	}
+	nextHop, hasNextHop := s.nextHop(msg, routed)
+	if uri, err := ParseURI(msg.RequestURI()); !hasNextHop && (err != nil || uri.User == "") {
+		return false
+	}
+	if router == nil {
+		router = s.defaultRoute
+	}
+	if hasNextHop {
+		// Loose routing keeps the Request-URI (RFC 3261 16.6)
+		router = func(req *Message) (string, net.Addr, error) {
+			target, err := s.nextHopAddr(nextHop)
+			return req.RequestURI(), target, err
+		}
+	}
+	method := msg.Method()
+
+	// Only Proxy-Require concerns a proxy (RFC 3261 16.3)
+	unsupported := s.unsupportedExtensions(msg.Headers["Proxy-Require"])
+	if len(unsupported) > 0 && method != "ACK" && method != "CANCEL" {
+		resp := NewResponse("420", "Bad Extension", msg)
+		resp.Headers["Unsupported"] = strings.Join(unsupported, ", ")
+		s.sendResponse(addr, resp)
+		return true
+	}
+
+	if resp := s.checkForwarding(msg); resp != nil {
+		if method != "ACK" {
+			s.sendResponse(addr, resp)
+		}
+		return true
+	}
+
+	requestURI, target, err := router(msg)
+	if err != nil {
+		log.Printf("no route for %s %s: %v", method, msg.RequestURI(), err)
+		if method != "ACK" {
+			s.sendResponse(addr, NewResponse("404", "Not Found", msg))
+		}
+		return true
+	}
+
+	received := msg.Clone()
+	received.Headers["Via"] = receivedVia(received.Headers["Via"], addr)
+	fwd := s.proxyRequest(received, requestURI, target, statelessBranch(msg))
+	// The loop hash goes in a Via parameter of its own, as it differs
+	// between an INVITE and its non-2xx ACK
+	vias := splitHeaderValues(fwd.Headers["Via"])
+	vias[0] += ";" + loopParam + "=" + loopHash(msg)
+	fwd.Headers["Via"] = strings.Join(vias, ", ")
+	s.addRecordRoute(fwd, addr, target)
+	if err := s.send(target, fwd); err != nil {
+		log.Printf("stateless forwarding to %s failed: %v", target.String(), err)
+		if method != "ACK" {
+			s.sendResponse(addr, NewResponse("503", "Service Unavailable", msg))
+		}
+	}
+	return true
+}
+
+// receivedVia adds the received and rport parameters of RFC 3261 18.2.1 and
+// RFC 3581 to the top Via of a request from addr, so that responses can be
+// sent back without transaction state
+func receivedVia(vias string, addr net.Addr) string {
+	values := splitHeaderValues(vias)
+	if len(values) == 0 {
+		return vias
+	}
+	ip, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return vias
+	}
+
+	top := values[0]
+	if host, _ := viaSentByHostPort(top); host != ip {
+		top += ";received=" + ip
+	}
+	if rport, ok := headerParam(top, "rport"); ok && rport == "" {
+		top = strings.Replace(top, ";rport", ";rport="+port, 1)
+	}
+	values[0] = top
+	return strings.Join(values, ", ")
+}
+
+// viaAddr returns where responses are sent for a Via header value: its
+// received and rport parameters, or else its sent-by (RFC 3261 18.2.2)
+func viaAddr(via string) (net.Addr, error) {
+	fields := strings.Fields(via)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid Via: %s", via)
+	}
+	transport := strings.ToLower(strings.TrimPrefix(strings.ToUpper(fields[0]), "SIP/2.0/"))
+
+	host, port := viaSentByHostPort(via)
+	params := headerParams(via)
+	if received, ok := params["received"]; ok && received != "" {
+		host = received
+	}
+	if rport, err := strconv.Atoi(params["rport"]); err == nil {
+		port = rport
+	}
+	if port == 0 {
+		port = defaultPort(transport)
+	}
+	hostPort := net.JoinHostPort(host, strconv.Itoa(port))
+
+	switch transport {
+	case "udp":
+		return net.ResolveUDPAddr("udp", hostPort)
+	case "tcp", "tls":
+		tcpAddr, err := net.ResolveTCPAddr("tcp", hostPort)
+		if err != nil {
+			return nil, err
+		}
+		if transport == "tls" {
+			return &tlsAddr{TCPAddr: tcpAddr, ServerName: host}, nil
+		}
+		return tcpAddr, nil
+	}
+	return nil, fmt.Errorf("unsupported Via transport: %s", transport)
+}
+
+// relayStateless relays a response to a statelessly forwarded request to
+// the address of the next Via. It reports whether the response was one.
+func (s *Server) relayStateless(msg *Message) bool {
+	via := topHeaderValue(msg.Headers["Via"])
+	branch, _ := headerParam(via, "branch")
+	if !strings.HasPrefix(branch, statelessBranchPrefix) {
+		return false
+	}
+	if fields := strings.Fields(via); len(fields) < 2 || !strings.HasPrefix(fields[1], s.viaSentBy()) {
+		return false
+	}
+
+	resp := msg.Clone()
+	resp.Headers["Via"] = removeTopHeaderValue(resp.Headers["Via"])
+	next := topHeaderValue(resp.Headers["Via"])
+	if next == "" {
+		log.Printf("response without Via to relay to: %s", msg.StartLine)
+		return true
+	}
+	addr, err := viaAddr(next)
+	if err != nil {
+		log.Printf("cannot relay %s: %v", msg.StartLine, err)
+		return true
+	}
+	s.sendResponse(addr, resp)
+	return true
+}
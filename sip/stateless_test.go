@@ -0,0 +1,177 @@
+package sip
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestStatelessForwarding(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	clientAddr := &net.UDPAddr{IP: net.ParseIP("10.0.0.7"), Port: 12345}
+	target := &net.UDPAddr{IP: net.ParseIP("127.0.0.9"), Port: 5080}
+
+	server.SetStateless(true)
+	server.SetRouter(func(req *Message) (string, net.Addr, error) {
+		return "sip:bob@127.0.0.9:5080", target, nil
+	})
+
+	invite := newTestInvite("sip:bob@example.com", "stateless-1")
+	server.handleMessage(clientAddr, []byte(invite.String()))
+	server.handleMessage(clientAddr, []byte(invite.String()))
+	server.handleMessage(clientAddr, []byte(newTestCancel(invite).String()))
+
+	packets := mockConn.GetSentPackets()
+	if len(packets) != 3 {
+		t.Fatalf("Expected 3 forwarded requests, got %d", len(packets))
+	}
+	var branches []string
+	for _, packet := range packets {
+		fwd, err := ParseMessage(string(packet.Data))
+		if err != nil {
+			t.Fatalf("Failed to parse forwarded request: %v", err)
+		}
+		if packet.Addr.String() != target.String() || fwd.RequestURI() != "sip:bob@127.0.0.9:5080" {
+			t.Errorf("Request not routed: %s to %s", fwd.StartLine, packet.Addr)
+		}
+		branch, _ := headerParam(topHeaderValue(fwd.Headers["Via"]), "branch")
+		branches = append(branches, branch)
+	}
+	// Retransmissions and the CANCEL get the branch of the INVITE
+	if !strings.HasPrefix(branches[0], "z9hG4bK") || branches[1] != branches[0] || branches[2] != branches[0] {
+		t.Errorf("Branches not deterministic: %v", branches)
+	}
+	server.mu.Lock()
+	pending := len(server.proxied) + len(server.invites)
+	server.mu.Unlock()
+	if pending != 0 {
+		t.Errorf("Stateless proxy kept %d transactions", pending)
+	}
+
+	// Responses follow the Via headers back, using the received parameter
+	fwd, _ := ParseMessage(string(packets[0].Data))
+	if via := splitHeaderValues(fwd.Headers["Via"])[1]; !strings.Contains(via, "received=10.0.0.7") {
+		t.Errorf("Missing received parameter: %s", via)
+	}
+	ringing := NewResponse("180", "Ringing", fwd)
+	server.handleMessage(target, []byte(ringing.String()))
+	packets = mockConn.GetSentPackets()
+	last := packets[len(packets)-1]
+	relayed, _ := ParseMessage(string(last.Data))
+	if relayed.StatusCode() != 180 || last.Addr.String() != clientAddr.String() {
+		t.Fatalf("Response not relayed to the client: %s to %s", relayed.StartLine, last.Addr)
+	}
+	if vias := splitHeaderValues(relayed.Headers["Via"]); len(vias) != 1 {
+		t.Errorf("Server Via not removed: %v", vias)
+	}
+}
+
+func TestStatelessACKBranch(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	clientAddr := &net.UDPAddr{IP: net.ParseIP("10.0.0.7"), Port: 12345}
+	target := &net.UDPAddr{IP: net.ParseIP("127.0.0.9"), Port: 5080}
+	server.SetStateless(true)
+	server.SetRouter(func(req *Message) (string, net.Addr, error) {
+		return "sip:bob@127.0.0.9:5080", target, nil
+	})
+
+	// With and without a magic cookie, the CANCEL and the ACK of a non-2xx
+	// response, which carries the To tag of the response, match the INVITE
+	for _, via := range []string{"SIP/2.0/UDP 10.0.0.7:12345;branch=z9hG4bKack1", "SIP/2.0/UDP 10.0.0.7:12345"} {
+		invite := newTestInvite("sip:bob@example.com", "stateless-ack")
+		invite.Headers["Via"] = via
+		ack := newTestCancel(invite)
+		ack.StartLine = "ACK sip:bob@example.com SIP/2.0"
+		ack.Headers["To"] += ";tag=486"
+		ack.Headers["CSeq"] = "1 ACK"
+
+		before := len(sentTo(t, mockConn, target))
+		for _, req := range []*Message{invite, newTestCancel(invite), ack} {
+			server.handleMessage(clientAddr, []byte(req.String()))
+		}
+		forwarded := sentTo(t, mockConn, target)[before:]
+		if len(forwarded) != 3 {
+			t.Fatalf("Expected 3 forwarded requests, got %d", len(forwarded))
+		}
+		var branches []string
+		for _, fwd := range forwarded {
+			branch, _ := headerParam(topHeaderValue(fwd.Headers["Via"]), "branch")
+			branches = append(branches, branch)
+		}
+		if branches[1] != branches[0] || branches[2] != branches[0] {
+			t.Errorf("Branches differ for Via %q: %v", via, branches)
+		}
+	}
+}
+
+func TestStatelessDefaultRoute(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	clientAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	bobAddr := &net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 5070}
+	server.SetStateless(true)
+
+	// REGISTER has no user part and reaches the registrar
+	server.handleMessage(bobAddr, []byte(newOutboundRegister("<sip:bob@10.0.0.5:5070>").String()))
+	if code := lastSent(t, mockConn).StatusCode(); code != 200 {
+		t.Fatalf("Expected 200 to REGISTER, got %d", code)
+	}
+
+	server.handleMessage(clientAddr, []byte(newTestMessage("sip:bob@example.com", "hi").String()))
+	packets := mockConn.GetSentPackets()
+	last := packets[len(packets)-1]
+	fwd, _ := ParseMessage(string(last.Data))
+	if fwd.Method() != "MESSAGE" || fwd.RequestURI() != "sip:bob@10.0.0.5:5070" || last.Addr.String() != bobAddr.String() {
+		t.Errorf("MESSAGE not routed to bob: %s to %s", fwd.StartLine, last.Addr)
+	}
+
+	server.handleMessage(clientAddr, []byte(newTestMessage("sip:nobody@example.com", "hi").String()))
+	if code := lastSent(t, mockConn).StatusCode(); code != 404 {
+		t.Errorf("Expected 404 for an unknown user, got %d", code)
+	}
+
+	msg := newTestMessage("sip:bob@example.com", "hi")
+	msg.Headers["Proxy-Require"] = "foo"
+	server.handleMessage(clientAddr, []byte(msg.String()))
+	if resp := lastSent(t, mockConn); resp.StatusCode() != 420 || resp.Headers["Unsupported"] != "foo" {
+		t.Errorf("Expected 420, got %s", resp.StartLine)
+	}
+}
+
+func TestStatelessBranch(t *testing.T) {
+	// Requests of RFC 2543 clients without a magic cookie are told apart by their fields
+	msg := newTestMessage("sip:bob@example.com", "hi")
+	msg.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345"
+	first := statelessBranch(msg)
+	if statelessBranch(msg.Clone()) != first {
+		t.Error("Branch of the same request differs")
+	}
+	msg.Headers["CSeq"] = "2 MESSAGE"
+	if statelessBranch(msg) == first {
+		t.Error("Branch of a new request is the same")
+	}
+}
+
+func TestViaAddr(t *testing.T) {
+	tests := []struct {
+		via  string
+		want string
+	}{
+		{"SIP/2.0/UDP 10.0.0.1:5070;branch=z9hG4bK1", "udp 10.0.0.1:5070"},
+		{"SIP/2.0/UDP 10.0.0.1;branch=z9hG4bK1;received=192.0.2.1;rport=4000", "udp 192.0.2.1:4000"},
+		{"SIP/2.0/TCP 10.0.0.1;branch=z9hG4bK1", "tcp 10.0.0.1:5060"},
+		{"SIP/2.0/TLS 10.0.0.1;branch=z9hG4bK1", "tls 10.0.0.1:5061"},
+	}
+	for _, tt := range tests {
+		addr, err := viaAddr(tt.via)
+		if err != nil {
+			t.Errorf("viaAddr(%q) failed: %v", tt.via, err)
+			continue
+		}
+		if got := addr.Network() + " " + addr.String(); got != tt.want {
+			t.Errorf("viaAddr(%q) = %s, want %s", tt.via, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package sip
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultSubscriptionExpires is used when a SUBSCRIBE has no Expires header;
+	// longer requested durations are shortened to it
+	defaultSubscriptionExpires = 3600
+	// minSubscriptionExpires is the shortest subscription the server accepts
+	minSubscriptionExpires = 60
+)
+
+// EventPackage implements an event package served through SUBSCRIBE and
+// NOTIFY (RFC 6665). The server manages the subscription dialogs; the
+// package only describes the state of its resources.
+type EventPackage interface {
+	// Name is the Event header value the package handles, e.g. "presence"
+	Name() string
+	// ContentType is the body type of the package's NOTIFY requests
+	ContentType() string
+	// State returns the NOTIFY body describing the resource of a subscription
+	State(sub *Subscription) string
+}
+
+// Subscription is a subscription dialog in which the server is the notifier
+type Subscription struct {
+	Event      string    // event package name
+	Resource   string    // AOR being watched
+	Subscriber string    // From header of the SUBSCRIBE
+	Expires    time.Time // when the subscription ends unless refreshed
+	Notified   int       // NOTIFY requests sent before the current one
+	id         string    // dialog ID
+	eventID    string    // id parameter of the Event header
+	callID     string
+	localTag   string
+	remoteURI  string // subscriber's Contact, target of NOTIFY requests
+	target     net.Addr
+	cseq       int
+	timer      *time.Timer
+	dialog     *Dialog // dialog shared with a call, e.g. for REFER
+}
+
+// dialogID identifies a dialog by its Call-ID and tags
+func dialogID(callID, localTag, remoteTag string) string {
+	return callID + ";" + localTag + ";" + remoteTag
+}
+
+// RegisterEventPackage makes the server accept subscriptions to an event package
+func (s *Server) RegisterEventPackage(pkg EventPackage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.eventPackages[pkg.Name()] = pkg
+}
+
+// allowEventsHeader lists the event packages the server supports
+func (s *Server) allowEventsHeader() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := make([]string, 0, len(s.eventPackages))
+	for name := range s.eventPackages {
+		events = append(events, name)
+	}
+	sort.Strings(events)
+	return strings.Join(events, ", ")
+}
+
+// handleSubscribe processes SUBSCRIBE requests, creating, refreshing and
+// ending subscription dialogs
+func (s *Server) handleSubscribe(addr net.Addr, msg *Message) {
+	event := msg.Headers["Event"]
+	eventName := strings.TrimSpace(strings.SplitN(event, ";", 2)[0])
+
+	// Subscriptions to other domains are forwarded to their servers
+	toTag, inDialog := headerParam(msg.Headers["To"], "tag")
+	if uri, err := ParseURI(msg.RequestURI()); err == nil && !inDialog && !s.isLocalDomain(uri.Host) {
+		if err := s.forwardToURI(addr, msg, msg.RequestURI()); err != nil {
+			log.Printf("SUBSCRIBE forwarding error: %v", err)
+			s.sendResponse(addr, NewResponse("503", "Service Unavailable", msg))
+		}
+		return
+	}
+	if s.rejectUnsupported(addr, msg) {
+		return
+	}
+
+	s.mu.Lock()
+	pkg, ok := s.eventPackages[eventName]
+	s.mu.Unlock()
+	if eventName == s.refers.Name() && inDialog {
+		// Implicit refer subscriptions may only be refreshed or ended
+		pkg, ok = s.refers, true
+	}
+	if !ok {
+		resp := NewResponse("489", "Bad Event", msg)
+		resp.Headers["Allow-Events"] = s.allowEventsHeader()
+		s.sendResponse(addr, resp)
+		return
+	}
+
+	expires := defaultSubscriptionExpires
+	if value, ok := msg.Headers["Expires"]; ok {
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || n < 0 {
+			s.sendResponse(addr, NewResponse("400", "Bad Request", msg))
+			return
+		}
+		expires = n
+	}
+	if expires > 0 && expires < minSubscriptionExpires {
+		resp := NewResponse("423", "Interval Too Brief", msg)
+		resp.Headers["Min-Expires"] = strconv.Itoa(minSubscriptionExpires)
+		s.sendResponse(addr, resp)
+		return
+	}
+	if expires > defaultSubscriptionExpires {
+		expires = defaultSubscriptionExpires
+	}
+
+	fromTag, _ := headerParam(msg.Headers["From"], "tag")
+	var sub *Subscription
+	if inDialog {
+		id := dialogID(msg.Headers["Call-ID"], toTag, fromTag)
+		if eventName == s.refers.Name() {
+			eventID, _ := headerParam(event, "id")
+			id += ";refer=" + eventID
+		}
+		s.mu.Lock()
+		sub = s.subscriptions[id]
+		s.mu.Unlock()
+		if sub == nil {
+			s.sendResponse(addr, NewResponse("481", "Subscription Does Not Exist", msg))
+			return
+		}
+	} else {
+		eventID, _ := headerParam(event, "id")
+		sub = &Subscription{
+			Event:      eventName,
+			Resource:   extractSIPURI(msg.RequestURI()),
+			Subscriber: msg.Headers["From"],
+			eventID:    eventID,
+			callID:     msg.Headers["Call-ID"],
+			localTag:   newTag(),
+		}
+		sub.id = dialogID(sub.callID, sub.localTag, fromTag)
+	}
+
+	s.mu.Lock()
+	sub.target = addr
+	if contact := topHeaderValue(msg.Headers["Contact"]); contact != "" {
+		sub.remoteURI = contactURI(contact)
+	} else if sub.remoteURI == "" {
+		sub.remoteURI = extractSIPURI(msg.Headers["From"])
+	}
+	sub.Expires = time.Now().Add(time.Duration(expires) * time.Second)
+	if sub.timer != nil {
+		sub.timer.Stop()
+	}
+	if expires > 0 {
+		s.subscriptions[sub.id] = sub
+		id := sub.id
+		sub.timer = time.AfterFunc(time.Duration(expires)*time.Second, func() {
+			s.expireSubscription(id)
+		})
+	} else {
+		delete(s.subscriptions, sub.id)
+	}
+	s.mu.Unlock()
+
+	resp := NewResponse("200", "OK", msg)
+	if !inDialog {
+		resp.Headers["To"] = msg.Headers["To"] + ";tag=" + sub.localTag
+	}
+	resp.Headers["Expires"] = strconv.Itoa(expires)
+	resp.Headers["Contact"] = s.contactHeader()
+	s.sendResponse(addr, resp)
+
+	// Every accepted SUBSCRIBE is followed by a NOTIFY with the current
+	// state; an unsubscribe gets a final one
+	if expires > 0 {
+		log.Printf("%s subscription to %s by %s", eventName, sub.Resource, extractSIPURI(sub.Subscriber))
+		s.notify(pkg, sub, "active")
+	} else {
+		log.Printf("%s subscription to %s ended by subscriber", eventName, sub.Resource)
+		s.notify(pkg, sub, "terminated;reason=timeout")
+	}
+}
+
+// NotifySubscribers sends the current state of a resource to everyone
+// subscribed to it. Event packages call it when the state changes.
+func (s *Server) NotifySubscribers(event, resource string) {
+	s.mu.Lock()
+	pkg := s.eventPackages[event]
+	subs := s.findSubscriptions(event, resource)
+	s.mu.Unlock()
+
+	for _, sub := range subs {
+		s.notify(pkg, sub, "active")
+	}
+}
+
+// TerminateSubscriptions ends every subscription to a resource with a final
+// NOTIFY carrying the given reason (RFC 6665 4.1.3), e.g. "noresource"
+func (s *Server) TerminateSubscriptions(event, resource, reason string) {
+	s.mu.Lock()
+	pkg := s.eventPackages[event]
+	subs := s.findSubscriptions(event, resource)
+	for _, sub := range subs {
+		s.removeSubscription(sub)
+	}
+	s.mu.Unlock()
+
+	for _, sub := range subs {
+		s.notify(pkg, sub, "terminated;reason="+reason)
+	}
+}
+
+// findSubscriptions returns the subscriptions to a resource. The caller must hold s.mu.
+func (s *Server) findSubscriptions(event, resource string) []*Subscription {
+	var subs []*Subscription
+	for _, sub := range s.subscriptions {
+		if sub.Event == event && sub.Resource == resource {
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}
+
+// removeSubscription forgets a subscription. The caller must hold s.mu.
+func (s *Server) removeSubscription(sub *Subscription) {
+	if sub.timer != nil {
+		sub.timer.Stop()
+	}
+	delete(s.subscriptions, sub.id)
+}
+
+// expireSubscription ends a subscription that was not refreshed in time
+func (s *Server) expireSubscription(id string) {
+	s.mu.Lock()
+	sub, ok := s.subscriptions[id]
+	var pkg EventPackage
+	if ok {
+		s.removeSubscription(sub)
+		pkg = s.eventPackages[sub.Event]
+		if sub.Event == s.refers.Name() {
+			pkg = s.refers
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	log.Printf("%s subscription to %s expired", sub.Event, sub.Resource)
+	s.notify(pkg, sub, "terminated;reason=timeout")
+}
+
+// notify sends a NOTIFY in a subscription dialog. state is the value of the
+// Subscription-State header; active subscriptions report their remaining time.
+func (s *Server) notify(pkg EventPackage, sub *Subscription, state string) {
+	s.mu.Lock()
+	var cseq int
+	if sub.dialog != nil {
+		// Requests of all usages of a dialog share its CSeq space
+		sub.dialog.localSeq++
+		cseq = sub.dialog.localSeq
+	} else {
+		sub.cseq++
+		cseq = sub.cseq
+	}
+	target := sub.target
+	// The package and the request below use a copy, read without locking
+	snapshot := *sub
+	snapshot.timer = nil
+	snapshot.dialog = nil
+	sub.Notified++
+	if state == "active" {
+		remaining := int(time.Until(sub.Expires).Seconds())
+		if remaining < 0 {
+			remaining = 0
+		}
+		state = fmt.Sprintf("active;expires=%d", remaining)
+	}
+	s.mu.Unlock()
+
+	req := NewMessage()
+	req.StartLine = fmt.Sprintf("NOTIFY %s SIP/2.0", snapshot.remoteURI)
+	req.Headers["From"] = "<" + snapshot.Resource + ">;tag=" + snapshot.localTag
+	req.Headers["To"] = snapshot.Subscriber
+	req.Headers["Call-ID"] = snapshot.callID
+	req.Headers["CSeq"] = fmt.Sprintf("%d NOTIFY", cseq)
+	req.Headers["Max-Forwards"] = "70"
+	req.Headers["Contact"] = s.contactHeader()
+	req.Headers["Event"] = snapshot.Event
+	if snapshot.eventID != "" {
+		req.Headers["Event"] += ";id=" + snapshot.eventID
+	}
+	req.Headers["Subscription-State"] = state
+	req.Headers["User-Agent"] = "Go-SIP-Server"
+
+	if pkg != nil {
+		body := pkg.State(&snapshot)
+		if body != "" {
+			req.Headers["Content-Type"] = pkg.ContentType()
+			req.Body = body
+		}
+	}
+	req.Headers["Content-Length"] = strconv.Itoa(len(req.Body))
+
+	id := snapshot.id
+	err := s.sendRequest(target, req, func(resp *Message) {
+		if resp != nil && resp.StatusCode() < 300 {
+			return
+		}
+		// A subscriber that rejects or ignores a NOTIFY is gone (RFC 6665 4.2.2)
+		s.mu.Lock()
+		if current, ok := s.subscriptions[id]; ok {
+			log.Printf("NOTIFY for %s failed, removing subscription", current.Resource)
+			s.removeSubscription(current)
+		}
+		s.mu.Unlock()
+	})
+	if err != nil {
+		log.Printf("NOTIFY sending error: %v", err)
+	}
+}
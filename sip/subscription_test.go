@@ -0,0 +1,140 @@
+package sip
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testPackage is an event package reporting a fixed state per resource
+type testPackage struct {
+	states map[string]string
+}
+
+func (p *testPackage) Name() string        { return "test" }
+func (p *testPackage) ContentType() string { return "text/plain" }
+func (p *testPackage) State(sub *Subscription) string {
+	return p.states[sub.Resource] + " #" + strconv.Itoa(sub.Notified)
+}
+
+func newTestSubscribe(event, expires string) *Message {
+	msg := NewMessage()
+	msg.StartLine = "SUBSCRIBE sip:bob@example.com SIP/2.0"
+	msg.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKsub1"
+	msg.Headers["From"] = "<sip:alice@example.com>;tag=123"
+	msg.Headers["To"] = "<sip:bob@example.com>"
+	msg.Headers["Call-ID"] = "subscribe-test-1"
+	msg.Headers["CSeq"] = "1 SUBSCRIBE"
+	msg.Headers["Contact"] = "<sip:alice@127.0.0.1:12345>"
+	msg.Headers["Event"] = event
+	msg.Headers["Expires"] = expires
+	msg.Headers["Content-Length"] = "0"
+	return msg
+}
+
+func TestSubscribeRejected(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	server.RegisterEventPackage(&testPackage{})
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	server.handleSubscribe(addr, newTestSubscribe("unknown", "600"))
+	server.handleSubscribe(addr, newTestSubscribe("test", "10"))
+
+	msgs := sentMessages(t, mockConn)
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 responses, got %d", len(msgs))
+	}
+	if msgs[0].StatusCode() != 489 || !strings.Contains(msgs[0].Headers["Allow-Events"], "test") {
+		t.Errorf("Expected 489 Bad Event with Allow-Events, got %s", msgs[0].String())
+	}
+	if msgs[1].StatusCode() != 423 || msgs[1].Headers["Min-Expires"] != "60" {
+		t.Errorf("Expected 423 Interval Too Brief with Min-Expires, got %s", msgs[1].String())
+	}
+}
+
+func TestSubscriptionLifecycle(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	pkg := &testPackage{states: map[string]string{"sip:bob@example.com": "idle"}}
+	server.RegisterEventPackage(pkg)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	server.handleSubscribe(addr, newTestSubscribe("test", "7200"))
+
+	msgs := sentMessages(t, mockConn)
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 200 OK and NOTIFY, got %d messages", len(msgs))
+	}
+	resp, notify := msgs[0], msgs[1]
+	if resp.StatusCode() != 200 || resp.Headers["Expires"] != "3600" {
+		t.Errorf("Unexpected SUBSCRIBE response: %s", resp.String())
+	}
+	toTag, ok := headerParam(resp.Headers["To"], "tag")
+	if !ok {
+		t.Fatal("SUBSCRIBE response has no To tag")
+	}
+	if notify.Method() != "NOTIFY" || notify.RequestURI() != "sip:alice@127.0.0.1:12345" {
+		t.Fatalf("Unexpected NOTIFY: %s", notify.StartLine)
+	}
+	if notify.Headers["Subscription-State"] != "active;expires=3599" && notify.Headers["Subscription-State"] != "active;expires=3600" {
+		t.Errorf("Wrong Subscription-State: %s", notify.Headers["Subscription-State"])
+	}
+	if notify.Body != "idle #0" || notify.Headers["Content-Type"] != "text/plain" || notify.Headers["Event"] != "test" {
+		t.Errorf("Unexpected NOTIFY content: %s", notify.String())
+	}
+	if tag, _ := headerParam(notify.Headers["From"], "tag"); tag != toTag {
+		t.Errorf("NOTIFY From tag %s does not match dialog tag %s", tag, toTag)
+	}
+
+	// State changes are sent to the subscriber
+	pkg.states["sip:bob@example.com"] = "busy"
+	server.NotifySubscribers("test", "sip:bob@example.com")
+	msgs = sentMessages(t, mockConn)
+	if len(msgs) != 3 || msgs[2].Body != "busy #1" || msgs[2].Headers["CSeq"] != "2 NOTIFY" {
+		t.Fatalf("Expected a second NOTIFY, got %v", msgs[len(msgs)-1].String())
+	}
+
+	// Unsubscribing within the dialog ends the subscription
+	unsubscribe := newTestSubscribe("test", "0")
+	unsubscribe.Headers["To"] = resp.Headers["To"]
+	unsubscribe.Headers["CSeq"] = "2 SUBSCRIBE"
+	server.handleSubscribe(addr, unsubscribe)
+	msgs = sentMessages(t, mockConn)
+	if len(msgs) != 5 || msgs[3].StatusCode() != 200 {
+		t.Fatalf("Expected 200 OK and a final NOTIFY, got %d messages", len(msgs))
+	}
+	if msgs[4].Headers["Subscription-State"] != "terminated;reason=timeout" {
+		t.Errorf("Wrong final Subscription-State: %s", msgs[4].Headers["Subscription-State"])
+	}
+	if len(server.subscriptions) != 0 {
+		t.Error("Subscription was not removed")
+	}
+
+	// Refreshing an unknown dialog fails
+	server.handleSubscribe(addr, unsubscribe)
+	msgs = sentMessages(t, mockConn)
+	if msgs[len(msgs)-1].StatusCode() != 481 {
+		t.Errorf("Expected 481 for an unknown subscription, got %s", msgs[len(msgs)-1].StartLine)
+	}
+}
+
+func TestSubscriptionRemovedOnNotifyFailure(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	server.RegisterEventPackage(&testPackage{})
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	server.handleSubscribe(addr, newTestSubscribe("test", "600"))
+	notify := sentMessages(t, mockConn)[1]
+
+	resp := NewResponse("481", "Call/Transaction Does Not Exist", notify)
+	server.handleMessage(addr, []byte(resp.String()))
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.subscriptions) != 0 {
+		t.Error("Subscription was kept after a 481 to its NOTIFY")
+	}
+}
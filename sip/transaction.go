@@ -0,0 +1,172 @@
+package sip
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// inviteTransaction is an INVITE server transaction (RFC 3261 17.2.1)
+type inviteTransaction struct {
+	key     string
+	request *Message
+	source  net.Addr
+	final   bool // a final response has been sent
+}
+
+// serverTransactionKey identifies a server transaction by the branch and
+// sent-by of the top Via (RFC 3261 17.2.3). A CANCEL has the same key as
+// the INVITE it cancels.
+func serverTransactionKey(msg *Message) string {
+	via := topHeaderValue(msg.Headers["Via"])
+	branch, _ := headerParam(via, "branch")
+	host, port := viaSentByHostPort(via)
+	return branch + "|" + net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// startInviteTransaction records a new INVITE server transaction
+func (s *Server) startInviteTransaction(addr net.Addr, msg *Message) {
+	key := serverTransactionKey(msg)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.invites[key]; !exists {
+		s.invites[key] = &inviteTransaction{key: key, request: msg, source: addr}
+	}
+}
+
+// finalizeInvite marks the INVITE transaction of msg as answered. It returns
+// false if a final response was already sent, e.g. because it was cancelled.
+func (s *Server) finalizeInvite(msg *Message) bool {
+	key := serverTransactionKey(msg)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	txn, ok := s.invites[key]
+	if !ok {
+		return true
+	}
+	if txn.final {
+		return false
+	}
+	txn.final = true
+	s.endReliable(key)
+
+	// Keep the transaction around to absorb retransmissions and late CANCELs
+	time.AfterFunc(s.transactionTimeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.invites, key)
+	})
+	return true
+}
+
+// handleCancel processes CANCEL requests
+func (s *Server) handleCancel(addr net.Addr, msg *Message) {
+	key := serverTransactionKey(msg)
+
+	s.mu.Lock()
+	txn, ok := s.invites[key]
+	s.mu.Unlock()
+
+	if !ok {
+		s.sendResponse(addr, NewResponse("481", "Call/Transaction Does Not Exist", msg))
+		return
+	}
+
+	// The CANCEL itself always succeeds once it matches a transaction
+	s.sendResponse(addr, NewResponse("200", "OK", msg))
+
+	// Propagate the CANCEL to the branches the INVITE was forwarded to; their
+	// 487 responses are relayed back to the caller. A call ringing targets
+	// in turn stops moving on, including branches not sent yet.
+	forwarded := s.forwardedBranches(txn.request)
+	for _, branch := range forwarded {
+		if branch.sequence != nil {
+			forwarded = append(forwarded, s.cancelSequence(branch.sequence)...)
+			break
+		}
+	}
+	if len(forwarded) > 0 {
+		for _, branch := range forwarded {
+			s.cancelBranch(branch)
+		}
+		return
+	}
+
+	if !s.finalizeInvite(txn.request) {
+		return // already answered, the CANCEL has no effect
+	}
+
+	s.setCallState(txn.request, "")
+
+	s.sendResponse(txn.source, NewResponse("487", "Request Terminated", txn.request))
+	log.Printf("call cancelled: %s", txn.request.Headers["Call-ID"])
+
+	// The outbound leg of a B2BUA call is cancelled in turn
+	s.cancelCall(txn.request)
+}
+
+// forwardedBranches returns the pending client transactions the request was forwarded on
+func (s *Server) forwardedBranches(request *Message) []*proxyTransaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var branches []*proxyTransaction
+	for _, txn := range s.proxied {
+		if txn.original == request {
+			branches = append(branches, txn)
+		}
+	}
+	return branches
+}
+
+// cancelBranch sends a CANCEL for a forwarded INVITE. If no provisional
+// response has arrived yet, the CANCEL is sent once one does (RFC 3261 9.1).
+func (s *Server) cancelBranch(txn *proxyTransaction) {
+	s.mu.Lock()
+	if txn.cancelled {
+		s.mu.Unlock()
+		return
+	}
+	txn.cancelled = true
+	send := txn.provisional
+	s.mu.Unlock()
+
+	if send {
+		s.sendCancel(txn)
+	}
+}
+
+// sendCancel builds and sends the CANCEL of a forwarded request
+func (s *Server) sendCancel(txn *proxyTransaction) {
+	s.cancelRequest(txn.request, txn.target)
+}
+
+// cancelRequest sends the CANCEL of a request the server sent to target;
+// it reuses the branch of the request (RFC 3261 9.1)
+func (s *Server) cancelRequest(request *Message, target net.Addr) {
+	cseq := strings.Fields(request.Headers["CSeq"])
+	if len(cseq) == 0 {
+		return
+	}
+
+	cancel := NewMessage()
+	cancel.StartLine = fmt.Sprintf("CANCEL %s SIP/2.0", request.RequestURI())
+	cancel.Headers["Via"] = topHeaderValue(request.Headers["Via"])
+	cancel.Headers["From"] = request.Headers["From"]
+	cancel.Headers["To"] = request.Headers["To"]
+	cancel.Headers["Call-ID"] = request.Headers["Call-ID"]
+	cancel.Headers["CSeq"] = cseq[0] + " CANCEL"
+	cancel.Headers["Max-Forwards"] = "70"
+	cancel.Headers["Content-Length"] = "0"
+
+	log.Printf("cancelling %s at %s", request.Headers["Call-ID"], target.String())
+	if err := s.send(target, cancel); err != nil {
+		log.Printf("CANCEL sending error: %v", err)
+	}
+}
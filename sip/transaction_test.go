@@ -0,0 +1,222 @@
+package sip
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCancel(invite *Message) *Message {
+	cancel := NewMessage()
+	cancel.StartLine = "CANCEL " + invite.RequestURI() + " SIP/2.0"
+	cancel.Headers["Via"] = invite.Headers["Via"]
+	cancel.Headers["From"] = invite.Headers["From"]
+	cancel.Headers["To"] = invite.Headers["To"]
+	cancel.Headers["Call-ID"] = invite.Headers["Call-ID"]
+	cancel.Headers["CSeq"] = "1 CANCEL"
+	cancel.Headers["Content-Length"] = "0"
+	return cancel
+}
+
+// sentMessages parses every message the mock connection sent
+func sentMessages(t *testing.T, mockConn *MockConn) []*Message {
+	t.Helper()
+	var msgs []*Message
+	for _, packet := range mockConn.GetSentPackets() {
+		msg, err := ParseMessage(string(packet.Data))
+		if err != nil {
+			t.Fatalf("Failed to parse sent message: %v", err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func TestCancelUnmatched(t *testing.T) {
+	server := setupTestServer(t)
+	clientAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	server.handleCancel(clientAddr, newTestCancel(newTestInvite("sip:bob@example.com", "cancel-unmatched")))
+
+	response := string(server.conn.(*MockConn).GetSentData())
+	if !strings.HasPrefix(response, "SIP/2.0 481 ") {
+		t.Errorf("Expected 481, got %s", response)
+	}
+}
+
+func TestCancelPendingInvite(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	clientAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	// An INVITE that is still ringing
+	invite := newTestInvite("sip:bob@example.com", "cancel-pending")
+	server.startInviteTransaction(clientAddr, invite)
+	server.calls["cancel-pending"] = "ringing"
+
+	server.handleCancel(clientAddr, newTestCancel(invite))
+
+	msgs := sentMessages(t, mockConn)
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 responses, got %d", len(msgs))
+	}
+	if msgs[0].StatusCode() != 200 || msgs[0].Headers["CSeq"] != "1 CANCEL" {
+		t.Errorf("Expected 200 OK to CANCEL, got %s / %s", msgs[0].StartLine, msgs[0].Headers["CSeq"])
+	}
+	if msgs[1].StatusCode() != 487 || msgs[1].Headers["CSeq"] != "1 INVITE" {
+		t.Errorf("Expected 487 to INVITE, got %s / %s", msgs[1].StartLine, msgs[1].Headers["CSeq"])
+	}
+	if _, exists := server.calls["cancel-pending"]; exists {
+		t.Error("Cancelled call not removed")
+	}
+
+	// The INVITE can no longer be answered
+	if server.finalizeInvite(invite) {
+		t.Error("Cancelled INVITE was answered")
+	}
+}
+
+func TestCancelAnsweredInvite(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	clientAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	invite := newTestInvite("sip:bob@example.com", "cancel-answered")
+	server.handleInvite(clientAddr, invite)
+	sentBefore := len(mockConn.GetSentPackets())
+
+	server.handleCancel(clientAddr, newTestCancel(invite))
+
+	msgs := sentMessages(t, mockConn)[sentBefore:]
+	if len(msgs) != 1 || msgs[0].StatusCode() != 200 {
+		t.Fatalf("Expected only 200 OK to CANCEL, got %d responses", len(msgs))
+	}
+	if server.calls["cancel-answered"] != "connected" {
+		t.Error("Answered call should not be affected by CANCEL")
+	}
+}
+
+func TestCancelForwardedInvite(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	callerAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	calleeAddr := &net.UDPAddr{IP: net.ParseIP("192.0.2.5"), Port: 5060}
+
+	invite := newTestInvite("sip:bob@example.com", "cancel-forwarded")
+	server.startInviteTransaction(callerAddr, invite)
+	if err := server.forwardRequest(callerAddr, invite, "sip:bob@192.0.2.5", calleeAddr); err != nil {
+		t.Fatalf("Failed to forward INVITE: %v", err)
+	}
+	forwarded := sentMessages(t, mockConn)[0]
+
+	// No CANCEL goes downstream before a provisional response arrived
+	server.handleCancel(callerAddr, newTestCancel(invite))
+	for _, msg := range sentMessages(t, mockConn) {
+		if msg.Method() == "CANCEL" {
+			t.Fatal("CANCEL sent before a provisional response")
+		}
+	}
+
+	server.handleResponse(calleeAddr, NewResponse("180", "Ringing", forwarded))
+	var cancel *Message
+	for _, msg := range sentMessages(t, mockConn) {
+		if msg.Method() == "CANCEL" {
+			cancel = msg
+		}
+	}
+	if cancel == nil {
+		t.Fatal("CANCEL not propagated to the forwarded branch")
+	}
+	if cancel.Headers["Via"] != topHeaderValue(forwarded.Headers["Via"]) {
+		t.Errorf("CANCEL branch does not match the INVITE: %s", cancel.Headers["Via"])
+	}
+	if cancel.RequestURI() != "sip:bob@192.0.2.5" || cancel.Headers["CSeq"] != "1 CANCEL" {
+		t.Errorf("Wrong CANCEL: %s / %s", cancel.StartLine, cancel.Headers["CSeq"])
+	}
+
+	// The 200 to the CANCEL is absorbed, the 487 is relayed and ACKed
+	sentBefore := len(mockConn.GetSentPackets())
+	cancelOK := NewResponse("200", "OK", cancel)
+	server.handleResponse(calleeAddr, cancelOK)
+	if len(mockConn.GetSentPackets()) != sentBefore {
+		t.Error("Response to CANCEL was relayed")
+	}
+
+	server.handleResponse(calleeAddr, NewResponse("487", "Request Terminated", forwarded))
+	var relayed, ack bool
+	for _, msg := range sentMessages(t, mockConn)[sentBefore:] {
+		if msg.StatusCode() == 487 && msg.Headers["Via"] == invite.Headers["Via"] {
+			relayed = true
+		}
+		if msg.Method() == "ACK" {
+			ack = true
+		}
+	}
+	if !relayed {
+		t.Error("487 not relayed to the caller")
+	}
+	if !ack {
+		t.Error("487 not acknowledged downstream")
+	}
+}
+
+func TestInviteTimerC(t *testing.T) {
+	server := setupTestServer(t)
+	server.timerC = 200 * time.Millisecond
+	mockConn := server.conn.(*MockConn)
+	callerAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	calleeAddr := &net.UDPAddr{IP: net.ParseIP("192.0.2.5"), Port: 5060}
+
+	invite := newTestInvite("sip:bob@example.com", "timer-c")
+	server.startInviteTransaction(callerAddr, invite)
+	if err := server.forwardRequest(callerAddr, invite, "sip:bob@192.0.2.5", calleeAddr); err != nil {
+		t.Fatalf("Failed to forward INVITE: %v", err)
+	}
+	forwarded := sentMessages(t, mockConn)[0]
+
+	// Each provisional response restarts Timer C
+	server.handleResponse(calleeAddr, NewResponse("180", "Ringing", forwarded))
+	time.Sleep(150 * time.Millisecond)
+	server.handleResponse(calleeAddr, NewResponse("183", "Session Progress", forwarded))
+	time.Sleep(150 * time.Millisecond)
+	for _, msg := range sentMessages(t, mockConn) {
+		if msg.Method() == "CANCEL" {
+			t.Fatal("Timer C not restarted by a provisional response")
+		}
+	}
+
+	// Once it fires, the branch is cancelled and the caller gets 408
+	var cancel, timeout *Message
+	waitFor(t, "Timer C", func() bool {
+		for _, msg := range sentMessages(t, mockConn) {
+			if msg.Method() == "CANCEL" {
+				cancel = msg
+			}
+			if msg.StatusCode() == 408 {
+				timeout = msg
+			}
+		}
+		return cancel != nil && timeout != nil
+	})
+	if cancel.Headers["Via"] != topHeaderValue(forwarded.Headers["Via"]) {
+		t.Errorf("CANCEL branch does not match the INVITE: %s", cancel.Headers["Via"])
+	}
+	if timeout.Headers["Via"] != invite.Headers["Via"] {
+		t.Errorf("408 not sent to the caller: %s", timeout.String())
+	}
+
+	// The 487 of the cancelled branch is acknowledged but not relayed
+	sentBefore := len(mockConn.GetSentPackets())
+	server.handleResponse(calleeAddr, NewResponse("487", "Request Terminated", forwarded))
+	for _, msg := range sentMessages(t, mockConn)[sentBefore:] {
+		if msg.StatusCode() == 487 {
+			t.Error("487 relayed after the 408")
+		}
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.proxied) != 0 {
+		t.Errorf("Transaction kept after the 487: %d", len(server.proxied))
+	}
+}
@@ -0,0 +1,390 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultTrunkExpires is the registration interval asked for by trunks
+	// configured without one
+	defaultTrunkExpires = time.Hour
+	// trunkRetryInterval is the wait before registering again after a failure
+	trunkRetryInterval = time.Minute
+)
+
+// Trunk is a SIP trunk of a provider that calls to outside numbers are sent to
+type Trunk struct {
+	Name   string
+	Domain string // domain of the provider, the host of Request-URIs sent over the trunk
+	Proxy  string // URI of the provider's outbound proxy; the domain is located when empty
+
+	// Registration with the provider, for trunks that require it
+	Registrar string        // URI of the provider's registrar, no registration when empty
+	Username  string        // user of the registered AOR and of digest authentication
+	Password  string        // password of digest authentication
+	Expires   time.Duration // registration interval asked for
+}
+
+// trunkState is a trunk with the state of its registration
+type trunkState struct {
+	Trunk
+	registered bool
+	callID     string // Call-ID and From tag are kept across refreshes
+	fromTag    string
+	cseq       int
+	timer      *time.Timer // next refresh or retry
+}
+
+// AddTrunk adds a trunk that dial plan rules can send requests to. Trunks
+// with a registrar are registered once the server starts.
+func (s *Server) AddTrunk(trunk Trunk) {
+	if trunk.Expires <= 0 {
+		trunk.Expires = defaultTrunkExpires
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trunks[trunk.Name] = &trunkState{Trunk: trunk}
+}
+
+// TrunkAvailable reports whether calls can be sent over the named trunk:
+// it exists and, if it registers, its registration succeeded
+func (s *Server) TrunkAvailable(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.trunks[name]
+	return ok && (state.Registrar == "" || state.registered)
+}
+
+// trunkProxy returns the URI requests over a trunk are sent to
+func trunkProxy(trunk Trunk) string {
+	if trunk.Proxy != "" {
+		return trunk.Proxy
+	}
+	if trunk.Registrar != "" {
+		return trunk.Registrar
+	}
+	return "sip:" + trunk.Domain
+}
+
+// startTrunks registers every trunk that has a registrar
+func (s *Server) startTrunks() {
+	s.mu.Lock()
+	var names []string
+	for name, state := range s.trunks {
+		if state.Registrar != "" {
+			names = append(names, name)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, name := range names {
+		go s.registerTrunk(name)
+	}
+}
+
+// registerTrunk sends a REGISTER for the named trunk to its provider
+func (s *Server) registerTrunk(name string) {
+	s.mu.Lock()
+	state, ok := s.trunks[name]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	if state.callID == "" {
+		state.callID = randomToken(12) + "@" + s.viaSentBy()
+		state.fromTag = newTag()
+	}
+	trunk := state.Trunk
+	aor := fmt.Sprintf("<sip:%s@%s>", trunk.Username, trunk.Domain)
+	req := s.newRequest("REGISTER", trunk.Registrar, aor, aor)
+	req.Headers["From"] = aor + ";tag=" + state.fromTag
+	req.Headers["Call-ID"] = state.callID
+	req.Headers["Contact"] = fmt.Sprintf("<sip:%s@%s>", trunk.Username, s.viaSentBy())
+	req.Headers["Expires"] = strconv.Itoa(int(trunk.Expires / time.Second))
+	s.mu.Unlock()
+
+	targets, err := s.resolver.Resolve(context.Background(), trunkProxy(trunk))
+	if err != nil || len(targets) == 0 {
+		log.Printf("cannot resolve trunk %s: %v", name, err)
+		s.trunkRegistered(name, 0)
+		return
+	}
+	s.sendTrunkRegister(name, targets[0].Addr(), req, false)
+}
+
+// sendTrunkRegister sends a REGISTER of a trunk with the next CSeq. A
+// challenge is answered once with the trunk's credentials.
+func (s *Server) sendTrunkRegister(name string, target net.Addr, req *Message, authorized bool) {
+	s.mu.Lock()
+	state, ok := s.trunks[name]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	state.cseq++
+	req.Headers["CSeq"] = fmt.Sprintf("%d REGISTER", state.cseq)
+	username, password := state.Username, state.Password
+	s.mu.Unlock()
+
+	err := s.sendRequest(target, req, func(resp *Message) {
+		if resp != nil && resp.StatusCode() < 200 {
+			return
+		}
+		if resp == nil {
+			s.trunkRegistered(name, 0)
+			return
+		}
+
+		code := resp.StatusCode()
+		if (code == 401 || code == 407) && !authorized {
+			challengeHeader, authHeader := "WWW-Authenticate", "Authorization"
+			if code == 407 {
+				challengeHeader, authHeader = "Proxy-Authenticate", "Proxy-Authorization"
+			}
+			auth, err := digestAuthorization(resp.Headers[challengeHeader], "REGISTER", req.RequestURI(), username, password)
+			if err != nil {
+				log.Printf("trunk %s: cannot answer challenge: %v", name, err)
+				s.trunkRegistered(name, 0)
+				return
+			}
+			retry := req.Clone()
+			retry.Headers[authHeader] = auth
+			s.sendTrunkRegister(name, target, retry, true)
+			return
+		}
+		if code >= 300 {
+			log.Printf("trunk %s registration failed: %s", name, resp.StartLine)
+			s.trunkRegistered(name, 0)
+			return
+		}
+		s.trunkRegistered(name, grantedExpires(resp, req))
+	})
+	if err != nil {
+		log.Printf("trunk %s: REGISTER sending error: %v", name, err)
+		s.trunkRegistered(name, 0)
+	}
+}
+
+// grantedExpires returns the registration interval the registrar granted in
+// a 2xx response: the expires of our Contact, else the Expires header, else
+// the interval asked for
+func grantedExpires(resp, req *Message) time.Duration {
+	ours := contactURI(req.Headers["Contact"])
+	for _, contact := range splitHeaderValues(resp.Headers["Contact"]) {
+		if contactURI(contact) != ours {
+			continue
+		}
+		if value, ok := headerParam(contact, "expires"); ok {
+			if n, err := strconv.Atoi(value); err == nil {
+				return time.Duration(n) * time.Second
+			}
+		}
+	}
+	for _, value := range []string{resp.Headers["Expires"], req.Headers["Expires"]} {
+		if n, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+			return time.Duration(n) * time.Second
+		}
+	}
+	return defaultTrunkExpires
+}
+
+// trunkRegistered records the outcome of a trunk registration and schedules
+// the next one: a refresh halfway through a granted interval, or a retry
+// after a failure (expires 0)
+func (s *Server) trunkRegistered(name string, expires time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.trunks[name]
+	if !ok {
+		return
+	}
+	registered := expires > 0
+	if state.registered != registered {
+		if registered {
+			log.Printf("trunk %s is registered for %v", name, expires)
+		} else {
+			log.Printf("trunk %s is not registered", name)
+		}
+	}
+	state.registered = registered
+
+	next := trunkRetryInterval
+	if registered {
+		next = expires / 2
+	}
+	if state.timer != nil {
+		state.timer.Stop()
+	}
+	state.timer = time.AfterFunc(next, func() {
+		s.registerTrunk(name)
+	})
+}
+
+// forwardToTrunks forwards a request for user over the first available of
+// the named trunks. It fails over to the next server of the provider on 503
+// or timeout, and to the next trunk once the provider's servers are exhausted.
+func (s *Server) forwardToTrunks(from net.Addr, msg *Message, names []string, user string) error {
+	err := fmt.Errorf("no trunk given")
+	for i, name := range names {
+		s.mu.Lock()
+		state, ok := s.trunks[name]
+		var trunk Trunk
+		if ok {
+			trunk = state.Trunk
+		}
+		available := ok && (state.Registrar == "" || state.registered)
+		down := s.peerDown(name)
+		s.mu.Unlock()
+
+		if !ok {
+			err = fmt.Errorf("unknown trunk %s", name)
+			continue
+		}
+		if down {
+			log.Printf("skipping trunk %s: peer is down", name)
+			err = fmt.Errorf("trunk %s is down", name)
+			continue
+		}
+		if !available {
+			log.Printf("skipping trunk %s: not registered", name)
+			err = fmt.Errorf("trunk %s is not registered", name)
+			continue
+		}
+		targets, resolveErr := s.resolver.Resolve(context.Background(), trunkProxy(trunk))
+		if resolveErr != nil || len(targets) == 0 {
+			log.Printf("cannot resolve trunk %s: %v", name, resolveErr)
+			err = fmt.Errorf("no servers found for trunk %s", name)
+			continue
+		}
+
+		return s.forwardTransaction(&proxyTransaction{
+			original:   msg,
+			requestURI: "sip:" + user + "@" + trunk.Domain,
+			upstream:   from,
+			target:     targets[0].Addr(),
+			alternates: targets[1:],
+			trunks:     names[i+1:],
+			trunk:      name,
+		})
+	}
+	return err
+}
+
+// trunkNames splits the comma-separated trunk names of a dial plan target
+func trunkNames(target string) []string {
+	var names []string
+	for _, name := range strings.Split(target, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// renumbering is the CSeq offset of the caller's requests within a call
+// whose INVITE the server re-sent with credentials under a higher CSeq
+type renumbering struct {
+	fromTag string
+	offset  int
+}
+
+// renumber applies the CSeq offset of an authenticated trunk call to a
+// request of the caller forwarded within the call
+func (s *Server) renumber(fwd *Message) {
+	if _, inDialog := headerParam(fwd.Headers["To"], "tag"); !inDialog {
+		return
+	}
+	fromTag, _ := headerParam(fwd.Headers["From"], "tag")
+	s.mu.Lock()
+	r, ok := s.renumbered[fwd.Headers["Call-ID"]]
+	s.mu.Unlock()
+	if ok && r.fromTag == fromTag {
+		fwd.Headers["CSeq"] = fmt.Sprintf("%d %s", cseqNumber(fwd)+r.offset, fwd.Method())
+	}
+}
+
+// forgetRenumbering drops the CSeq offset of a call once it ended
+func (s *Server) forgetRenumbering(callID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.renumbered, callID)
+}
+
+// authorizeTrunkRequest answers a 401 or 407 to a request forwarded over a
+// trunk by sending it again with the trunk's credentials, once, under a new
+// branch and the next CSeq. The transaction then stands for the new request,
+// so a CANCEL goes out with its CSeq. It returns false when the challenge
+// cannot be answered and goes upstream.
+func (s *Server) authorizeTrunkRequest(txn *proxyTransaction, resp *Message) bool {
+	s.mu.Lock()
+	state, ok := s.trunks[txn.trunk]
+	var username, password string
+	if ok {
+		username, password = state.Username, state.Password
+	}
+	retry := ok && !txn.authorized && !txn.cancelled && username != ""
+	s.mu.Unlock()
+	if !retry {
+		return false
+	}
+
+	challengeHeader, authHeader := "WWW-Authenticate", "Authorization"
+	if resp.StatusCode() == 407 {
+		challengeHeader, authHeader = "Proxy-Authenticate", "Proxy-Authorization"
+	}
+	method := txn.original.Method()
+	auth, err := digestAuthorization(resp.Headers[challengeHeader], method, txn.requestURI, username, password)
+	if err != nil {
+		log.Printf("trunk %s: cannot answer challenge: %v", txn.trunk, err)
+		return false
+	}
+
+	branch := proxyBranch(txn.original)
+	fwd := s.proxyRequest(txn.original, txn.requestURI, txn.target, branch)
+	s.addRecordRoute(fwd, txn.upstream, txn.target)
+	fwd.Headers[authHeader] = auth
+	fwd.Headers["CSeq"] = fmt.Sprintf("%d %s", cseqNumber(txn.request)+1, method)
+	if method == "INVITE" && !s.recordRouted(fwd) {
+		// The caller's later requests of the call are renumbered by the
+		// server, so they must pass through it
+		s.insertRecordRoute(fwd, txn.upstream, txn.target)
+	}
+
+	s.mu.Lock()
+	if method == "INVITE" {
+		fromTag, _ := headerParam(txn.original.Headers["From"], "tag")
+		s.renumbered[txn.original.Headers["Call-ID"]] = renumbering{
+			fromTag: fromTag,
+			offset:  cseqNumber(fwd) - cseqNumber(txn.original),
+		}
+	}
+	txn.branch = branch
+	txn.request = fwd
+	txn.authorized = true
+	txn.provisional = false
+	s.proxied[branch] = txn
+	txn.timer = time.AfterFunc(s.transactionTimeout, func() {
+		s.transactionTimedOut(branch)
+	})
+	s.mu.Unlock()
+
+	log.Printf("trunk %s: answering challenge to %s", txn.trunk, method)
+	if err := s.send(txn.target, fwd); err != nil {
+		log.Printf("forwarding to %s failed: %v", txn.target.String(), err)
+		s.mu.Lock()
+		delete(s.proxied, branch)
+		txn.timer.Stop()
+		s.mu.Unlock()
+		return false
+	}
+	return true
+}
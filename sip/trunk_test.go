@@ -0,0 +1,257 @@
+package sip
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestTrunkRegistration(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	trunkAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.7"), Port: 5090}
+	server.AddTrunk(Trunk{
+		Name:      "carrier",
+		Domain:    "carrier.example",
+		Proxy:     "sip:127.0.0.7:5090",
+		Registrar: "sip:carrier.example",
+		Username:  "pbx1",
+		Password:  "secret",
+	})
+	if server.TrunkAvailable("carrier") {
+		t.Error("Trunk available before registering")
+	}
+
+	server.registerTrunk("carrier")
+	sent := sentTo(t, mockConn, trunkAddr)
+	if len(sent) != 1 {
+		t.Fatalf("Expected a REGISTER, got %d messages", len(sent))
+	}
+	register := sent[0]
+	if register.RequestURI() != "sip:carrier.example" || !strings.HasPrefix(register.Headers["From"], "<sip:pbx1@carrier.example>;tag=") ||
+		register.Headers["To"] != "<sip:pbx1@carrier.example>" || register.Headers["Expires"] != "3600" ||
+		register.Headers["Contact"] != "<sip:pbx1@192.0.2.10:5060>" {
+		t.Errorf("Wrong REGISTER: %s", register.String())
+	}
+
+	// The challenge is answered with credentials in the same registration
+	challenge := NewResponse("401", "Unauthorized", register)
+	challenge.Headers["WWW-Authenticate"] = `Digest realm="carrier.example", nonce="abc", qop="auth"`
+	server.handleMessage(trunkAddr, []byte(challenge.String()))
+	sent = sentTo(t, mockConn, trunkAddr)
+	if len(sent) != 2 {
+		t.Fatalf("Challenge not answered: %d messages", len(sent))
+	}
+	authorized := sent[1]
+	auth := authorized.Headers["Authorization"]
+	if authorized.Headers["CSeq"] != "2 REGISTER" || authorized.Headers["Call-ID"] != register.Headers["Call-ID"] ||
+		!strings.Contains(auth, `username="pbx1"`) || !strings.Contains(auth, `nonce="abc"`) {
+		t.Errorf("Wrong authorized REGISTER: %s", authorized.String())
+	}
+
+	// A second challenge means the credentials were wrong
+	server.handleMessage(trunkAddr, []byte(challenge.String()))
+	if len(sentTo(t, mockConn, trunkAddr)) != 2 {
+		t.Error("Challenge answered twice")
+	}
+
+	// The registration is refreshed halfway through the granted interval
+	ok := NewResponse("200", "OK", authorized)
+	ok.Headers["Contact"] = "<sip:other@192.0.2.1>;expires=600, <sip:pbx1@192.0.2.10:5060>;expires=2"
+	server.handleMessage(trunkAddr, []byte(ok.String()))
+	if !server.TrunkAvailable("carrier") {
+		t.Fatal("Trunk not available after registering")
+	}
+	waitFor(t, "refresh", func() bool { return len(mockConn.GetSentPackets()) == 3 })
+	refresh := lastSent(t, mockConn)
+	if refresh.Headers["CSeq"] != "3 REGISTER" || refresh.Headers["Call-ID"] != register.Headers["Call-ID"] {
+		t.Errorf("Wrong refresh: %s", refresh.String())
+	}
+
+	server.handleMessage(trunkAddr, []byte(NewResponse("403", "Forbidden", refresh).String()))
+	if server.TrunkAvailable("carrier") {
+		t.Error("Trunk available after its registration failed")
+	}
+}
+
+func TestTrunkFailover(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	carrierAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.7"), Port: 5090}
+	backupAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.8"), Port: 5090}
+	server.AddTrunk(Trunk{Name: "unregistered", Domain: "other.example", Proxy: "sip:127.0.0.6:5090", Registrar: "sip:other.example"})
+	server.AddTrunk(Trunk{Name: "carrier", Domain: "carrier.example", Proxy: "sip:127.0.0.7:5090"})
+	server.AddTrunk(Trunk{Name: "backup", Domain: "backup.example", Proxy: "sip:127.0.0.8:5090"})
+	plan, err := NewDialPlan([]Rule{{User: "^00(\\d+)$", Rewrite: "sip:+$1@example.com", Action: "trunk", Target: "unregistered, carrier,backup"}})
+	if err != nil {
+		t.Fatalf("NewDialPlan failed: %v", err)
+	}
+	server.SetDialPlan(plan)
+
+	// The unregistered trunk is skipped
+	server.handleMessage(addr, []byte(newTestInvite("sip:0049301234@example.com", "trunk-failover").String()))
+	if sent := sentTo(t, mockConn, &net.UDPAddr{IP: net.ParseIP("127.0.0.6"), Port: 5090}); len(sent) != 0 {
+		t.Error("INVITE sent over an unregistered trunk")
+	}
+	sent := sentTo(t, mockConn, carrierAddr)
+	if len(sent) != 1 || sent[0].RequestURI() != "sip:+49301234@carrier.example" {
+		t.Fatalf("INVITE not sent over the first trunk: %v", sent)
+	}
+
+	// A server failure of the carrier tries the next trunk
+	server.handleMessage(carrierAddr, []byte(NewResponse("500", "Server Internal Error", sent[0]).String()))
+	sent = sentTo(t, mockConn, backupAddr)
+	if len(sent) != 1 || sent[0].RequestURI() != "sip:+49301234@backup.example" {
+		t.Fatalf("INVITE not failed over to the backup trunk: %v", sent)
+	}
+	if resp := sentTo(t, mockConn, addr); resp[len(resp)-1].StatusCode() != 100 {
+		t.Errorf("Failure relayed upstream: %s", resp[len(resp)-1].StartLine)
+	}
+
+	// With no trunk left the failure goes upstream
+	server.handleMessage(backupAddr, []byte(NewResponse("500", "Server Internal Error", sent[0]).String()))
+	if resp := lastSent(t, mockConn); resp.StatusCode() != 500 {
+		t.Errorf("Expected 500 upstream, got %s", resp.StartLine)
+	}
+
+	// A trunk whose peer failed its OPTIONS ping is skipped
+	server.AddPeer(Peer{Name: "carrier", URI: "sip:127.0.0.7:5090"})
+	server.setPeerUp("carrier", false)
+	invite := newTestInvite("sip:0049301234@example.com", "trunk-peer-down")
+	invite.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=z9hG4bKpeerdown"
+	server.handleMessage(addr, []byte(invite.String()))
+	if sent := sentTo(t, mockConn, carrierAddr); sent[len(sent)-1].Headers["Call-ID"] == "trunk-peer-down" {
+		t.Error("INVITE sent over a trunk that is down")
+	}
+	if sent := sentTo(t, mockConn, backupAddr); sent[len(sent)-1].Headers["Call-ID"] != "trunk-peer-down" {
+		t.Errorf("INVITE not sent over the backup trunk: %v", sent)
+	}
+}
+
+func TestTrunkChallenge(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	carrierAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.7"), Port: 5090}
+	server.AddTrunk(Trunk{Name: "carrier", Domain: "carrier.example", Proxy: "sip:127.0.0.7:5090", Username: "acme", Password: "secret"})
+	plan, err := NewDialPlan([]Rule{{User: "^00(\\d+)$", Rewrite: "sip:+$1@example.com", Action: "trunk", Target: "carrier"}})
+	if err != nil {
+		t.Fatalf("NewDialPlan failed: %v", err)
+	}
+	server.SetDialPlan(plan)
+
+	invite := newTestInvite("sip:0049301234@example.com", "trunk-challenge")
+	server.handleMessage(addr, []byte(invite.String()))
+	sent := sentTo(t, mockConn, carrierAddr)
+	if len(sent) != 1 {
+		t.Fatalf("INVITE not sent over the trunk: %v", sent)
+	}
+	challenge := NewResponse("407", "Proxy Authentication Required", sent[0])
+	challenge.Headers["To"] += ";tag=c1"
+	challenge.Headers["Proxy-Authenticate"] = `Digest realm="carrier.example", nonce="abc", qop="auth"`
+	server.handleMessage(carrierAddr, []byte(challenge.String()))
+
+	// The challenge is acknowledged and answered, not relayed
+	sent = sentTo(t, mockConn, carrierAddr)
+	if len(sent) != 3 || sent[1].Method() != "ACK" || sent[2].Method() != "INVITE" {
+		t.Fatalf("Expected ACK and INVITE to the carrier, got %v", sent)
+	}
+	retry := sent[2]
+	auth := retry.Headers["Proxy-Authorization"]
+	if !strings.Contains(auth, `username="acme"`) || !strings.Contains(auth, `uri="sip:+49301234@carrier.example"`) {
+		t.Errorf("Unexpected credentials: %s", auth)
+	}
+	if retry.Headers["CSeq"] != "2 INVITE" {
+		t.Errorf("Expected CSeq 2 INVITE, got %s", retry.Headers["CSeq"])
+	}
+	first, _ := headerParam(topHeaderValue(sent[0].Headers["Via"]), "branch")
+	branch, _ := headerParam(topHeaderValue(retry.Headers["Via"]), "branch")
+	if branch == first {
+		t.Error("Retry reused the branch of the challenged INVITE")
+	}
+	for _, resp := range sentTo(t, mockConn, addr) {
+		if resp.StatusCode() == 407 {
+			t.Error("Challenge relayed to the caller")
+		}
+	}
+
+	// Responses reach the caller under its CSeq, and a CANCEL goes out
+	// under that of the retry
+	server.handleMessage(carrierAddr, []byte(NewResponse("180", "Ringing", retry).String()))
+	if resp := lastSent(t, mockConn); resp.StatusCode() != 180 || resp.Headers["CSeq"] != invite.Headers["CSeq"] {
+		t.Errorf("Expected 180 with CSeq %s, got %s", invite.Headers["CSeq"], resp.String())
+	}
+	server.handleMessage(addr, []byte(newTestCancel(invite).String()))
+	cancel := sentTo(t, mockConn, carrierAddr)[3]
+	cancelBranch, _ := headerParam(topHeaderValue(cancel.Headers["Via"]), "branch")
+	if cancel.Method() != "CANCEL" || cancel.Headers["CSeq"] != "2 CANCEL" || cancelBranch != branch {
+		t.Errorf("Unexpected CANCEL: %s", cancel.String())
+	}
+}
+
+func TestTrunkChallengeDialog(t *testing.T) {
+	server := setupTestServer(t)
+	mockConn := server.conn.(*MockConn)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+	carrierAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.7"), Port: 5090}
+	server.AddTrunk(Trunk{Name: "carrier", Domain: "carrier.example", Proxy: "sip:127.0.0.7:5090", Username: "acme", Password: "secret"})
+	plan, err := NewDialPlan([]Rule{{User: "^00(\\d+)$", Rewrite: "sip:+$1@example.com", Action: "trunk", Target: "carrier"}})
+	if err != nil {
+		t.Fatalf("NewDialPlan failed: %v", err)
+	}
+	server.SetDialPlan(plan)
+
+	invite := newTestInvite("sip:0049301234@example.com", "trunk-dialog")
+	server.handleMessage(addr, []byte(invite.String()))
+	challenge := NewResponse("401", "Unauthorized", sentTo(t, mockConn, carrierAddr)[0])
+	challenge.Headers["To"] += ";tag=c1"
+	challenge.Headers["WWW-Authenticate"] = `Digest realm="carrier.example", nonce="abc"`
+	server.handleMessage(carrierAddr, []byte(challenge.String()))
+	retry := sentTo(t, mockConn, carrierAddr)[2]
+
+	// The server stays on the route of the call to renumber its requests
+	if !server.recordRouted(retry) {
+		t.Fatalf("Authenticated INVITE is not record-routed: %s", retry.String())
+	}
+	ok := NewResponse("200", "OK", retry)
+	ok.Headers["To"] += ";tag=c2"
+	ok.Headers["Contact"] = "<sip:carrier@127.0.0.7:5090>"
+	server.handleMessage(carrierAddr, []byte(ok.String()))
+	if resp := lastSent(t, mockConn); resp.StatusCode() != 200 || resp.Headers["CSeq"] != "1 INVITE" {
+		t.Fatalf("Expected 200 with CSeq 1 INVITE, got %s", resp.String())
+	}
+
+	// The caller's ACK and BYE reach the carrier numbered after the retry
+	inDialog := func(method, cseq, branch string) *Message {
+		msg := NewMessage()
+		msg.StartLine = method + " sip:carrier@127.0.0.7:5090 SIP/2.0"
+		msg.Headers["Via"] = "SIP/2.0/UDP 127.0.0.1:12345;branch=" + branch
+		msg.Headers["Route"] = server.recordRouteURI("udp")
+		msg.Headers["From"] = invite.Headers["From"]
+		msg.Headers["To"] = ok.Headers["To"]
+		msg.Headers["Call-ID"] = "trunk-dialog"
+		msg.Headers["CSeq"] = cseq + " " + method
+		msg.Headers["Content-Length"] = "0"
+		return msg
+	}
+	server.handleMessage(addr, []byte(inDialog("ACK", "1", "z9hG4bKack2xx").String()))
+	server.handleMessage(addr, []byte(inDialog("BYE", "2", "z9hG4bKbye").String()))
+	sent := sentTo(t, mockConn, carrierAddr)
+	if len(sent) != 5 || sent[3].Method() != "ACK" || sent[3].Headers["CSeq"] != "2 ACK" {
+		t.Fatalf("Expected the ACK with CSeq 2 ACK, got %v", sent[3:])
+	}
+	bye := sent[4]
+	if bye.Method() != "BYE" || bye.Headers["CSeq"] != "3 BYE" {
+		t.Fatalf("Expected the BYE with CSeq 3 BYE, got %s", bye.String())
+	}
+	server.handleMessage(carrierAddr, []byte(NewResponse("200", "OK", bye).String()))
+	if resp := lastSent(t, mockConn); resp.StatusCode() != 200 || resp.Headers["CSeq"] != "2 BYE" {
+		t.Errorf("Expected 200 with CSeq 2 BYE, got %s", resp.String())
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if _, ok := server.renumbered["trunk-dialog"]; ok {
+		t.Error("Renumbering kept after the call ended")
+	}
+}
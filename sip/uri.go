@@ -0,0 +1,120 @@
+package sip
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// URI is a parsed SIP or SIPS URI
+type URI struct {
+	Scheme string
+	User   string
+	Host   string
+	Port   int // 0 when not present
+	Params map[string]string
+}
+
+// ParseURI parses a sip: or sips: URI. URI headers (after '?') are ignored.
+func ParseURI(uri string) (*URI, error) {
+	uri = strings.TrimSpace(uri)
+	colon := strings.Index(uri, ":")
+	if colon == -1 {
+		return nil, fmt.Errorf("invalid SIP URI: %s", uri)
+	}
+
+	u := &URI{
+		Scheme: strings.ToLower(uri[:colon]),
+		Params: make(map[string]string),
+	}
+	if u.Scheme != "sip" && u.Scheme != "sips" {
+		return nil, fmt.Errorf("unsupported URI scheme: %s", u.Scheme)
+	}
+
+	rest := uri[colon+1:]
+	if q := strings.Index(rest, "?"); q != -1 {
+		rest = rest[:q]
+	}
+	if at := strings.LastIndex(rest, "@"); at != -1 {
+		u.User = rest[:at]
+		rest = rest[at+1:]
+	}
+
+	hostport := rest
+	if semicolon := strings.Index(rest, ";"); semicolon != -1 {
+		hostport = rest[:semicolon]
+		for _, param := range strings.Split(rest[semicolon+1:], ";") {
+			if param == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(param, "=")
+			u.Params[strings.ToLower(name)] = value
+		}
+	}
+
+	host, port := hostport, ""
+	if strings.HasPrefix(hostport, "[") {
+		end := strings.Index(hostport, "]")
+		if end == -1 {
+			return nil, fmt.Errorf("invalid IPv6 reference: %s", hostport)
+		}
+		host = hostport[1:end]
+		port = strings.TrimPrefix(hostport[end+1:], ":")
+	} else if i := strings.LastIndex(hostport, ":"); i != -1 {
+		host, port = hostport[:i], hostport[i+1:]
+	}
+
+	if host == "" {
+		return nil, fmt.Errorf("missing host in SIP URI: %s", uri)
+	}
+	u.Host = host
+
+	if port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n <= 0 || n > 65535 {
+			return nil, fmt.Errorf("invalid port in SIP URI: %s", uri)
+		}
+		u.Port = n
+	}
+
+	return u, nil
+}
+
+// String formats the URI. Parameters are written in sorted order.
+func (u *URI) String() string {
+	var sb strings.Builder
+	sb.WriteString(u.Scheme + ":")
+	if u.User != "" {
+		sb.WriteString(u.User + "@")
+	}
+
+	host := u.Host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	sb.WriteString(host)
+	if u.Port != 0 {
+		sb.WriteString(":" + strconv.Itoa(u.Port))
+	}
+
+	names := make([]string, 0, len(u.Params))
+	for name := range u.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sb.WriteString(";" + name)
+		if value := u.Params[name]; value != "" {
+			sb.WriteString("=" + value)
+		}
+	}
+
+	return sb.String()
+}
+
+// HostIsIP reports whether the host part is a numeric IP address
+func (u *URI) HostIsIP() bool {
+	return net.ParseIP(u.Host) != nil
+}
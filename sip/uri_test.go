@@ -0,0 +1,53 @@
+package sip
+
+import "testing"
+
+func TestParseURI(t *testing.T) {
+	testCases := []struct {
+		uri       string
+		scheme    string
+		user      string
+		host      string
+		port      int
+		transport string
+	}{
+		{"sip:alice@example.com", "sip", "alice", "example.com", 0, ""},
+		{"sips:bob@example.com:5071", "sips", "bob", "example.com", 5071, ""},
+		{"sip:example.com;transport=tcp", "sip", "", "example.com", 0, "tcp"},
+		{"sip:carol@[2001:db8::1]:5062;transport=udp?subject=x", "sip", "carol", "2001:db8::1", 5062, "udp"},
+		{"sip:+15551234567;phone-context=example.com@10.0.0.1", "sip", "+15551234567;phone-context=example.com", "10.0.0.1", 0, ""},
+	}
+
+	for i, tc := range testCases {
+		u, err := ParseURI(tc.uri)
+		if err != nil {
+			t.Errorf("Test case %d: unexpected error: %v", i, err)
+			continue
+		}
+		if u.Scheme != tc.scheme || u.User != tc.user || u.Host != tc.host || u.Port != tc.port {
+			t.Errorf("Test case %d: got %+v", i, u)
+		}
+		if u.Params["transport"] != tc.transport {
+			t.Errorf("Test case %d: wrong transport %q", i, u.Params["transport"])
+		}
+	}
+
+	for _, invalid := range []string{"", "tel:+12345", "sip:", "sip:alice@example.com:notaport"} {
+		if _, err := ParseURI(invalid); err == nil {
+			t.Errorf("Expected error for %q", invalid)
+		}
+	}
+}
+
+func TestURIString(t *testing.T) {
+	u, err := ParseURI("sip:alice@[2001:db8::1]:5060;transport=tcp;lr")
+	if err != nil {
+		t.Fatalf("Failed to parse URI: %v", err)
+	}
+	if u.String() != "sip:alice@[2001:db8::1]:5060;lr;transport=tcp" {
+		t.Errorf("Wrong URI string: %s", u.String())
+	}
+	if !u.HostIsIP() {
+		t.Error("Host should be an IP address")
+	}
+}